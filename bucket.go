@@ -0,0 +1,128 @@
+package hefty
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+	"github.com/vinujohn/hefty/internal/utils"
+)
+
+const healthCheckKeyPrefix = "hefty-health-check/"
+
+// BucketValidationMode determines when a client wrapper checks that its AWS S3 bucket exists and is accessible.
+type BucketValidationMode int
+
+const (
+	// ValidateBucketOnCreate checks the bucket when the wrapper is created. This is the default.
+	ValidateBucketOnCreate BucketValidationMode = iota
+	// ValidateBucketLazily checks the bucket before the first hefty message is uploaded to it. A failed check is
+	// returned by the send and attempted again with the next hefty message.
+	ValidateBucketLazily
+	// SkipBucketValidation never checks the bucket, for example when the principal of the AWS S3 client is not allowed
+	// to use HeadBucket. `HealthCheck` can be used to verify access to the bucket instead.
+	SkipBucketValidation
+)
+
+// If selected, the bucket of the wrapper is validated according to `mode`. The bucket is validated with a HeadBucket
+// request, which requires the s3:ListBucket permission.
+func BucketValidation(mode BucketValidationMode) Option {
+	return func(opts *options) error {
+		if mode < ValidateBucketOnCreate || mode > SkipBucketValidation {
+			return fmt.Errorf("unknown bucket validation mode %d", mode)
+		}
+		opts.bucketValidation = mode
+		return nil
+	}
+}
+
+// bucketValidator checks a bucket once it is needed and remembers a successful check.
+type bucketValidator struct {
+	s3Client *s3.Client
+	bucket   string
+
+	mu        sync.Mutex
+	validated bool
+}
+
+func newBucketValidator(ctx context.Context, s3Client *s3.Client, bucket string, mode BucketValidationMode) (*bucketValidator, error) {
+	validator := &bucketValidator{
+		s3Client:  s3Client,
+		bucket:    bucket,
+		validated: mode == SkipBucketValidation,
+	}
+
+	if mode == ValidateBucketOnCreate {
+		if err := validator.validate(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	return validator, nil
+}
+
+func (validator *bucketValidator) validate(ctx context.Context) error {
+	validator.mu.Lock()
+	defer validator.mu.Unlock()
+
+	if validator.validated {
+		return nil
+	}
+
+	// check if bucket exits
+	if ok, err := utils.BucketExists(ctx, validator.s3Client, validator.bucket); !ok {
+		if err != nil {
+			return err
+		}
+
+		return fmt.Errorf("bucket %s does not exist or is not accessible", validator.bucket)
+	}
+	validator.validated = true
+
+	return nil
+}
+
+// healthCheck puts a probe object in `bucket`, gets it, and deletes it. The probe object is deleted even if getting it
+// fails.
+func (store *payloadStore) healthCheck(ctx context.Context, bucket string) (err error) {
+	key := healthCheckKeyPrefix + uuid.New().String()
+	probe := []byte(key)
+
+	err = store.upload(ctx, bucket, key, probe)
+	if err != nil {
+		return fmt.Errorf("unable to put health check object in bucket %s. %w", bucket, err)
+	}
+	defer func() {
+		// delete the probe object even if ctx has been cancelled so that it is not left in the bucket
+		deleteErr := store.delete(context.WithoutCancel(ctx), bucket, key)
+		if deleteErr != nil {
+			err = errors.Join(err, fmt.Errorf("unable to delete health check object from bucket %s. %w", bucket, deleteErr))
+		}
+	}()
+
+	data, err := store.download(ctx, bucket, key)
+	if err != nil {
+		return fmt.Errorf("unable to get health check object from bucket %s. %w", bucket, err)
+	}
+	if !bytes.Equal(data, probe) {
+		return fmt.Errorf("health check object from bucket %s does not match the object put", bucket)
+	}
+
+	return nil
+}
+
+// HealthCheck verifies that hefty messages can be put in, read from, and deleted from the AWS S3 bucket of the wrapper
+// by doing so with a small probe object under the prefix "hefty-health-check/".
+func (wrapper *SqsClientWrapper) HealthCheck(ctx context.Context) error {
+	return wrapper.store.healthCheck(ctx, wrapper.bucket)
+}
+
+// HealthCheck verifies that hefty messages can be put in, read from, and deleted from the AWS S3 bucket of the wrapper
+// by doing so with a small probe object under the prefix "hefty-health-check/".
+func (wrapper *SnsClientWrapper) HealthCheck(ctx context.Context) error {
+	return wrapper.store.healthCheck(ctx, wrapper.bucket)
+}
@@ -0,0 +1,218 @@
+package hefty
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCircuitFailureThreshold = 5
+	defaultCircuitOpenTimeout      = 30 * time.Second
+)
+
+// CircuitState is the state of the circuit breaker around AWS S3 operations.
+type CircuitState int
+
+const (
+	// CircuitClosed allows all operations. This is the state when no circuit breaker is selected.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails all operations with ErrPayloadStoreUnavailable until the open timeout has passed.
+	CircuitOpen
+	// CircuitHalfOpen allows a single probe operation. The circuit closes if it succeeds and opens again if it fails.
+	CircuitHalfOpen
+)
+
+func (state CircuitState) String() string {
+	switch state {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("CircuitState(%d)", int(state))
+	}
+}
+
+// CircuitBreakerConfig determines when AWS S3 operations performed by the client wrappers fail fast.
+type CircuitBreakerConfig struct {
+	// FailureThreshold is the number of consecutive failed operations which opens the circuit. Defaults to 5.
+	FailureThreshold int
+	// OpenTimeout is how long the circuit stays open before a probe operation is allowed. Defaults to 30s.
+	OpenTimeout time.Duration
+	// IsFailure determines whether an error counts as a failure of AWS S3. Defaults to IsRetryableError so that errors
+	// such as a missing object or cancelled context do not open the circuit.
+	IsFailure func(err error) bool
+	// OnStateChange is called whenever the state of the circuit changes.
+	OnStateChange func(from, to CircuitState)
+}
+
+func (config *CircuitBreakerConfig) validate() error {
+	if config.FailureThreshold == 0 {
+		config.FailureThreshold = defaultCircuitFailureThreshold
+	}
+	if config.OpenTimeout == 0 {
+		config.OpenTimeout = defaultCircuitOpenTimeout
+	}
+	if config.IsFailure == nil {
+		config.IsFailure = IsRetryableError
+	}
+	if config.FailureThreshold < 1 {
+		return fmt.Errorf("failure threshold must be greater than 0 but received %d", config.FailureThreshold)
+	}
+	if config.OpenTimeout < 0 {
+		return fmt.Errorf("open timeout must not be negative but received %v", config.OpenTimeout)
+	}
+	return nil
+}
+
+// If selected, AWS S3 operations used to send, receive, and delete hefty messages fail fast with ErrPayloadStoreUnavailable
+// after repeated failures instead of waiting for AWS S3, according to `config`.
+func S3CircuitBreaker(config CircuitBreakerConfig) Option {
+	return func(opts *options) error {
+		if err := config.validate(); err != nil {
+			return err
+		}
+		opts.circuitBreaker = &config
+		return nil
+	}
+}
+
+// PayloadStoreState returns the state of the circuit breaker around AWS S3 operations selected with `S3CircuitBreaker`.
+func (wrapper *SqsClientWrapper) PayloadStoreState() CircuitState {
+	return wrapper.store.state()
+}
+
+// PayloadStoreState returns the state of the circuit breaker around AWS S3 operations selected with `S3CircuitBreaker`.
+func (wrapper *SnsClientWrapper) PayloadStoreState() CircuitState {
+	return wrapper.store.state()
+}
+
+type circuitBreaker struct {
+	config CircuitBreakerConfig
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+	changes  []stateChange // state changes which still need to be reported
+}
+
+type stateChange struct {
+	from, to CircuitState
+}
+
+func newCircuitBreaker(config CircuitBreakerConfig) *circuitBreaker {
+	return &circuitBreaker{config: config}
+}
+
+// currentState returns the state of the circuit, moving an open circuit to half-open once its timeout has passed.
+func (breaker *circuitBreaker) currentState() CircuitState {
+	breaker.lock()
+	defer breaker.unlock()
+
+	breaker.refresh()
+	return breaker.state
+}
+
+// call performs `fn` if the circuit allows it and records its outcome.
+func (breaker *circuitBreaker) call(fn func() error) error {
+	probe, ok := breaker.allow()
+	if !ok {
+		return ErrPayloadStoreUnavailable
+	}
+
+	err := fn()
+	breaker.record(probe, err)
+
+	return err
+}
+
+// allow determines whether a call may be performed and whether it is the probe of a half-open circuit. Whether a call
+// is the probe is decided when it starts, since the state of the circuit may change before the call completes.
+func (breaker *circuitBreaker) allow() (probe, ok bool) {
+	breaker.lock()
+	defer breaker.unlock()
+
+	breaker.refresh()
+	switch breaker.state {
+	case CircuitOpen:
+		return false, false
+	case CircuitHalfOpen:
+		// only a single probe at a time
+		if breaker.probing {
+			return false, false
+		}
+		breaker.probing = true
+		return true, true
+	}
+
+	return false, true
+}
+
+func (breaker *circuitBreaker) record(probe bool, err error) {
+	breaker.lock()
+	defer breaker.unlock()
+
+	failed := err != nil && breaker.config.IsFailure(err)
+	if probe {
+		breaker.probing = false
+	}
+
+	switch {
+	case !failed && probe:
+		breaker.failures = 0
+		breaker.setState(CircuitClosed)
+	case !failed:
+		if err == nil {
+			breaker.failures = 0
+		}
+	case probe:
+		breaker.open()
+	case breaker.state == CircuitClosed:
+		breaker.failures++
+		if breaker.failures >= breaker.config.FailureThreshold {
+			breaker.open()
+		}
+	}
+}
+
+func (breaker *circuitBreaker) open() {
+	breaker.openedAt = time.Now()
+	breaker.setState(CircuitOpen)
+}
+
+func (breaker *circuitBreaker) refresh() {
+	if breaker.state == CircuitOpen && time.Since(breaker.openedAt) >= breaker.config.OpenTimeout {
+		breaker.setState(CircuitHalfOpen)
+	}
+}
+
+func (breaker *circuitBreaker) setState(state CircuitState) {
+	if breaker.state == state {
+		return
+	}
+
+	breaker.changes = append(breaker.changes, stateChange{from: breaker.state, to: state})
+	breaker.state = state
+}
+
+func (breaker *circuitBreaker) lock() {
+	breaker.mu.Lock()
+}
+
+// unlock releases the circuit and then reports state changes so that OnStateChange may call back into the wrapper.
+func (breaker *circuitBreaker) unlock() {
+	changes := breaker.changes
+	breaker.changes = nil
+	breaker.mu.Unlock()
+
+	if breaker.config.OnStateChange != nil {
+		for _, change := range changes {
+			breaker.config.OnStateChange(change.from, change.to)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vinujohn/hefty/internal/messages"
+)
+
+func decode(_ context.Context, args []string, env *env) error {
+	flags := newFlagSet(env, "decode", "[file]",
+		"Decodes a hefty message as stored in AWS S3, read from file or stdin, and writes its body and message attributes as JSON.")
+	if err := parse(flags, args, 1); err != nil {
+		return err
+	}
+
+	data, err := readInput(flags, env)
+	if err != nil {
+		return err
+	}
+
+	heftyMsg, err := messages.DeserializeHeftyMessage(data)
+	if err != nil {
+		return fmt.Errorf("unable to decode hefty message. %w", err)
+	}
+
+	return write(env, toMessage(heftyMsg))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/vinujohn/hefty"
+	"github.com/vinujohn/hefty/internal/messages"
+)
+
+func fetch(ctx context.Context, args []string, env *env) error {
+	flags := newFlagSet(env, "fetch", "[-raw] [reference-file]",
+		"Fetches the hefty message of a reference message, read as JSON from reference-file or stdin, from AWS S3 or from\n"+
+			"its presigned url and writes its body and message attributes as JSON.")
+	raw := flags.Bool("raw", false, "write the hefty message as stored in AWS S3 instead of decoding it")
+	if err := parse(flags, args, 1); err != nil {
+		return err
+	}
+
+	data, err := readInput(flags, env)
+	if err != nil {
+		return err
+	}
+	refMsg, err := messages.ToReferenceMsg(string(data))
+	if err != nil {
+		return fmt.Errorf("unable to unmarshal reference message. %w", err)
+	} else if !refMsg.IsValid() {
+		return errors.New("reference message does not contain an s3 bucket and s3 key or a presigned url")
+	}
+
+	clients, err := env.clients(ctx)
+	if err != nil {
+		return err
+	}
+	blob, err := hefty.DownloadHeftyMessage(ctx, clients.s3, clients.http, refMsg)
+	if err != nil {
+		return err
+	}
+
+	if *raw {
+		if _, err := env.stdout.Write(blob); err != nil {
+			return fmt.Errorf("unable to write output. %w", err)
+		}
+		return nil
+	}
+
+	heftyMsg, err := hefty.DecodeHeftyMessage(blob, refMsg)
+	if err != nil {
+		return err
+	}
+	msg := toMessage(heftyMsg)
+	msg.Reference = refMsg
+
+	return write(env, msg)
+}
@@ -0,0 +1,264 @@
+// Command hefty inspects, fetches, and sends hefty messages.
+//
+// Usage:
+//
+//	hefty [-region region] [-profile profile] <command> [flags] [arguments]
+//
+// The commands are:
+//
+//	decode  decode a hefty message stored in AWS S3 from a local file into JSON
+//	peek    show the messages of an AWS SQS queue with hefty messages resolved, without deleting them
+//	fetch   fetch the hefty message of a reference message from AWS S3 or its presigned url
+//	send    send a file as a hefty message to an AWS SQS queue or an AWS SNS topic
+//
+// AWS clients are configured with the default AWS SDK configuration, including the AWS_ENDPOINT_URL environment
+// variables. Run "hefty <command> -h" for the flags of a command.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/vinujohn/hefty/internal/messages"
+)
+
+const usage = `Usage: hefty [-region region] [-profile profile] <command> [flags] [arguments]
+
+Commands:
+  decode  decode a hefty message stored in AWS S3 from a local file into JSON
+  peek    show the messages of an AWS SQS queue with hefty messages resolved, without deleting them
+  fetch   fetch the hefty message of a reference message from AWS S3 or its presigned url
+  send    send a file as a hefty message to an AWS SQS queue or an AWS SNS topic
+
+Run "hefty <command> -h" for the flags of a command.
+`
+
+// errUsage is returned when a command is used incorrectly, after its usage has been printed.
+var errUsage = errors.New("invalid usage")
+
+// clients are the clients used by the commands.
+type clients struct {
+	sqs  *sqs.Client
+	sns  *sns.Client
+	s3   *s3.Client
+	http *http.Client
+}
+
+// env is the environment of a command.
+type env struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	// clients creates the clients when a command needs them
+	clients func(ctx context.Context) (*clients, error)
+}
+
+// command runs a command with its arguments.
+type command func(ctx context.Context, args []string, env *env) error
+
+// message is the JSON representation of a message written by the commands.
+type message struct {
+	MessageId         string                 `json:"message_id,omitempty"`
+	Body              *string                `json:"body"`
+	MessageAttributes map[string]attribute   `json:"message_attributes,omitempty"`
+	Attributes        map[string]string      `json:"attributes,omitempty"`
+	Reference         *messages.ReferenceMsg `json:"reference,omitempty"`
+	Error             string                 `json:"error,omitempty"`
+}
+
+// attribute is the JSON representation of a message attribute. Binary values are base64 encoded.
+type attribute struct {
+	DataType    string  `json:"data_type"`
+	StringValue *string `json:"string_value,omitempty"`
+	BinaryValue []byte  `json:"binary_value,omitempty"`
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err := run(ctx, os.Args[1:], &env{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr})
+	if errors.Is(err, errUsage) {
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "hefty: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, env *env) error {
+	flags := flag.NewFlagSet("hefty", flag.ContinueOnError)
+	flags.SetOutput(env.stderr)
+	flags.Usage = func() {
+		fmt.Fprint(env.stderr, usage)
+	}
+	region := flags.String("region", "", "AWS region, which defaults to the region of the AWS SDK configuration")
+	profile := flags.String("profile", "", "AWS shared configuration profile")
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return errUsage
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errUsage
+	}
+
+	if env.clients == nil {
+		env.clients = func(ctx context.Context) (*clients, error) {
+			return newClients(ctx, *region, *profile)
+		}
+	}
+
+	var cmd command
+	switch name := flags.Arg(0); name {
+	case "decode":
+		cmd = decode
+	case "peek":
+		cmd = peek
+	case "fetch":
+		cmd = fetch
+	case "send":
+		cmd = send
+	default:
+		fmt.Fprintf(env.stderr, "hefty: unknown command %q\n\n", name)
+		flags.Usage()
+		return errUsage
+	}
+
+	err := cmd(ctx, flags.Args()[1:], env)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+
+	return err
+}
+
+// newClients creates clients with the default AWS SDK configuration.
+func newClients(ctx context.Context, region, profile string) (*clients, error) {
+	var optFns []func(*config.LoadOptions) error
+	if region != "" {
+		optFns = append(optFns, config.WithRegion(region))
+	}
+	if profile != "" {
+		optFns = append(optFns, config.WithSharedConfigProfile(profile))
+	}
+
+	sdkConfig, err := config.LoadDefaultConfig(ctx, optFns...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load aws configuration. %w", err)
+	}
+
+	return &clients{
+		sqs:  sqs.NewFromConfig(sdkConfig),
+		sns:  sns.NewFromConfig(sdkConfig),
+		s3:   s3.NewFromConfig(sdkConfig),
+		http: http.DefaultClient,
+	}, nil
+}
+
+// newFlagSet creates the flag set of a command whose usage is printed with `synopsis` and `description`.
+func newFlagSet(env *env, name, synopsis, description string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(env.stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(env.stderr, "Usage: hefty %s %s\n\n%s\n", name, synopsis, description)
+		if hasFlags(flags) {
+			fmt.Fprintln(env.stderr, "\nFlags:")
+			flags.PrintDefaults()
+		}
+	}
+
+	return flags
+}
+
+func hasFlags(flags *flag.FlagSet) bool {
+	has := false
+	flags.VisitAll(func(*flag.Flag) {
+		has = true
+	})
+
+	return has
+}
+
+// parse parses the arguments of a command and checks that there are at most `maxArgs` positional arguments.
+func parse(flags *flag.FlagSet, args []string, maxArgs int) error {
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return flag.ErrHelp
+		}
+		return errUsage
+	}
+	if flags.NArg() > maxArgs {
+		fmt.Fprintf(flags.Output(), "hefty %s: too many arguments\n\n", flags.Name())
+		flags.Usage()
+		return errUsage
+	}
+
+	return nil
+}
+
+// readInput reads the file named by the first positional argument of `flags`, or stdin if there is none or it is "-".
+func readInput(flags *flag.FlagSet, env *env) ([]byte, error) {
+	in := io.NopCloser(env.stdin)
+	if name := flags.Arg(0); name != "" && name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open input file. %w", err)
+		}
+		in = f
+	}
+	defer in.Close()
+
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read input. %w", err)
+	}
+
+	return data, nil
+}
+
+// write writes `v` as indented JSON.
+func write(env *env, v any) error {
+	encoder := json.NewEncoder(env.stdout)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return fmt.Errorf("unable to write output. %w", err)
+	}
+
+	return nil
+}
+
+// toMessage converts a hefty message into its JSON representation.
+func toMessage(heftyMsg *messages.HeftyMessage) *message {
+	msg := &message{
+		Body: heftyMsg.Body,
+	}
+	if len(heftyMsg.MessageAttributes) > 0 {
+		msg.MessageAttributes = make(map[string]attribute, len(heftyMsg.MessageAttributes))
+		for name, value := range heftyMsg.MessageAttributes {
+			msg.MessageAttributes[name] = attribute{
+				DataType:    aws.ToString(value.DataType),
+				StringValue: value.StringValue,
+				BinaryValue: value.BinaryValue,
+			}
+		}
+	}
+
+	return msg
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vinujohn/hefty/heftytest"
+	"github.com/vinujohn/hefty/internal/messages"
+)
+
+const bucket = "hefty-cli"
+
+func newTestEnv(t *testing.T) (*env, *heftytest.Server, *bytes.Buffer) {
+	t.Helper()
+	server := heftytest.NewServer()
+	t.Cleanup(server.Close)
+
+	_, err := server.S3Client().CreateBucket(context.TODO(), &s3.CreateBucketInput{Bucket: aws.String(bucket)})
+	require.NoError(t, err)
+
+	stdout := &bytes.Buffer{}
+	return &env{
+		stdin:  strings.NewReader(""),
+		stdout: stdout,
+		stderr: &bytes.Buffer{},
+		clients: func(context.Context) (*clients, error) {
+			return &clients{
+				sqs:  server.SqsClient(),
+				sns:  server.SnsClient(),
+				s3:   server.S3Client(),
+				http: http.DefaultClient,
+			}, nil
+		},
+	}, server, stdout
+}
+
+func createQueue(t *testing.T, server *heftytest.Server, name string) string {
+	t.Helper()
+	out, err := server.SqsClient().CreateQueue(context.TODO(), &sqs.CreateQueueInput{QueueName: aws.String(name)})
+	require.NoError(t, err)
+
+	return aws.ToString(out.QueueUrl)
+}
+
+// decodeOutput decodes the JSON values written to `stdout`.
+func decodeOutput[T any](t *testing.T, stdout *bytes.Buffer) []T {
+	t.Helper()
+	var values []T
+	decoder := json.NewDecoder(stdout)
+	for decoder.More() {
+		var v T
+		require.NoError(t, decoder.Decode(&v))
+		values = append(values, v)
+	}
+
+	return values
+}
+
+func TestSendPeekFetch(t *testing.T) {
+	env, server, stdout := newTestEnv(t)
+	queueUrl := createQueue(t, server, "queue")
+	body := strings.Repeat("a", 300_000)
+	file := filepath.Join(t.TempDir(), "body.txt")
+	require.NoError(t, os.WriteFile(file, []byte(body), 0o600))
+
+	err := run(context.TODO(), []string{"send", "-bucket", bucket, "-queue-url", queueUrl, "-attr", "color=blue", "-attr", "count:Number=5", file}, env)
+	require.NoError(t, err)
+	sentMsgs := decodeOutput[sent](t, stdout)
+	require.Len(t, sentMsgs, 1)
+	assert.NotEmpty(t, sentMsgs[0].MessageId)
+
+	// peek twice as messages are made visible again
+	for i := 0; i < 2; i++ {
+		err = run(context.TODO(), []string{"peek", "-queue-url", queueUrl}, env)
+		require.NoError(t, err)
+		peeked := decodeOutput[message](t, stdout)
+		require.Len(t, peeked, 1)
+		assert.Equal(t, sentMsgs[0].MessageId, peeked[0].MessageId)
+		assert.Equal(t, body, aws.ToString(peeked[0].Body))
+		assert.Equal(t, "blue", aws.ToString(peeked[0].MessageAttributes["color"].StringValue))
+		assert.Equal(t, "Number", peeked[0].MessageAttributes["count"].DataType)
+		require.NotNil(t, peeked[0].Reference)
+		assert.Empty(t, peeked[0].Error)
+	}
+
+	// fetch the hefty message of the reference message from the queue
+	received, err := server.SqsClient().ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{QueueUrl: aws.String(queueUrl)})
+	require.NoError(t, err)
+	require.Len(t, received.Messages, 1)
+	env.stdin = strings.NewReader(aws.ToString(received.Messages[0].Body))
+	err = run(context.TODO(), []string{"fetch"}, env)
+	require.NoError(t, err)
+	fetched := decodeOutput[message](t, stdout)
+	require.Len(t, fetched, 1)
+	assert.Equal(t, body, aws.ToString(fetched[0].Body))
+	assert.Equal(t, "5", aws.ToString(fetched[0].MessageAttributes["count"].StringValue))
+
+	// decode the hefty message as stored in AWS S3
+	env.stdin = strings.NewReader(aws.ToString(received.Messages[0].Body))
+	err = run(context.TODO(), []string{"fetch", "-raw"}, env)
+	require.NoError(t, err)
+	env.stdin = bytes.NewReader(stdout.Bytes())
+	stdout.Reset()
+	err = run(context.TODO(), []string{"decode", "-"}, env)
+	require.NoError(t, err)
+	decoded := decodeOutput[message](t, stdout)
+	require.Len(t, decoded, 1)
+	assert.Equal(t, fetched[0].Body, decoded[0].Body)
+	assert.Equal(t, fetched[0].MessageAttributes, decoded[0].MessageAttributes)
+}
+
+func TestPeekMissingPayload(t *testing.T) {
+	env, server, stdout := newTestEnv(t)
+	queueUrl := createQueue(t, server, "queue")
+
+	refMsg, err := messages.NewReferenceMsg(heftytest.Region, bucket, "missing", "", "").ToJson()
+	require.NoError(t, err)
+	_, err = server.SqsClient().SendMessage(context.TODO(), &sqs.SendMessageInput{
+		QueueUrl:    aws.String(queueUrl),
+		MessageBody: aws.String(string(refMsg)),
+	})
+	require.NoError(t, err)
+
+	err = run(context.TODO(), []string{"peek", "-queue-url", queueUrl}, env)
+	require.NoError(t, err)
+	peeked := decodeOutput[message](t, stdout)
+	require.Len(t, peeked, 1)
+	assert.Equal(t, string(refMsg), aws.ToString(peeked[0].Body))
+	assert.Contains(t, peeked[0].Error, "NoSuchKey")
+}
+
+func TestSendTopic(t *testing.T) {
+	env, server, stdout := newTestEnv(t)
+	queueUrl := createQueue(t, server, "queue")
+	topic, err := server.SnsClient().CreateTopic(context.TODO(), &sns.CreateTopicInput{Name: aws.String("topic")})
+	require.NoError(t, err)
+	_, err = server.SnsClient().Subscribe(context.TODO(), &sns.SubscribeInput{
+		TopicArn:   topic.TopicArn,
+		Protocol:   aws.String("sqs"),
+		Endpoint:   aws.String("arn:aws:sqs:" + heftytest.Region + ":" + heftytest.AccountId + ":queue"),
+		Attributes: map[string]string{"RawMessageDelivery": "true"},
+	})
+	require.NoError(t, err)
+
+	env.stdin = strings.NewReader("hello")
+	err = run(context.TODO(), []string{"send", "-bucket", bucket, "-topic-arn", aws.ToString(topic.TopicArn), "-always-s3"}, env)
+	require.NoError(t, err)
+	assert.Len(t, decodeOutput[sent](t, stdout), 1)
+
+	received, err := server.SqsClient().ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{
+		QueueUrl:              aws.String(queueUrl),
+		MessageAttributeNames: []string{"All"},
+	})
+	require.NoError(t, err)
+	require.Len(t, received.Messages, 1)
+	msg := resolve(context.TODO(), &clients{s3: server.S3Client()}, received.Messages[0])
+	assert.Equal(t, "hello", aws.ToString(msg.Body))
+	assert.NotNil(t, msg.Reference)
+}
+
+func TestUsage(t *testing.T) {
+	var tests = []struct {
+		desc   string
+		args   []string
+		expErr error
+	}{
+		{
+			desc:   "no command",
+			args:   []string{},
+			expErr: errUsage,
+		},
+		{
+			desc:   "unknown command",
+			args:   []string{"unknown"},
+			expErr: errUsage,
+		},
+		{
+			desc: "help",
+			args: []string{"-h"},
+		},
+		{
+			desc: "command help",
+			args: []string{"peek", "-h"},
+		},
+		{
+			desc:   "unknown flag",
+			args:   []string{"decode", "-unknown"},
+			expErr: errUsage,
+		},
+		{
+			desc:   "too many arguments",
+			args:   []string{"decode", "a", "b"},
+			expErr: errUsage,
+		},
+		{
+			desc:   "peek without queue",
+			args:   []string{"peek"},
+			expErr: errUsage,
+		},
+		{
+			desc:   "send to queue and topic",
+			args:   []string{"send", "-bucket", bucket, "-queue-url", "url", "-topic-arn", "arn"},
+			expErr: errUsage,
+		},
+		{
+			desc:   "invalid attribute",
+			args:   []string{"send", "-attr", "color"},
+			expErr: errUsage,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			env := &env{stdin: strings.NewReader(""), stdout: &bytes.Buffer{}, stderr: &bytes.Buffer{}}
+			err := run(context.TODO(), test.args, env)
+			if test.expErr != nil {
+				assert.ErrorIs(t, err, test.expErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	var tests = []struct {
+		desc   string
+		value  string
+		exp    messages.MessageAttributeValue
+		expErr bool
+	}{
+		{
+			desc:  "string",
+			value: "name=a=b",
+			exp:   messages.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("a=b")},
+		},
+		{
+			desc:  "custom type",
+			value: "name:Number.float=1.5",
+			exp:   messages.MessageAttributeValue{DataType: aws.String("Number.float"), StringValue: aws.String("1.5")},
+		},
+		{
+			desc:  "binary",
+			value: "name:Binary=AQID",
+			exp:   messages.MessageAttributeValue{DataType: aws.String("Binary"), BinaryValue: []byte{1, 2, 3}},
+		},
+		{
+			desc:   "invalid binary",
+			value:  "name:Binary=!",
+			expErr: true,
+		},
+		{
+			desc:   "missing value",
+			value:  "name",
+			expErr: true,
+		},
+		{
+			desc:   "missing name",
+			value:  "=value",
+			expErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			attr := attributes{}
+			err := attr.Set(test.value)
+			if test.expErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.exp, attr["name"])
+		})
+	}
+}
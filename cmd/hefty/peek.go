@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/vinujohn/hefty"
+	"github.com/vinujohn/hefty/internal/messages"
+)
+
+func peek(ctx context.Context, args []string, env *env) error {
+	flags := newFlagSet(env, "peek", "-queue-url url [flags]",
+		"Receives messages of an AWS SQS queue and writes them as JSON, with reference messages resolved to their hefty\n"+
+			"messages. The messages are made visible again afterwards and are not deleted. Peeking counts as receiving the\n"+
+			"messages, which counts towards the maximum receive count of the redrive policy of the queue.")
+	queueUrl := flags.String("queue-url", "", "url of the AWS SQS queue (required)")
+	maxMessages := flags.Int("max", 10, "maximum number of messages to receive, from 1 to 10")
+	wait := flags.Int("wait", 0, "seconds to wait for messages, from 0 to 20")
+	visibility := flags.Int("visibility", 30, "seconds during which the messages are hidden from other consumers while peeking")
+	if err := parse(flags, args, 0); err != nil {
+		return err
+	}
+	if *queueUrl == "" {
+		fmt.Fprint(env.stderr, "hefty peek: -queue-url is required\n\n")
+		flags.Usage()
+		return errUsage
+	}
+
+	clients, err := env.clients(ctx)
+	if err != nil {
+		return err
+	}
+	out, err := clients.sqs.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:              queueUrl,
+		MaxNumberOfMessages:   int32(*maxMessages),
+		WaitTimeSeconds:       int32(*wait),
+		VisibilityTimeout:     int32(*visibility),
+		MessageAttributeNames: []string{"All"},
+		AttributeNames:        []types.QueueAttributeName{types.QueueAttributeNameAll},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to receive messages. %w", err)
+	}
+
+	// messages are made visible again even if they could not be written
+	var errs []error
+	for _, m := range out.Messages {
+		if err := write(env, resolve(ctx, clients, m)); err != nil {
+			errs = append(errs, err)
+			break
+		}
+	}
+	errs = append(errs, release(ctx, clients, queueUrl, out.Messages))
+
+	return errors.Join(errs...)
+}
+
+// resolve converts a received message into its JSON representation. A reference message is replaced by its hefty
+// message, or the error getting the hefty message.
+func resolve(ctx context.Context, clients *clients, m types.Message) *message {
+	msg := &message{
+		MessageId:  aws.ToString(m.MessageId),
+		Body:       m.Body,
+		Attributes: m.Attributes,
+	}
+	if len(m.MessageAttributes) > 0 {
+		msg.MessageAttributes = toMessage(&messages.HeftyMessage{
+			MessageAttributes: messages.MapFromSqsMessageAttributeValues(m.MessageAttributes),
+		}).MessageAttributes
+	}
+
+	refMsg, ok, err := hefty.SqsReferenceMsg(m)
+	if !ok {
+		return msg
+	} else if err != nil {
+		msg.Error = err.Error()
+		return msg
+	}
+	msg.Reference = refMsg
+
+	blob, err := hefty.DownloadHeftyMessage(ctx, clients.s3, clients.http, refMsg)
+	if err != nil {
+		msg.Error = err.Error()
+		return msg
+	}
+	heftyMsg, err := hefty.DecodeHeftyMessage(blob, refMsg)
+	if err != nil {
+		msg.Error = err.Error()
+		return msg
+	}
+	resolved := toMessage(heftyMsg)
+	msg.Body, msg.MessageAttributes = resolved.Body, resolved.MessageAttributes
+
+	return msg
+}
+
+// release makes received messages visible again.
+func release(ctx context.Context, clients *clients, queueUrl *string, received []types.Message) error {
+	if len(received) == 0 {
+		return nil
+	}
+
+	entries := make([]types.ChangeMessageVisibilityBatchRequestEntry, len(received))
+	for i, m := range received {
+		entries[i] = types.ChangeMessageVisibilityBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(i)),
+			ReceiptHandle:     m.ReceiptHandle,
+			VisibilityTimeout: 0,
+		}
+	}
+	out, err := clients.sqs.ChangeMessageVisibilityBatch(ctx, &sqs.ChangeMessageVisibilityBatchInput{
+		QueueUrl: queueUrl,
+		Entries:  entries,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to make messages visible again. %w", err)
+	}
+
+	var errs []error
+	for _, failed := range out.Failed {
+		i, _ := strconv.Atoi(aws.ToString(failed.Id))
+		errs = append(errs, fmt.Errorf("unable to make message %s visible again. %s", aws.ToString(received[i].MessageId), aws.ToString(failed.Message)))
+	}
+
+	return errors.Join(errs...)
+}
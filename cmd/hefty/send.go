@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/vinujohn/hefty"
+	"github.com/vinujohn/hefty/internal/messages"
+)
+
+// attributes are message attributes set with repeated flags of the form name=value or name:type=value.
+type attributes map[string]messages.MessageAttributeValue
+
+func (attr attributes) String() string {
+	names := make([]string, 0, len(attr))
+	for name := range attr {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ",")
+}
+
+func (attr attributes) Set(s string) error {
+	nameType, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("expected name=value or name:type=value but received %q", s)
+	}
+	name, dataType, ok := strings.Cut(nameType, ":")
+	if !ok {
+		dataType = "String"
+	}
+	if name == "" {
+		return fmt.Errorf("message attribute name must not be empty in %q", s)
+	}
+
+	attrValue := messages.MessageAttributeValue{DataType: aws.String(dataType)}
+	if strings.HasPrefix(dataType, "Binary") {
+		binaryValue, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return fmt.Errorf("unable to decode base64 value of binary message attribute %s. %w", name, err)
+		}
+		attrValue.BinaryValue = binaryValue
+	} else {
+		attrValue.StringValue = aws.String(value)
+	}
+	attr[name] = attrValue
+
+	return nil
+}
+
+// sent is the JSON representation of a sent message.
+type sent struct {
+	MessageId string `json:"message_id"`
+}
+
+func send(ctx context.Context, args []string, env *env) error {
+	flags := newFlagSet(env, "send", "-bucket bucket (-queue-url url | -topic-arn arn) [flags] [file]",
+		"Sends the content of file, or stdin, as the body of a message to an AWS SQS queue or an AWS SNS topic. Messages over\n"+
+			"the AWS size limit are stored in the AWS S3 bucket and a reference message is sent instead.")
+	bucket := flags.String("bucket", "", "AWS S3 bucket of hefty messages (required)")
+	queueUrl := flags.String("queue-url", "", "url of the AWS SQS queue to send the message to")
+	topicArn := flags.String("topic-arn", "", "ARN of the AWS SNS topic to publish the message to")
+	alwaysSendToS3 := flags.Bool("always-s3", false, "store the message in AWS S3 regardless of its size")
+	msgAttr := attributes{}
+	flags.Var(msgAttr, "attr", "message `attribute` as name=value or name:type=value, where type is a data type such as Number or\nBinary with a base64 encoded value. Can be repeated")
+	if err := parse(flags, args, 1); err != nil {
+		return err
+	}
+	if *bucket == "" || (*queueUrl == "") == (*topicArn == "") {
+		fmt.Fprint(env.stderr, "hefty send: -bucket and either -queue-url or -topic-arn are required\n\n")
+		flags.Usage()
+		return errUsage
+	}
+
+	data, err := readInput(flags, env)
+	if err != nil {
+		return err
+	}
+	body := string(data)
+
+	var opts []hefty.Option
+	if *alwaysSendToS3 {
+		opts = append(opts, hefty.AlwaysSendToS3())
+	}
+	clients, err := env.clients(ctx)
+	if err != nil {
+		return err
+	}
+
+	if *queueUrl != "" {
+		wrapper, err := hefty.NewSqsClientWrapperWithContext(ctx, clients.sqs, clients.s3, *bucket, opts...)
+		if err != nil {
+			return fmt.Errorf("unable to create hefty sqs client wrapper. %w", err)
+		}
+		out, err := wrapper.SendHeftyMessage(ctx, &sqs.SendMessageInput{
+			QueueUrl:          queueUrl,
+			MessageBody:       &body,
+			MessageAttributes: messages.MapToSqsMessageAttributeValues(msgAttr),
+		})
+		if err != nil {
+			return fmt.Errorf("unable to send message. %w", err)
+		}
+		return write(env, sent{MessageId: aws.ToString(out.MessageId)})
+	}
+
+	wrapper, err := hefty.NewSnsClientWrapperWithContext(ctx, clients.sns, clients.s3, *bucket, opts...)
+	if err != nil {
+		return fmt.Errorf("unable to create hefty sns client wrapper. %w", err)
+	}
+	out, err := wrapper.PublishHeftyMessage(ctx, &sns.PublishInput{
+		TopicArn:          topicArn,
+		Message:           &body,
+		MessageAttributes: messages.MapToSnsMessageAttributeValues(msgAttr),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to publish message. %w", err)
+	}
+
+	return write(env, sent{MessageId: aws.ToString(out.MessageId)})
+}
@@ -0,0 +1,314 @@
+package hefty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const (
+	defaultConsumerMaxWorkers       = 10
+	defaultConsumerMaxMessages      = 10 // sqs limit
+	defaultConsumerWaitTimeSeconds  = 20 // sqs limit
+	defaultConsumerReceiveErrorWait = time.Second
+	defaultConsumerShutdownGrace    = 30 * time.Second
+)
+
+// MessageHandler processes a single message received by a Consumer. Returning nil signals that the message was
+// processed successfully and can be deleted. Returning an error leaves the message in AWS SQS so that it becomes visible
+// again after its visibility timeout and can eventually be redriven to a dead letter queue.
+type MessageHandler func(ctx context.Context, msg types.Message) error
+
+// ConsumerErrorHandler is called whenever a Consumer encounters an error. `msg` is nil when the error is not related
+// to a specific message, such as an error while receiving messages from AWS SQS.
+type ConsumerErrorHandler func(ctx context.Context, msg *types.Message, err error)
+
+type consumerOptions struct {
+	maxWorkers            int
+	maxNumberOfMessages   int32
+	waitTimeSeconds       int32
+	visibilityTimeout     int32
+	messageAttributeNames []string
+	errorHandler          ConsumerErrorHandler
+	heartbeat             *VisibilityHeartbeatConfig
+	shutdownGracePeriod   time.Duration
+}
+
+type ConsumerOption func(opts *consumerOptions) error
+
+// ConsumerMaxWorkers sets the maximum number of messages that are processed concurrently by a Consumer. Defaults to 10.
+func ConsumerMaxWorkers(n int) ConsumerOption {
+	return func(opts *consumerOptions) error {
+		if n < 1 {
+			return fmt.Errorf("max workers must be greater than 0 but received %d", n)
+		}
+		opts.maxWorkers = n
+		return nil
+	}
+}
+
+// ConsumerMaxNumberOfMessages sets the maximum number of messages requested from AWS SQS per receive call. Defaults to 10.
+func ConsumerMaxNumberOfMessages(n int32) ConsumerOption {
+	return func(opts *consumerOptions) error {
+		if n < 1 || n > defaultConsumerMaxMessages {
+			return fmt.Errorf("max number of messages must be between 1 and %d but received %d", defaultConsumerMaxMessages, n)
+		}
+		opts.maxNumberOfMessages = n
+		return nil
+	}
+}
+
+// ConsumerWaitTimeSeconds sets the long polling duration used per receive call. Defaults to 20 seconds.
+func ConsumerWaitTimeSeconds(seconds int32) ConsumerOption {
+	return func(opts *consumerOptions) error {
+		if seconds < 0 || seconds > defaultConsumerWaitTimeSeconds {
+			return fmt.Errorf("wait time seconds must be between 0 and %d but received %d", defaultConsumerWaitTimeSeconds, seconds)
+		}
+		opts.waitTimeSeconds = seconds
+		return nil
+	}
+}
+
+// ConsumerVisibilityTimeout sets the visibility timeout requested per receive call. If not set, the queue's default is used.
+func ConsumerVisibilityTimeout(seconds int32) ConsumerOption {
+	return func(opts *consumerOptions) error {
+		if seconds < 0 {
+			return fmt.Errorf("visibility timeout must not be negative but received %d", seconds)
+		}
+		opts.visibilityTimeout = seconds
+		return nil
+	}
+}
+
+// ConsumerMessageAttributeNames sets the message attributes requested per receive call. Defaults to all message attributes.
+func ConsumerMessageAttributeNames(names ...string) ConsumerOption {
+	return func(opts *consumerOptions) error {
+		opts.messageAttributeNames = names
+		return nil
+	}
+}
+
+// ConsumerVisibilityHeartbeat extends the visibility timeout of each message while its MessageHandler is running as
+// determined by `config`. This prevents messages which take longer to process than the queue's visibility timeout from
+// being received again while they are still being processed.
+func ConsumerVisibilityHeartbeat(config VisibilityHeartbeatConfig) ConsumerOption {
+	return func(opts *consumerOptions) error {
+		if config.Interval == 0 {
+			config.Interval = config.VisibilityTimeout / 2
+		}
+		if err := config.validate(); err != nil {
+			return err
+		}
+		opts.heartbeat = &config
+		return nil
+	}
+}
+
+// ConsumerShutdownGracePeriod sets how long messages which are being processed when the context given to Run is
+// cancelled are allowed to complete. Once the grace period has elapsed, the context given to the MessageHandler is
+// cancelled. Defaults to 30 seconds.
+func ConsumerShutdownGracePeriod(d time.Duration) ConsumerOption {
+	return func(opts *consumerOptions) error {
+		if d < 0 {
+			return fmt.Errorf("shutdown grace period must not be negative but received %s", d)
+		}
+		opts.shutdownGracePeriod = d
+		return nil
+	}
+}
+
+// OnConsumerError sets a function which is called with errors encountered by a Consumer. These include errors receiving
+// messages, errors returned by the MessageHandler, errors deleting messages, and hefty messages which could not be
+// retrieved from AWS S3.
+func OnConsumerError(handler ConsumerErrorHandler) ConsumerOption {
+	return func(opts *consumerOptions) error {
+		opts.errorHandler = handler
+		return nil
+	}
+}
+
+// Consumer continuously receives messages from an AWS SQS queue using a Hefty SQS client wrapper and processes them
+// with a MessageHandler on a bounded pool of workers. Messages are deleted after they have been processed successfully.
+type Consumer struct {
+	client   *SqsClientWrapper
+	queueUrl string
+	handler  MessageHandler
+	opts     consumerOptions
+}
+
+// NewConsumer creates a new Consumer which receives messages from the queue at `queueUrl` using `client` and passes
+// each message to `handler`.
+func NewConsumer(client *SqsClientWrapper, queueUrl string, handler MessageHandler, opts ...ConsumerOption) (*Consumer, error) {
+	if client == nil {
+		return nil, errors.New("client is nil")
+	}
+	if handler == nil {
+		return nil, errors.New("handler is nil")
+	}
+
+	consumer := &Consumer{
+		client:   client,
+		queueUrl: queueUrl,
+		handler:  handler,
+		opts: consumerOptions{
+			maxWorkers:            defaultConsumerMaxWorkers,
+			maxNumberOfMessages:   defaultConsumerMaxMessages,
+			waitTimeSeconds:       defaultConsumerWaitTimeSeconds,
+			messageAttributeNames: []string{"All"},
+			shutdownGracePeriod:   defaultConsumerShutdownGrace,
+		},
+	}
+
+	// process available options
+	for _, opt := range opts {
+		err := opt(&consumer.opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return consumer, nil
+}
+
+// Run receives and processes messages until `ctx` is cancelled. Once cancelled, no more messages are received and Run
+// waits for messages that are currently being processed before returning. Messages being processed during shutdown
+// are given a context which is only cancelled once the shutdown grace period has elapsed so that they can complete and
+// be deleted. MessageHandlers must return once their context is cancelled for Run to return.
+func (c *Consumer) Run(ctx context.Context) error {
+	workers := make(chan struct{}, c.opts.maxWorkers)
+	var wg sync.WaitGroup
+
+	// messages already received are processed even if ctx has been cancelled
+	processCtx, cancelProcessing := context.WithCancel(context.WithoutCancel(ctx))
+	defer c.shutdown(&wg, cancelProcessing)
+
+	for {
+		// wait for at least one free worker so that messages are not received before they can be processed
+		select {
+		case workers <- struct{}{}:
+		case <-ctx.Done():
+			return nil
+		}
+		available := c.acquireWorkers(workers, 1)
+
+		out, err := c.client.ReceiveHeftyMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(c.queueUrl),
+			MaxNumberOfMessages:   int32(available),
+			WaitTimeSeconds:       c.opts.waitTimeSeconds,
+			VisibilityTimeout:     c.opts.visibilityTimeout,
+			MessageAttributeNames: c.opts.messageAttributeNames,
+		})
+		if err != nil {
+			releaseWorkers(workers, available)
+			if ctx.Err() != nil {
+				return nil
+			}
+			c.reportError(ctx, nil, fmt.Errorf("unable to receive messages. %w", err))
+
+			// avoid hammering AWS SQS when it is returning errors
+			select {
+			case <-time.After(defaultConsumerReceiveErrorWait):
+			case <-ctx.Done():
+				return nil
+			}
+			continue
+		}
+
+		for i := range out.Messages {
+			msg := out.Messages[i]
+			available--
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer releaseWorkers(workers, 1)
+				c.process(processCtx, msg)
+			}()
+		}
+		releaseWorkers(workers, available)
+	}
+}
+
+// shutdown waits for messages that are being processed and cancels their context once the shutdown grace period has
+// elapsed.
+func (c *Consumer) shutdown(wg *sync.WaitGroup, cancelProcessing context.CancelFunc) {
+	defer cancelProcessing()
+
+	timer := time.AfterFunc(c.opts.shutdownGracePeriod, cancelProcessing)
+	defer timer.Stop()
+
+	wg.Wait()
+}
+
+// acquireWorkers takes as many additional free workers as possible without blocking, up to the maximum number of
+// messages per receive call. It returns the total number of workers held including `held`.
+func (c *Consumer) acquireWorkers(workers chan struct{}, held int) int {
+	for held < int(c.opts.maxNumberOfMessages) {
+		select {
+		case workers <- struct{}{}:
+			held++
+		default:
+			return held
+		}
+	}
+	return held
+}
+
+func releaseWorkers(workers chan struct{}, n int) {
+	for i := 0; i < n; i++ {
+		<-workers
+	}
+}
+
+func (c *Consumer) process(ctx context.Context, msg types.Message) {
+	// hefty messages which could not be retrieved are left for redrive
+	if errMsg, ok := ErrorMsg(aws.ToString(msg.Body)); ok {
+		c.reportError(ctx, &msg, fmt.Errorf("unable to retrieve hefty message. %s", errMsg.Error))
+		return
+	}
+
+	err := c.handle(ctx, msg)
+	if err != nil {
+		c.reportError(ctx, &msg, fmt.Errorf("message handler returned an error. %w", err))
+		return
+	}
+
+	_, err = c.client.DeleteHeftyMessage(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(c.queueUrl),
+		ReceiptHandle: msg.ReceiptHandle,
+	})
+	if err != nil {
+		c.reportError(ctx, &msg, fmt.Errorf("unable to delete message. %w", err))
+	}
+}
+
+// handle runs the MessageHandler while keeping the message invisible if a visibility heartbeat was configured.
+func (c *Consumer) handle(ctx context.Context, msg types.Message) error {
+	if c.opts.heartbeat == nil {
+		return c.handler(ctx, msg)
+	}
+
+	heartbeat, err := c.client.StartVisibilityHeartbeat(ctx, c.queueUrl, aws.ToString(msg.ReceiptHandle), *c.opts.heartbeat)
+	if err != nil {
+		c.reportError(ctx, &msg, err)
+		return c.handler(ctx, msg)
+	}
+
+	err = c.handler(ctx, msg)
+	if hbErr := heartbeat.Stop(); hbErr != nil {
+		c.reportError(ctx, &msg, hbErr)
+	}
+
+	return err
+}
+
+func (c *Consumer) reportError(ctx context.Context, msg *types.Message, err error) {
+	if c.opts.errorHandler != nil {
+		c.opts.errorHandler(ctx, msg, err)
+	}
+}
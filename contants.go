@@ -3,4 +3,6 @@ package hefty
 const (
 	MaxAwsMessageLengthBytes   = 262_144    // 256KB; used for both SQS and SNS
 	MaxHeftyMessageLengthBytes = 33_554_432 // 32MB
+
+	maxAwsMessageAttributeCount = 10 // used for both SQS and SNS
 )
@@ -0,0 +1,133 @@
+package hefty
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/vinujohn/hefty/internal/utils"
+)
+
+const (
+	defaultContentAddressPrefix = "hefty-cas/"
+	defaultContentRefreshAfter  = 24 * time.Hour
+)
+
+// ContentAddressingConfig determines how hefty messages are stored in AWS S3 under the hash of their content.
+type ContentAddressingConfig struct {
+	// Prefix is the prefix of the keys of hefty messages in AWS S3 and must not contain "|". Defaults to "hefty-cas/".
+	Prefix string
+	// RefreshAfter is the age after which a hefty message which already exists is copied onto itself when it is sent
+	// again, which restarts the expiration of an AWS S3 lifecycle rule. Defaults to 24h.
+	RefreshAfter time.Duration
+}
+
+func (config *ContentAddressingConfig) validate() error {
+	if config.Prefix == "" {
+		config.Prefix = defaultContentAddressPrefix
+	}
+	if config.RefreshAfter == 0 {
+		config.RefreshAfter = defaultContentRefreshAfter
+	}
+	if strings.Contains(config.Prefix, "|") {
+		// keys are encoded in receipt handles separated by "|"
+		return fmt.Errorf("prefix must not contain \"|\" but received %s", config.Prefix)
+	}
+	if config.RefreshAfter < 0 {
+		return fmt.Errorf("refresh after must not be negative but received %v", config.RefreshAfter)
+	}
+	return nil
+}
+
+// If selected, hefty messages are stored in AWS S3 under the SHA-256 hash of their serialized content, so that sending
+// the same message several times, or to several queues or topics, stores it only once. A hefty message which already
+// exists is not uploaded again.
+//
+// As a hefty message may be shared by several reference messages, `DeleteHeftyMessage` never removes it from AWS S3.
+// Instead, an AWS S3 lifecycle rule on the prefix of `config` should expire hefty messages after longer than the message
+// retention period of the queues plus `RefreshAfter`.
+func ContentAddressing(config ContentAddressingConfig) Option {
+	return func(opts *options) error {
+		if err := config.validate(); err != nil {
+			return err
+		}
+		opts.contentAddressing = &config
+		return nil
+	}
+}
+
+// contentKey returns the content addressed key of the serialized hefty message `data`, or false if hefty messages
+// are not content addressed.
+func (store *payloadStore) contentKey(data []byte) (string, bool) {
+	if store.contentAddressing == nil {
+		return "", false
+	}
+
+	hash := sha256.Sum256(data)
+	return store.contentAddressing.Prefix + hex.EncodeToString(hash[:]), true
+}
+
+// put uploads a hefty message. A content addressed hefty message is only uploaded if it does not exist yet, and is
+// refreshed if it exists for longer than RefreshAfter. Returns true if the hefty message was uploaded.
+func (store *payloadStore) put(ctx context.Context, bucket, key string, data []byte) (bool, error) {
+	if store.contentAddressing == nil {
+		return true, store.upload(ctx, bucket, key, data)
+	}
+
+	lastModified, exists, err := store.head(ctx, bucket, key)
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case !exists:
+		return true, store.upload(ctx, bucket, key, data)
+	case time.Since(lastModified) >= store.contentAddressing.RefreshAfter:
+		return false, store.refresh(ctx, bucket, key)
+	default:
+		return false, nil
+	}
+}
+
+// head returns the last modified time of an object, or false if the object does not exist.
+func (store *payloadStore) head(ctx context.Context, bucket, key string) (time.Time, bool, error) {
+	var out *s3.HeadObjectOutput
+	err := store.do(ctx, "head", func() (err error) {
+		out, err = store.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	})
+	if utils.IsNoSuchKey(err) {
+		return time.Time{}, false, nil
+	} else if err != nil {
+		return time.Time{}, false, wrapError("head", bucket, key, err)
+	}
+
+	return aws.ToTime(out.LastModified), true, nil
+}
+
+// refresh copies an object onto itself, which restarts its lifecycle expiration.
+func (store *payloadStore) refresh(ctx context.Context, bucket, key string) error {
+	source := (&url.URL{Path: bucket + "/" + key}).EscapedPath()
+	err := store.do(ctx, "copy", func() error {
+		_, err := store.s3Client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:            aws.String(bucket),
+			Key:               aws.String(key),
+			CopySource:        aws.String(source),
+			MetadataDirective: s3Types.MetadataDirectiveReplace,
+			ChecksumAlgorithm: store.checksumAlgorithm,
+		})
+		return err
+	})
+
+	return wrapError("copy", bucket, key, err)
+}
@@ -0,0 +1,44 @@
+package hefty
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrMessageTooLarge is returned when a message is greater than MaxHeftyMessageLengthBytes.
+	ErrMessageTooLarge = errors.New("message too large")
+	// ErrInvalidQueueURL is returned when the name of a queue cannot be determined from its url.
+	ErrInvalidQueueURL = errors.New("invalid queue url")
+	// ErrInvalidReceiptHandle is returned when a receipt handle of a hefty message cannot be decoded.
+	ErrInvalidReceiptHandle = errors.New("invalid receipt handle")
+	// ErrPayloadStoreUnavailable is returned without contacting AWS S3 when the circuit breaker selected with
+	// `S3CircuitBreaker` is open because of previous failures.
+	ErrPayloadStoreUnavailable = errors.New("payload store unavailable")
+	// ErrStoredInOutbox is returned with an empty output when a message was not sent but stored in the outbox selected
+	// with `Outbox`, from which it is sent later. The message should not be sent again by the caller.
+	ErrStoredInOutbox = errors.New("message stored in outbox")
+)
+
+// PayloadStoreError is returned when an AWS S3 operation on a hefty message fails. The error returned by the AWS SDK
+// can be reached with errors.As, for example as a smithy.APIError.
+type PayloadStoreError struct {
+	// Op is the failed operation, one of "upload", "download", "delete", "put", "list", "head", "copy", "presign",
+	// or "fetch".
+	Op string
+	// Bucket is the AWS S3 bucket of the operation. It is empty when fetching a presigned url.
+	Bucket string
+	// Key is the AWS S3 key of the operation, the prefix when listing objects, or the presigned url without its
+	// signature when fetching a presigned url.
+	Key string
+	// Err is the cause of the failure.
+	Err error
+}
+
+func (e *PayloadStoreError) Error() string {
+	return fmt.Sprintf("unable to %s s3 object %s in bucket %s. %v", e.Op, e.Key, e.Bucket, e.Err)
+}
+
+func (e *PayloadStoreError) Unwrap() error {
+	return e.Err
+}
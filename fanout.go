@@ -0,0 +1,171 @@
+package hefty
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/vinujohn/hefty/internal/messages"
+)
+
+const (
+	subscriberCountCacheDuration = time.Minute // how long the number of subscribers to a topic is cached
+	acknowledgementKeySuffix     = ".acks/"    // suffix of the S3 prefix holding acknowledgements of a hefty message
+)
+
+// FanOutDeleteMode determines when a hefty message published to AWS SNS is removed from AWS S3. When a topic has
+// several AWS SQS subscribers, each subscriber receives a reference to the same hefty message in AWS S3.
+type FanOutDeleteMode int
+
+const (
+	// DeleteOnFirstSubscriber removes the hefty message when the first subscriber deletes its reference message.
+	// Other subscribers will not be able to get the hefty message. This is the default and is only safe for topics
+	// with a single AWS SQS subscriber.
+	DeleteOnFirstSubscriber FanOutDeleteMode = iota
+	// DeleteAfterAllSubscribers removes the hefty message once every AWS SQS subscriber to the topic at the time of
+	// publishing has deleted its reference message. Each subscriber acknowledges its delete with a small marker object
+	// in AWS S3. Subscribers whose filter policy excludes a message never acknowledge it, in which case the hefty message
+	// is never removed and should be expired with an S3 lifecycle rule.
+	DeleteAfterAllSubscribers
+	// NeverDelete never removes the hefty message from AWS S3. An S3 lifecycle rule should be used to expire messages.
+	NeverDelete
+)
+
+// If selected, hefty messages published to AWS SNS are removed from AWS S3 according to `mode` when subscribers
+// delete their reference messages. Only valid for the SNS client wrapper.
+func FanOutDelete(mode FanOutDeleteMode) Option {
+	return func(opts *options) error {
+		if mode < DeleteOnFirstSubscriber || mode > NeverDelete {
+			return fmt.Errorf("unknown fan out delete mode %d", mode)
+		}
+		opts.fanOutDeleteMode = mode
+		return nil
+	}
+}
+
+// subscriberCounter caches the number of AWS SQS subscribers per topic to avoid listing subscriptions on every publish.
+type subscriberCounter struct {
+	mu     sync.Mutex
+	counts map[string]subscriberCount
+}
+
+type subscriberCount struct {
+	count   int
+	expires time.Time
+}
+
+func (counter *subscriberCounter) get(ctx context.Context, client *sns.Client, topicArn string) (int, error) {
+	counter.mu.Lock()
+	cached, ok := counter.counts[topicArn]
+	counter.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.count, nil
+	}
+
+	// count subscriptions which have a sqs endpoint
+	count := 0
+	paginator := sns.NewListSubscriptionsByTopicPaginator(client, &sns.ListSubscriptionsByTopicInput{
+		TopicArn: aws.String(topicArn),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("unable to list subscriptions of topic. %w", err)
+		}
+		for _, subscription := range page.Subscriptions {
+			if aws.ToString(subscription.Protocol) == "sqs" {
+				count++
+			}
+		}
+	}
+
+	counter.mu.Lock()
+	if counter.counts == nil {
+		counter.counts = make(map[string]subscriberCount)
+	}
+	counter.counts[topicArn] = subscriberCount{count: count, expires: time.Now().Add(subscriberCountCacheDuration)}
+	counter.mu.Unlock()
+
+	return count, nil
+}
+
+// setFanOutDeletion records the deletion behavior of a hefty message in its reference message so that
+// subscribers delete the hefty message accordingly.
+func (wrapper *SnsClientWrapper) setFanOutDeletion(ctx context.Context, topicArn *string, refMsg *messages.ReferenceMsg) error {
+	switch wrapper.fanOutDeleteMode {
+	case DeleteAfterAllSubscribers:
+		count, err := wrapper.subscriberCounter.get(ctx, &wrapper.Client, aws.ToString(topicArn))
+		if err != nil {
+			return err
+		}
+		refMsg.SubscriberCount = count
+	case NeverDelete:
+		refMsg.RetainPayload = true
+	}
+
+	return nil
+}
+
+// deletePayload removes a hefty message from AWS S3 according to the deletion behavior in `receiptHandle`.
+func (wrapper *SqsClientWrapper) deletePayload(ctx context.Context, queueUrl *string, receiptHandle *heftyReceiptHandle) (DeleteOutcome, error) {
+	if receiptHandle.retainPayload {
+		return DeleteOutcomeRetained, nil
+	}
+
+	if receiptHandle.subscriberCount <= 1 {
+		return wrapper.removeObjects(ctx, receiptHandle.s3Bucket, receiptHandle.s3Key)
+	}
+
+	// acknowledge delete for this subscriber; the queue arn is used so that a redelivered message is only counted once
+	// and queues of the same name in other accounts or regions are counted separately
+	queueArn, err := wrapper.queueArn(ctx, queueUrl)
+	if err != nil {
+		return DeleteOutcomeFailed, err
+	}
+	ackPrefix := receiptHandle.s3Key + acknowledgementKeySuffix
+	err = wrapper.store.putMarker(ctx, receiptHandle.s3Bucket, ackPrefix+queueArn)
+	if err != nil {
+		return DeleteOutcomeFailed, fmt.Errorf("could not acknowledge delete of s3 object for hefty message. %w", err)
+	}
+
+	// only the subscriber seeing every acknowledgement removes the hefty message
+	acks, err := wrapper.store.listKeys(ctx, receiptHandle.s3Bucket, ackPrefix)
+	if err != nil {
+		return DeleteOutcomeFailed, fmt.Errorf("could not list acknowledgements of s3 object for hefty message. %w", err)
+	}
+	if len(acks) < receiptHandle.subscriberCount {
+		return DeleteOutcomeAcknowledged, nil
+	}
+
+	return wrapper.removeObjects(ctx, receiptHandle.s3Bucket, append([]string{receiptHandle.s3Key}, acks...)...)
+}
+
+// removeObjects deletes objects from AWS S3, or schedules them to be deleted when deleting asynchronously.
+func (wrapper *SqsClientWrapper) removeObjects(ctx context.Context, bucket string, keys ...string) (DeleteOutcome, error) {
+	if wrapper.payloadDeleter != nil {
+		wrapper.payloadDeleter.enqueue(bucket, keys...)
+		return DeleteOutcomeScheduled, nil
+	}
+
+	if len(keys) == 1 {
+		err := wrapper.store.delete(ctx, bucket, keys[0])
+		if err != nil {
+			return DeleteOutcomeFailed, fmt.Errorf("could not delete s3 object for hefty message. %w", err)
+		}
+		return DeleteOutcomeDeleted, nil
+	}
+
+	failed, err := wrapper.store.deleteObjects(ctx, bucket, keys)
+	if err != nil {
+		return DeleteOutcomeFailed, fmt.Errorf("could not delete s3 object for hefty message. %w", err)
+	}
+
+	if len(failed) > 0 {
+		return DeleteOutcomeFailed, fmt.Errorf("could not delete s3 object for hefty message. %w", deleteError(bucket, failed[0]))
+	}
+
+	return DeleteOutcomeDeleted, nil
+}
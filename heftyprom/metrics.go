@@ -0,0 +1,112 @@
+// Package heftyprom records the statistics of hefty client wrappers with Prometheus.
+package heftyprom
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vinujohn/hefty"
+)
+
+// Metrics implements hefty.Metrics with Prometheus collectors. Use it with the `hefty.RecordMetrics` option.
+type Metrics struct {
+	messagesSent    *prometheus.CounterVec
+	messageSize     *prometheus.HistogramVec
+	payloadBytes    *prometheus.CounterVec
+	s3Duration      *prometheus.HistogramVec
+	s3Errors        *prometheus.CounterVec
+	downloadErrors  *prometheus.CounterVec
+	messagesDeleted *prometheus.CounterVec
+}
+
+var _ hefty.Metrics = (*Metrics)(nil)
+
+// NewMetrics creates the collectors of hefty and registers them with `reg`. The collectors are:
+//
+//   - hefty_messages_sent_total{wrapper, offloaded}
+//   - hefty_message_size_bytes{wrapper, offloaded}
+//   - hefty_payload_bytes_total{wrapper, direction}
+//   - hefty_s3_operation_duration_seconds{wrapper, operation}
+//   - hefty_s3_operation_errors_total{wrapper, operation}
+//   - hefty_download_errors_total{wrapper, kind}
+//   - hefty_messages_deleted_total{wrapper, outcome}
+func NewMetrics(reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		messagesSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "hefty_messages_sent_total",
+			Help: "Number of messages sent, by whether they were offloaded to AWS S3.",
+		}, []string{"wrapper", "offloaded"}),
+		messageSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "hefty_message_size_bytes",
+			Help:    "Size of messages sent, by whether they were offloaded to AWS S3.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 9),
+		}, []string{"wrapper", "offloaded"}),
+		payloadBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "hefty_payload_bytes_total",
+			Help: "Bytes of hefty messages uploaded to and downloaded from AWS S3.",
+		}, []string{"wrapper", "direction"}),
+		s3Duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "hefty_s3_operation_duration_seconds",
+			Help:    "Duration of requests to AWS S3.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"wrapper", "operation"}),
+		s3Errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "hefty_s3_operation_errors_total",
+			Help: "Number of requests to AWS S3 which returned an error.",
+		}, []string{"wrapper", "operation"}),
+		downloadErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "hefty_download_errors_total",
+			Help: "Number of reference messages whose hefty message could not be received, by kind of error.",
+		}, []string{"wrapper", "kind"}),
+		messagesDeleted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "hefty_messages_deleted_total",
+			Help: "Number of messages deleted, by what happened to their hefty message in AWS S3.",
+		}, []string{"wrapper", "outcome"}),
+	}
+
+	collectors := []prometheus.Collector{
+		m.messagesSent,
+		m.messageSize,
+		m.payloadBytes,
+		m.s3Duration,
+		m.s3Errors,
+		m.downloadErrors,
+		m.messagesDeleted,
+	}
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+func (m *Metrics) MessageSent(wrapper string, offloaded bool, size int) {
+	m.messagesSent.WithLabelValues(wrapper, strconv.FormatBool(offloaded)).Inc()
+	m.messageSize.WithLabelValues(wrapper, strconv.FormatBool(offloaded)).Observe(float64(size))
+}
+
+func (m *Metrics) PayloadUploaded(wrapper string, bytes int) {
+	m.payloadBytes.WithLabelValues(wrapper, "upload").Add(float64(bytes))
+}
+
+func (m *Metrics) PayloadDownloaded(wrapper string, bytes int) {
+	m.payloadBytes.WithLabelValues(wrapper, "download").Add(float64(bytes))
+}
+
+func (m *Metrics) S3Operation(wrapper string, op string, duration time.Duration, err error) {
+	m.s3Duration.WithLabelValues(wrapper, op).Observe(duration.Seconds())
+	if err != nil {
+		m.s3Errors.WithLabelValues(wrapper, op).Inc()
+	}
+}
+
+func (m *Metrics) DownloadFailed(wrapper string, kind hefty.DownloadErrorKind) {
+	m.downloadErrors.WithLabelValues(wrapper, string(kind)).Inc()
+}
+
+func (m *Metrics) MessageDeleted(wrapper string, outcome hefty.DeleteOutcome) {
+	m.messagesDeleted.WithLabelValues(wrapper, string(outcome)).Inc()
+}
@@ -0,0 +1,138 @@
+package heftyprom
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vinujohn/hefty"
+)
+
+func TestNewMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	_, err := NewMetrics(reg)
+	require.NoError(t, err)
+
+	// collectors can only be registered once
+	_, err = NewMetrics(reg)
+	assert.Error(t, err)
+}
+
+func TestMetrics(t *testing.T) {
+	var tests = []struct {
+		desc   string
+		record func(m *Metrics)
+		name   string
+		exp    string
+	}{
+		{
+			desc: "messages_sent",
+			record: func(m *Metrics) {
+				m.MessageSent("sqs", false, 100)
+				m.MessageSent("sqs", true, 300_000)
+				m.MessageSent("sqs", true, 400_000)
+			},
+			name: "hefty_messages_sent_total",
+			exp: `
+# HELP hefty_messages_sent_total Number of messages sent, by whether they were offloaded to AWS S3.
+# TYPE hefty_messages_sent_total counter
+hefty_messages_sent_total{offloaded="false",wrapper="sqs"} 1
+hefty_messages_sent_total{offloaded="true",wrapper="sqs"} 2
+`,
+		},
+		{
+			desc: "payload_bytes",
+			record: func(m *Metrics) {
+				m.PayloadUploaded("sns", 1000)
+				m.PayloadUploaded("sns", 500)
+				m.PayloadDownloaded("sqs", 1500)
+			},
+			name: "hefty_payload_bytes_total",
+			exp: `
+# HELP hefty_payload_bytes_total Bytes of hefty messages uploaded to and downloaded from AWS S3.
+# TYPE hefty_payload_bytes_total counter
+hefty_payload_bytes_total{direction="download",wrapper="sqs"} 1500
+hefty_payload_bytes_total{direction="upload",wrapper="sns"} 1500
+`,
+		},
+		{
+			desc: "s3_errors",
+			record: func(m *Metrics) {
+				m.S3Operation("sqs", "upload", time.Millisecond, nil)
+				m.S3Operation("sqs", "download", time.Millisecond, errors.New("boom"))
+				m.S3Operation("sns", "presign", time.Millisecond, errors.New("boom"))
+			},
+			name: "hefty_s3_operation_errors_total",
+			exp: `
+# HELP hefty_s3_operation_errors_total Number of requests to AWS S3 which returned an error.
+# TYPE hefty_s3_operation_errors_total counter
+hefty_s3_operation_errors_total{operation="download",wrapper="sqs"} 1
+hefty_s3_operation_errors_total{operation="presign",wrapper="sns"} 1
+`,
+		},
+		{
+			desc: "download_errors",
+			record: func(m *Metrics) {
+				m.DownloadFailed("sqs", hefty.DownloadErrorMissingPayload)
+				m.DownloadFailed("sqs", hefty.DownloadErrorMissingPayload)
+				m.DownloadFailed("sqs", hefty.DownloadErrorDecode)
+			},
+			name: "hefty_download_errors_total",
+			exp: `
+# HELP hefty_download_errors_total Number of reference messages whose hefty message could not be received, by kind of error.
+# TYPE hefty_download_errors_total counter
+hefty_download_errors_total{kind="decode_error",wrapper="sqs"} 1
+hefty_download_errors_total{kind="missing_payload",wrapper="sqs"} 2
+`,
+		},
+		{
+			desc: "messages_deleted",
+			record: func(m *Metrics) {
+				m.MessageDeleted("sqs", hefty.DeleteOutcomeInline)
+				m.MessageDeleted("sqs", hefty.DeleteOutcomeDeleted)
+				m.MessageDeleted("sqs", hefty.DeleteOutcomeDeleted)
+			},
+			name: "hefty_messages_deleted_total",
+			exp: `
+# HELP hefty_messages_deleted_total Number of messages deleted, by what happened to their hefty message in AWS S3.
+# TYPE hefty_messages_deleted_total counter
+hefty_messages_deleted_total{outcome="deleted",wrapper="sqs"} 2
+hefty_messages_deleted_total{outcome="inline",wrapper="sqs"} 1
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			m, err := NewMetrics(reg)
+			require.NoError(t, err)
+
+			test.record(m)
+
+			err = testutil.GatherAndCompare(reg, strings.NewReader(test.exp), test.name)
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestS3OperationDuration(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := NewMetrics(reg)
+	require.NoError(t, err)
+
+	m.S3Operation("sqs", "upload", 20*time.Millisecond, nil)
+	m.S3Operation("sqs", "upload", 30*time.Millisecond, errors.New("boom"))
+	m.S3Operation("sns", "upload", 10*time.Millisecond, nil)
+	m.S3Operation("sns", "presign", time.Millisecond, nil)
+
+	count, err := testutil.GatherAndCount(reg, "hefty_s3_operation_duration_seconds")
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+}
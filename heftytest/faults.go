@@ -0,0 +1,312 @@
+package heftytest
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// Fault injects a fault into a request of an AWS SDK client. `next` sends the request to AWS or to a fake.
+type Fault func(r *http.Request, next aws.HTTPClient) (*http.Response, error)
+
+// Rule injects a Fault into the requests it matches.
+type Rule struct {
+	// Service is the service id of the AWS SDK client sending requests, which is "SQS", "SNS", or "S3" regardless of
+	// case. Requests of all services are matched when empty.
+	Service string
+	// Operation is the name of the operation of requests, such as "GetObject". Requests of all operations are matched
+	// when empty.
+	Operation string
+	// Match further selects requests when set.
+	Match func(r *http.Request) bool
+	// After is the number of matched requests which are sent without a fault before the fault is injected.
+	After int
+	// Times is the number of requests the fault is injected into, after which the rule no longer matches. The fault is
+	// injected into all matched requests when zero.
+	Times int
+	// Fault is injected into matched requests.
+	Fault Fault
+}
+
+// Faults injects faults into the requests of AWS SDK clients by rule, so that the handling of failures can be tested
+// deterministically. Faults are injected into the clients of a Server or into clients of AWS:
+//
+//	faults := heftytest.NewFaults(heftytest.Rule{
+//		Service:   "S3",
+//		Operation: "GetObject",
+//		Times:     1,
+//		Fault:     heftytest.Truncate(100),
+//	})
+//	s3Client := server.S3Client(faults.S3)
+//
+// The first rule which matches a request determines its fault. Every attempt of the retryer of an AWS SDK client is a
+// separate request. Rules can be added while clients are in use.
+type Faults struct {
+	mu       sync.Mutex
+	rules    []*faultRule
+	injected int
+}
+
+type faultRule struct {
+	Rule
+	matched  int
+	injected int
+}
+
+// NewFaults creates Faults which inject faults according to `rules`.
+func NewFaults(rules ...Rule) *Faults {
+	faults := &Faults{}
+	faults.Add(rules...)
+
+	return faults
+}
+
+// Add adds rules after the existing rules.
+func (faults *Faults) Add(rules ...Rule) {
+	faults.mu.Lock()
+	defer faults.mu.Unlock()
+
+	for _, rule := range rules {
+		faults.rules = append(faults.rules, &faultRule{Rule: rule})
+	}
+}
+
+// Reset removes all rules and resets the number of injected faults.
+func (faults *Faults) Reset() {
+	faults.mu.Lock()
+	defer faults.mu.Unlock()
+
+	faults.rules = nil
+	faults.injected = 0
+}
+
+// Injected returns the number of faults which have been injected.
+func (faults *Faults) Injected() int {
+	faults.mu.Lock()
+	defer faults.mu.Unlock()
+
+	return faults.injected
+}
+
+// HTTPClient decorates `next`, the HTTP client of an AWS SDK client, so that faults are injected into its requests.
+func (faults *Faults) HTTPClient(next aws.HTTPClient) aws.HTTPClient {
+	if next == nil {
+		next = http.DefaultClient
+	}
+
+	return &faultClient{faults: faults, next: next}
+}
+
+// Sqs injects faults into the requests of an AWS SQS client when used as an option of the client.
+func (faults *Faults) Sqs(o *sqs.Options) {
+	o.HTTPClient = faults.HTTPClient(o.HTTPClient)
+}
+
+// Sns injects faults into the requests of an AWS SNS client when used as an option of the client.
+func (faults *Faults) Sns(o *sns.Options) {
+	o.HTTPClient = faults.HTTPClient(o.HTTPClient)
+}
+
+// S3 injects faults into the requests of an AWS S3 client when used as an option of the client.
+func (faults *Faults) S3(o *s3.Options) {
+	o.HTTPClient = faults.HTTPClient(o.HTTPClient)
+}
+
+// fault returns the fault to inject into `r`, if any.
+func (faults *Faults) fault(r *http.Request) Fault {
+	faults.mu.Lock()
+	defer faults.mu.Unlock()
+
+	service, operation := service(r), awsmiddleware.GetOperationName(r.Context())
+	for _, rule := range faults.rules {
+		if rule.Service != "" && !strings.EqualFold(rule.Service, service) {
+			continue
+		}
+		if rule.Operation != "" && rule.Operation != operation {
+			continue
+		}
+		if rule.Times > 0 && rule.injected >= rule.Times {
+			continue
+		}
+		if rule.Match != nil && !rule.Match(r) {
+			continue
+		}
+
+		rule.matched++
+		if rule.matched <= rule.After {
+			return nil
+		}
+		rule.injected++
+		faults.injected++
+
+		return rule.Fault
+	}
+
+	return nil
+}
+
+type faultClient struct {
+	faults *Faults
+	next   aws.HTTPClient
+}
+
+func (client *faultClient) Do(r *http.Request) (*http.Response, error) {
+	fault := client.faults.fault(r)
+	if fault == nil {
+		return client.next.Do(r)
+	}
+
+	return fault(r, client.next)
+}
+
+// service returns the service id of the AWS SDK client sending `r` in lower case.
+func service(r *http.Request) string {
+	return strings.ToLower(awsmiddleware.GetServiceID(r.Context()))
+}
+
+// Fail fails requests with `err` as if they could not be sent. The AWS SDK retries requests which could not be sent.
+func Fail(err error) Fault {
+	return func(*http.Request, aws.HTTPClient) (*http.Response, error) {
+		return nil, err
+	}
+}
+
+// Error responds to requests with an error of `status`, `code`, and `message` in the format of the service of the
+// request, without sending them.
+func Error(status int, code, message string) Fault {
+	return func(r *http.Request, _ aws.HTTPClient) (*http.Response, error) {
+		return errorResponse(r, newApiError(status, code, message)), nil
+	}
+}
+
+// Throttle responds to requests with the throttling error of the service of the request, without sending them. The AWS
+// SDK retries throttled requests.
+func Throttle() Fault {
+	return func(r *http.Request, _ aws.HTTPClient) (*http.Response, error) {
+		var err *apiError
+		switch service(r) {
+		case "s3":
+			err = newApiError(http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate.")
+		case "sns":
+			err = newApiError(http.StatusBadRequest, "Throttling", "Rate exceeded")
+		default:
+			err = newApiError(http.StatusBadRequest, "RequestThrottled", "Request is throttled.")
+		}
+
+		return errorResponse(r, err), nil
+	}
+}
+
+// Latency delays requests by `d` before sending them. A request fails with the error of its context if the context is
+// done while the request is delayed.
+func Latency(d time.Duration) Fault {
+	return func(r *http.Request, next aws.HTTPClient) (*http.Response, error) {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+			return next.Do(r)
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+	}
+}
+
+// Truncate sends requests and cuts off the bodies of successful responses after `n` bytes, as if the connection was lost
+// during a download. Reading past `n` bytes fails with io.ErrUnexpectedEOF unless the body is not longer than `n` bytes.
+func Truncate(n int64) Fault {
+	return func(r *http.Request, next aws.HTTPClient) (*http.Response, error) {
+		res, err := next.Do(r)
+		if err != nil || res.StatusCode >= http.StatusMultipleChoices {
+			return res, err
+		}
+		res.Body = &truncatedBody{ReadCloser: res.Body, remaining: n}
+
+		return res, nil
+	}
+}
+
+// Corrupt sends requests and flips the bits of the byte at `offset` of the bodies of successful responses. Bodies which
+// are not longer than `offset` are not changed.
+func Corrupt(offset int64) Fault {
+	return func(r *http.Request, next aws.HTTPClient) (*http.Response, error) {
+		res, err := next.Do(r)
+		if err != nil || res.StatusCode >= http.StatusMultipleChoices {
+			return res, err
+		}
+		res.Body = &corruptedBody{ReadCloser: res.Body, offset: offset}
+
+		return res, nil
+	}
+}
+
+// errorResponse creates a response with `err` in the format of the service of `r`.
+func errorResponse(r *http.Request, err *apiError) *http.Response {
+	recorder := httptest.NewRecorder()
+	switch service(r) {
+	case "sqs":
+		writeSqsError(recorder, err)
+	case "sns":
+		writeSnsError(recorder, err)
+	default:
+		writeS3Error(recorder, r, "", err)
+	}
+
+	res := recorder.Result()
+	res.ContentLength = int64(recorder.Body.Len())
+	res.Request = r
+
+	return res
+}
+
+type truncatedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (body *truncatedBody) Read(p []byte) (int, error) {
+	if body.remaining <= 0 {
+		// bodies of at most n bytes are not truncated
+		var peek [1]byte
+		n, err := io.ReadFull(body.ReadCloser, peek[:])
+		if n == 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			return 0, io.EOF
+		} else if n == 0 {
+			return 0, err
+		}
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > body.remaining {
+		p = p[:body.remaining]
+	}
+	n, err := body.ReadCloser.Read(p)
+	body.remaining -= int64(n)
+
+	return n, err
+}
+
+type corruptedBody struct {
+	io.ReadCloser
+	offset int64
+	read   int64
+}
+
+func (body *corruptedBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	if body.offset >= body.read && body.offset < body.read+int64(n) {
+		p[body.offset-body.read] ^= 0xff
+	}
+	body.read += int64(n)
+
+	return n, err
+}
@@ -0,0 +1,365 @@
+package heftytest
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vinujohn/hefty"
+)
+
+// retryer retries requests three times without a backoff to keep tests fast.
+func retryer() aws.Retryer {
+	return retry.NewStandard(func(o *retry.StandardOptions) {
+		o.MaxAttempts = 3
+		o.Backoff = retry.BackoffDelayerFunc(func(int, error) (time.Duration, error) {
+			return 0, nil
+		})
+	})
+}
+
+func TestFaults(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	bucket := createBucket(t, server.S3Client())
+	_, err := server.S3Client().PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String("key"),
+		Body:   strings.NewReader("0123456789"),
+	})
+	require.NoError(t, err)
+
+	var tests = []struct {
+		desc        string
+		rule        Rule
+		expBody     string
+		expCode     string
+		expErr      error
+		expInjected int
+	}{
+		{
+			desc:        "other operation",
+			rule:        Rule{Operation: "PutObject", Fault: Error(http.StatusInternalServerError, "InternalError", "failed")},
+			expBody:     "0123456789",
+			expInjected: 0,
+		},
+		{
+			desc:        "other service",
+			rule:        Rule{Service: "SQS", Fault: Error(http.StatusInternalServerError, "InternalError", "failed")},
+			expBody:     "0123456789",
+			expInjected: 0,
+		},
+		{
+			desc:        "error",
+			rule:        Rule{Service: "s3", Operation: "GetObject", Fault: Error(http.StatusForbidden, "AccessDenied", "Access Denied")},
+			expCode:     "AccessDenied",
+			expInjected: 1,
+		},
+		{
+			desc:        "error is retried",
+			rule:        Rule{Operation: "GetObject", Times: 2, Fault: Error(http.StatusInternalServerError, "InternalError", "failed")},
+			expBody:     "0123456789",
+			expInjected: 2,
+		},
+		{
+			desc:        "throttling is retried",
+			rule:        Rule{Operation: "GetObject", Times: 2, Fault: Throttle()},
+			expBody:     "0123456789",
+			expInjected: 2,
+		},
+		{
+			desc:        "throttling",
+			rule:        Rule{Operation: "GetObject", Fault: Throttle()},
+			expCode:     "SlowDown",
+			expInjected: 3,
+		},
+		{
+			desc:        "failure",
+			rule:        Rule{Operation: "GetObject", Fault: Fail(errors.New("connection reset"))},
+			expErr:      errors.New("connection reset"),
+			expInjected: 3,
+		},
+		{
+			desc:        "after",
+			rule:        Rule{Operation: "GetObject", After: 1, Fault: Fail(errors.New("connection reset"))},
+			expBody:     "0123456789",
+			expInjected: 0,
+		},
+		{
+			desc:        "match",
+			rule:        Rule{Match: func(r *http.Request) bool { return r.Method == http.MethodPut }, Fault: Throttle()},
+			expBody:     "0123456789",
+			expInjected: 0,
+		},
+		{
+			desc:        "truncate",
+			rule:        Rule{Operation: "GetObject", Fault: Truncate(4)},
+			expBody:     "0123",
+			expErr:      io.ErrUnexpectedEOF,
+			expInjected: 1,
+		},
+		{
+			desc:        "truncate at the end of the body",
+			rule:        Rule{Operation: "GetObject", Fault: Truncate(10)},
+			expBody:     "0123456789",
+			expInjected: 1,
+		},
+		{
+			desc:        "corrupt",
+			rule:        Rule{Operation: "GetObject", Fault: Corrupt(1)},
+			expBody:     "0\xce23456789",
+			expInjected: 1,
+		},
+		{
+			desc:        "corrupt past the end of the body",
+			rule:        Rule{Operation: "GetObject", Fault: Corrupt(10)},
+			expBody:     "0123456789",
+			expInjected: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			faults := NewFaults(test.rule)
+			client := server.S3Client(faults.S3, func(o *s3.Options) {
+				o.Retryer = retryer()
+			})
+
+			out, err := client.GetObject(context.TODO(), &s3.GetObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String("key"),
+			})
+			assert.Equal(t, test.expInjected, faults.Injected())
+			if test.expCode != "" {
+				var apiErr smithy.APIError
+				require.True(t, errors.As(err, &apiErr), "expected api error but got %v", err)
+				assert.Equal(t, test.expCode, apiErr.ErrorCode())
+				return
+			}
+			if test.expErr != nil && test.expBody == "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.expErr.Error())
+				return
+			}
+			require.NoError(t, err)
+			defer out.Body.Close()
+
+			body, err := io.ReadAll(out.Body)
+			assert.Equal(t, test.expBody, string(body))
+			if test.expErr != nil {
+				assert.ErrorIs(t, err, test.expErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	var tests = []struct {
+		desc    string
+		body    string
+		expBody string
+		expErr  error
+	}{
+		{
+			desc:    "longer body",
+			body:    "0123456789",
+			expBody: "0123",
+			expErr:  io.ErrUnexpectedEOF,
+		},
+		{
+			desc:    "body of n bytes",
+			body:    "0123",
+			expBody: "0123",
+		},
+		{
+			desc:    "shorter body",
+			body:    "01",
+			expBody: "01",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			// a body which returns io.EOF only after its last byte has been read
+			next := &stubClient{body: test.body}
+			res, err := Truncate(4)(&http.Request{}, next)
+			require.NoError(t, err)
+
+			body, err := io.ReadAll(res.Body)
+			assert.Equal(t, test.expBody, string(body))
+			assert.Equal(t, test.expErr, err)
+		})
+	}
+}
+
+type stubClient struct {
+	body string
+}
+
+func (client *stubClient) Do(*http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(iotest.OneByteReader(strings.NewReader(client.body))),
+	}, nil
+}
+
+func TestFaultsLatency(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	faults := NewFaults(Rule{Service: "SQS", Operation: "ListQueues", Fault: Latency(200 * time.Millisecond)})
+	client := server.SqsClient(faults.Sqs)
+
+	start := time.Now()
+	_, err := client.ListQueues(context.TODO(), &sqs.ListQueuesInput{})
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+
+	// a delayed request is cancelled with its context
+	ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+	defer cancel()
+	_, err = client.ListQueues(ctx, &sqs.ListQueuesInput{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	faults.Reset()
+	start = time.Now()
+	_, err = client.ListQueues(context.TODO(), &sqs.ListQueuesInput{})
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), 200*time.Millisecond)
+	assert.Zero(t, faults.Injected())
+}
+
+// TestFaultsHefty tests how the hefty client wrappers handle faults.
+func TestFaultsHefty(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	bucket := createBucket(t, server.S3Client())
+	queueUrl := createQueue(t, server.SqsClient(), "queue", nil)
+	body := strings.Repeat("a", 300_000)
+
+	faults := NewFaults()
+	sqsClient := server.SqsClient(faults.Sqs, func(o *sqs.Options) {
+		o.Retryer = retryer()
+	})
+	s3Client := server.S3Client(faults.S3, func(o *s3.Options) {
+		o.Retryer = retryer()
+	})
+	wrapper, err := hefty.NewSqsClientWrapper(sqsClient, s3Client, bucket)
+	require.NoError(t, err)
+
+	send := func() {
+		t.Helper()
+		_, err := wrapper.SendHeftyMessage(context.TODO(), &sqs.SendMessageInput{
+			QueueUrl:    aws.String(queueUrl),
+			MessageBody: aws.String(body),
+		})
+		require.NoError(t, err)
+	}
+	receive := func() *sqs.ReceiveMessageOutput {
+		t.Helper()
+		out, err := wrapper.ReceiveHeftyMessage(context.TODO(), &sqs.ReceiveMessageInput{
+			QueueUrl:          aws.String(queueUrl),
+			VisibilityTimeout: 1,
+		})
+		require.NoError(t, err)
+		require.Len(t, out.Messages, 1)
+		return out
+	}
+	deleteAll := func() {
+		t.Helper()
+		_, err := server.SqsClient().PurgeQueue(context.TODO(), &sqs.PurgeQueueInput{QueueUrl: aws.String(queueUrl)})
+		require.NoError(t, err)
+		faults.Reset()
+	}
+
+	t.Run("failed upload", func(t *testing.T) {
+		defer deleteAll()
+		faults.Add(Rule{Service: "S3", Operation: "PutObject", Fault: Error(http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.")})
+
+		_, err := wrapper.SendHeftyMessage(context.TODO(), &sqs.SendMessageInput{
+			QueueUrl:    aws.String(queueUrl),
+			MessageBody: aws.String(body),
+		})
+		var storeErr *hefty.PayloadStoreError
+		require.ErrorAs(t, err, &storeErr)
+		assert.Equal(t, "upload", storeErr.Op)
+
+		// no reference message is sent
+		out, err := server.SqsClient().ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{QueueUrl: aws.String(queueUrl)})
+		require.NoError(t, err)
+		assert.Empty(t, out.Messages)
+	})
+
+	t.Run("failed download", func(t *testing.T) {
+		defer deleteAll()
+		send()
+		faults.Add(Rule{Service: "S3", Operation: "GetObject", Fault: Error(http.StatusForbidden, "AccessDenied", "Access Denied")})
+
+		out := receive()
+		errMsg, ok := hefty.ErrorMsg(aws.ToString(out.Messages[0].Body))
+		require.True(t, ok)
+		assert.Contains(t, errMsg.Error, "AccessDenied")
+	})
+
+	t.Run("partial download", func(t *testing.T) {
+		defer deleteAll()
+		send()
+		faults.Add(Rule{Service: "S3", Operation: "GetObject", Times: 1, Fault: Truncate(1000)})
+
+		// the body of the part is downloaded again
+		out := receive()
+		assert.Equal(t, body, aws.ToString(out.Messages[0].Body))
+		assert.Equal(t, 1, faults.Injected())
+	})
+
+	t.Run("corrupted download", func(t *testing.T) {
+		defer deleteAll()
+		send()
+		faults.Add(Rule{Service: "S3", Operation: "GetObject", Fault: Corrupt(100)})
+
+		// the corruption is detected by the md5 digest of the message body
+		out := receive()
+		digest := md5.Sum([]byte(aws.ToString(out.Messages[0].Body)))
+		assert.NotEqual(t, aws.ToString(out.Messages[0].MD5OfBody), hex.EncodeToString(digest[:]))
+	})
+
+	t.Run("throttled receive", func(t *testing.T) {
+		defer deleteAll()
+		send()
+		faults.Add(Rule{Service: "SQS", Operation: "ReceiveMessage", Times: 2, Fault: Throttle()})
+
+		out := receive()
+		assert.Equal(t, body, aws.ToString(out.Messages[0].Body))
+		assert.Equal(t, 2, faults.Injected())
+	})
+
+	t.Run("stale receipt handle", func(t *testing.T) {
+		defer deleteAll()
+		send()
+		out := receive()
+		faults.Add(Rule{Service: "SQS", Operation: "DeleteMessage", Fault: Error(http.StatusBadRequest, "ReceiptHandleIsInvalid", "The input receipt handle is invalid.")})
+
+		_, err := wrapper.DeleteHeftyMessage(context.TODO(), &sqs.DeleteMessageInput{
+			QueueUrl:      aws.String(queueUrl),
+			ReceiptHandle: out.Messages[0].ReceiptHandle,
+		})
+		var apiErr smithy.APIError
+		require.ErrorAs(t, err, &apiErr)
+		assert.Equal(t, "ReceiptHandleIsInvalid", apiErr.ErrorCode())
+	})
+}
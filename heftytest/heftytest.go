@@ -0,0 +1,183 @@
+// Package heftytest provides in-memory fakes of AWS SQS, AWS SNS, and AWS S3 so that code using the hefty client wrappers
+// can be tested without AWS. The fakes are served over HTTP on the loopback interface and speak the protocols of the
+// AWS SDK, so the clients returned by a Server are ordinary AWS SDK clients which can be passed to the hefty client
+// wrappers:
+//
+//	server := heftytest.NewServer()
+//	defer server.Close()
+//
+//	s3Client := server.S3Client()
+//	s3Client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String("my-bucket")})
+//	wrapper, err := hefty.NewSqsClientWrapper(server.SqsClient(), s3Client, "my-bucket")
+//
+// Only the operations used by hefty are supported:
+//   - AWS SQS: CreateQueue, DeleteQueue, GetQueueUrl, ListQueues, PurgeQueue, GetQueueAttributes, SetQueueAttributes,
+//     SendMessage, SendMessageBatch, ReceiveMessage, DeleteMessage, DeleteMessageBatch, ChangeMessageVisibility, and
+//     ChangeMessageVisibilityBatch on standard queues, including long polling, delays, visibility timeouts, and redrive
+//     policies.
+//   - AWS SNS: CreateTopic, DeleteTopic, ListTopics, GetTopicAttributes, Subscribe, Unsubscribe,
+//     ListSubscriptionsByTopic, SetSubscriptionAttributes, Publish, and PublishBatch, where messages are delivered to
+//     subscribed fake queues with or without raw message delivery and subscription filter policies on message
+//     attributes are applied.
+//   - AWS S3: CreateBucket, DeleteBucket, HeadBucket, ListObjectsV2, PutObject, GetObject with ranges, HeadObject,
+//     DeleteObject, DeleteObjects, CopyObject, and multipart uploads, including presigned urls.
+//
+// Requests are not authenticated and the size limits of AWS SQS and AWS SNS are enforced.
+//
+// Faults injects failures, latency, partial downloads, corrupted bytes, and throttling into the requests of AWS SDK
+// clients by rule, whether they are clients of the fakes or of AWS.
+package heftytest
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/google/uuid"
+)
+
+const (
+	// Region is the AWS region of the fakes.
+	Region = "us-east-1"
+	// AccountId is the AWS account id used in queue urls and ARNs of the fakes.
+	AccountId = "000000000000"
+)
+
+// Server serves fakes of AWS SQS, AWS SNS, and AWS S3. Each Server has its own queues, topics, and buckets.
+type Server struct {
+	sqs *sqsService
+	sns *snsService
+	s3  *s3Service
+
+	sqsServer *httptest.Server
+	snsServer *httptest.Server
+	s3Server  *httptest.Server
+}
+
+// NewServer starts fakes of AWS SQS, AWS SNS, and AWS S3. Close should be called to stop them.
+func NewServer() *Server {
+	server := &Server{
+		sqs: newSqsService(),
+		s3:  newS3Service(),
+	}
+	server.sns = newSnsService(server.sqs)
+
+	server.sqsServer = httptest.NewServer(server.sqs)
+	server.snsServer = httptest.NewServer(server.sns)
+	server.s3Server = httptest.NewServer(server.s3)
+	server.sqs.baseUrl = server.sqsServer.URL
+
+	return server
+}
+
+// Close stops the fakes. Waiting receive requests return immediately.
+func (server *Server) Close() {
+	server.sqs.close()
+	server.sqsServer.Close()
+	server.snsServer.Close()
+	server.s3Server.Close()
+}
+
+// SqsEndpoint returns the endpoint of the fake of AWS SQS.
+func (server *Server) SqsEndpoint() string {
+	return server.sqsServer.URL
+}
+
+// SnsEndpoint returns the endpoint of the fake of AWS SNS.
+func (server *Server) SnsEndpoint() string {
+	return server.snsServer.URL
+}
+
+// S3Endpoint returns the endpoint of the fake of AWS S3.
+func (server *Server) S3Endpoint() string {
+	return server.s3Server.URL
+}
+
+// SqsClient returns an AWS SQS client of the fake. `optFns` are applied after the endpoint is set.
+func (server *Server) SqsClient(optFns ...func(*sqs.Options)) *sqs.Client {
+	return sqs.NewFromConfig(Config(), append([]func(*sqs.Options){func(o *sqs.Options) {
+		o.BaseEndpoint = aws.String(server.SqsEndpoint())
+	}}, optFns...)...)
+}
+
+// SnsClient returns an AWS SNS client of the fake. `optFns` are applied after the endpoint is set.
+func (server *Server) SnsClient(optFns ...func(*sns.Options)) *sns.Client {
+	return sns.NewFromConfig(Config(), append([]func(*sns.Options){func(o *sns.Options) {
+		o.BaseEndpoint = aws.String(server.SnsEndpoint())
+	}}, optFns...)...)
+}
+
+// S3Client returns an AWS S3 client of the fake, which uses path style addressing. `optFns` are applied after the
+// endpoint is set.
+func (server *Server) S3Client(optFns ...func(*s3.Options)) *s3.Client {
+	return s3.NewFromConfig(Config(), append([]func(*s3.Options){func(o *s3.Options) {
+		o.BaseEndpoint = aws.String(server.S3Endpoint())
+		o.UsePathStyle = true
+	}}, optFns...)...)
+}
+
+// Config returns an AWS SDK config with the region and static credentials of the fakes. Clients created from it must
+// set their endpoint to one of a Server, which is useful when the Server runs in another process.
+func Config() aws.Config {
+	return aws.Config{
+		Region: Region,
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "heftytest", SecretAccessKey: "heftytest", Source: "heftytest"}, nil
+		}),
+	}
+}
+
+// apiError is an error returned to a client of a fake.
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.code + ": " + e.message
+}
+
+// fault returns whether the client, "Sender", or the service, "Receiver", is at fault for the error.
+func (e *apiError) fault() string {
+	if e.status >= http.StatusInternalServerError {
+		return "Receiver"
+	}
+
+	return "Sender"
+}
+
+func newApiError(status int, code, message string) *apiError {
+	return &apiError{status: status, code: code, message: message}
+}
+
+func newId() string {
+	return uuid.NewString()
+}
+
+func writeJson(w http.ResponseWriter, status int, contentType string, v any) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Amzn-RequestId", newId())
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeXml(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "text/xml")
+	w.Header().Set("X-Amz-Request-Id", newId())
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+// isTrue checks whether an attribute value is "true" regardless of case.
+func isTrue(value string) bool {
+	return strings.EqualFold(value, "true")
+}
@@ -0,0 +1,882 @@
+package heftytest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	s3Xmlns          = "http://s3.amazonaws.com/doc/2006-03-01/"
+	maxKeys          = 1000
+	minPartSize      = 5 << 20 // 5MB
+	checksumPrefix   = "X-Amz-Checksum-"
+	metadataPrefix   = "X-Amz-Meta-"
+	s3TimeFormat     = "2006-01-02T15:04:05.000Z"
+	presignedAmzDate = "20060102T150405Z"
+)
+
+// s3Service is the fake of AWS S3 with path style addressing.
+type s3Service struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	name    string
+	created time.Time
+	objects map[string]*object
+	uploads map[string]*multipartUpload // by upload id
+}
+
+type object struct {
+	data         []byte
+	etag         string
+	lastModified time.Time
+	contentType  string
+	metadata     map[string]string // by canonical header name
+	checksums    map[string]string // by canonical header name, only for objects which were not uploaded in parts
+}
+
+type multipartUpload struct {
+	key         string
+	contentType string
+	metadata    map[string]string
+	parts       map[int]*uploadPart
+}
+
+type uploadPart struct {
+	data []byte
+	etag string
+}
+
+type s3Error struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string
+	Message   string
+	Key       string `xml:",omitempty"`
+	RequestId string
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	ContinuationToken     string         `xml:",omitempty"`
+	NextContinuationToken string         `xml:",omitempty"`
+	StartAfter            string         `xml:",omitempty"`
+	Contents              []listedObject `xml:"Contents"`
+	CommonPrefixes        []string       `xml:"CommonPrefixes>Prefix"`
+}
+
+type listedObject struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+	StorageClass string
+}
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name       `xml:"ListAllMyBucketsResult"`
+	Xmlns   string         `xml:"xmlns,attr"`
+	Buckets []listedBucket `xml:"Buckets>Bucket"`
+}
+
+type listedBucket struct {
+	Name         string
+	CreationDate string
+}
+
+type deleteRequest struct {
+	Quiet   bool
+	Objects []struct {
+		Key string
+	} `xml:"Object"`
+}
+
+type deleteResult struct {
+	XMLName xml.Name        `xml:"DeleteResult"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Deleted []deletedObject `xml:"Deleted"`
+	Errors  []deleteError   `xml:"Error"`
+}
+
+type deletedObject struct {
+	Key string
+}
+
+type deleteError struct {
+	Key     string
+	Code    string
+	Message string
+}
+
+type copyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	ETag         string
+	LastModified string
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+type completeMultipartUpload struct {
+	Parts []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+func newS3Service() *s3Service {
+	return &s3Service{
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func (svc *s3Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucketName, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+
+	var err error
+	switch {
+	case bucketName == "" && r.Method == http.MethodGet:
+		err = svc.listBuckets(w)
+	case bucketName == "":
+		err = newApiError(http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+	case key == "" && r.Method == http.MethodPut:
+		err = svc.createBucket(w, bucketName)
+	case key == "" && r.Method == http.MethodDelete:
+		err = svc.deleteBucket(w, bucketName)
+	case key == "" && r.Method == http.MethodHead:
+		err = svc.headBucket(w, bucketName)
+	case key == "" && r.Method == http.MethodGet:
+		err = svc.listObjects(w, bucketName, query)
+	case key == "" && r.Method == http.MethodPost && query.Has("delete"):
+		err = svc.deleteObjects(w, r, bucketName)
+	case key == "":
+		err = newApiError(http.StatusNotImplemented, "NotImplemented", "The bucket operation is not supported by heftytest.")
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		err = svc.uploadPart(w, r, bucketName, key, query)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		err = svc.copyObject(w, r, bucketName, key)
+	case r.Method == http.MethodPut:
+		err = svc.putObject(w, r, bucketName, key)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		err = svc.getObject(w, r, bucketName, key)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		err = svc.abortMultipartUpload(w, bucketName, query.Get("uploadId"))
+	case r.Method == http.MethodDelete:
+		err = svc.deleteObject(w, bucketName, key)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		err = svc.createMultipartUpload(w, r, bucketName, key)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		err = svc.completeMultipartUpload(w, r, bucketName, key, query.Get("uploadId"))
+	default:
+		err = newApiError(http.StatusNotImplemented, "NotImplemented", "The object operation is not supported by heftytest.")
+	}
+
+	if err != nil {
+		writeS3Error(w, r, key, err)
+	}
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, key string, err error) {
+	apiErr, ok := err.(*apiError)
+	if !ok {
+		apiErr = newApiError(http.StatusBadRequest, "InvalidRequest", err.Error())
+	}
+
+	// responses to head requests have no body
+	if r.Method == http.MethodHead {
+		w.WriteHeader(apiErr.status)
+		return
+	}
+	writeXml(w, apiErr.status, s3Error{Code: apiErr.code, Message: apiErr.message, Key: key, RequestId: newId()})
+}
+
+func noSuchBucket() error {
+	return newApiError(http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+}
+
+func noSuchKey() error {
+	return newApiError(http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+}
+
+// bucket returns the bucket named `name`. The lock must be held.
+func (svc *s3Service) bucket(name string) (*bucket, error) {
+	b, ok := svc.buckets[name]
+	if !ok {
+		return nil, noSuchBucket()
+	}
+
+	return b, nil
+}
+
+func (svc *s3Service) listBuckets(w http.ResponseWriter) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	result := listAllMyBucketsResult{Xmlns: s3Xmlns}
+	for _, b := range svc.buckets {
+		result.Buckets = append(result.Buckets, listedBucket{Name: b.name, CreationDate: b.created.UTC().Format(s3TimeFormat)})
+	}
+	slices.SortFunc(result.Buckets, func(a, b listedBucket) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	writeXml(w, http.StatusOK, result)
+
+	return nil
+}
+
+func (svc *s3Service) createBucket(w http.ResponseWriter, name string) error {
+	if len(name) < 3 || len(name) > 63 || strings.Trim(name, "abcdefghijklmnopqrstuvwxyz0123456789.-") != "" {
+		return newApiError(http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid.")
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	if _, ok := svc.buckets[name]; ok {
+		return newApiError(http.StatusConflict, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it.")
+	}
+	svc.buckets[name] = &bucket{
+		name:    name,
+		created: time.Now(),
+		objects: make(map[string]*object),
+		uploads: make(map[string]*multipartUpload),
+	}
+	w.Header().Set("Location", "/"+name)
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+func (svc *s3Service) deleteBucket(w http.ResponseWriter, name string) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	b, err := svc.bucket(name)
+	if err != nil {
+		return err
+	}
+	if len(b.objects) > 0 {
+		return newApiError(http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty")
+	}
+	delete(svc.buckets, name)
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+func (svc *s3Service) headBucket(w http.ResponseWriter, name string) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	if _, err := svc.bucket(name); err != nil {
+		return err
+	}
+	w.Header().Set("X-Amz-Bucket-Region", Region)
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+func (svc *s3Service) listObjects(w http.ResponseWriter, name string, query url.Values) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	b, err := svc.bucket(name)
+	if err != nil {
+		return err
+	}
+
+	limit := maxKeys
+	if query.Has("max-keys") {
+		limit, err = strconv.Atoi(query.Get("max-keys"))
+		if err != nil || limit < 0 {
+			return newApiError(http.StatusBadRequest, "InvalidArgument", "max-keys must be a non-negative integer")
+		}
+		limit = min(limit, maxKeys)
+	}
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	result := listBucketResult{
+		Xmlns:             s3Xmlns,
+		Name:              name,
+		Prefix:            prefix,
+		Delimiter:         delimiter,
+		MaxKeys:           limit,
+		ContinuationToken: query.Get("continuation-token"),
+		StartAfter:        query.Get("start-after"),
+	}
+	after := result.StartAfter
+	if result.ContinuationToken != "" {
+		token, err := base64.RawURLEncoding.DecodeString(result.ContinuationToken)
+		if err != nil {
+			return newApiError(http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect")
+		}
+		after = string(token)
+	}
+
+	keys := make([]string, 0, len(b.objects))
+	for key := range b.objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	last := ""
+	for _, key := range keys {
+		if result.KeyCount == limit {
+			result.IsTruncated = true
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+			break
+		}
+
+		// keys containing the delimiter after the prefix are rolled up into a common prefix
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				commonPrefix := key[:len(prefix)+i+len(delimiter)]
+				if !slices.Contains(result.CommonPrefixes, commonPrefix) {
+					result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix)
+					result.KeyCount++
+				}
+				last = key
+				continue
+			}
+		}
+
+		obj := b.objects[key]
+		result.Contents = append(result.Contents, listedObject{
+			Key:          key,
+			LastModified: obj.lastModified.UTC().Format(s3TimeFormat),
+			ETag:         obj.etag,
+			Size:         len(obj.data),
+			StorageClass: "STANDARD",
+		})
+		result.KeyCount++
+		last = key
+	}
+	writeXml(w, http.StatusOK, result)
+
+	return nil
+}
+
+func (svc *s3Service) deleteObjects(w http.ResponseWriter, r *http.Request, name string) error {
+	var req deleteRequest
+	err := xml.NewDecoder(r.Body).Decode(&req)
+	if err != nil || len(req.Objects) == 0 || len(req.Objects) > maxKeys {
+		return newApiError(http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema")
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	b, err := svc.bucket(name)
+	if err != nil {
+		return err
+	}
+
+	result := deleteResult{Xmlns: s3Xmlns}
+	for _, obj := range req.Objects {
+		delete(b.objects, obj.Key)
+		if !req.Quiet {
+			result.Deleted = append(result.Deleted, deletedObject{Key: obj.Key})
+		}
+	}
+	writeXml(w, http.StatusOK, result)
+
+	return nil
+}
+
+// readBody reads the body of a request, which is decoded if it uses the aws-chunked content encoding. The checksums of
+// the request, including those in the trailer of an aws-chunked body, are validated and returned.
+func readBody(r *http.Request) ([]byte, map[string]string, error) {
+	var data []byte
+	var err error
+	headers := r.Header.Clone()
+	if strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") || strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		data, err = decodeChunked(r.Body, headers)
+	} else {
+		data, err = io.ReadAll(r.Body)
+	}
+	if err != nil {
+		return nil, nil, newApiError(http.StatusBadRequest, "IncompleteBody", err.Error())
+	}
+
+	if contentMd5 := headers.Get("Content-Md5"); contentMd5 != "" {
+		digest := md5.Sum(data)
+		if contentMd5 != base64.StdEncoding.EncodeToString(digest[:]) {
+			return nil, nil, newApiError(http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received.")
+		}
+	}
+
+	checksums := make(map[string]string)
+	for name := range headers {
+		if !strings.HasPrefix(name, checksumPrefix) || name == checksumPrefix+"Algorithm" {
+			continue
+		}
+		algorithm := strings.TrimPrefix(name, checksumPrefix)
+		checksum, ok := computeChecksum(algorithm, data)
+		if !ok {
+			continue
+		}
+		if checksum != headers.Get(name) {
+			return nil, nil, newApiError(http.StatusBadRequest, "BadDigest", fmt.Sprintf("The %s you specified did not match the calculated checksum.", strings.ToUpper(algorithm)))
+		}
+		checksums[name] = checksum
+	}
+
+	return data, checksums, nil
+}
+
+// decodeChunked decodes an aws-chunked body. Trailing headers are added to `headers`.
+func decodeChunked(body io.Reader, headers http.Header) ([]byte, error) {
+	reader := bufio.NewReader(body)
+	var data bytes.Buffer
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("unable to read chunk header. %w", err)
+		}
+		sizeField, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeField, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunk size %q", sizeField)
+		}
+		if size == 0 {
+			break
+		}
+		if _, err := io.CopyN(&data, reader, size); err != nil {
+			return nil, fmt.Errorf("unable to read chunk. %w", err)
+		}
+		if _, err := reader.ReadString('\n'); err != nil {
+			return nil, fmt.Errorf("unable to read chunk. %w", err)
+		}
+	}
+
+	// trailing headers end with an empty line
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line == "" || err != nil {
+			break
+		}
+		if name, value, ok := strings.Cut(line, ":"); ok && !strings.HasPrefix(name, "x-amz-trailer-signature") {
+			headers.Set(name, strings.TrimSpace(value))
+		}
+	}
+
+	return data.Bytes(), nil
+}
+
+// computeChecksum computes a checksum of `algorithm` such as "Crc32c" the way AWS S3 does.
+func computeChecksum(algorithm string, data []byte) (string, bool) {
+	var h hash.Hash
+	switch strings.ToLower(algorithm) {
+	case "crc32":
+		h = crc32.NewIEEE()
+	case "crc32c":
+		h = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case "sha1":
+		h = sha1.New()
+	case "sha256":
+		h = sha256.New()
+	default:
+		return "", false
+	}
+	h.Write(data)
+
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), true
+}
+
+// metadata returns the user defined metadata of a request.
+func metadata(r *http.Request) map[string]string {
+	m := make(map[string]string)
+	for name := range r.Header {
+		if strings.HasPrefix(name, metadataPrefix) {
+			m[name] = r.Header.Get(name)
+		}
+	}
+
+	return m
+}
+
+func etag(data []byte) string {
+	digest := md5.Sum(data)
+	return `"` + hex.EncodeToString(digest[:]) + `"`
+}
+
+func (svc *s3Service) putObject(w http.ResponseWriter, r *http.Request, name, key string) error {
+	data, checksums, err := readBody(r)
+	if err != nil {
+		return err
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	b, err := svc.bucket(name)
+	if err != nil {
+		return err
+	}
+	obj := &object{
+		data:         data,
+		etag:         etag(data),
+		lastModified: time.Now(),
+		contentType:  r.Header.Get("Content-Type"),
+		metadata:     metadata(r),
+		checksums:    checksums,
+	}
+	b.objects[key] = obj
+
+	for name, value := range checksums {
+		w.Header().Set(name, value)
+	}
+	w.Header().Set("ETag", obj.etag)
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// checkPresignedUrl checks that a presigned url has not expired.
+func checkPresignedUrl(query url.Values) error {
+	if !query.Has("X-Amz-Expires") {
+		return nil
+	}
+
+	signed, err := time.Parse(presignedAmzDate, query.Get("X-Amz-Date"))
+	expires, errExpires := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || errExpires != nil {
+		return newApiError(http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Date and X-Amz-Expires must be set.")
+	}
+	if time.Now().After(signed.Add(time.Duration(expires) * time.Second)) {
+		return newApiError(http.StatusForbidden, "AccessDenied", "Request has expired")
+	}
+
+	return nil
+}
+
+// parseRange parses a single byte range of an object of `size` bytes and returns its first and last byte.
+func parseRange(header string, size int) (int, int, error) {
+	invalid := newApiError(http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, invalid
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, invalid
+	}
+
+	if first == "" {
+		// suffix range of the last bytes
+		n, err := strconv.Atoi(last)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, invalid
+		}
+		return max(size-n, 0), size - 1, nil
+	}
+
+	start, err := strconv.Atoi(first)
+	if err != nil || start >= size {
+		return 0, 0, invalid
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.Atoi(last)
+		if err != nil || end < start {
+			return 0, 0, invalid
+		}
+		end = min(end, size-1)
+	}
+
+	return start, end, nil
+}
+
+func (svc *s3Service) getObject(w http.ResponseWriter, r *http.Request, name, key string) error {
+	err := checkPresignedUrl(r.URL.Query())
+	if err != nil {
+		return err
+	}
+
+	svc.mu.Lock()
+	b, err := svc.bucket(name)
+	if err != nil {
+		svc.mu.Unlock()
+		return err
+	}
+	obj, ok := b.objects[key]
+	svc.mu.Unlock()
+	if !ok {
+		return noSuchKey()
+	}
+
+	header := w.Header()
+	header.Set("ETag", obj.etag)
+	header.Set("Last-Modified", obj.lastModified.UTC().Format(http.TimeFormat))
+	header.Set("Accept-Ranges", "bytes")
+	if obj.contentType != "" {
+		header.Set("Content-Type", obj.contentType)
+	}
+	for name, value := range obj.metadata {
+		header.Set(name, value)
+	}
+
+	data, status := obj.data, http.StatusOK
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		start, end, err := parseRange(rangeHeader, len(obj.data))
+		if err != nil {
+			return err
+		}
+		data, status = obj.data[start:end+1], http.StatusPartialContent
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(obj.data)))
+	} else if strings.EqualFold(r.Header.Get("X-Amz-Checksum-Mode"), "ENABLED") {
+		// checksums are of the whole object
+		for name, value := range obj.checksums {
+			header.Set(name, value)
+		}
+	}
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(data)
+	}
+
+	return nil
+}
+
+func (svc *s3Service) deleteObject(w http.ResponseWriter, name, key string) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	b, err := svc.bucket(name)
+	if err != nil {
+		return err
+	}
+	delete(b.objects, key)
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+func (svc *s3Service) copyObject(w http.ResponseWriter, r *http.Request, name, key string) error {
+	source, err := url.PathUnescape(strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/"))
+	if err != nil {
+		return newApiError(http.StatusBadRequest, "InvalidArgument", "Copy Source must mention the source bucket and key: sourcebucket/sourcekey")
+	}
+	source, _, _ = strings.Cut(source, "?versionId=")
+	sourceBucket, sourceKey, ok := strings.Cut(source, "/")
+	if !ok || sourceKey == "" {
+		return newApiError(http.StatusBadRequest, "InvalidArgument", "Copy Source must mention the source bucket and key: sourcebucket/sourcekey")
+	}
+	replace := strings.EqualFold(r.Header.Get("X-Amz-Metadata-Directive"), "REPLACE")
+	if sourceBucket == name && sourceKey == key && !replace {
+		return newApiError(http.StatusBadRequest, "InvalidRequest", "This copy request is illegal because it is trying to copy an object to itself without changing the object's metadata, storage class, website redirect location or encryption attributes.")
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	src, err := svc.bucket(sourceBucket)
+	if err != nil {
+		return err
+	}
+	srcObj, ok := src.objects[sourceKey]
+	if !ok {
+		return noSuchKey()
+	}
+	dst, err := svc.bucket(name)
+	if err != nil {
+		return err
+	}
+
+	obj := &object{
+		data:         srcObj.data,
+		etag:         srcObj.etag,
+		lastModified: time.Now(),
+		contentType:  srcObj.contentType,
+		metadata:     srcObj.metadata,
+		checksums:    srcObj.checksums,
+	}
+	if replace {
+		obj.contentType, obj.metadata = r.Header.Get("Content-Type"), metadata(r)
+	}
+	if algorithm := r.Header.Get("X-Amz-Checksum-Algorithm"); algorithm != "" {
+		if checksum, ok := computeChecksum(algorithm, obj.data); ok {
+			obj.checksums = map[string]string{http.CanonicalHeaderKey(checksumPrefix + algorithm): checksum}
+		}
+	}
+	dst.objects[key] = obj
+
+	writeXml(w, http.StatusOK, copyObjectResult{ETag: obj.etag, LastModified: obj.lastModified.UTC().Format(s3TimeFormat)})
+
+	return nil
+}
+
+func (svc *s3Service) createMultipartUpload(w http.ResponseWriter, r *http.Request, name, key string) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	b, err := svc.bucket(name)
+	if err != nil {
+		return err
+	}
+	uploadId := newId()
+	b.uploads[uploadId] = &multipartUpload{
+		key:         key,
+		contentType: r.Header.Get("Content-Type"),
+		metadata:    metadata(r),
+		parts:       make(map[int]*uploadPart),
+	}
+	writeXml(w, http.StatusOK, initiateMultipartUploadResult{Xmlns: s3Xmlns, Bucket: name, Key: key, UploadId: uploadId})
+
+	return nil
+}
+
+// upload returns the multipart upload with `uploadId` in the bucket named `name`. The lock must be held.
+func (svc *s3Service) upload(name, uploadId string) (*bucket, *multipartUpload, error) {
+	b, err := svc.bucket(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	upload, ok := b.uploads[uploadId]
+	if !ok {
+		return nil, nil, newApiError(http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist. The upload ID may be invalid, or the upload may have been aborted or completed.")
+	}
+
+	return b, upload, nil
+}
+
+func (svc *s3Service) uploadPart(w http.ResponseWriter, r *http.Request, name, key string, query url.Values) error {
+	partNumber, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > 10_000 {
+		return newApiError(http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000, inclusive")
+	}
+	data, checksums, err := readBody(r)
+	if err != nil {
+		return err
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	_, upload, err := svc.upload(name, query.Get("uploadId"))
+	if err != nil {
+		return err
+	}
+	part := &uploadPart{data: data, etag: etag(data)}
+	upload.parts[partNumber] = part
+
+	for name, value := range checksums {
+		w.Header().Set(name, value)
+	}
+	w.Header().Set("ETag", part.etag)
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+func (svc *s3Service) completeMultipartUpload(w http.ResponseWriter, r *http.Request, name, key, uploadId string) error {
+	var req completeMultipartUpload
+	err := xml.NewDecoder(r.Body).Decode(&req)
+	if err != nil || len(req.Parts) == 0 {
+		return newApiError(http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema")
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	b, upload, err := svc.upload(name, uploadId)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	digests := md5.New()
+	for i, p := range req.Parts {
+		part, ok := upload.parts[p.PartNumber]
+		if !ok || part.etag != p.ETag {
+			return newApiError(http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found. The part may not have been uploaded, or the specified entity tag may not have matched the part's entity tag.")
+		}
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			return newApiError(http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order. Parts must be ordered by part number.")
+		}
+		if i < len(req.Parts)-1 && len(part.data) < minPartSize {
+			return newApiError(http.StatusBadRequest, "EntityTooSmall", "Your proposed upload is smaller than the minimum allowed object size.")
+		}
+		data = append(data, part.data...)
+		digest, _ := hex.DecodeString(strings.Trim(part.etag, `"`))
+		digests.Write(digest)
+	}
+
+	obj := &object{
+		data:         data,
+		etag:         fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(digests.Sum(nil)), len(req.Parts)),
+		lastModified: time.Now(),
+		contentType:  upload.contentType,
+		metadata:     upload.metadata,
+	}
+	b.objects[key] = obj
+	delete(b.uploads, uploadId)
+
+	writeXml(w, http.StatusOK, completeMultipartUploadResult{
+		Xmlns:    s3Xmlns,
+		Location: "/" + name + "/" + key,
+		Bucket:   name,
+		Key:      key,
+		ETag:     obj.etag,
+	})
+
+	return nil
+}
+
+func (svc *s3Service) abortMultipartUpload(w http.ResponseWriter, name, uploadId string) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	b, _, err := svc.upload(name, uploadId)
+	if err != nil {
+		return err
+	}
+	delete(b.uploads, uploadId)
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
@@ -0,0 +1,216 @@
+package heftytest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createBucket(t *testing.T, client *s3.Client) string {
+	t.Helper()
+	_, err := client.CreateBucket(context.TODO(), &s3.CreateBucketInput{Bucket: aws.String("bucket")})
+	require.NoError(t, err)
+
+	return "bucket"
+}
+
+func TestS3Objects(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	client := server.S3Client()
+	bucket := createBucket(t, client)
+
+	_, err := client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String("dir/key"),
+		Body:              strings.NewReader("0123456789"),
+		ChecksumAlgorithm: s3Types.ChecksumAlgorithmCrc32,
+		Metadata:          map[string]string{"name": "value"},
+	})
+	require.NoError(t, err)
+
+	var tests = []struct {
+		desc    string
+		key     string
+		rng     string
+		expBody string
+		code    string
+	}{
+		{
+			desc:    "whole object",
+			key:     "dir/key",
+			expBody: "0123456789",
+		},
+		{
+			desc:    "range",
+			key:     "dir/key",
+			rng:     "bytes=2-4",
+			expBody: "234",
+		},
+		{
+			desc:    "range past the end of the object",
+			key:     "dir/key",
+			rng:     "bytes=8-20",
+			expBody: "89",
+		},
+		{
+			desc: "range starting after the object",
+			key:  "dir/key",
+			rng:  "bytes=10-20",
+			code: "InvalidRange",
+		},
+		{
+			desc: "missing key",
+			key:  "missing",
+			code: "NoSuchKey",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			input := &s3.GetObjectInput{
+				Bucket:       aws.String(bucket),
+				Key:          aws.String(test.key),
+				ChecksumMode: s3Types.ChecksumModeEnabled,
+			}
+			if test.rng != "" {
+				input.Range = aws.String(test.rng)
+			}
+			out, err := client.GetObject(context.TODO(), input)
+			if test.code != "" {
+				var apiErr smithy.APIError
+				require.True(t, errors.As(err, &apiErr), "expected api error but got %v", err)
+				assert.Equal(t, test.code, apiErr.ErrorCode())
+				return
+			}
+			require.NoError(t, err)
+			defer out.Body.Close()
+
+			body, err := io.ReadAll(out.Body)
+			require.NoError(t, err)
+			assert.Equal(t, test.expBody, string(body))
+			assert.Equal(t, "value", out.Metadata["name"])
+		})
+	}
+
+	head, err := client.HeadObject(context.TODO(), &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String("dir/key")})
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), aws.ToInt64(head.ContentLength))
+
+	list, err := client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String("dir/")})
+	require.NoError(t, err)
+	require.Len(t, list.Contents, 1)
+	assert.Equal(t, "dir/key", aws.ToString(list.Contents[0].Key))
+
+	_, err = client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String("dir/key")})
+	require.NoError(t, err)
+
+	_, err = client.HeadObject(context.TODO(), &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String("dir/key")})
+	var notFound *s3Types.NotFound
+	assert.ErrorAs(t, err, &notFound)
+
+	_, err = client.DeleteBucket(context.TODO(), &s3.DeleteBucketInput{Bucket: aws.String(bucket)})
+	require.NoError(t, err)
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	client := server.S3Client()
+	bucket := createBucket(t, client)
+
+	data := bytes.Repeat([]byte("0123456789"), 1_200_000) // spans three parts
+	uploader := manager.NewUploader(client, func(u *manager.Uploader) {
+		u.PartSize = minPartSize
+	})
+	_, err := uploader.Upload(context.TODO(), &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String("key"),
+		Body:   bytes.NewReader(data),
+	})
+	require.NoError(t, err)
+
+	// the downloader gets the object with ranges
+	buf := manager.NewWriteAtBuffer(nil)
+	n, err := manager.NewDownloader(client).Download(context.TODO(), buf, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String("key"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	assert.Equal(t, data, buf.Bytes())
+
+	head, err := client.HeadObject(context.TODO(), &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String("key")})
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(aws.ToString(head.ETag), `-3"`))
+}
+
+func TestS3PresignedUrl(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	client := server.S3Client()
+	bucket := createBucket(t, client)
+
+	_, err := client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String("key"),
+		Body:   strings.NewReader("data"),
+	})
+	require.NoError(t, err)
+
+	var tests = []struct {
+		desc      string
+		expires   time.Duration
+		signedAt  time.Time
+		expStatus int
+	}{
+		{
+			desc:      "valid",
+			expires:   time.Minute,
+			signedAt:  time.Now(),
+			expStatus: http.StatusOK,
+		},
+		{
+			desc:      "expired",
+			expires:   time.Minute,
+			signedAt:  time.Now().Add(-time.Hour),
+			expStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			presigned, err := s3.NewPresignClient(client, s3.WithPresignExpires(test.expires)).PresignGetObject(context.TODO(), &s3.GetObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String("key"),
+			})
+			require.NoError(t, err)
+
+			// signatures are not verified so the signing time can be changed
+			presignedUrl, err := url.Parse(presigned.URL)
+			require.NoError(t, err)
+			query := presignedUrl.Query()
+			query.Set("X-Amz-Date", test.signedAt.UTC().Format("20060102T150405Z"))
+			presignedUrl.RawQuery = query.Encode()
+
+			res, err := http.Get(presignedUrl.String())
+			require.NoError(t, err)
+			defer res.Body.Close()
+			assert.Equal(t, test.expStatus, res.StatusCode)
+		})
+	}
+}
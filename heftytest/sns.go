@@ -0,0 +1,757 @@
+package heftytest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/vinujohn/hefty/internal/messages"
+)
+
+const snsXmlns = "http://sns.amazonaws.com/doc/2010-03-31/"
+
+// snsService is the fake of AWS SNS. Messages are delivered to subscribed queues of the fake of AWS SQS. Subscriptions
+// with other protocols are recorded but receive no messages.
+type snsService struct {
+	sqs *sqsService
+
+	mu     sync.Mutex
+	topics map[string]*topic // by arn
+}
+
+type topic struct {
+	arn           string
+	attributes    map[string]string
+	subscriptions []*subscription
+}
+
+type subscription struct {
+	arn        string
+	topicArn   string
+	protocol   string
+	endpoint   string
+	attributes map[string]string
+}
+
+type snsResponse struct {
+	XMLName   xml.Name
+	Xmlns     string `xml:"xmlns,attr"`
+	Result    any
+	RequestId string `xml:"ResponseMetadata>RequestId"`
+}
+
+type snsErrorResponse struct {
+	XMLName   xml.Name `xml:"ErrorResponse"`
+	Xmlns     string   `xml:"xmlns,attr"`
+	Type      string   `xml:"Error>Type"`
+	Code      string   `xml:"Error>Code"`
+	Message   string   `xml:"Error>Message"`
+	RequestId string
+}
+
+type snsEmptyResult struct {
+	XMLName xml.Name
+}
+
+type createTopicResult struct {
+	XMLName  xml.Name `xml:"CreateTopicResult"`
+	TopicArn string
+}
+
+type snsAttributeEntry struct {
+	Key   string `xml:"key"`
+	Value string `xml:"value"`
+}
+
+type getTopicAttributesResult struct {
+	XMLName    xml.Name            `xml:"GetTopicAttributesResult"`
+	Attributes []snsAttributeEntry `xml:"Attributes>entry"`
+}
+
+type listTopicsResult struct {
+	XMLName xml.Name `xml:"ListTopicsResult"`
+	Topics  []string `xml:"Topics>member>TopicArn"`
+}
+
+type subscribeResult struct {
+	XMLName         xml.Name `xml:"SubscribeResult"`
+	SubscriptionArn string
+}
+
+type snsSubscriptionMember struct {
+	SubscriptionArn string
+	Owner           string
+	Protocol        string
+	Endpoint        string
+	TopicArn        string
+}
+
+type listSubscriptionsByTopicResult struct {
+	XMLName       xml.Name                `xml:"ListSubscriptionsByTopicResult"`
+	Subscriptions []snsSubscriptionMember `xml:"Subscriptions>member"`
+}
+
+type publishResult struct {
+	XMLName   xml.Name `xml:"PublishResult"`
+	MessageId string
+}
+
+type publishBatchSuccess struct {
+	Id        string
+	MessageId string
+}
+
+type publishBatchFailure struct {
+	Id          string
+	Code        string
+	Message     string
+	SenderFault bool
+}
+
+type publishBatchResult struct {
+	XMLName    xml.Name              `xml:"PublishBatchResult"`
+	Successful []publishBatchSuccess `xml:"Successful>member"`
+	Failed     []publishBatchFailure `xml:"Failed>member"`
+}
+
+// snsAttributeValue is a message attribute in a notification which is not delivered raw.
+type snsAttributeValue struct {
+	Type  string
+	Value string
+}
+
+type snsNotification struct {
+	Type              string
+	MessageId         string
+	TopicArn          string
+	Subject           string `json:",omitempty"`
+	Message           string
+	Timestamp         string
+	SignatureVersion  string
+	Signature         string
+	SigningCertURL    string
+	UnsubscribeURL    string
+	MessageAttributes map[string]snsAttributeValue `json:",omitempty"`
+}
+
+func newSnsService(sqs *sqsService) *snsService {
+	return &snsService{
+		sqs:    sqs,
+		topics: make(map[string]*topic),
+	}
+}
+
+func (svc *snsService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		writeSnsError(w, newApiError(http.StatusBadRequest, "MalformedQueryString", err.Error()))
+		return
+	}
+	action := r.Form.Get("Action")
+
+	var result any
+	switch action {
+	case "CreateTopic":
+		result, err = svc.createTopic(r.Form)
+	case "DeleteTopic":
+		result, err = svc.deleteTopic(r.Form)
+	case "ListTopics":
+		result, err = svc.listTopics()
+	case "GetTopicAttributes":
+		result, err = svc.getTopicAttributes(r.Form)
+	case "Subscribe":
+		result, err = svc.subscribe(r.Form)
+	case "Unsubscribe":
+		result, err = svc.unsubscribe(r.Form)
+	case "ListSubscriptionsByTopic":
+		result, err = svc.listSubscriptionsByTopic(r.Form)
+	case "SetSubscriptionAttributes":
+		result, err = svc.setSubscriptionAttributes(r.Form)
+	case "Publish":
+		result, err = svc.publish(r.Form)
+	case "PublishBatch":
+		result, err = svc.publishBatch(r.Form)
+	default:
+		err = newApiError(http.StatusBadRequest, "InvalidAction", fmt.Sprintf("action %s is not supported by heftytest", action))
+	}
+
+	if err != nil {
+		writeSnsError(w, err)
+		return
+	}
+
+	writeXml(w, http.StatusOK, snsResponse{
+		XMLName:   xml.Name{Local: action + "Response"},
+		Xmlns:     snsXmlns,
+		Result:    result,
+		RequestId: newId(),
+	})
+}
+
+func writeSnsError(w http.ResponseWriter, err error) {
+	apiErr, ok := err.(*apiError)
+	if !ok {
+		apiErr = newApiError(http.StatusBadRequest, "InvalidParameter", err.Error())
+	}
+
+	writeXml(w, apiErr.status, snsErrorResponse{
+		Xmlns:     snsXmlns,
+		Type:      apiErr.fault(),
+		Code:      apiErr.code,
+		Message:   apiErr.message,
+		RequestId: newId(),
+	})
+}
+
+func emptyResult(action string) snsEmptyResult {
+	return snsEmptyResult{XMLName: xml.Name{Local: action + "Result"}}
+}
+
+func invalidParameter(format string, args ...any) error {
+	return newApiError(http.StatusBadRequest, "InvalidParameter", "Invalid parameter: "+fmt.Sprintf(format, args...))
+}
+
+// formMap returns a map of a query request, such as the attributes "Attributes.entry.1.key" and
+// "Attributes.entry.1.value", where `key` and `value` are the names of the key and value of each entry.
+func formMap(form url.Values, prefix, key, value string) map[string]string {
+	var m map[string]string
+	for i := 1; ; i++ {
+		entry := fmt.Sprintf("%s.entry.%d.", prefix, i)
+		if !form.Has(entry + key) {
+			return m
+		}
+		if m == nil {
+			m = make(map[string]string)
+		}
+		m[form.Get(entry+key)] = form.Get(entry + value)
+	}
+}
+
+// formMessageAttributes returns the message attributes of a query request with `prefix`, such as "MessageAttributes".
+func formMessageAttributes(form url.Values, prefix string) (map[string]messages.MessageAttributeValue, error) {
+	var msgAttr map[string]messages.MessageAttributeValue
+	for i := 1; ; i++ {
+		entry := fmt.Sprintf("%s.entry.%d.", prefix, i)
+		if !form.Has(entry + "Name") {
+			return msgAttr, nil
+		}
+
+		value := messages.MessageAttributeValue{DataType: aws.String(form.Get(entry + "Value.DataType"))}
+		if form.Has(entry + "Value.StringValue") {
+			value.StringValue = aws.String(form.Get(entry + "Value.StringValue"))
+		}
+		if form.Has(entry + "Value.BinaryValue") {
+			binary, err := base64.StdEncoding.DecodeString(form.Get(entry + "Value.BinaryValue"))
+			if err != nil {
+				return nil, invalidParameter("binary value of message attribute %s is not base64 encoded", form.Get(entry+"Name"))
+			}
+			value.BinaryValue = binary
+		}
+		if msgAttr == nil {
+			msgAttr = make(map[string]messages.MessageAttributeValue)
+		}
+		msgAttr[form.Get(entry+"Name")] = value
+	}
+}
+
+// topic returns the topic with `arn`. The lock must be held.
+func (svc *snsService) topic(arn string) (*topic, error) {
+	t, ok := svc.topics[arn]
+	if !ok {
+		return nil, newApiError(http.StatusNotFound, "NotFound", "Topic does not exist")
+	}
+
+	return t, nil
+}
+
+func (svc *snsService) createTopic(form url.Values) (any, error) {
+	name := form.Get("Name")
+	if name == "" || len(name) > 256 || strings.Trim(name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_") != "" {
+		return nil, invalidParameter("Topic Name")
+	}
+	attributes := formMap(form, "Attributes", "key", "value")
+	if isTrue(attributes["FifoTopic"]) {
+		return nil, invalidParameter("FIFO topics are not supported by heftytest")
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	arn := fmt.Sprintf("arn:aws:sns:%s:%s:%s", Region, AccountId, name)
+	if _, ok := svc.topics[arn]; !ok {
+		svc.topics[arn] = &topic{arn: arn, attributes: attributes}
+	}
+
+	return createTopicResult{TopicArn: arn}, nil
+}
+
+func (svc *snsService) deleteTopic(form url.Values) (any, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	delete(svc.topics, form.Get("TopicArn"))
+
+	return emptyResult("DeleteTopic"), nil
+}
+
+func (svc *snsService) getTopicAttributes(form url.Values) (any, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	t, err := svc.topic(form.Get("TopicArn"))
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := map[string]string{
+		"TopicArn":               t.arn,
+		"Owner":                  AccountId,
+		"SubscriptionsConfirmed": strconv.Itoa(len(t.subscriptions)),
+		"SubscriptionsPending":   "0",
+		"SubscriptionsDeleted":   "0",
+	}
+	for k, v := range t.attributes {
+		attributes[k] = v
+	}
+
+	result := getTopicAttributesResult{}
+	for k, v := range attributes {
+		result.Attributes = append(result.Attributes, snsAttributeEntry{Key: k, Value: v})
+	}
+
+	return result, nil
+}
+
+func (svc *snsService) listTopics() (any, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	result := listTopicsResult{Topics: []string{}}
+	for arn := range svc.topics {
+		result.Topics = append(result.Topics, arn)
+	}
+	slices.Sort(result.Topics)
+
+	return result, nil
+}
+
+func (svc *snsService) subscribe(form url.Values) (any, error) {
+	protocol, endpoint := form.Get("Protocol"), form.Get("Endpoint")
+	if protocol == "" {
+		return nil, invalidParameter("Protocol")
+	} else if endpoint == "" {
+		return nil, invalidParameter("Endpoint")
+	}
+	attributes := formMap(form, "Attributes", "key", "value")
+	for name, value := range attributes {
+		if err := validateSubscriptionAttribute(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	t, err := svc.topic(form.Get("TopicArn"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sub := range t.subscriptions {
+		if sub.protocol == protocol && sub.endpoint == endpoint {
+			return subscribeResult{SubscriptionArn: sub.arn}, nil
+		}
+	}
+	sub := &subscription{
+		arn:        t.arn + ":" + newId(),
+		topicArn:   t.arn,
+		protocol:   protocol,
+		endpoint:   endpoint,
+		attributes: make(map[string]string),
+	}
+	for name, value := range attributes {
+		sub.attributes[name] = value
+	}
+	t.subscriptions = append(t.subscriptions, sub)
+
+	return subscribeResult{SubscriptionArn: sub.arn}, nil
+}
+
+// validateSubscriptionAttribute validates a subscription attribute which can be set.
+func validateSubscriptionAttribute(name, value string) error {
+	switch name {
+	case "RawMessageDelivery":
+		if !isTrue(value) && !strings.EqualFold(value, "false") {
+			return invalidParameter("Attributes Reason: RawMessageDelivery: Invalid value [%s]. Must be true or false.", value)
+		}
+	case "FilterPolicy":
+		if value == "" {
+			return nil
+		}
+		if _, err := parseFilterPolicy(value); err != nil {
+			return invalidParameter("Filter policy: %v", err)
+		}
+	case "FilterPolicyScope":
+		if value != "MessageAttributes" {
+			return invalidParameter("Attributes Reason: FilterPolicyScope: only MessageAttributes is supported by heftytest")
+		}
+	case "DeliveryPolicy", "RedrivePolicy", "SubscriptionRoleArn":
+	default:
+		return invalidParameter("Attributes Reason: Unknown attribute %s", name)
+	}
+
+	return nil
+}
+
+func (svc *snsService) unsubscribe(form url.Values) (any, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	arn := form.Get("SubscriptionArn")
+	for _, t := range svc.topics {
+		t.subscriptions = slices.DeleteFunc(t.subscriptions, func(sub *subscription) bool {
+			return sub.arn == arn
+		})
+	}
+
+	return emptyResult("Unsubscribe"), nil
+}
+
+func (svc *snsService) listSubscriptionsByTopic(form url.Values) (any, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	t, err := svc.topic(form.Get("TopicArn"))
+	if err != nil {
+		return nil, err
+	}
+
+	result := listSubscriptionsByTopicResult{Subscriptions: []snsSubscriptionMember{}}
+	for _, sub := range t.subscriptions {
+		result.Subscriptions = append(result.Subscriptions, snsSubscriptionMember{
+			SubscriptionArn: sub.arn,
+			Owner:           AccountId,
+			Protocol:        sub.protocol,
+			Endpoint:        sub.endpoint,
+			TopicArn:        sub.topicArn,
+		})
+	}
+
+	return result, nil
+}
+
+func (svc *snsService) setSubscriptionAttributes(form url.Values) (any, error) {
+	name, value := form.Get("AttributeName"), form.Get("AttributeValue")
+	if err := validateSubscriptionAttribute(name, value); err != nil {
+		return nil, err
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	arn := form.Get("SubscriptionArn")
+	for _, t := range svc.topics {
+		for _, sub := range t.subscriptions {
+			if sub.arn == arn {
+				sub.attributes[name] = value
+				return emptyResult("SetSubscriptionAttributes"), nil
+			}
+		}
+	}
+
+	return nil, newApiError(http.StatusNotFound, "NotFound", "Subscription does not exist")
+}
+
+func (svc *snsService) publish(form url.Values) (any, error) {
+	topicArn := form.Get("TopicArn")
+	if topicArn == "" {
+		topicArn = form.Get("TargetArn")
+	}
+	msgAttr, err := formMessageAttributes(form, "MessageAttributes")
+	if err != nil {
+		return nil, err
+	}
+
+	msgId, err := svc.publishMessage(topicArn, form.Get("Message"), form.Get("Subject"), form.Get("MessageStructure"), msgAttr)
+	if err != nil {
+		return nil, err
+	}
+
+	return publishResult{MessageId: msgId}, nil
+}
+
+func (svc *snsService) publishBatch(form url.Values) (any, error) {
+	topicArn := form.Get("TopicArn")
+	var ids []string
+	for i := 1; form.Has(fmt.Sprintf("PublishBatchRequestEntries.member.%d.Id", i)); i++ {
+		ids = append(ids, form.Get(fmt.Sprintf("PublishBatchRequestEntries.member.%d.Id", i)))
+	}
+	if err := validateBatch(ids); err != nil {
+		return nil, err
+	}
+
+	result := publishBatchResult{Successful: []publishBatchSuccess{}, Failed: []publishBatchFailure{}}
+	for i, id := range ids {
+		entry := fmt.Sprintf("PublishBatchRequestEntries.member.%d.", i+1)
+		msgAttr, err := formMessageAttributes(form, entry+"MessageAttributes")
+		var msgId string
+		if err == nil {
+			msgId, err = svc.publishMessage(topicArn, form.Get(entry+"Message"), form.Get(entry+"Subject"), form.Get(entry+"MessageStructure"), msgAttr)
+		}
+		if apiErr, ok := err.(*apiError); ok && apiErr.code == "NotFound" {
+			return nil, err
+		} else if err != nil {
+			failed := batchError(id, err)
+			result.Failed = append(result.Failed, publishBatchFailure(failed))
+			continue
+		}
+		result.Successful = append(result.Successful, publishBatchSuccess{Id: id, MessageId: msgId})
+	}
+
+	return result, nil
+}
+
+// publishMessage publishes a message to a topic and delivers it to the subscribed queues whose filter policy matches.
+func (svc *snsService) publishMessage(topicArn, body, subject, structure string, msgAttr map[string]messages.MessageAttributeValue) (string, error) {
+	err := validateMessage(&body, msgAttr, maxMessageSize)
+	if err != nil {
+		return "", invalidParameter("%s", err.(*apiError).message)
+	}
+	if structure != "" && structure != "json" {
+		return "", invalidParameter("MessageStructure")
+	}
+
+	// a message with a json structure holds the message of each protocol
+	sqsBody := body
+	if structure == "json" {
+		var bodies map[string]string
+		if err := json.Unmarshal([]byte(body), &bodies); err != nil || bodies["default"] == "" {
+			return "", invalidParameter("Message Structure - No default entry in JSON message body")
+		}
+		sqsBody = bodies["default"]
+		if b, ok := bodies["sqs"]; ok {
+			sqsBody = b
+		}
+	}
+
+	svc.mu.Lock()
+	t, err := svc.topic(topicArn)
+	if err != nil {
+		svc.mu.Unlock()
+		return "", err
+	}
+	subscriptions := slices.Clone(t.subscriptions)
+	attributes := make([]map[string]string, len(subscriptions))
+	for i, sub := range subscriptions {
+		attributes[i] = make(map[string]string, len(sub.attributes))
+		for name, value := range sub.attributes {
+			attributes[i][name] = value
+		}
+	}
+	svc.mu.Unlock()
+
+	msgId := newId()
+	now := time.Now().UTC()
+	for i, sub := range subscriptions {
+		if sub.protocol != "sqs" {
+			continue
+		}
+		if policy := attributes[i]["FilterPolicy"]; policy != "" {
+			filter, _ := parseFilterPolicy(policy)
+			if !filter.matches(msgAttr) {
+				continue
+			}
+		}
+
+		if isTrue(attributes[i]["RawMessageDelivery"]) {
+			svc.sqs.deliver(sub.endpoint, sqsBody, msgAttr)
+			continue
+		}
+
+		notification := snsNotification{
+			Type:             "Notification",
+			MessageId:        msgId,
+			TopicArn:         topicArn,
+			Subject:          subject,
+			Message:          sqsBody,
+			Timestamp:        now.Format("2006-01-02T15:04:05.000Z"),
+			SignatureVersion: "1",
+			Signature:        "heftytest",
+			SigningCertURL:   "https://sns." + Region + ".amazonaws.com/heftytest.pem",
+			UnsubscribeURL:   "https://sns." + Region + ".amazonaws.com/?Action=Unsubscribe&SubscriptionArn=" + url.QueryEscape(sub.arn),
+		}
+		for name, value := range msgAttr {
+			if notification.MessageAttributes == nil {
+				notification.MessageAttributes = make(map[string]snsAttributeValue)
+			}
+			v := aws.ToString(value.StringValue)
+			if value.BinaryValue != nil {
+				v = base64.StdEncoding.EncodeToString(value.BinaryValue)
+			}
+			notification.MessageAttributes[name] = snsAttributeValue{Type: aws.ToString(value.DataType), Value: v}
+		}
+		envelope, _ := json.Marshal(notification)
+		svc.sqs.deliver(sub.endpoint, string(envelope), nil)
+	}
+
+	return msgId, nil
+}
+
+// filterPolicy is a subscription filter policy on message attributes. Exact string and numeric values and the
+// operators "prefix", "suffix", "equals-ignore-case", "exists", "anything-but", and "numeric" are supported.
+type filterPolicy map[string][]any
+
+func parseFilterPolicy(value string) (filterPolicy, error) {
+	var policy filterPolicy
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+	err := decoder.Decode(&policy)
+	if err != nil {
+		return nil, fmt.Errorf("filter policy must be an object of arrays. %w", err)
+	}
+
+	return policy, nil
+}
+
+// matches checks whether every attribute of the policy matches at least one of its conditions.
+func (policy filterPolicy) matches(msgAttr map[string]messages.MessageAttributeValue) bool {
+	for name, conditions := range policy {
+		value, ok := msgAttr[name]
+		matched := false
+		for _, condition := range conditions {
+			if matchCondition(condition, value, ok) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchCondition checks whether a condition of a filter policy matches a message attribute, where `ok` is false if the
+// message does not have the attribute.
+func matchCondition(condition any, value messages.MessageAttributeValue, ok bool) bool {
+	if operator, isOperator := condition.(map[string]any); isOperator {
+		if exists, isExists := operator["exists"].(bool); isExists {
+			return exists == ok
+		}
+	}
+	if !ok || value.StringValue == nil {
+		return false
+	}
+
+	// the values of a string array attribute match individually
+	values := []string{*value.StringValue}
+	dataType := aws.ToString(value.DataType)
+	if strings.HasPrefix(dataType, "String.Array") {
+		var array []any
+		if json.Unmarshal([]byte(*value.StringValue), &array) == nil {
+			values = values[:0]
+			for _, v := range array {
+				values = append(values, fmt.Sprint(v))
+			}
+		}
+	}
+	isNumber := strings.HasPrefix(dataType, "Number")
+
+	for _, v := range values {
+		if matchValue(condition, v, isNumber) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchValue(condition any, value string, isNumber bool) bool {
+	switch c := condition.(type) {
+	case string:
+		return !isNumber && c == value
+	case json.Number:
+		return isNumber && numbersEqual(c.String(), value)
+	case map[string]any:
+		for operator, operand := range c {
+			switch operator {
+			case "prefix":
+				s, _ := operand.(string)
+				return strings.HasPrefix(value, s)
+			case "suffix":
+				s, _ := operand.(string)
+				return strings.HasSuffix(value, s)
+			case "equals-ignore-case":
+				s, _ := operand.(string)
+				return strings.EqualFold(value, s)
+			case "anything-but":
+				operands, isList := operand.([]any)
+				if !isList {
+					operands = []any{operand}
+				}
+				for _, o := range operands {
+					if matchValue(o, value, isNumber) {
+						return false
+					}
+				}
+				return true
+			case "numeric":
+				return isNumber && matchNumeric(operand, value)
+			}
+		}
+	}
+
+	return false
+}
+
+func numbersEqual(a, b string) bool {
+	x, errX := strconv.ParseFloat(a, 64)
+	y, errY := strconv.ParseFloat(b, 64)
+	return errX == nil && errY == nil && x == y
+}
+
+// matchNumeric matches a numeric condition such as [">", 0, "<=", 5].
+func matchNumeric(operand any, value string) bool {
+	conditions, _ := operand.([]any)
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || len(conditions) == 0 || len(conditions)%2 != 0 {
+		return false
+	}
+
+	for i := 0; i < len(conditions); i += 2 {
+		operator, _ := conditions[i].(string)
+		number, _ := conditions[i+1].(json.Number)
+		m, err := number.Float64()
+		if err != nil {
+			return false
+		}
+		var ok bool
+		switch operator {
+		case "=":
+			ok = n == m
+		case "<":
+			ok = n < m
+		case "<=":
+			ok = n <= m
+		case ">":
+			ok = n > m
+		case ">=":
+			ok = n >= m
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,168 @@
+package heftytest
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snsTypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// subscribeQueue creates a queue and subscribes it to `topicArn`.
+func subscribeQueue(t *testing.T, server *Server, topicArn, name string, attributes map[string]string) string {
+	t.Helper()
+	queueUrl := createQueue(t, server.SqsClient(), name, nil)
+	attr, err := server.SqsClient().GetQueueAttributes(context.TODO(), &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(queueUrl),
+		AttributeNames: []types.QueueAttributeName{types.QueueAttributeNameQueueArn},
+	})
+	require.NoError(t, err)
+
+	_, err = server.SnsClient().Subscribe(context.TODO(), &sns.SubscribeInput{
+		TopicArn:   aws.String(topicArn),
+		Protocol:   aws.String("sqs"),
+		Endpoint:   aws.String(attr.Attributes["QueueArn"]),
+		Attributes: attributes,
+	})
+	require.NoError(t, err)
+
+	return queueUrl
+}
+
+func TestSnsPublish(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	topic, err := server.SnsClient().CreateTopic(context.TODO(), &sns.CreateTopicInput{Name: aws.String("topic")})
+	require.NoError(t, err)
+	topicArn := aws.ToString(topic.TopicArn)
+
+	rawUrl := subscribeQueue(t, server, topicArn, "raw", map[string]string{"RawMessageDelivery": "true"})
+	envelopeUrl := subscribeQueue(t, server, topicArn, "envelope", nil)
+	filteredUrl := subscribeQueue(t, server, topicArn, "filtered", map[string]string{
+		"RawMessageDelivery": "true",
+		"FilterPolicy":       `{"color":["blue",{"prefix":"gr"}]}`,
+	})
+
+	publish := func(color string) {
+		t.Helper()
+		_, err := server.SnsClient().Publish(context.TODO(), &sns.PublishInput{
+			TopicArn: aws.String(topicArn),
+			Message:  aws.String(color + " message"),
+			MessageAttributes: map[string]snsTypes.MessageAttributeValue{
+				"color": {DataType: aws.String("String"), StringValue: aws.String(color)},
+			},
+		})
+		require.NoError(t, err)
+	}
+	publish("red")
+	publish("green")
+
+	var tests = []struct {
+		desc     string
+		queueUrl string
+		expBody  []string
+		raw      bool
+	}{
+		{
+			desc:     "raw message delivery",
+			queueUrl: rawUrl,
+			expBody:  []string{"red message", "green message"},
+			raw:      true,
+		},
+		{
+			desc:     "notification envelope",
+			queueUrl: envelopeUrl,
+			expBody:  []string{"red message", "green message"},
+		},
+		{
+			desc:     "filter policy",
+			queueUrl: filteredUrl,
+			expBody:  []string{"green message"},
+			raw:      true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			received, err := server.SqsClient().ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{
+				QueueUrl:              aws.String(test.queueUrl),
+				MaxNumberOfMessages:   10,
+				MessageAttributeNames: []string{"All"},
+			})
+			require.NoError(t, err)
+
+			var bodies []string
+			for _, msg := range received.Messages {
+				if test.raw {
+					bodies = append(bodies, aws.ToString(msg.Body))
+					assert.Contains(t, msg.MessageAttributes, "color")
+					continue
+				}
+
+				var notification struct {
+					Type              string
+					TopicArn          string
+					Message           string
+					MessageAttributes map[string]struct{ Type, Value string }
+				}
+				require.NoError(t, json.Unmarshal([]byte(aws.ToString(msg.Body)), &notification))
+				assert.Equal(t, "Notification", notification.Type)
+				assert.Equal(t, topicArn, notification.TopicArn)
+				assert.Equal(t, "String", notification.MessageAttributes["color"].Type)
+				assert.Empty(t, msg.MessageAttributes)
+				bodies = append(bodies, notification.Message)
+			}
+			assert.ElementsMatch(t, test.expBody, bodies)
+		})
+	}
+}
+
+func TestSnsPublishBatch(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	topic, err := server.SnsClient().CreateTopic(context.TODO(), &sns.CreateTopicInput{Name: aws.String("topic")})
+	require.NoError(t, err)
+	queueUrl := subscribeQueue(t, server, aws.ToString(topic.TopicArn), "queue", map[string]string{"RawMessageDelivery": "true"})
+
+	out, err := server.SnsClient().PublishBatch(context.TODO(), &sns.PublishBatchInput{
+		TopicArn: topic.TopicArn,
+		PublishBatchRequestEntries: []snsTypes.PublishBatchRequestEntry{
+			{Id: aws.String("1"), Message: aws.String("a")},
+			{Id: aws.String("2"), Message: aws.String("")},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, out.Successful, 1)
+	assert.Equal(t, "1", aws.ToString(out.Successful[0].Id))
+	require.Len(t, out.Failed, 1)
+	assert.Equal(t, "2", aws.ToString(out.Failed[0].Id))
+
+	received, err := server.SqsClient().ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{QueueUrl: aws.String(queueUrl), MaxNumberOfMessages: 10})
+	require.NoError(t, err)
+	require.Len(t, received.Messages, 1)
+	assert.Equal(t, "a", aws.ToString(received.Messages[0].Body))
+}
+
+func TestSnsGetTopicAttributes(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	topic, err := server.SnsClient().CreateTopic(context.TODO(), &sns.CreateTopicInput{Name: aws.String("topic")})
+	require.NoError(t, err)
+	subscribeQueue(t, server, aws.ToString(topic.TopicArn), "queue", nil)
+
+	out, err := server.SnsClient().GetTopicAttributes(context.TODO(), &sns.GetTopicAttributesInput{TopicArn: topic.TopicArn})
+	require.NoError(t, err)
+	assert.Equal(t, aws.ToString(topic.TopicArn), out.Attributes["TopicArn"])
+	assert.Equal(t, AccountId, out.Attributes["Owner"])
+	assert.Equal(t, "1", out.Attributes["SubscriptionsConfirmed"])
+
+	_, err = server.SnsClient().GetTopicAttributes(context.TODO(), &sns.GetTopicAttributesInput{TopicArn: aws.String("arn:aws:sns:us-east-1:000000000000:missing")})
+	var notFound *snsTypes.NotFoundException
+	assert.ErrorAs(t, err, &notFound)
+}
@@ -0,0 +1,949 @@
+package heftytest
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/vinujohn/hefty/internal/messages"
+)
+
+const (
+	sqsContentType           = "application/x-amz-json-1.0"
+	sqsTargetPrefix          = "AmazonSQS."
+	defaultVisibilityTimeout = 30
+	maxVisibilityTimeout     = 43_200 // 12 hours
+	maxDelaySeconds          = 900
+	maxWaitTimeSeconds       = 20
+	maxReceiveMessages       = 10
+	maxBatchEntries          = 10
+	maxMessageAttributes     = 10
+	maxMessageSize           = 262_144
+)
+
+// sqsService is the fake of AWS SQS.
+type sqsService struct {
+	baseUrl string
+
+	mu     sync.Mutex
+	queues map[string]*queue // by name
+	closed chan struct{}
+}
+
+type queue struct {
+	name       string
+	url        string
+	arn        string
+	created    time.Time
+	modified   time.Time
+	attributes map[string]string
+	messages   []*sqsMessage
+
+	// changed is closed and replaced whenever a message may have become available
+	changed chan struct{}
+}
+
+type sqsMessage struct {
+	id            string
+	body          string
+	attributes    map[string]messages.MessageAttributeValue
+	sent          time.Time
+	visibleAt     time.Time
+	receiveCount  int
+	firstReceived time.Time
+	receiptHandle string // of the latest receive
+}
+
+// sqsAttributeValue is a message attribute in a response.
+type sqsAttributeValue struct {
+	DataType    string
+	StringValue *string `json:",omitempty"`
+	BinaryValue []byte  `json:",omitempty"`
+}
+
+type sqsReceivedMessage struct {
+	MessageId              string
+	ReceiptHandle          string
+	Body                   string
+	MD5OfBody              string
+	MD5OfMessageAttributes string                       `json:",omitempty"`
+	Attributes             map[string]string            `json:",omitempty"`
+	MessageAttributes      map[string]sqsAttributeValue `json:",omitempty"`
+}
+
+type sqsSentMessage struct {
+	Id                     string `json:",omitempty"`
+	MessageId              string
+	MD5OfMessageBody       string
+	MD5OfMessageAttributes string `json:",omitempty"`
+}
+
+type sqsBatchResultEntry struct {
+	Id string
+}
+
+type sqsBatchErrorEntry struct {
+	Id          string
+	Code        string
+	Message     string
+	SenderFault bool
+}
+
+type sqsBatchOutput struct {
+	Successful []any
+	Failed     []sqsBatchErrorEntry
+}
+
+func newSqsService() *sqsService {
+	return &sqsService{
+		queues: make(map[string]*queue),
+		closed: make(chan struct{}),
+	}
+}
+
+func (svc *sqsService) close() {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	select {
+	case <-svc.closed:
+	default:
+		close(svc.closed)
+	}
+}
+
+func (svc *sqsService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	op := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), sqsTargetPrefix)
+
+	var out any
+	var err error
+	switch op {
+	case "CreateQueue":
+		out, err = handle(r, svc.createQueue)
+	case "DeleteQueue":
+		out, err = handle(r, svc.deleteQueue)
+	case "GetQueueUrl":
+		out, err = handle(r, svc.getQueueUrl)
+	case "ListQueues":
+		out, err = handle(r, svc.listQueues)
+	case "PurgeQueue":
+		out, err = handle(r, svc.purgeQueue)
+	case "GetQueueAttributes":
+		out, err = handle(r, svc.getQueueAttributes)
+	case "SetQueueAttributes":
+		out, err = handle(r, svc.setQueueAttributes)
+	case "SendMessage":
+		out, err = handle(r, svc.sendMessage)
+	case "SendMessageBatch":
+		out, err = handle(r, svc.sendMessageBatch)
+	case "ReceiveMessage":
+		out, err = handle(r, svc.receiveMessage)
+	case "DeleteMessage":
+		out, err = handle(r, svc.deleteMessage)
+	case "DeleteMessageBatch":
+		out, err = handle(r, svc.deleteMessageBatch)
+	case "ChangeMessageVisibility":
+		out, err = handle(r, svc.changeMessageVisibility)
+	case "ChangeMessageVisibilityBatch":
+		out, err = handle(r, svc.changeMessageVisibilityBatch)
+	default:
+		err = newApiError(http.StatusBadRequest, "UnsupportedOperation", fmt.Sprintf("operation %s is not supported by heftytest", op))
+	}
+
+	if err != nil {
+		writeSqsError(w, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, sqsContentType, out)
+}
+
+func writeSqsError(w http.ResponseWriter, err error) {
+	apiErr, ok := err.(*apiError)
+	if !ok {
+		apiErr = newApiError(http.StatusBadRequest, "InvalidParameterValue", err.Error())
+	}
+
+	w.Header().Set("X-Amzn-Query-Error", apiErr.code+";"+apiErr.fault())
+	writeJson(w, apiErr.status, sqsContentType, map[string]string{
+		"__type":  "com.amazonaws.sqs#" + apiErr.code,
+		"message": apiErr.message,
+	})
+}
+
+// handle decodes the input of an operation from the body of `r` and calls `op` with it.
+func handle[In any](r *http.Request, op func(ctx context.Context, in *In) (any, error)) (any, error) {
+	in := new(In)
+	err := json.NewDecoder(r.Body).Decode(in)
+	if err != nil {
+		return nil, newApiError(http.StatusBadRequest, "MalformedInput", err.Error())
+	}
+
+	return op(r.Context(), in)
+}
+
+// queue returns the queue at `queueUrl`. The lock must be held.
+func (svc *sqsService) queue(queueUrl *string) (*queue, error) {
+	if queueUrl == nil {
+		return nil, newApiError(http.StatusBadRequest, "MissingParameter", "The request must contain the parameter QueueUrl.")
+	}
+
+	q, ok := svc.queues[path.Base(*queueUrl)]
+	if !ok {
+		return nil, newApiError(http.StatusBadRequest, "QueueDoesNotExist", "The specified queue does not exist.")
+	}
+
+	return q, nil
+}
+
+// queueByArn returns the queue with `arn`. The lock must be held.
+func (svc *sqsService) queueByArn(arn string) (*queue, bool) {
+	for _, q := range svc.queues {
+		if q.arn == arn {
+			return q, true
+		}
+	}
+
+	return nil, false
+}
+
+func (svc *sqsService) createQueue(_ context.Context, in *sqs.CreateQueueInput) (any, error) {
+	name := aws.ToString(in.QueueName)
+	if name == "" || len(name) > 80 || strings.Trim(name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_") != "" {
+		return nil, newApiError(http.StatusBadRequest, "InvalidParameterValue", fmt.Sprintf("Invalid queue name %q.", name))
+	}
+	for name, value := range in.Attributes {
+		if err := validateQueueAttribute(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	q, ok := svc.queues[name]
+	if !ok {
+		now := time.Now()
+		q = &queue{
+			name:       name,
+			url:        fmt.Sprintf("%s/%s/%s", svc.baseUrl, AccountId, name),
+			arn:        fmt.Sprintf("arn:aws:sqs:%s:%s:%s", Region, AccountId, name),
+			created:    now,
+			modified:   now,
+			attributes: map[string]string{"VisibilityTimeout": strconv.Itoa(defaultVisibilityTimeout)},
+			changed:    make(chan struct{}),
+		}
+		for name, value := range in.Attributes {
+			q.attributes[name] = value
+		}
+		svc.queues[name] = q
+	}
+
+	return map[string]string{"QueueUrl": q.url}, nil
+}
+
+func (svc *sqsService) deleteQueue(_ context.Context, in *sqs.DeleteQueueInput) (any, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	q, err := svc.queue(in.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+	delete(svc.queues, q.name)
+	q.notify()
+
+	return struct{}{}, nil
+}
+
+func (svc *sqsService) getQueueUrl(_ context.Context, in *sqs.GetQueueUrlInput) (any, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	q, ok := svc.queues[aws.ToString(in.QueueName)]
+	if !ok {
+		return nil, newApiError(http.StatusBadRequest, "QueueDoesNotExist", "The specified queue does not exist.")
+	}
+
+	return map[string]string{"QueueUrl": q.url}, nil
+}
+
+func (svc *sqsService) listQueues(_ context.Context, in *sqs.ListQueuesInput) (any, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	urls := []string{}
+	for name, q := range svc.queues {
+		if strings.HasPrefix(name, aws.ToString(in.QueueNamePrefix)) {
+			urls = append(urls, q.url)
+		}
+	}
+	slices.Sort(urls)
+
+	return map[string][]string{"QueueUrls": urls}, nil
+}
+
+func (svc *sqsService) purgeQueue(_ context.Context, in *sqs.PurgeQueueInput) (any, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	q, err := svc.queue(in.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+	q.messages = nil
+
+	return struct{}{}, nil
+}
+
+func (svc *sqsService) getQueueAttributes(_ context.Context, in *sqs.GetQueueAttributesInput) (any, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	q, err := svc.queue(in.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	all := q.allAttributes(time.Now())
+	attributes := make(map[string]string)
+	for _, name := range in.AttributeNames {
+		if name == types.QueueAttributeNameAll {
+			attributes = all
+			break
+		}
+		if value, ok := all[string(name)]; ok {
+			attributes[string(name)] = value
+		}
+	}
+
+	return map[string]map[string]string{"Attributes": attributes}, nil
+}
+
+func (svc *sqsService) setQueueAttributes(_ context.Context, in *sqs.SetQueueAttributesInput) (any, error) {
+	for name, value := range in.Attributes {
+		if err := validateQueueAttribute(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	q, err := svc.queue(in.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range in.Attributes {
+		q.attributes[name] = value
+	}
+	q.modified = time.Now()
+
+	return struct{}{}, nil
+}
+
+// validateQueueAttribute validates a queue attribute which can be set.
+func validateQueueAttribute(name, value string) error {
+	invalid := func(reason string) error {
+		return newApiError(http.StatusBadRequest, "InvalidAttributeValue", fmt.Sprintf("Invalid value for the parameter %s. Reason: %s", name, reason))
+	}
+	between := func(min, max int) error {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < min || n > max {
+			return invalid(fmt.Sprintf("must be between %d and %d.", min, max))
+		}
+		return nil
+	}
+
+	switch name {
+	case "VisibilityTimeout":
+		return between(0, maxVisibilityTimeout)
+	case "DelaySeconds":
+		return between(0, maxDelaySeconds)
+	case "ReceiveMessageWaitTimeSeconds":
+		return between(0, maxWaitTimeSeconds)
+	case "MessageRetentionPeriod":
+		return between(60, 1_209_600)
+	case "MaximumMessageSize":
+		return between(1024, maxMessageSize)
+	case "RedrivePolicy":
+		if value == "" {
+			return nil
+		}
+		if _, _, err := parseRedrivePolicy(value); err != nil {
+			return invalid(err.Error())
+		}
+		return nil
+	case "FifoQueue", "ContentBasedDeduplication":
+		if isTrue(value) {
+			return invalid("FIFO queues are not supported by heftytest.")
+		}
+		return nil
+	case "Policy", "RedriveAllowPolicy", "KmsMasterKeyId", "KmsDataKeyReusePeriodSeconds", "SqsManagedSseEnabled":
+		return nil
+	}
+
+	return newApiError(http.StatusBadRequest, "InvalidAttributeName", fmt.Sprintf("Unknown Attribute %s.", name))
+}
+
+// parseRedrivePolicy returns the ARN of the dead letter queue and the maximum receive count of a redrive policy.
+func parseRedrivePolicy(value string) (string, int, error) {
+	var policy struct {
+		DeadLetterTargetArn string
+		MaxReceiveCount     json.Number
+	}
+	err := json.Unmarshal([]byte(value), &policy)
+	if err != nil {
+		return "", 0, fmt.Errorf("redrive policy is not valid JSON. %w", err)
+	}
+	maxReceiveCount, err := strconv.Atoi(policy.MaxReceiveCount.String())
+	if err != nil || maxReceiveCount < 1 || policy.DeadLetterTargetArn == "" {
+		return "", 0, fmt.Errorf("redrive policy requires a deadLetterTargetArn and a maxReceiveCount greater than 0")
+	}
+
+	return policy.DeadLetterTargetArn, maxReceiveCount, nil
+}
+
+func (q *queue) intAttribute(name string) int {
+	n, _ := strconv.Atoi(q.attributes[name])
+	return n
+}
+
+func (q *queue) allAttributes(now time.Time) map[string]string {
+	attributes := make(map[string]string, len(q.attributes)+6)
+	for name, value := range q.attributes {
+		attributes[name] = value
+	}
+
+	var visible, notVisible, delayed int
+	for _, msg := range q.messages {
+		switch {
+		case !msg.visibleAt.After(now):
+			visible++
+		case msg.receiptHandle != "":
+			notVisible++
+		default:
+			delayed++
+		}
+	}
+	attributes["QueueArn"] = q.arn
+	attributes["ApproximateNumberOfMessages"] = strconv.Itoa(visible)
+	attributes["ApproximateNumberOfMessagesNotVisible"] = strconv.Itoa(notVisible)
+	attributes["ApproximateNumberOfMessagesDelayed"] = strconv.Itoa(delayed)
+	attributes["CreatedTimestamp"] = strconv.FormatInt(q.created.Unix(), 10)
+	attributes["LastModifiedTimestamp"] = strconv.FormatInt(q.modified.Unix(), 10)
+
+	return attributes
+}
+
+// notify wakes up receive requests waiting for messages. The lock must be held.
+func (q *queue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// validateMessage validates the body and message attributes of a message sent to AWS SQS or published to AWS SNS.
+func validateMessage(body *string, msgAttr map[string]messages.MessageAttributeValue, maxSize int) error {
+	if aws.ToString(body) == "" {
+		return newApiError(http.StatusBadRequest, "MissingParameter", "The request must contain the parameter MessageBody.")
+	}
+	if len(msgAttr) > maxMessageAttributes {
+		return newApiError(http.StatusBadRequest, "InvalidParameterValue", fmt.Sprintf("Number of message attributes [%d] exceeds the allowed maximum [%d].", len(msgAttr), maxMessageAttributes))
+	}
+	for name, value := range msgAttr {
+		dataType := aws.ToString(value.DataType)
+		switch {
+		case name == "":
+			return newApiError(http.StatusBadRequest, "InvalidParameterValue", "Message attribute name must not be empty.")
+		case strings.HasPrefix(dataType, "String") || strings.HasPrefix(dataType, "Number"):
+			if value.StringValue == nil {
+				return newApiError(http.StatusBadRequest, "InvalidParameterValue", fmt.Sprintf("Message attribute '%s' must contain a non-empty value of type '%s'.", name, dataType))
+			}
+		case strings.HasPrefix(dataType, "Binary"):
+			if len(value.BinaryValue) == 0 {
+				return newApiError(http.StatusBadRequest, "InvalidParameterValue", fmt.Sprintf("Message attribute '%s' must contain a non-empty value of type '%s'.", name, dataType))
+			}
+		default:
+			return newApiError(http.StatusBadRequest, "InvalidParameterValue", fmt.Sprintf("The type of message attribute '%s' is invalid.", name))
+		}
+	}
+
+	size, err := messages.MessageSize(body, msgAttr)
+	if err != nil {
+		return newApiError(http.StatusBadRequest, "InvalidParameterValue", err.Error())
+	}
+	if size > maxSize {
+		return newApiError(http.StatusBadRequest, "InvalidParameterValue", fmt.Sprintf("One or more parameters are invalid. Reason: Message must be shorter than %d bytes.", maxSize))
+	}
+
+	return nil
+}
+
+// enqueue adds a message to `q`. The lock must be held.
+func (q *queue) enqueue(body *string, msgAttr map[string]messages.MessageAttributeValue, delaySeconds int32) (*sqsSentMessage, error) {
+	maxSize := maxMessageSize
+	if _, ok := q.attributes["MaximumMessageSize"]; ok {
+		maxSize = q.intAttribute("MaximumMessageSize")
+	}
+	err := validateMessage(body, msgAttr, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	if delaySeconds < 0 || delaySeconds > maxDelaySeconds {
+		return nil, newApiError(http.StatusBadRequest, "InvalidParameterValue", fmt.Sprintf("Value %d for parameter DelaySeconds is invalid. Reason: must be between 0 and %d.", delaySeconds, maxDelaySeconds))
+	} else if delaySeconds == 0 {
+		delaySeconds = int32(q.intAttribute("DelaySeconds"))
+	}
+	msgAttrHash, err := messages.MessageAttributesMd5Digest(msgAttr)
+	if err != nil {
+		return nil, newApiError(http.StatusBadRequest, "InvalidParameterValue", err.Error())
+	}
+
+	now := time.Now()
+	msg := &sqsMessage{
+		id:         newId(),
+		body:       *body,
+		attributes: msgAttr,
+		sent:       now,
+		visibleAt:  now.Add(time.Duration(delaySeconds) * time.Second),
+	}
+	q.messages = append(q.messages, msg)
+	q.notify()
+
+	return &sqsSentMessage{
+		MessageId:              msg.id,
+		MD5OfMessageBody:       messages.Md5Digest([]byte(msg.body)),
+		MD5OfMessageAttributes: msgAttrHash,
+	}, nil
+}
+
+func (svc *sqsService) sendMessage(_ context.Context, in *sqs.SendMessageInput) (any, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	q, err := svc.queue(in.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	return q.enqueue(in.MessageBody, messages.MapFromSqsMessageAttributeValues(in.MessageAttributes), in.DelaySeconds)
+}
+
+func (svc *sqsService) sendMessageBatch(_ context.Context, in *sqs.SendMessageBatchInput) (any, error) {
+	ids := make([]string, len(in.Entries))
+	for i := range in.Entries {
+		ids[i] = aws.ToString(in.Entries[i].Id)
+	}
+	if err := validateBatch(ids); err != nil {
+		return nil, err
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	q, err := svc.queue(in.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	// the total size of the messages of a batch is limited like the size of a single message
+	size := 0
+	for _, entry := range in.Entries {
+		n, _ := messages.MessageSize(entry.MessageBody, messages.MapFromSqsMessageAttributeValues(entry.MessageAttributes))
+		size += n
+	}
+	if size > maxMessageSize {
+		return nil, newApiError(http.StatusBadRequest, "BatchRequestTooLong", fmt.Sprintf("Batch requests cannot be longer than %d bytes. You have sent %d bytes.", maxMessageSize, size))
+	}
+
+	out := sqsBatchOutput{Successful: []any{}, Failed: []sqsBatchErrorEntry{}}
+	for _, entry := range in.Entries {
+		sent, err := q.enqueue(entry.MessageBody, messages.MapFromSqsMessageAttributeValues(entry.MessageAttributes), entry.DelaySeconds)
+		if err != nil {
+			out.Failed = append(out.Failed, batchError(aws.ToString(entry.Id), err))
+			continue
+		}
+		sent.Id = aws.ToString(entry.Id)
+		out.Successful = append(out.Successful, sent)
+	}
+
+	return out, nil
+}
+
+// validateBatch validates the ids of the entries of a batch request.
+func validateBatch(ids []string) error {
+	if len(ids) == 0 {
+		return newApiError(http.StatusBadRequest, "EmptyBatchRequest", "There should be at least one entry in the request.")
+	} else if len(ids) > maxBatchEntries {
+		return newApiError(http.StatusBadRequest, "TooManyEntriesInBatchRequest", fmt.Sprintf("Maximum number of entries per request are %d. You have sent %d.", maxBatchEntries, len(ids)))
+	}
+
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if id == "" {
+			return newApiError(http.StatusBadRequest, "InvalidBatchEntryId", "A batch entry id must not be empty.")
+		} else if seen[id] {
+			return newApiError(http.StatusBadRequest, "BatchEntryIdsNotDistinct", fmt.Sprintf("Id %s repeated.", id))
+		}
+		seen[id] = true
+	}
+
+	return nil
+}
+
+func batchError(id string, err error) sqsBatchErrorEntry {
+	apiErr, ok := err.(*apiError)
+	if !ok {
+		apiErr = newApiError(http.StatusBadRequest, "InvalidParameterValue", err.Error())
+	}
+
+	return sqsBatchErrorEntry{Id: id, Code: apiErr.code, Message: apiErr.message, SenderFault: true}
+}
+
+func (svc *sqsService) receiveMessage(ctx context.Context, in *sqs.ReceiveMessageInput) (any, error) {
+	maxMessages := int(in.MaxNumberOfMessages)
+	if maxMessages == 0 {
+		maxMessages = 1
+	} else if maxMessages < 1 || maxMessages > maxReceiveMessages {
+		return nil, newApiError(http.StatusBadRequest, "InvalidParameterValue", fmt.Sprintf("Value %d for parameter MaxNumberOfMessages is invalid. Reason: Must be between 1 and %d.", maxMessages, maxReceiveMessages))
+	}
+	if in.WaitTimeSeconds < 0 || in.WaitTimeSeconds > maxWaitTimeSeconds {
+		return nil, newApiError(http.StatusBadRequest, "InvalidParameterValue", fmt.Sprintf("Value %d for parameter WaitTimeSeconds is invalid. Reason: Must be between 0 and %d.", in.WaitTimeSeconds, maxWaitTimeSeconds))
+	}
+	if in.VisibilityTimeout < 0 || in.VisibilityTimeout > maxVisibilityTimeout {
+		return nil, newApiError(http.StatusBadRequest, "InvalidParameterValue", fmt.Sprintf("Value %d for parameter VisibilityTimeout is invalid. Reason: Must be between 0 and %d.", in.VisibilityTimeout, maxVisibilityTimeout))
+	}
+
+	var deadline time.Time
+	for {
+		svc.mu.Lock()
+		q, err := svc.queue(in.QueueUrl)
+		if err != nil {
+			svc.mu.Unlock()
+			return nil, err
+		}
+		now := time.Now()
+		if deadline.IsZero() {
+			waitTimeSeconds := int(in.WaitTimeSeconds)
+			if waitTimeSeconds == 0 {
+				waitTimeSeconds = q.intAttribute("ReceiveMessageWaitTimeSeconds")
+			}
+			deadline = now.Add(time.Duration(waitTimeSeconds) * time.Second)
+		}
+		received := svc.receive(q, in, maxMessages, now)
+		changed, next := q.changed, q.nextVisible(now)
+		svc.mu.Unlock()
+
+		if len(received) > 0 || !now.Before(deadline) {
+			return map[string][]sqsReceivedMessage{"Messages": received}, nil
+		}
+
+		// wait for a message to be sent or to become visible
+		wait := deadline.Sub(now)
+		if !next.IsZero() && next.Sub(now) < wait {
+			wait = next.Sub(now)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-svc.closed:
+			timer.Stop()
+			return map[string][]sqsReceivedMessage{"Messages": {}}, nil
+		case <-changed:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// receive receives up to `maxMessages` visible messages from `q`. Messages which were received more often than the
+// maximum receive count of a redrive policy are moved to the dead letter queue instead. The lock must be held.
+func (svc *sqsService) receive(q *queue, in *sqs.ReceiveMessageInput, maxMessages int, now time.Time) []sqsReceivedMessage {
+	visibilityTimeout := int(in.VisibilityTimeout)
+	if visibilityTimeout == 0 {
+		visibilityTimeout = q.intAttribute("VisibilityTimeout")
+	}
+	deadLetterQueue, maxReceiveCount := svc.deadLetterQueue(q)
+
+	received := []sqsReceivedMessage{}
+	for i := 0; i < len(q.messages) && len(received) < maxMessages; i++ {
+		msg := q.messages[i]
+		if msg.visibleAt.After(now) {
+			continue
+		}
+
+		if deadLetterQueue != nil && msg.receiveCount >= maxReceiveCount {
+			q.messages = slices.Delete(q.messages, i, i+1)
+			i--
+			msg.visibleAt, msg.receiptHandle = now, ""
+			deadLetterQueue.messages = append(deadLetterQueue.messages, msg)
+			deadLetterQueue.notify()
+			continue
+		}
+
+		msg.receiveCount++
+		if msg.firstReceived.IsZero() {
+			msg.firstReceived = now
+		}
+		msg.visibleAt = now.Add(time.Duration(visibilityTimeout) * time.Second)
+		msg.receiptHandle = encodeReceiptHandle(q.name, msg.id)
+
+		received = append(received, msg.received(in))
+	}
+
+	return received
+}
+
+// deadLetterQueue returns the dead letter queue and maximum receive count of the redrive policy of `q`, if any. The lock
+// must be held.
+func (svc *sqsService) deadLetterQueue(q *queue) (*queue, int) {
+	arn, maxReceiveCount, err := parseRedrivePolicy(q.attributes["RedrivePolicy"])
+	if err != nil {
+		return nil, 0
+	}
+	deadLetterQueue, ok := svc.queueByArn(arn)
+	if !ok || deadLetterQueue == q {
+		return nil, 0
+	}
+
+	return deadLetterQueue, maxReceiveCount
+}
+
+// nextVisible returns when the next message of `q` which is not visible becomes visible, or zero if there is none.
+func (q *queue) nextVisible(now time.Time) time.Time {
+	var next time.Time
+	for _, msg := range q.messages {
+		if msg.visibleAt.After(now) && (next.IsZero() || msg.visibleAt.Before(next)) {
+			next = msg.visibleAt
+		}
+	}
+
+	return next
+}
+
+// received returns `msg` as received with the attributes requested by `in`.
+func (msg *sqsMessage) received(in *sqs.ReceiveMessageInput) sqsReceivedMessage {
+	out := sqsReceivedMessage{
+		MessageId:     msg.id,
+		ReceiptHandle: msg.receiptHandle,
+		Body:          msg.body,
+		MD5OfBody:     messages.Md5Digest([]byte(msg.body)),
+	}
+
+	msgAttr := messages.FilterMessageAttributes(msg.attributes, in.MessageAttributeNames)
+	if len(msgAttr) > 0 {
+		out.MD5OfMessageAttributes, _ = messages.MessageAttributesMd5Digest(msgAttr)
+		out.MessageAttributes = make(map[string]sqsAttributeValue, len(msgAttr))
+		for name, value := range msgAttr {
+			out.MessageAttributes[name] = sqsAttributeValue{
+				DataType:    aws.ToString(value.DataType),
+				StringValue: value.StringValue,
+				BinaryValue: value.BinaryValue,
+			}
+		}
+	}
+
+	system := map[string]string{
+		"SenderId":                         AccountId,
+		"SentTimestamp":                    strconv.FormatInt(msg.sent.UnixMilli(), 10),
+		"ApproximateReceiveCount":          strconv.Itoa(msg.receiveCount),
+		"ApproximateFirstReceiveTimestamp": strconv.FormatInt(msg.firstReceived.UnixMilli(), 10),
+	}
+	for _, name := range in.AttributeNames {
+		if name == types.QueueAttributeNameAll {
+			out.Attributes = system
+			break
+		}
+		if value, ok := system[string(name)]; ok {
+			if out.Attributes == nil {
+				out.Attributes = make(map[string]string)
+			}
+			out.Attributes[string(name)] = value
+		}
+	}
+
+	return out
+}
+
+// A receipt handle identifies a queue, a message, and the receive of the message.
+
+func encodeReceiptHandle(queueName, msgId string) string {
+	return base64.StdEncoding.EncodeToString([]byte(queueName + "/" + msgId + "/" + newId()))
+}
+
+func decodeReceiptHandle(receiptHandle *string) (queueName, msgId string, err error) {
+	invalid := newApiError(http.StatusBadRequest, "ReceiptHandleIsInvalid", fmt.Sprintf("The input receipt handle %q is not a valid receipt handle.", aws.ToString(receiptHandle)))
+	decoded, err := base64.StdEncoding.DecodeString(aws.ToString(receiptHandle))
+	if err != nil {
+		return "", "", invalid
+	}
+	parts := strings.Split(string(decoded), "/")
+	if len(parts) != 3 {
+		return "", "", invalid
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// message returns the message of `receiptHandle` in `q`, or nil if the message was deleted. The lock must be held.
+func (q *queue) message(receiptHandle *string) (int, *sqsMessage, error) {
+	queueName, msgId, err := decodeReceiptHandle(receiptHandle)
+	if err != nil {
+		return 0, nil, err
+	} else if queueName != q.name {
+		return 0, nil, newApiError(http.StatusBadRequest, "ReceiptHandleIsInvalid", "The receipt handle is not valid for this queue.")
+	}
+
+	for i, msg := range q.messages {
+		if msg.id == msgId {
+			return i, msg, nil
+		}
+	}
+
+	return 0, nil, nil
+}
+
+// delete deletes the message of `receiptHandle` from `q`. Like AWS SQS, deleting a message which was already deleted
+// succeeds, and deleting a message with a receipt handle of an earlier receive succeeds without deleting the message.
+// The lock must be held.
+func (q *queue) delete(receiptHandle *string) error {
+	i, msg, err := q.message(receiptHandle)
+	if err != nil || msg == nil {
+		return err
+	}
+
+	if msg.receiptHandle == *receiptHandle {
+		q.messages = slices.Delete(q.messages, i, i+1)
+	}
+
+	return nil
+}
+
+// changeVisibility changes the visibility timeout of the message of `receiptHandle` in `q`. The lock must be held.
+func (q *queue) changeVisibility(receiptHandle *string, visibilityTimeout int32, now time.Time) error {
+	if visibilityTimeout < 0 || visibilityTimeout > maxVisibilityTimeout {
+		return newApiError(http.StatusBadRequest, "InvalidParameterValue", fmt.Sprintf("Value %d for parameter VisibilityTimeout is invalid. Reason: Must be between 0 and %d.", visibilityTimeout, maxVisibilityTimeout))
+	}
+
+	_, msg, err := q.message(receiptHandle)
+	if err != nil {
+		return err
+	}
+	if msg == nil || msg.receiptHandle != *receiptHandle {
+		return newApiError(http.StatusBadRequest, "InvalidParameterValue", fmt.Sprintf("Value %s for parameter ReceiptHandle is invalid. Reason: Message does not exist or is not available for visibility timeout change.", *receiptHandle))
+	}
+	// like AWS SQS, the visibility of a message can still be changed after its visibility timeout has expired as long as
+	// it has not been received again
+	msg.visibleAt = now.Add(time.Duration(visibilityTimeout) * time.Second)
+	if visibilityTimeout == 0 {
+		q.notify()
+	}
+
+	return nil
+}
+
+func (svc *sqsService) deleteMessage(_ context.Context, in *sqs.DeleteMessageInput) (any, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	q, err := svc.queue(in.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	return struct{}{}, q.delete(in.ReceiptHandle)
+}
+
+func (svc *sqsService) deleteMessageBatch(_ context.Context, in *sqs.DeleteMessageBatchInput) (any, error) {
+	ids := make([]string, len(in.Entries))
+	for i := range in.Entries {
+		ids[i] = aws.ToString(in.Entries[i].Id)
+	}
+	if err := validateBatch(ids); err != nil {
+		return nil, err
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	q, err := svc.queue(in.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	out := sqsBatchOutput{Successful: []any{}, Failed: []sqsBatchErrorEntry{}}
+	for _, entry := range in.Entries {
+		if err := q.delete(entry.ReceiptHandle); err != nil {
+			out.Failed = append(out.Failed, batchError(aws.ToString(entry.Id), err))
+			continue
+		}
+		out.Successful = append(out.Successful, sqsBatchResultEntry{Id: aws.ToString(entry.Id)})
+	}
+
+	return out, nil
+}
+
+func (svc *sqsService) changeMessageVisibility(_ context.Context, in *sqs.ChangeMessageVisibilityInput) (any, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	q, err := svc.queue(in.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	return struct{}{}, q.changeVisibility(in.ReceiptHandle, in.VisibilityTimeout, time.Now())
+}
+
+func (svc *sqsService) changeMessageVisibilityBatch(_ context.Context, in *sqs.ChangeMessageVisibilityBatchInput) (any, error) {
+	ids := make([]string, len(in.Entries))
+	for i := range in.Entries {
+		ids[i] = aws.ToString(in.Entries[i].Id)
+	}
+	if err := validateBatch(ids); err != nil {
+		return nil, err
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	q, err := svc.queue(in.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	out := sqsBatchOutput{Successful: []any{}, Failed: []sqsBatchErrorEntry{}}
+	for _, entry := range in.Entries {
+		if err := q.changeVisibility(entry.ReceiptHandle, entry.VisibilityTimeout, now); err != nil {
+			out.Failed = append(out.Failed, batchError(aws.ToString(entry.Id), err))
+			continue
+		}
+		out.Successful = append(out.Successful, sqsBatchResultEntry{Id: aws.ToString(entry.Id)})
+	}
+
+	return out, nil
+}
+
+// deliver adds a message published to AWS SNS to the queue with `arn`. Messages to queues which do not exist are dropped.
+func (svc *sqsService) deliver(arn string, body string, msgAttr map[string]messages.MessageAttributeValue) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	if q, ok := svc.queueByArn(arn); ok {
+		q.enqueue(&body, msgAttr, 0)
+	}
+}
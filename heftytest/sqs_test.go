@@ -0,0 +1,249 @@
+package heftytest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createQueue(t *testing.T, client *sqs.Client, name string, attributes map[string]string) string {
+	t.Helper()
+	out, err := client.CreateQueue(context.TODO(), &sqs.CreateQueueInput{
+		QueueName:  aws.String(name),
+		Attributes: attributes,
+	})
+	require.NoError(t, err)
+
+	return aws.ToString(out.QueueUrl)
+}
+
+func TestSqsSendReceiveDelete(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	client := server.SqsClient()
+	queueUrl := createQueue(t, client, "queue", nil)
+
+	// the sdk client validates the md5 digests of the message body and message attributes
+	sent, err := client.SendMessage(context.TODO(), &sqs.SendMessageInput{
+		QueueUrl:    aws.String(queueUrl),
+		MessageBody: aws.String("hello"),
+		MessageAttributes: map[string]types.MessageAttributeValue{
+			"string": {DataType: aws.String("String"), StringValue: aws.String("value")},
+			"binary": {DataType: aws.String("Binary"), BinaryValue: []byte{1, 2, 3}},
+		},
+	})
+	require.NoError(t, err)
+
+	received, err := client.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{
+		QueueUrl:              aws.String(queueUrl),
+		MessageAttributeNames: []string{"All"},
+		AttributeNames:        []types.QueueAttributeName{"ApproximateReceiveCount"},
+	})
+	require.NoError(t, err)
+	require.Len(t, received.Messages, 1)
+	msg := received.Messages[0]
+	assert.Equal(t, aws.ToString(sent.MessageId), aws.ToString(msg.MessageId))
+	assert.Equal(t, "hello", aws.ToString(msg.Body))
+	assert.Equal(t, "value", aws.ToString(msg.MessageAttributes["string"].StringValue))
+	assert.Equal(t, []byte{1, 2, 3}, msg.MessageAttributes["binary"].BinaryValue)
+	assert.Equal(t, "1", msg.Attributes["ApproximateReceiveCount"])
+
+	// the message is in flight
+	received, err = client.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{QueueUrl: aws.String(queueUrl)})
+	require.NoError(t, err)
+	assert.Empty(t, received.Messages)
+
+	_, err = client.DeleteMessage(context.TODO(), &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(queueUrl),
+		ReceiptHandle: msg.ReceiptHandle,
+	})
+	require.NoError(t, err)
+
+	attr, err := client.GetQueueAttributes(context.TODO(), &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(queueUrl),
+		AttributeNames: []types.QueueAttributeName{types.QueueAttributeNameAll},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "0", attr.Attributes["ApproximateNumberOfMessages"])
+	assert.Equal(t, "0", attr.Attributes["ApproximateNumberOfMessagesNotVisible"])
+}
+
+func TestSqsValidation(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	client := server.SqsClient()
+	queueUrl := createQueue(t, client, "queue", nil)
+
+	var tests = []struct {
+		desc  string
+		input *sqs.SendMessageInput
+		code  string
+	}{
+		{
+			desc:  "queue does not exist",
+			input: &sqs.SendMessageInput{QueueUrl: aws.String(strings.Replace(queueUrl, "queue", "missing", 1)), MessageBody: aws.String("a")},
+			code:  "QueueDoesNotExist",
+		},
+		{
+			desc:  "message too large",
+			input: &sqs.SendMessageInput{QueueUrl: aws.String(queueUrl), MessageBody: aws.String(strings.Repeat("a", maxMessageSize+1))},
+			code:  "InvalidParameterValue",
+		},
+		{
+			desc:  "empty message",
+			input: &sqs.SendMessageInput{QueueUrl: aws.String(queueUrl), MessageBody: aws.String("")},
+			code:  "MissingParameter",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := client.SendMessage(context.TODO(), test.input)
+			var apiErr smithy.APIError
+			require.True(t, errors.As(err, &apiErr), "expected api error but got %v", err)
+			assert.Equal(t, test.code, apiErr.ErrorCode())
+		})
+	}
+}
+
+func TestSqsVisibility(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	client := server.SqsClient()
+	queueUrl := createQueue(t, client, "queue", map[string]string{"VisibilityTimeout": "1"})
+
+	_, err := client.SendMessage(context.TODO(), &sqs.SendMessageInput{QueueUrl: aws.String(queueUrl), MessageBody: aws.String("a")})
+	require.NoError(t, err)
+
+	first, err := client.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{QueueUrl: aws.String(queueUrl)})
+	require.NoError(t, err)
+	require.Len(t, first.Messages, 1)
+
+	// the message becomes visible again after the visibility timeout of the queue, ending the long poll
+	start := time.Now()
+	second, err := client.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{QueueUrl: aws.String(queueUrl), WaitTimeSeconds: 5})
+	require.NoError(t, err)
+	require.Len(t, second.Messages, 1)
+	assert.Less(t, time.Since(start), 3*time.Second)
+	assert.NotEqual(t, aws.ToString(first.Messages[0].ReceiptHandle), aws.ToString(second.Messages[0].ReceiptHandle))
+
+	// the stale receipt handle can no longer change the visibility of the message
+	_, err = client.ChangeMessageVisibility(context.TODO(), &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(queueUrl),
+		ReceiptHandle:     first.Messages[0].ReceiptHandle,
+		VisibilityTimeout: 0,
+	})
+	assert.Error(t, err)
+
+	// making the message visible ends a waiting long poll
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		client.ChangeMessageVisibility(context.TODO(), &sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          aws.String(queueUrl),
+			ReceiptHandle:     second.Messages[0].ReceiptHandle,
+			VisibilityTimeout: 0,
+		})
+	}()
+	third, err := client.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{
+		QueueUrl:          aws.String(queueUrl),
+		WaitTimeSeconds:   5,
+		VisibilityTimeout: 30,
+	})
+	require.NoError(t, err)
+	require.Len(t, third.Messages, 1)
+}
+
+func TestSqsBatches(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	client := server.SqsClient()
+	queueUrl := createQueue(t, client, "queue", nil)
+
+	sent, err := client.SendMessageBatch(context.TODO(), &sqs.SendMessageBatchInput{
+		QueueUrl: aws.String(queueUrl),
+		Entries: []types.SendMessageBatchRequestEntry{
+			{Id: aws.String("1"), MessageBody: aws.String("a")},
+			{Id: aws.String("2"), MessageBody: aws.String("b")},
+			{Id: aws.String("3"), MessageBody: aws.String("c"), MessageAttributes: map[string]types.MessageAttributeValue{
+				"invalid": {DataType: aws.String("Invalid"), StringValue: aws.String("value")},
+			}},
+		},
+	})
+	require.NoError(t, err)
+	assert.Len(t, sent.Successful, 2)
+	require.Len(t, sent.Failed, 1)
+	assert.Equal(t, "3", aws.ToString(sent.Failed[0].Id))
+
+	received, err := client.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(queueUrl),
+		MaxNumberOfMessages: 10,
+	})
+	require.NoError(t, err)
+	require.Len(t, received.Messages, 2)
+
+	entries := []types.DeleteMessageBatchRequestEntry{}
+	for i, msg := range received.Messages {
+		entries = append(entries, types.DeleteMessageBatchRequestEntry{Id: aws.String(string(rune('a' + i))), ReceiptHandle: msg.ReceiptHandle})
+	}
+	deleted, err := client.DeleteMessageBatch(context.TODO(), &sqs.DeleteMessageBatchInput{
+		QueueUrl: aws.String(queueUrl),
+		Entries:  entries,
+	})
+	require.NoError(t, err)
+	assert.Len(t, deleted.Successful, 2)
+	assert.Empty(t, deleted.Failed)
+
+	// ids of entries must be distinct
+	_, err = client.SendMessageBatch(context.TODO(), &sqs.SendMessageBatchInput{
+		QueueUrl: aws.String(queueUrl),
+		Entries: []types.SendMessageBatchRequestEntry{
+			{Id: aws.String("1"), MessageBody: aws.String("a")},
+			{Id: aws.String("1"), MessageBody: aws.String("b")},
+		},
+	})
+	var apiErr smithy.APIError
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, "BatchEntryIdsNotDistinct", apiErr.ErrorCode())
+}
+
+func TestSqsRedrivePolicy(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	client := server.SqsClient()
+	dlqUrl := createQueue(t, client, "dlq", nil)
+	queueUrl := createQueue(t, client, "queue", map[string]string{
+		"RedrivePolicy": `{"deadLetterTargetArn":"arn:aws:sqs:us-east-1:000000000000:dlq","maxReceiveCount":"1"}`,
+	})
+
+	_, err := client.SendMessage(context.TODO(), &sqs.SendMessageInput{QueueUrl: aws.String(queueUrl), MessageBody: aws.String("a")})
+	require.NoError(t, err)
+
+	received, err := client.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{QueueUrl: aws.String(queueUrl)})
+	require.NoError(t, err)
+	require.Len(t, received.Messages, 1)
+	_, err = client.ChangeMessageVisibility(context.TODO(), &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(queueUrl),
+		ReceiptHandle:     received.Messages[0].ReceiptHandle,
+		VisibilityTimeout: 0,
+	})
+	require.NoError(t, err)
+
+	// the message was received the maximum number of times and is moved to the dead letter queue
+	received, err = client.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{QueueUrl: aws.String(queueUrl)})
+	require.NoError(t, err)
+	assert.Empty(t, received.Messages)
+
+	received, err = client.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{QueueUrl: aws.String(dlqUrl)})
+	require.NoError(t, err)
+	require.Len(t, received.Messages, 1)
+	assert.Equal(t, "a", aws.ToString(received.Messages[0].Body))
+}
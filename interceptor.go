@@ -0,0 +1,205 @@
+package hefty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/vinujohn/hefty/internal/messages"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// HeftyMessage is the body and message attributes of a message as seen by an Interceptor.
+type HeftyMessage = messages.HeftyMessage
+
+// MessageAttributeValue is a message attribute of a HeftyMessage.
+type MessageAttributeValue = messages.MessageAttributeValue
+
+// InterceptedMessage is passed to the hooks of an Interceptor. Fields which are not known yet at a hook are empty.
+type InterceptedMessage struct {
+	// Wrapper is "sqs" for the SQS client wrapper and "sns" for the SNS client wrapper.
+	Wrapper string
+	// Destination is the queue url or topic arn of the message.
+	Destination string
+	// Offloaded is true if the message is stored in AWS S3.
+	Offloaded bool
+	// Bucket and Key locate the hefty message in AWS S3.
+	Bucket string
+	Key    string
+	// MessageId is the id of the message in AWS SQS or AWS SNS.
+	MessageId string
+	// Message is the body and message attributes of the message. Hooks may modify it where documented.
+	Message *HeftyMessage
+	// Serialized is the hefty message as stored in AWS S3. Hooks may replace it where documented.
+	Serialized []byte
+}
+
+// InterceptorHook is called at a stage of sending or receiving a message. Returning an error aborts the operation.
+type InterceptorHook func(ctx context.Context, msg *InterceptedMessage) error
+
+// Interceptor hooks into the stages of sending and receiving messages, for example to validate, enrich, or audit them.
+// Any hook may be nil. A hook returning an error aborts the operation with that error: sending returns the error and
+// a received message is replaced with an error message, just like a failed download.
+type Interceptor struct {
+	// BeforeSerialize is called before a message is serialized to be stored in AWS S3. The body and message attributes
+	// of Message may be modified.
+	BeforeSerialize InterceptorHook
+	// AfterSerialize is called with the serialized message. Serialized may be replaced, for example to encrypt it, in which
+	// case BeforeDeserialize has to reverse the change.
+	AfterSerialize InterceptorHook
+	// BeforeUpload is called before the serialized message is uploaded to AWS S3.
+	BeforeUpload InterceptorHook
+	// AfterUpload is called once the serialized message has been uploaded to AWS S3. The hefty message is not removed from
+	// AWS S3 if this hook aborts the send.
+	AfterUpload InterceptorHook
+	// BeforeSend is called before a message is sent to AWS SQS or published to AWS SNS. Message is the message which is
+	// sent, which is the reference message when the message is stored in AWS S3. Its message attributes may be modified,
+	// as may its body unless it is a reference message.
+	BeforeSend InterceptorHook
+	// AfterSend is called once a message has been sent, with its MessageId.
+	AfterSend InterceptorHook
+	// BeforeDownload is called before a hefty message is downloaded from AWS S3.
+	BeforeDownload InterceptorHook
+	// AfterDownload is called with the downloaded hefty message in Serialized.
+	AfterDownload InterceptorHook
+	// BeforeDeserialize is called before the downloaded hefty message is deserialized. Serialized may be replaced.
+	BeforeDeserialize InterceptorHook
+	// AfterDeserialize is called with the received message. The body and message attributes of Message may be modified,
+	// in which case their MD5 digests are calculated again.
+	AfterDeserialize InterceptorHook
+}
+
+// If selected, `interceptors` are called in order at each stage of sending and receiving messages. Can be selected
+// several times to add more interceptors.
+func Intercept(interceptors ...Interceptor) Option {
+	return func(opts *options) error {
+		opts.interceptors = append(opts.interceptors, interceptors...)
+		return nil
+	}
+}
+
+type interceptStage int
+
+const (
+	beforeSerialize interceptStage = iota
+	afterSerialize
+	beforeUpload
+	afterUpload
+	beforeSend
+	afterSend
+	beforeDownload
+	afterDownload
+	beforeDeserialize
+	afterDeserialize
+)
+
+func (stage interceptStage) String() string {
+	return [...]string{
+		"before serialize", "after serialize",
+		"before upload", "after upload",
+		"before send", "after send",
+		"before download", "after download",
+		"before deserialize", "after deserialize",
+	}[stage]
+}
+
+func (interceptor *Interceptor) hook(stage interceptStage) InterceptorHook {
+	switch stage {
+	case beforeSerialize:
+		return interceptor.BeforeSerialize
+	case afterSerialize:
+		return interceptor.AfterSerialize
+	case beforeUpload:
+		return interceptor.BeforeUpload
+	case afterUpload:
+		return interceptor.AfterUpload
+	case beforeSend:
+		return interceptor.BeforeSend
+	case afterSend:
+		return interceptor.AfterSend
+	case beforeDownload:
+		return interceptor.BeforeDownload
+	case afterDownload:
+		return interceptor.AfterDownload
+	case beforeDeserialize:
+		return interceptor.BeforeDeserialize
+	case afterDeserialize:
+		return interceptor.AfterDeserialize
+	}
+
+	return nil
+}
+
+type interceptors []Interceptor
+
+// run calls the hooks of `stage` in order until one returns an error.
+func (list interceptors) run(ctx context.Context, stage interceptStage, msg *InterceptedMessage) error {
+	for i := range list {
+		hook := list[i].hook(stage)
+		if hook == nil {
+			continue
+		}
+
+		if err := hook(ctx, msg); err != nil {
+			return fmt.Errorf("interceptor aborted %s. %w", stage, err)
+		}
+	}
+
+	return nil
+}
+
+// intercepts returns whether any interceptor has a hook for `stage`.
+func (list interceptors) intercepts(stage interceptStage) bool {
+	for i := range list {
+		if list[i].hook(stage) != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serializeHeftyMessage serializes the message of `intercepted` between the serialize hooks of `list`. Returns the
+// serialized message along with the md5 digests of its body and message attributes.
+func serializeHeftyMessage(ctx context.Context, t *tracer, list interceptors, intercepted *InterceptedMessage) (serialized []byte, msgBodyHash, msgAttrHash string, err error) {
+	err = list.run(ctx, beforeSerialize, intercepted)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	// the message may have been changed by an interceptor
+	heftyMsg := intercepted.Message
+	if list.intercepts(beforeSerialize) {
+		if heftyMsg == nil || heftyMsg.Body == nil {
+			return nil, "", "", errors.New("interceptor removed the message body")
+		}
+		heftyMsg.Size, err = messages.MessageSize(heftyMsg.Body, heftyMsg.MessageAttributes)
+		if err != nil {
+			return nil, "", "", fmt.Errorf("unable to get size of message. %w", err)
+		}
+		if heftyMsg.Size > MaxHeftyMessageLengthBytes {
+			return nil, "", "", fmt.Errorf("%w. message size of %d bytes greater than allowed message size of %d bytes", ErrMessageTooLarge, heftyMsg.Size, MaxHeftyMessageLengthBytes)
+		}
+	}
+
+	_, serializeSpan := t.start(ctx, "serialize", trace.SpanKindInternal)
+	serialized, bodyOffset, msgAttrOffset, err := heftyMsg.Serialize()
+	endSpan(serializeSpan, err)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("unable to serialize message. %w", err)
+	}
+
+	// create md5 digests
+	msgBodyHash = messages.Md5Digest(serialized[bodyOffset:msgAttrOffset])
+	if len(heftyMsg.MessageAttributes) > 0 {
+		msgAttrHash = messages.Md5Digest(serialized[msgAttrOffset:])
+	}
+
+	intercepted.Serialized = serialized
+	err = list.run(ctx, afterSerialize, intercepted)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	return intercepted.Serialized, msgBodyHash, msgAttrHash, nil
+}
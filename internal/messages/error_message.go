@@ -2,18 +2,11 @@ package messages
 
 import (
 	"encoding/json"
-	"fmt"
 	"strings"
 )
 
 const errorMsgIdentifierKey = "b58c8bae78504da3a2e32cceeb77d342"
 
-var jsonErrorMsgPrefix string
-
-func init() {
-	jsonErrorMsgPrefix = fmt.Sprintf("{\n\t\"identifier\": \"%s\",", errorMsgIdentifierKey)
-}
-
 type ErrorMsg struct {
 	Identifier   string        `json:"identifier"` // used to identify an error message from other types of messages
 	Error        string        `json:"error"`
@@ -38,6 +31,14 @@ func ToErrorMsg(msg string) (*ErrorMsg, error) {
 	return &errMsg, err
 }
 
+// IsErrorMsg checks whether `msg` is a JSON error message containing the error message identifier.
+// The formatting of the JSON is not important so that error messages which have been re-serialized are detected.
 func IsErrorMsg(msg string) bool {
-	return strings.HasPrefix(msg, jsonErrorMsgPrefix)
+	// avoid unmarshalling messages which cannot be error messages
+	if !strings.Contains(msg, errorMsgIdentifierKey) || !isJsonObject(msg) {
+		return false
+	}
+
+	errMsg, err := ToErrorMsg(msg)
+	return err == nil && errMsg.Identifier == errorMsgIdentifierKey
 }
@@ -1,6 +1,7 @@
 package messages
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"testing"
@@ -33,6 +34,10 @@ func TestErrorMessageSerialization(t *testing.T) {
 	// test IsErrorMessage
 	assert.True(t, IsErrorMsg(string(j)))
 	assert.False(t, IsErrorMsg("foo"))
+	compact, _ := json.Marshal(testErrMsg)
+	assert.True(t, IsErrorMsg(string(compact)))
+	refMsg, _ := testRefMsg.ToJson()
+	assert.False(t, IsErrorMsg(string(refMsg)))
 
 	// test ToErrorMsg
 	errMsg2, err := ToErrorMsg(string(j))
@@ -210,7 +210,7 @@ func DeserializeHeftyMessage(in []byte) (*HeftyMessage, error) {
 		// read attribute transport type
 		attrTransportType, err := reader.ReadByte()
 		if err != nil {
-			return nil, fmt.Errorf("unable to read attribute transport type during deserialization. %v", err)
+			return nil, fmt.Errorf("unable to read attribute transport type during deserialization. %w", err)
 		}
 
 		// read attribute value
@@ -235,7 +235,7 @@ func DeserializeHeftyMessage(in []byte) (*HeftyMessage, error) {
 
 	msgSize, err := MessageSize(&body, msgAttr)
 	if err != nil {
-		return nil, fmt.Errorf("unable to calculate message size during deserialization. %v", err)
+		return nil, fmt.Errorf("unable to calculate message size during deserialization. %w", err)
 	}
 
 	return NewHeftyMessage(&body, msgAttr, msgSize), nil
@@ -2,18 +2,11 @@ package messages
 
 import (
 	"encoding/json"
-	"fmt"
 	"strings"
 )
 
 const referenceMsgIdentifierKey = "d3131a62e0224688b77a506fd333dac4"
 
-var jsonReferenceMsgPrefix string
-
-func init() {
-	jsonReferenceMsgPrefix = fmt.Sprintf("{\n\t\"identifier\": \"%s\",", referenceMsgIdentifierKey)
-}
-
 // ReferenceMsg is what is sent to AWS SQS or AWS SNS in place of hefty message stored in AWS S3.
 type ReferenceMsg struct {
 	Identifier       string `json:"identifier"` // used to identify a reference message from other types of messages
@@ -22,6 +15,9 @@ type ReferenceMsg struct {
 	S3Key            string `json:"s3_key"`
 	Md5DigestMsgBody string `json:"md5_digest_msg_body"`
 	Md5DigestMsgAttr string `json:"md5_digest_msg_attr"`
+	SubscriberCount  int    `json:"subscriber_count,omitempty"` // number of AWS SQS subscribers which must delete the message before it is removed from AWS S3
+	RetainPayload    bool   `json:"retain_payload,omitempty"`   // if set, the message is never removed from AWS S3 when deleted
+	PresignedUrl     string `json:"presigned_url,omitempty"`    // presigned url to get the message from AWS S3 without credentials
 }
 
 func NewReferenceMsg(s3Region, s3Bucket, s3Key, md5Body, md5Attr string) *ReferenceMsg {
@@ -45,6 +41,26 @@ func ToReferenceMsg(msg string) (*ReferenceMsg, error) {
 	return &refMsg, err
 }
 
+// IsReferenceMsg checks whether `msg` is a JSON reference message containing the reference message identifier.
+// The formatting of the JSON is not important so that reference messages which have been re-serialized are detected.
 func IsReferenceMsg(msg string) bool {
-	return strings.HasPrefix(msg, jsonReferenceMsgPrefix)
+	// avoid unmarshalling messages which cannot be reference messages
+	if !strings.Contains(msg, referenceMsgIdentifierKey) || !isJsonObject(msg) {
+		return false
+	}
+
+	refMsg, err := ToReferenceMsg(msg)
+	return err == nil && refMsg.Identifier == referenceMsgIdentifierKey
+}
+
+// IsValid checks whether the reference message contains the information needed to get a hefty message from AWS S3,
+// either its bucket and key or a presigned url. The identifier is not required so that reference messages created by
+// other tools can be used.
+func (msg *ReferenceMsg) IsValid() bool {
+	return msg.HasObject() || msg.PresignedUrl != ""
+}
+
+// HasObject checks whether the reference message contains the bucket and key of the hefty message in AWS S3.
+func (msg *ReferenceMsg) HasObject() bool {
+	return msg.S3Bucket != "" && msg.S3Key != ""
 }
@@ -1,6 +1,8 @@
 package messages
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"testing"
 
@@ -33,3 +35,92 @@ func TestReferenceMessageSerialization(t *testing.T) {
 	assert.Nil(t, err, "error should be nil when calling ToReferenceMsg")
 	assert.Equal(t, testRefMsg, refMsg2)
 }
+
+func TestReferenceMessageSerializationWithDeletionFields(t *testing.T) {
+	expected := `{
+	"identifier": "%s",
+	"s3_region": "testS3RegionVal",
+	"s3_bucket": "testS3BucketVal",
+	"s3_key": "testS3KeyVal",
+	"md5_digest_msg_body": "testMd5BodyVal",
+	"md5_digest_msg_attr": "testMd5AttrVal",
+	"subscriber_count": 3,
+	"retain_payload": true
+}`
+	expected = fmt.Sprintf(expected, referenceMsgIdentifierKey)
+	testRefMsg := NewReferenceMsg("testS3RegionVal", "testS3BucketVal", "testS3KeyVal", "testMd5BodyVal", "testMd5AttrVal")
+	testRefMsg.SubscriberCount = 3
+	testRefMsg.RetainPayload = true
+
+	j, err := testRefMsg.ToJson()
+	assert.Nil(t, err, "error should be nil when calling ToJson")
+	assert.Equal(t, expected, string(j))
+
+	refMsg2, err := ToReferenceMsg(string(j))
+	assert.Nil(t, err, "error should be nil when calling ToReferenceMsg")
+	assert.Equal(t, testRefMsg, refMsg2)
+}
+
+func TestIsReferenceMsg(t *testing.T) {
+	testRefMsg := NewReferenceMsg("testS3RegionVal", "testS3BucketVal", "testS3KeyVal", "testMd5BodyVal", "testMd5AttrVal")
+	compact, _ := json.Marshal(testRefMsg)
+	errMsg, _ := NewErrorMsg(errors.New("testErrorVal"), testRefMsg).ToJson()
+
+	var tests = []struct {
+		desc string
+		msg  string
+		exp  bool
+	}{
+		{
+			desc: "compact_json",
+			msg:  string(compact),
+			exp:  true,
+		},
+		{
+			desc: "surrounding_whitespace",
+			msg:  "\n  " + string(compact) + "  \n",
+			exp:  true,
+		},
+		{
+			desc: "reordered_fields",
+			msg:  fmt.Sprintf(`{"s3_bucket":"b","s3_key":"k","identifier":"%s"}`, referenceMsgIdentifierKey),
+			exp:  true,
+		},
+		{
+			desc: "identifier_in_other_field",
+			msg:  fmt.Sprintf(`{"identifier":"other","s3_key":"%s"}`, referenceMsgIdentifierKey),
+			exp:  false,
+		},
+		{
+			desc: "error_message",
+			msg:  string(errMsg),
+			exp:  false,
+		},
+		{
+			desc: "not_json",
+			msg:  "foo " + referenceMsgIdentifierKey,
+			exp:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			assert.Equal(t, tt.exp, IsReferenceMsg(tt.msg))
+		})
+	}
+}
+
+func TestReferenceMessageIsValid(t *testing.T) {
+	refMsg, err := ToReferenceMsg(`{"s3_bucket":"b","s3_key":"k"}`)
+	assert.Nil(t, err)
+	assert.True(t, refMsg.IsValid())
+
+	refMsg, err = ToReferenceMsg(`{"s3_bucket":"b"}`)
+	assert.Nil(t, err)
+	assert.False(t, refMsg.IsValid())
+
+	refMsg, err = ToReferenceMsg(`{"presigned_url":"https://b.s3.amazonaws.com/k?X-Amz-Signature=s"}`)
+	assert.Nil(t, err)
+	assert.True(t, refMsg.IsValid())
+	assert.False(t, refMsg.HasObject())
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -39,3 +40,101 @@ func Md5Digest(buf []byte) string {
 	hash := md5.Sum(buf)
 	return hex.EncodeToString(hash[:])
 }
+
+// SelectMessageAttributes returns the message attributes in `msgAttr` for which `keep` returns true. Attributes are
+// selected in order of their names and only while the number of attributes selected is at most `maxCount` and
+// their total size, as calculated by MessageSize, is at most `maxSize`.
+func SelectMessageAttributes(msgAttr map[string]MessageAttributeValue, keep func(name string) bool, maxCount, maxSize int) map[string]MessageAttributeValue {
+	names := make([]string, 0, len(msgAttr))
+	for k := range msgAttr {
+		if keep(k) {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	var ret map[string]MessageAttributeValue
+	var size int
+	for _, name := range names {
+		if len(ret) >= maxCount {
+			break
+		}
+
+		attrSize, err := MessageSize(nil, map[string]MessageAttributeValue{name: msgAttr[name]})
+		if err != nil || size+attrSize > maxSize {
+			continue
+		}
+
+		if ret == nil {
+			ret = make(map[string]MessageAttributeValue)
+		}
+		ret[name] = msgAttr[name]
+		size += attrSize
+	}
+
+	return ret
+}
+
+// FilterMessageAttributes returns the message attributes in `msgAttr` which are requested by `names` using the same
+// semantics as the MessageAttributeNames of an AWS SQS receive request. The names "All" and ".*" request all attributes,
+// and names ending in ".*" request all attributes starting with the prefix before the "*", for example "bar.*".
+func FilterMessageAttributes(msgAttr map[string]MessageAttributeValue, names []string) map[string]MessageAttributeValue {
+	var exact map[string]bool
+	var prefixes []string
+	for _, name := range names {
+		if name == "All" || name == ".*" {
+			return msgAttr
+		} else if strings.HasSuffix(name, ".*") {
+			prefixes = append(prefixes, strings.TrimSuffix(name, "*"))
+		} else {
+			if exact == nil {
+				exact = make(map[string]bool)
+			}
+			exact[name] = true
+		}
+	}
+
+	var ret map[string]MessageAttributeValue
+	for k, v := range msgAttr {
+		requested := exact[k]
+		for i := 0; !requested && i < len(prefixes); i++ {
+			requested = strings.HasPrefix(k, prefixes[i])
+		}
+
+		if requested {
+			if ret == nil {
+				ret = make(map[string]MessageAttributeValue)
+			}
+			ret[k] = v
+		}
+	}
+
+	return ret
+}
+
+// MessageAttributesMd5Digest calculates the md5 digest of message attributes the same way as AWS SQS.
+// An empty string is returned when there are no message attributes.
+func MessageAttributesMd5Digest(msgAttr map[string]MessageAttributeValue) (string, error) {
+	if len(msgAttr) == 0 {
+		return "", nil
+	}
+
+	msgSize, err := MessageSize(nil, msgAttr)
+	if err != nil {
+		return "", err
+	}
+
+	// the serialized message attributes of a hefty message are in the format aws uses for calculating md5 digests
+	serialized, _, msgAttrOffset, err := NewHeftyMessage(new(string), msgAttr, msgSize).Serialize()
+	if err != nil {
+		return "", err
+	}
+
+	return Md5Digest(serialized[msgAttrOffset:]), nil
+}
+
+// isJsonObject checks whether `msg` looks like a JSON object, ignoring surrounding whitespace.
+func isJsonObject(msg string) bool {
+	msg = strings.TrimSpace(msg)
+	return strings.HasPrefix(msg, "{") && strings.HasSuffix(msg, "}")
+}
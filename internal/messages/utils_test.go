@@ -102,3 +102,164 @@ func TestMessageSize(t *testing.T) {
 		})
 	}
 }
+
+func TestSelectMessageAttributes(t *testing.T) {
+	msgAttr := map[string]MessageAttributeValue{
+		"b": {
+			DataType:    aws.String("String"),
+			StringValue: aws.String("0123456789"),
+		},
+		"a": {
+			DataType:    aws.String("Number"),
+			StringValue: aws.String("1"),
+		},
+		"c": {
+			DataType:    aws.String("Binary"),
+			BinaryValue: []byte{0, 1, 2},
+		},
+	}
+	keepAll := func(string) bool { return true }
+
+	var tests = []struct {
+		desc     string
+		keep     func(string) bool
+		maxCount int
+		maxSize  int
+		expNames []string
+	}{
+		{
+			desc:     "keep_none",
+			keep:     func(string) bool { return false },
+			maxCount: 10,
+			maxSize:  1000,
+		},
+		{
+			desc:     "keep_all",
+			keep:     keepAll,
+			maxCount: 10,
+			maxSize:  1000,
+			expNames: []string{"a", "b", "c"},
+		},
+		{
+			desc:     "keep_by_name",
+			keep:     func(name string) bool { return name == "c" },
+			maxCount: 10,
+			maxSize:  1000,
+			expNames: []string{"c"},
+		},
+		{
+			desc:     "max_count_in_name_order",
+			keep:     keepAll,
+			maxCount: 2,
+			maxSize:  1000,
+			expNames: []string{"a", "b"},
+		},
+		{
+			desc:     "max_size_skips_large_attribute",
+			keep:     keepAll,
+			maxCount: 10,
+			maxSize:  len("a") + len("Number") + len("1") + len("c") + len("Binary") + 3,
+			expNames: []string{"a", "c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			selected := SelectMessageAttributes(msgAttr, tt.keep, tt.maxCount, tt.maxSize)
+			assert.Len(t, selected, len(tt.expNames))
+			for _, name := range tt.expNames {
+				assert.Equal(t, msgAttr[name], selected[name])
+			}
+		})
+	}
+}
+
+func TestFilterMessageAttributes(t *testing.T) {
+	stringValue := func(v string) MessageAttributeValue {
+		return MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(v),
+		}
+	}
+	msgAttr := map[string]MessageAttributeValue{
+		"foo":     stringValue("1"),
+		"bar.baz": stringValue("2"),
+		"bar.qux": stringValue("3"),
+		"barqux":  stringValue("4"),
+	}
+
+	var tests = []struct {
+		desc     string
+		names    []string
+		expNames []string
+	}{
+		{
+			desc: "no_names",
+		},
+		{
+			desc:     "all",
+			names:    []string{"All"},
+			expNames: []string{"foo", "bar.baz", "bar.qux", "barqux"},
+		},
+		{
+			desc:     "all_wildcard",
+			names:    []string{".*"},
+			expNames: []string{"foo", "bar.baz", "bar.qux", "barqux"},
+		},
+		{
+			desc:     "exact_names",
+			names:    []string{"foo", "barqux", "missing"},
+			expNames: []string{"foo", "barqux"},
+		},
+		{
+			desc:     "prefix",
+			names:    []string{"bar.*"},
+			expNames: []string{"bar.baz", "bar.qux"},
+		},
+		{
+			desc:     "prefix_and_exact_name",
+			names:    []string{"bar.*", "foo"},
+			expNames: []string{"foo", "bar.baz", "bar.qux"},
+		},
+		{
+			desc:  "case_sensitive",
+			names: []string{"FOO"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			filtered := FilterMessageAttributes(msgAttr, tt.names)
+			assert.Len(t, filtered, len(tt.expNames))
+			for _, name := range tt.expNames {
+				assert.Equal(t, msgAttr[name], filtered[name])
+			}
+		})
+	}
+}
+
+func TestMessageAttributesMd5Digest(t *testing.T) {
+	// same attributes and digest as TestHeftyMessageSerializeAndDeserialize
+	msgAttr := map[string]MessageAttributeValue{
+		"test3": {
+			DataType:    aws.String("Binary"),
+			BinaryValue: []byte{1, 2, 3},
+		},
+		"test": {
+			DataType:    aws.String("String"),
+			StringValue: aws.String("test"),
+		},
+		"test2": {
+			DataType:    aws.String("Number"),
+			StringValue: aws.String("123"),
+		},
+	}
+
+	digest, err := MessageAttributesMd5Digest(msgAttr)
+	assert.Nil(t, err)
+	assert.Equal(t, "ae83a9fd2e99604a8073446145c4c523", digest)
+
+	digest, err = MessageAttributesMd5Digest(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "", digest)
+}
@@ -11,9 +11,9 @@ import (
 	"github.com/aws/smithy-go"
 )
 
-// bucketExists checks whether a bucket exists in the current account.
-func BucketExists(s3Client *s3.Client, bucketName string) (bool, error) {
-	_, err := s3Client.HeadBucket(context.TODO(), &s3.HeadBucketInput{
+// BucketExists checks whether a bucket exists in the current account.
+func BucketExists(ctx context.Context, s3Client *s3.Client, bucketName string) (bool, error) {
+	_, err := s3Client.HeadBucket(ctx, &s3.HeadBucketInput{
 		Bucket: aws.String(bucketName),
 	})
 
@@ -24,9 +24,29 @@ func BucketExists(s3Client *s3.Client, bucketName string) (bool, error) {
 			case *types.NotFound:
 				return false, nil
 			default:
-				return false, fmt.Errorf("unable to check if bucket exits. %v", apiError)
+				return false, fmt.Errorf("unable to check if bucket exits. %w", apiError)
 			}
 		}
+		return false, fmt.Errorf("unable to check if bucket exits. %w", err)
 	}
 	return true, nil
 }
+
+// IsNoSuchKey checks whether an error returned by AWS S3 signifies that an object does not exist.
+func IsNoSuchKey(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) {
+		return true
+	}
+
+	var apiError smithy.APIError
+	if errors.As(err, &apiError) {
+		switch apiError.ErrorCode() {
+		case "NoSuchKey", "NotFound":
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsNoSuchKey(t *testing.T) {
+	var tests = []struct {
+		desc string
+		err  error
+		exp  bool
+	}{
+		{
+			desc: "nil",
+			err:  nil,
+			exp:  false,
+		},
+		{
+			desc: "no_such_key",
+			err:  &types.NoSuchKey{},
+			exp:  true,
+		},
+		{
+			desc: "wrapped_not_found",
+			err:  fmt.Errorf("wrapped. %w", &types.NotFound{}),
+			exp:  true,
+		},
+		{
+			desc: "generic_api_error_no_such_key",
+			err:  &smithy.GenericAPIError{Code: "NoSuchKey"},
+			exp:  true,
+		},
+		{
+			desc: "generic_api_error_access_denied",
+			err:  &smithy.GenericAPIError{Code: "AccessDenied"},
+			exp:  false,
+		},
+		{
+			desc: "other_error",
+			err:  errors.New("NoSuchKey"),
+			exp:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			assert.Equal(t, tt.exp, IsNoSuchKey(tt.err))
+		})
+	}
+}
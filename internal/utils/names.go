@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+)
+
+// queueOrTopicName matches names of AWS SQS queues and AWS SNS topics, including FIFO queues and topics.
+var queueOrTopicName = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,256}(\.fifo)?$`)
+
+// QueueNameFromUrl returns the name of a queue from its url, which is the last segment of the url path. Besides AWS SQS
+// urls such as https://sqs.us-west-2.amazonaws.com/765908583888/MyTestQueue, this supports urls of custom endpoints such
+// as LocalStack, ElasticMQ, and VPC endpoints.
+func QueueNameFromUrl(queueUrl string) (string, error) {
+	u, err := url.Parse(queueUrl)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse queueUrl. %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("queueUrl %s is not an http or https url", queueUrl)
+	}
+
+	segments := strings.FieldsFunc(u.Path, func(r rune) bool { return r == '/' })
+	if len(segments) == 0 {
+		return "", fmt.Errorf("queueUrl %s has no queue name", queueUrl)
+	}
+
+	name := segments[len(segments)-1]
+	if !queueOrTopicName.MatchString(name) {
+		return "", fmt.Errorf("queueUrl %s does not end with a valid queue name", queueUrl)
+	}
+
+	return name, nil
+}
+
+// QueueNameFromArn returns the name of a queue from its ARN, such as arn:aws:sqs:us-west-2:765908583888:MyTestQueue.
+func QueueNameFromArn(queueArn string) (string, error) {
+	return nameFromArn(queueArn, "sqs")
+}
+
+// TopicNameFromArn returns the name of a topic from its ARN, such as arn:aws:sns:us-west-2:765908583888:MyTestTopic.
+func TopicNameFromArn(topicArn string) (string, error) {
+	return nameFromArn(topicArn, "sns")
+}
+
+func nameFromArn(s, service string) (string, error) {
+	parsed, err := arn.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse arn. %w", err)
+	}
+	if parsed.Service != service {
+		return "", fmt.Errorf("expected arn of service %s but received %s", service, parsed.Service)
+	}
+	if !queueOrTopicName.MatchString(parsed.Resource) {
+		return "", errors.New("arn does not end with a valid name")
+	}
+
+	return parsed.Resource, nil
+}
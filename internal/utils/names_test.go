@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueueNameFromUrl(t *testing.T) {
+	var tests = []struct {
+		desc     string
+		queueUrl string
+		exp      string
+		expErr   bool
+	}{
+		{
+			desc:     "aws",
+			queueUrl: "https://sqs.us-west-2.amazonaws.com/765908583888/MyTestQueue",
+			exp:      "MyTestQueue",
+		},
+		{
+			desc:     "aws_fifo",
+			queueUrl: "https://sqs.us-west-2.amazonaws.com/765908583888/MyTestQueue.fifo",
+			exp:      "MyTestQueue.fifo",
+		},
+		{
+			desc:     "vpc_endpoint",
+			queueUrl: "https://vpce-1a2b3c4d-5e6f.sqs.us-east-1.vpce.amazonaws.com/123456789012/MyQueue",
+			exp:      "MyQueue",
+		},
+		{
+			desc:     "localstack",
+			queueUrl: "http://sqs.us-east-1.localhost.localstack.cloud:4566/000000000000/my-queue",
+			exp:      "my-queue",
+		},
+		{
+			desc:     "localstack_path",
+			queueUrl: "http://localhost:4566/queue/us-east-1/000000000000/my-queue",
+			exp:      "my-queue",
+		},
+		{
+			desc:     "elasticmq",
+			queueUrl: "http://localhost:9324/queue/my_queue",
+			exp:      "my_queue",
+		},
+		{
+			desc:     "trailing_slash",
+			queueUrl: "http://localhost:9324/queue/my_queue/",
+			exp:      "my_queue",
+		},
+		{
+			desc:     "no_path",
+			queueUrl: "http://localhost:9324",
+			expErr:   true,
+		},
+		{
+			desc:     "queue_name",
+			queueUrl: "MyTestQueue",
+			expErr:   true,
+		},
+		{
+			desc:     "invalid_name",
+			queueUrl: "http://localhost:9324/queue/my%20queue",
+			expErr:   true,
+		},
+		{
+			desc:     "empty",
+			queueUrl: "",
+			expErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			name, err := QueueNameFromUrl(test.queueUrl)
+			if test.expErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, test.exp, name)
+			}
+		})
+	}
+}
+
+func TestNameFromArn(t *testing.T) {
+	var tests = []struct {
+		desc   string
+		arn    string
+		fn     func(string) (string, error)
+		exp    string
+		expErr bool
+	}{
+		{
+			desc: "queue",
+			arn:  "arn:aws:sqs:us-west-2:765908583888:MyTestQueue",
+			fn:   QueueNameFromArn,
+			exp:  "MyTestQueue",
+		},
+		{
+			desc: "topic_fifo",
+			arn:  "arn:aws:sns:us-west-2:765908583888:MyTestTopic.fifo",
+			fn:   TopicNameFromArn,
+			exp:  "MyTestTopic.fifo",
+		},
+		{
+			desc: "topic_other_partition",
+			arn:  "arn:aws-us-gov:sns:us-gov-west-1:765908583888:MyTestTopic",
+			fn:   TopicNameFromArn,
+			exp:  "MyTestTopic",
+		},
+		{
+			desc: "topic_localstack",
+			arn:  "arn:aws:sns:us-east-1:000000000000:my-topic",
+			fn:   TopicNameFromArn,
+			exp:  "my-topic",
+		},
+		{
+			desc:   "wrong_service",
+			arn:    "arn:aws:sqs:us-west-2:765908583888:MyTestQueue",
+			fn:     TopicNameFromArn,
+			expErr: true,
+		},
+		{
+			desc:   "subscription",
+			arn:    "arn:aws:sns:us-west-2:765908583888:MyTestTopic:8a21d249-4329-4871-acc6-7be709c6ea7f",
+			fn:     TopicNameFromArn,
+			expErr: true,
+		},
+		{
+			desc:   "not_an_arn",
+			arn:    "MyTestTopic",
+			fn:     TopicNameFromArn,
+			expErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			name, err := test.fn(test.arn)
+			if test.expErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, test.exp, name)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package hefty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/vinujohn/hefty/internal/messages"
+)
+
+const redactedValue = "[REDACTED]"
+
+// If selected, the wrapper logs with `logger`. Decisions made when sending, receiving, and deleting messages, such as
+// whether a message is stored in AWS S3, are logged at debug level along with the message size, AWS S3 bucket and key,
+// and message id. Failures and fallbacks, such as failed downloads, retries, and stored outbox messages, are logged at
+// warn or error level. Message bodies are never logged and values of message attributes are redacted unless
+// `LogAttributeValues` is selected.
+func Logger(logger *slog.Logger) Option {
+	return func(opts *options) error {
+		if logger == nil {
+			return errors.New("logger is nil")
+		}
+		opts.logger = logger
+		return nil
+	}
+}
+
+// If selected, values of message attributes are logged instead of being redacted. Only use this option when message
+// attributes do not hold sensitive data.
+func LogAttributeValues() Option {
+	return func(opts *options) error {
+		opts.logAttributeValues = true
+		return nil
+	}
+}
+
+// logger logs the decisions and failures of a wrapper. Without the `Logger` option, nothing is logged.
+type logger struct {
+	*slog.Logger
+	revealValues bool
+}
+
+func newLogger(l *slog.Logger, revealValues bool) *logger {
+	if l == nil {
+		l = slog.New(discardHandler{})
+	}
+
+	return &logger{
+		Logger:       l,
+		revealValues: revealValues,
+	}
+}
+
+// attributes returns `msgAttr` as a log attribute, with their values redacted unless LogAttributeValues is selected.
+func (l *logger) attributes(msgAttr map[string]messages.MessageAttributeValue) slog.Attr {
+	names := make([]string, 0, len(msgAttr))
+	for name := range msgAttr {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	attrs := make([]any, 0, len(names))
+	for _, name := range names {
+		value := redactedValue
+		if l.revealValues {
+			v := msgAttr[name]
+			if v.StringValue != nil {
+				value = *v.StringValue
+			} else {
+				value = fmt.Sprintf("<%d bytes>", len(v.BinaryValue))
+			}
+		}
+		attrs = append(attrs, slog.String(name, value))
+	}
+
+	return slog.Group("attributes", attrs...)
+}
+
+// sent logs the outcome of sending a message to `destination`. `key` is empty if the message was not stored in AWS S3.
+func (l *logger) sent(ctx context.Context, destination string, size int, offloaded bool, bucket, key string, msgAttr map[string]messages.MessageAttributeValue, messageId *string, err error) {
+	attrs := []any{"destination", destination, "size", size, "offloaded", offloaded}
+	if key != "" {
+		attrs = append(attrs, "bucket", bucket, "key", key)
+	}
+
+	if err != nil {
+		l.ErrorContext(ctx, "unable to send message", append(attrs, "error", err)...)
+		return
+	}
+
+	if l.Enabled(ctx, slog.LevelDebug) {
+		l.DebugContext(ctx, "sent message", append(attrs, "message_id", aws.ToString(messageId), l.attributes(msgAttr))...)
+	}
+}
+
+// onRetry returns `onRetry` of a retry policy which also logs the retry.
+func (l *logger) onRetry(onRetry func(op string, attempt int, err error)) func(op string, attempt int, err error) {
+	return func(op string, attempt int, err error) {
+		l.Warn("retrying s3 operation", "op", op, "attempt", attempt, "error", err)
+		if onRetry != nil {
+			onRetry(op, attempt, err)
+		}
+	}
+}
+
+// onStateChange returns `onStateChange` of a circuit breaker which also logs the state change.
+func (l *logger) onStateChange(onStateChange func(from, to CircuitState)) func(from, to CircuitState) {
+	return func(from, to CircuitState) {
+		level := slog.LevelWarn
+		if to == CircuitClosed {
+			level = slog.LevelInfo
+		}
+		l.Log(context.Background(), level, "s3 circuit breaker changed state", "from", from.String(), "to", to.String())
+		if onStateChange != nil {
+			onStateChange(from, to)
+		}
+	}
+}
+
+// onOutboxError returns `onError` of an outbox which also logs the error.
+func (l *logger) onOutboxError(onError func(err error)) func(err error) {
+	return func(err error) {
+		l.Error("unable to replay outbox", "error", err)
+		if onError != nil {
+			onError(err)
+		}
+	}
+}
+
+// onDeleteError returns `onError` of an asynchronous payload deleter which also logs the error.
+func (l *logger) onDeleteError(onError func(bucket, key string, err error)) func(bucket, key string, err error) {
+	return func(bucket, key string, err error) {
+		l.Error("unable to delete hefty message from s3", "bucket", bucket, "key", key, "error", err)
+		if onError != nil {
+			onError(bucket, key, err)
+		}
+	}
+}
+
+// discardHandler drops all log records.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
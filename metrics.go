@@ -0,0 +1,102 @@
+package hefty
+
+import (
+	"errors"
+	"time"
+
+	"github.com/vinujohn/hefty/internal/utils"
+)
+
+// DownloadErrorKind describes why a hefty message could not be downloaded from AWS S3.
+type DownloadErrorKind string
+
+const (
+	// DownloadErrorInvalidReference is a reference message which could not be parsed.
+	DownloadErrorInvalidReference DownloadErrorKind = "invalid_reference"
+	// DownloadErrorMissingPayload is a hefty message which no longer exists in AWS S3.
+	DownloadErrorMissingPayload DownloadErrorKind = "missing_payload"
+	// DownloadErrorUnavailable is a download which was not attempted because the circuit breaker was open.
+	DownloadErrorUnavailable DownloadErrorKind = "unavailable"
+	// DownloadErrorS3 is any other error returned by AWS S3.
+	DownloadErrorS3 DownloadErrorKind = "s3_error"
+	// DownloadErrorDecode is a hefty message which could not be decoded.
+	DownloadErrorDecode DownloadErrorKind = "decode_error"
+)
+
+// DeleteOutcome describes what happened to a hefty message in AWS S3 when its reference message was deleted.
+type DeleteOutcome string
+
+const (
+	// DeleteOutcomeInline is a message which was not stored in AWS S3.
+	DeleteOutcomeInline DeleteOutcome = "inline"
+	// DeleteOutcomeDeleted is a hefty message which was removed from AWS S3.
+	DeleteOutcomeDeleted DeleteOutcome = "deleted"
+	// DeleteOutcomeScheduled is a hefty message which is removed from AWS S3 in the background.
+	DeleteOutcomeScheduled DeleteOutcome = "scheduled"
+	// DeleteOutcomeAcknowledged is a hefty message which is kept in AWS S3 until its other subscribers delete it.
+	DeleteOutcomeAcknowledged DeleteOutcome = "acknowledged"
+	// DeleteOutcomeRetained is a hefty message which is never removed from AWS S3 by hefty.
+	DeleteOutcomeRetained DeleteOutcome = "retained"
+	// DeleteOutcomeFailed is a message which could not be deleted.
+	DeleteOutcomeFailed DeleteOutcome = "failed"
+)
+
+// Metrics records statistics of the client wrappers. `wrapper` is "sqs" for the SQS client wrapper and "sns" for the SNS
+// client wrapper. Implementations must be safe for concurrent use. See the heftyprom package for a Prometheus implementation.
+type Metrics interface {
+	// MessageSent is called for every message sent, where `offloaded` is true if the message was stored in AWS S3
+	// and `size` is the size of the message in bytes.
+	MessageSent(wrapper string, offloaded bool, size int)
+	// PayloadUploaded is called with the number of bytes of every hefty message uploaded to AWS S3.
+	PayloadUploaded(wrapper string, bytes int)
+	// PayloadDownloaded is called with the number of bytes of every hefty message downloaded from AWS S3.
+	PayloadDownloaded(wrapper string, bytes int)
+	// S3Operation is called after every request to AWS S3, where `op` is one of "upload", "download", "delete",
+	// "put", "list", "head", "copy", "presign", or "fetch" and `err` is the error of the request, if any.
+	S3Operation(wrapper string, op string, duration time.Duration, err error)
+	// DownloadFailed is called for every reference message whose hefty message could not be received.
+	DownloadFailed(wrapper string, kind DownloadErrorKind)
+	// MessageDeleted is called for every message deleted with `DeleteHeftyMessage`.
+	MessageDeleted(wrapper string, outcome DeleteOutcome)
+}
+
+// If selected, statistics of sending, receiving, and deleting messages are recorded with `metrics`.
+func RecordMetrics(metrics Metrics) Option {
+	return func(opts *options) error {
+		if metrics == nil {
+			return errors.New("metrics is nil")
+		}
+		opts.metrics = metrics
+		return nil
+	}
+}
+
+// nopMetrics is used when no metrics are selected.
+type nopMetrics struct{}
+
+func (nopMetrics) MessageSent(string, bool, int)                    {}
+func (nopMetrics) PayloadUploaded(string, int)                      {}
+func (nopMetrics) PayloadDownloaded(string, int)                    {}
+func (nopMetrics) S3Operation(string, string, time.Duration, error) {}
+func (nopMetrics) DownloadFailed(string, DownloadErrorKind)         {}
+func (nopMetrics) MessageDeleted(string, DeleteOutcome)             {}
+
+func metricsOrNop(metrics Metrics) Metrics {
+	if metrics == nil {
+		return nopMetrics{}
+	}
+
+	return metrics
+}
+
+// downloadErrorKind classifies an error returned when downloading a hefty message.
+func downloadErrorKind(err error) DownloadErrorKind {
+	switch {
+	case errors.Is(err, ErrPayloadStoreUnavailable):
+		return DownloadErrorUnavailable
+	case utils.IsNoSuchKey(err):
+		return DownloadErrorMissingPayload
+	default:
+		return DownloadErrorS3
+	}
+}
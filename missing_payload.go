@@ -0,0 +1,174 @@
+package hefty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/vinujohn/hefty/internal/messages"
+)
+
+// message attributes added to reference messages forwarded to a dead letter queue
+const (
+	MissingPayloadErrorAttribute       = "hefty-missing-payload-error"
+	MissingPayloadSourceQueueAttribute = "hefty-missing-payload-source-queue-url"
+	MissingPayloadMessageIdAttribute   = "hefty-missing-payload-message-id"
+	MissingPayloadS3BucketAttribute    = "hefty-missing-payload-s3-bucket"
+	MissingPayloadS3KeyAttribute       = "hefty-missing-payload-s3-key"
+)
+
+// ReferenceMessage is a message placed in AWS SQS or AWS SNS in place of a hefty message, which references the hefty
+// message stored in AWS S3.
+type ReferenceMessage = messages.ReferenceMsg
+
+// MissingPayloadCallback is called when the hefty message referenced by a reference message received from the queue
+// at `queueUrl` no longer exists in AWS S3. `msg` holds the reference message with its original AWS SQS receipt handle,
+// which can be used to delete the message. If an error is returned, the error is placed in the message body instead.
+type MissingPayloadCallback func(ctx context.Context, queueUrl string, msg types.Message, refMsg *ReferenceMessage) error
+
+type missingPayloadAction int
+
+const (
+	embedErrorOnMissingPayload missingPayloadAction = iota
+	deleteOnMissingPayload
+	forwardOnMissingPayload
+	callbackOnMissingPayload
+)
+
+// MissingPayloadPolicy determines what `ReceiveHeftyMessage` does with a reference message whose hefty message no
+// longer exists in AWS S3, for example because of an S3 lifecycle expiration or a manual delete. Without a policy,
+// these messages are redelivered with an error in their body until they are moved to a dead letter queue by AWS SQS.
+type MissingPayloadPolicy struct {
+	action             missingPayloadAction
+	deadLetterQueueUrl string
+	callback           MissingPayloadCallback
+}
+
+// EmbedErrorOnMissingPayload places an error in the message body, which can be inspected with `ErrorMsg(...)`.
+// This is the default policy.
+func EmbedErrorOnMissingPayload() MissingPayloadPolicy {
+	return MissingPayloadPolicy{action: embedErrorOnMissingPayload}
+}
+
+// DeleteOnMissingPayload deletes the reference message from AWS SQS and does not return it.
+func DeleteOnMissingPayload() MissingPayloadPolicy {
+	return MissingPayloadPolicy{action: deleteOnMissingPayload}
+}
+
+// ForwardOnMissingPayload sends the reference message to the queue at `deadLetterQueueUrl` with its own message attributes
+// along with message attributes describing the problem, deletes it from the original queue, and does not return it. Its
+// own message attributes are kept as far as the AWS SQS limit of 10 message attributes allows.
+func ForwardOnMissingPayload(deadLetterQueueUrl string) MissingPayloadPolicy {
+	return MissingPayloadPolicy{action: forwardOnMissingPayload, deadLetterQueueUrl: deadLetterQueueUrl}
+}
+
+// CallbackOnMissingPayload calls `callback` with the reference message and does not return it. The callback is
+// responsible for deleting the message if it should not be received again.
+func CallbackOnMissingPayload(callback MissingPayloadCallback) MissingPayloadPolicy {
+	return MissingPayloadPolicy{action: callbackOnMissingPayload, callback: callback}
+}
+
+func (policy *MissingPayloadPolicy) validate() error {
+	switch policy.action {
+	case forwardOnMissingPayload:
+		if policy.deadLetterQueueUrl == "" {
+			return errors.New("dead letter queue url for missing payloads is empty")
+		}
+	case callbackOnMissingPayload:
+		if policy.callback == nil {
+			return errors.New("callback for missing payloads is nil")
+		}
+	}
+	return nil
+}
+
+// handleMissingPayload applies the missing payload policy to `msg`, whose message attributes as received are `msgAttr`.
+// It returns true if `msg` should be removed from the messages returned to the caller.
+func (wrapper *SqsClientWrapper) handleMissingPayload(ctx context.Context, queueUrl *string, msg *types.Message, refMsg *messages.ReferenceMsg, msgAttr map[string]messages.MessageAttributeValue, downloadErr error) bool {
+	var err error
+
+	switch wrapper.missingPayloadPolicy.action {
+	case deleteOnMissingPayload:
+		_, err = wrapper.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+			QueueUrl:      queueUrl,
+			ReceiptHandle: msg.ReceiptHandle,
+		})
+		if err != nil {
+			err = fmt.Errorf("unable to delete reference message with missing payload. %w", err)
+		}
+	case forwardOnMissingPayload:
+		err = wrapper.forwardMissingPayload(ctx, queueUrl, msg, refMsg, msgAttr, downloadErr)
+	case callbackOnMissingPayload:
+		err = wrapper.missingPayloadPolicy.callback(ctx, aws.ToString(queueUrl), *msg, refMsg)
+		if err != nil {
+			err = fmt.Errorf("missing payload callback returned an error. %w", err)
+		}
+	default:
+		err = downloadErr
+	}
+
+	if err != nil {
+		if wrapper.missingPayloadPolicy.action != embedErrorOnMissingPayload {
+			wrapper.logger.ErrorContext(ctx, "unable to apply missing payload policy", "message_id", aws.ToString(msg.MessageId), "error", err)
+			err = fmt.Errorf("%v. %w", downloadErr, err)
+		}
+		addErrorToSqsMessage(msg, refMsg, err)
+		return false
+	}
+
+	wrapper.logger.WarnContext(ctx, "removed reference message with missing payload", "message_id", aws.ToString(msg.MessageId))
+	return true
+}
+
+func (wrapper *SqsClientWrapper) forwardMissingPayload(ctx context.Context, queueUrl *string, msg *types.Message, refMsg *messages.ReferenceMsg, msgAttr map[string]messages.MessageAttributeValue, downloadErr error) error {
+	stringAttribute := func(value string) messages.MessageAttributeValue {
+		return messages.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
+	}
+	diagnostics := map[string]messages.MessageAttributeValue{
+		MissingPayloadErrorAttribute:       stringAttribute(downloadErr.Error()),
+		MissingPayloadSourceQueueAttribute: stringAttribute(aws.ToString(queueUrl)),
+		MissingPayloadMessageIdAttribute:   stringAttribute(aws.ToString(msg.MessageId)),
+		MissingPayloadS3BucketAttribute:    stringAttribute(refMsg.S3Bucket),
+		MissingPayloadS3KeyAttribute:       stringAttribute(refMsg.S3Key),
+	}
+
+	// keep the message attributes of the reference message, such as its trace context, so that it can be correlated
+	diagnosticsSize, _ := messages.MessageSize(msg.Body, diagnostics)
+	forwardedAttr := messages.SelectMessageAttributes(msgAttr, func(name string) bool {
+		_, diagnostic := diagnostics[name]
+		return !diagnostic
+	}, maxAwsMessageAttributeCount-len(diagnostics), MaxAwsMessageLengthBytes-diagnosticsSize)
+	if forwardedAttr == nil {
+		forwardedAttr = make(map[string]messages.MessageAttributeValue, len(diagnostics))
+	}
+	for k, v := range diagnostics {
+		forwardedAttr[k] = v
+	}
+
+	// send reference message along with diagnostics to dead letter queue
+	_, err := wrapper.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:          aws.String(wrapper.missingPayloadPolicy.deadLetterQueueUrl),
+		MessageBody:       msg.Body,
+		MessageAttributes: messages.MapToSqsMessageAttributeValues(forwardedAttr),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to forward reference message with missing payload to dead letter queue. %w", err)
+	}
+
+	// delete reference message from original queue
+	_, err = wrapper.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      queueUrl,
+		ReceiptHandle: msg.ReceiptHandle,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to delete reference message with missing payload after forwarding. %w", err)
+	}
+
+	return nil
+}
@@ -1,7 +1,40 @@
 package hefty
 
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	s3manager "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
 type options struct {
-	alwaysSendToS3 bool
+	alwaysSendToS3       bool
+	missingPayloadPolicy MissingPayloadPolicy
+	fanOutDeleteMode     FanOutDeleteMode
+	deletePayloadFirst   bool
+	asyncDeletion        *AsyncDeletionConfig
+	keepAttribute        func(name string) bool
+	retryPolicy          *RetryPolicy
+	circuitBreaker       *CircuitBreakerConfig
+	outbox               *OutboxConfig
+	uploaderOptions      []func(*s3manager.Uploader)
+	downloaderOptions    []func(*s3manager.Downloader)
+	checksumAlgorithm    s3Types.ChecksumAlgorithm
+	bucketValidation     BucketValidationMode
+	tracing              *TracingConfig
+	metrics              Metrics
+	logger               *slog.Logger
+	logAttributeValues   bool
+	interceptors         interceptors
+	payloadCache         *PayloadCacheConfig
+	contentAddressing    *ContentAddressingConfig
+	presignExpiry        time.Duration
+	httpClient           *http.Client
 }
 
 type Option func(opts *options) error
@@ -13,3 +46,148 @@ func AlwaysSendToS3() Option {
 		return nil
 	}
 }
+
+// If selected, reference messages whose hefty message no longer exists in AWS S3 are handled according to `policy`
+// when received. Only valid for the SQS client wrapper.
+func OnMissingPayload(policy MissingPayloadPolicy) Option {
+	return func(opts *options) error {
+		if err := policy.validate(); err != nil {
+			return err
+		}
+		opts.missingPayloadPolicy = policy
+		return nil
+	}
+}
+
+// If selected, `DeleteHeftyMessage` removes the hefty message from AWS S3 before deleting the reference message from AWS SQS,
+// which was the behavior of previous versions. By default, the reference message is deleted first so that a failed delete,
+// for example because of an expired receipt handle, does not leave a redelivered reference message without its hefty message.
+// Has no effect when used with `AsyncPayloadDeletion`. Only valid for the SQS client wrapper.
+func DeletePayloadFirst() Option {
+	return func(opts *options) error {
+		opts.deletePayloadFirst = true
+		return nil
+	}
+}
+
+// If selected, `DeleteHeftyMessage` removes hefty messages from AWS S3 in the background in batches after their reference
+// messages have been deleted from AWS SQS. `Close` should be called on the wrapper to remove remaining hefty messages
+// before exiting. Only valid for the SQS client wrapper.
+func AsyncPayloadDeletion(config AsyncDeletionConfig) Option {
+	return func(opts *options) error {
+		if err := config.validate(); err != nil {
+			return err
+		}
+		opts.asyncDeletion = &config
+		return nil
+	}
+}
+
+// If selected, the message attributes named in `names` are also set on the reference message when a message is sent
+// to AWS S3, for example so that AWS SNS subscription filter policies keep matching large messages. All message
+// attributes are still stored in AWS S3. Attributes are kept in order of their names as long as the reference message,
+// including its reserved attributes, stays within the AWS limits of 10 message attributes and the AWS message size.
+func KeepAttributesOnReference(names ...string) Option {
+	keep := make(map[string]bool, len(names))
+	for _, name := range names {
+		keep[name] = true
+	}
+
+	return KeepAttributesOnReferenceFunc(func(name string) bool {
+		return keep[name]
+	})
+}
+
+// If selected, message attributes for which `keep` returns true are also set on the reference message when a message
+// is sent to AWS S3. The same limits as `KeepAttributesOnReference` apply.
+func KeepAttributesOnReferenceFunc(keep func(name string) bool) Option {
+	return func(opts *options) error {
+		if keep == nil {
+			return errors.New("keep function for reference message attributes is nil")
+		}
+		opts.keepAttribute = keep
+		return nil
+	}
+}
+
+// If selected, hefty messages are uploaded to and downloaded from AWS S3 in parts of `size` bytes. The size must be at
+// least 5MB, which is also the default.
+func S3PartSize(size int64) Option {
+	return func(opts *options) error {
+		if size < s3manager.MinUploadPartSize {
+			return fmt.Errorf("part size must be at least %d bytes but received %d", s3manager.MinUploadPartSize, size)
+		}
+		opts.uploaderOptions = append(opts.uploaderOptions, func(u *s3manager.Uploader) {
+			u.PartSize = size
+		})
+		opts.downloaderOptions = append(opts.downloaderOptions, func(d *s3manager.Downloader) {
+			d.PartSize = size
+		})
+		return nil
+	}
+}
+
+// If selected, up to `n` parts of a hefty message are uploaded to or downloaded from AWS S3 concurrently. Defaults to 5.
+func S3Concurrency(n int) Option {
+	return func(opts *options) error {
+		if n < 1 {
+			return fmt.Errorf("concurrency must be greater than 0 but received %d", n)
+		}
+		opts.uploaderOptions = append(opts.uploaderOptions, func(u *s3manager.Uploader) {
+			u.Concurrency = n
+		})
+		opts.downloaderOptions = append(opts.downloaderOptions, func(d *s3manager.Downloader) {
+			d.Concurrency = n
+		})
+		return nil
+	}
+}
+
+// If selected, parts of hefty messages uploaded to AWS S3 are buffered using `provider`, for example to pool buffers.
+func S3UploadBufferProvider(provider s3manager.ReadSeekerWriteToProvider) Option {
+	return func(opts *options) error {
+		if provider == nil {
+			return errors.New("upload buffer provider is nil")
+		}
+		opts.uploaderOptions = append(opts.uploaderOptions, func(u *s3manager.Uploader) {
+			u.BufferProvider = provider
+		})
+		return nil
+	}
+}
+
+// If selected, parts of hefty messages downloaded from AWS S3 are buffered using `provider`, for example to pool buffers.
+func S3DownloadBufferProvider(provider s3manager.WriterReadFromProvider) Option {
+	return func(opts *options) error {
+		if provider == nil {
+			return errors.New("download buffer provider is nil")
+		}
+		opts.downloaderOptions = append(opts.downloaderOptions, func(d *s3manager.Downloader) {
+			d.BufferProvider = provider
+		})
+		return nil
+	}
+}
+
+// If selected, hefty messages are uploaded to AWS S3 with a checksum calculated using `algorithm`, such as
+// `types.ChecksumAlgorithmCrc32c` or `types.ChecksumAlgorithmSha256`, and the checksum is validated when downloading.
+func S3ChecksumAlgorithm(algorithm s3Types.ChecksumAlgorithm) Option {
+	return func(opts *options) error {
+		if !slices.Contains(algorithm.Values(), algorithm) {
+			return fmt.Errorf("unknown checksum algorithm %s", algorithm)
+		}
+		opts.checksumAlgorithm = algorithm
+		return nil
+	}
+}
+
+// If selected, parts which were already uploaded are left in AWS S3 when a multipart upload of a hefty message fails
+// instead of aborting the upload. An S3 lifecycle rule should be used to abort incomplete multipart uploads.
+func S3LeavePartsOnError() Option {
+	return func(opts *options) error {
+		opts.uploaderOptions = append(opts.uploaderOptions, func(u *s3manager.Uploader) {
+			u.LeavePartsOnError = true
+		})
+		return nil
+	}
+}
@@ -0,0 +1,498 @@
+package hefty
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/vinujohn/hefty/internal/messages"
+)
+
+const (
+	defaultOutboxReplayInterval = 5 * time.Second
+	outboxEntrySuffix           = ".json"
+	outboxFailedSuffix          = ".failed" // entries which can never be sent are renamed with this suffix
+	outboxTempSuffix            = ".tmp"
+)
+
+// OutboxConfig determines how messages which could not be sent are stored and sent again later.
+type OutboxConfig struct {
+	// Dir is the directory of the journal holding messages which could not be sent. It is created if it does not exist
+	// and must not be shared by several wrappers. Messages found in the journal when the wrapper is created are sent again.
+	Dir string
+	// ReplayInterval is how often sending the messages in the journal is attempted. Defaults to 5s.
+	ReplayInterval time.Duration
+	// ShouldStore determines whether a message which failed to send with an error is stored in the journal. Defaults to
+	// storing messages which failed with ErrPayloadStoreUnavailable or an error for which IsRetryableError returns true.
+	ShouldStore func(err error) bool
+	// OnError is called with errors of the background replay. Messages which fail to send with an error for which
+	// ShouldStore returns false are renamed with the suffix ".failed" in Dir and are not sent again.
+	OnError func(err error)
+}
+
+func (config *OutboxConfig) validate() error {
+	if config.Dir == "" {
+		return errors.New("outbox directory must not be empty")
+	}
+	if config.ReplayInterval == 0 {
+		config.ReplayInterval = defaultOutboxReplayInterval
+	}
+	if config.ShouldStore == nil {
+		config.ShouldStore = func(err error) bool {
+			return errors.Is(err, ErrPayloadStoreUnavailable) || IsRetryableError(err)
+		}
+	}
+	if config.ReplayInterval < 0 {
+		return fmt.Errorf("replay interval must not be negative but received %v", config.ReplayInterval)
+	}
+	return nil
+}
+
+// If selected, messages which could not be sent because AWS S3, AWS SQS, or AWS SNS was unavailable are stored in an
+// on-disk journal according to `config` and are sent again in the background in the order they were sent. While the
+// journal holds messages, new messages are added to the journal as well so that their order is kept. Messages added to
+// the journal are returned with an empty output and ErrStoredInOutbox, and are sent without the `optFns` of the call.
+// A hefty message uploaded to AWS S3 for a message which is added to the journal is removed and uploaded again when
+// the message is sent from the journal. `Drain` or `Close` should be called on the wrapper before exiting.
+func Outbox(config OutboxConfig) Option {
+	return func(opts *options) error {
+		if err := config.validate(); err != nil {
+			return err
+		}
+		opts.outbox = &config
+		return nil
+	}
+}
+
+// outboxEntry is a message stored in the journal. The message body and attributes are stored as a serialized
+// hefty message while the remaining input holds the destination and other parameters of the message.
+type outboxEntry struct {
+	SqsInput *sqs.SendMessageInput `json:"sqs_input,omitempty"`
+	SnsInput *sns.PublishInput     `json:"sns_input,omitempty"`
+	Message  []byte                `json:"message"`
+}
+
+// outbox is an on-disk journal of messages. Each entry is a file named after its sequence number.
+type outbox struct {
+	config OutboxConfig
+	send   func(ctx context.Context, entry *outboxEntry) error
+
+	mu    sync.Mutex
+	next  uint64
+	count int
+
+	replayMu sync.Mutex // only one replay at a time so that entries are sent in order
+
+	// sends which are not replayed share the lock so that no message is sent while the journal holds an earlier one
+	sendMu sync.RWMutex
+
+	ctx    context.Context // cancelled to stop the background replay
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newOutbox(config OutboxConfig, send func(ctx context.Context, entry *outboxEntry) error) (*outbox, error) {
+	err := os.MkdirAll(config.Dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create outbox directory. %w", err)
+	}
+
+	box := &outbox{
+		config: config,
+		send:   send,
+		done:   make(chan struct{}),
+	}
+	box.ctx, box.cancel = context.WithCancel(context.Background())
+
+	// continue after the entries of a previous run
+	seqs, err := box.entries()
+	if err != nil {
+		return nil, err
+	}
+	box.count = len(seqs)
+	if len(seqs) > 0 {
+		box.next = seqs[len(seqs)-1] + 1
+	}
+
+	go box.run()
+
+	return box, nil
+}
+
+// backlog returns the number of messages in the journal.
+func (box *outbox) backlog() int {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+
+	return box.count
+}
+
+// add writes an entry to the journal. The entry is synced to disk before it is visible to the replay.
+func (box *outbox) add(entry *outboxEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("unable to marshal outbox entry. %w", err)
+	}
+
+	box.mu.Lock()
+	defer box.mu.Unlock()
+
+	name := box.entryName(box.next)
+	tmp := name + outboxTempSuffix
+	err = writeFileSync(tmp, data)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("unable to write outbox entry. %w", err)
+	}
+	err = os.Rename(tmp, name)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("unable to write outbox entry. %w", err)
+	}
+	syncDir(box.config.Dir)
+
+	box.next++
+	box.count++
+
+	return nil
+}
+
+func (box *outbox) run() {
+	defer close(box.done)
+
+	ticker := time.NewTicker(box.config.ReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-box.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := box.replay(box.ctx); err != nil && box.ctx.Err() == nil && box.config.OnError != nil {
+			box.config.OnError(err)
+		}
+	}
+}
+
+// replay sends the entries of the journal in order and removes them once sent. It stops at the first entry which
+// could not be sent, or when `ctx` is done, so that entries are never sent out of order.
+func (box *outbox) replay(ctx context.Context) error {
+	box.replayMu.Lock()
+	defer box.replayMu.Unlock()
+
+	seqs, err := box.entries()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, seq := range seqs {
+		if err := ctx.Err(); err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+
+		name := box.entryName(seq)
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return errors.Join(append(errs, fmt.Errorf("unable to read outbox entry. %w", err))...)
+		}
+
+		kept, err := box.replayEntry(ctx, name, data)
+		if kept {
+			return errors.Join(append(errs, err)...)
+		} else if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// replayEntry sends an entry of the journal and removes it, or keeps it aside if it can never be sent. Returns true if
+// the entry stays in the journal to be sent again. New messages are not sent meanwhile so that they are not sent
+// before the entry.
+func (box *outbox) replayEntry(ctx context.Context, name string, data []byte) (bool, error) {
+	box.sendMu.Lock()
+	defer box.sendMu.Unlock()
+
+	var entry outboxEntry
+	err := json.Unmarshal(data, &entry)
+	if err == nil {
+		err = box.send(ctx, &entry)
+		if err != nil && (ctx.Err() != nil || box.config.ShouldStore(err)) {
+			return true, fmt.Errorf("unable to send message from outbox. %w", err)
+		}
+	}
+
+	var sendErr error
+	if err != nil {
+		// the entry can never be sent; keep it aside rather than blocking the journal
+		sendErr = fmt.Errorf("unable to send message from outbox entry %s. %w", filepath.Base(name), err)
+		err = os.Rename(name, strings.TrimSuffix(name, outboxEntrySuffix)+outboxFailedSuffix)
+	} else {
+		err = os.Remove(name)
+	}
+	if err != nil {
+		return true, errors.Join(sendErr, fmt.Errorf("unable to remove outbox entry. %w", err))
+	}
+
+	box.mu.Lock()
+	box.count--
+	box.mu.Unlock()
+
+	return false, sendErr
+}
+
+// drain sends all entries of the journal, returning an error if entries remain when `ctx` is done.
+func (box *outbox) drain(ctx context.Context) error {
+	for {
+		err := box.replay(ctx)
+		if box.backlog() == 0 {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("unable to drain outbox with %d messages remaining. %w", box.backlog(), errors.Join(err, ctx.Err()))
+		case <-time.After(box.config.ReplayInterval):
+		}
+	}
+}
+
+// close stops the background replay, cancelling a replay in progress, and drains the journal.
+func (box *outbox) close(ctx context.Context) error {
+	box.cancel()
+	<-box.done
+
+	return box.drain(ctx)
+}
+
+// entries returns the sequence numbers of the entries in the journal in order.
+func (box *outbox) entries() ([]uint64, error) {
+	files, err := os.ReadDir(box.config.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read outbox directory. %w", err)
+	}
+
+	var seqs []uint64
+	for _, file := range files {
+		name, ok := strings.CutSuffix(file.Name(), outboxEntrySuffix)
+		if !ok || file.IsDir() {
+			continue
+		}
+		seq, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	return seqs, nil
+}
+
+func (box *outbox) entryName(seq uint64) string {
+	return filepath.Join(box.config.Dir, fmt.Sprintf("%020d%s", seq, outboxEntrySuffix))
+}
+
+func writeFileSync(name string, data []byte) error {
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	return errors.Join(err, file.Close())
+}
+
+// syncDir makes a rename in `dir` durable. Errors are ignored as not every platform supports syncing directories.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+}
+
+// serializeOutboxMessage serializes a message body and its attributes for the journal.
+func serializeOutboxMessage(body *string, msgAttributes map[string]messages.MessageAttributeValue) ([]byte, error) {
+	msgSize, err := messages.MessageSize(body, msgAttributes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get size of message. %w", err)
+	}
+
+	serialized, _, _, err := messages.NewHeftyMessage(body, msgAttributes, msgSize).Serialize()
+	if err != nil {
+		return nil, fmt.Errorf("unable to serialize message. %w", err)
+	}
+
+	return serialized, nil
+}
+
+// sendOrStore sends a message with `send` unless the journal holds messages, in which case or if sending fails
+// with an error selected by ShouldStore, the message is added to the journal with `entry` and ErrStoredInOutbox is
+// returned. The error of `send` is not wrapped so that callers do not retry a stored message.
+func (box *outbox) sendOrStore(send func() error, entry func() (*outboxEntry, error)) error {
+	// the journal cannot be replayed between deciding to send a message and storing it if sending fails
+	box.sendMu.RLock()
+	defer box.sendMu.RUnlock()
+
+	var sendErr error
+	if box.backlog() == 0 {
+		sendErr = send()
+		if sendErr == nil || !box.config.ShouldStore(sendErr) {
+			return sendErr
+		}
+	}
+
+	e, err := entry()
+	if err != nil {
+		return err
+	}
+
+	err = box.add(e)
+	if err != nil {
+		return fmt.Errorf("unable to add message to outbox. %w", err)
+	}
+
+	if sendErr != nil {
+		return fmt.Errorf("%w. %v", ErrStoredInOutbox, sendErr)
+	}
+	return ErrStoredInOutbox
+}
+
+// discardPayload removes the hefty message uploaded for a message which was not sent, as the message is uploaded again when it
+// is sent from the journal. A hefty message which cannot be removed is only logged.
+func discardPayload(ctx context.Context, store *payloadStore, logger *logger, bucket, key string) {
+	err := store.delete(context.WithoutCancel(ctx), bucket, key)
+	if err != nil {
+		logger.WarnContext(ctx, "unable to remove hefty message of message which was not sent", "bucket", bucket, "key", key, "error", err)
+	}
+}
+
+// Backlog returns the number of messages waiting in the outbox selected with `Outbox`.
+func (wrapper *SqsClientWrapper) Backlog() int {
+	if wrapper.outbox == nil {
+		return 0
+	}
+
+	return wrapper.outbox.backlog()
+}
+
+// Drain sends all messages waiting in the outbox selected with `Outbox`. An error is returned if messages remain
+// when `ctx` is done.
+func (wrapper *SqsClientWrapper) Drain(ctx context.Context) error {
+	if wrapper.outbox == nil {
+		return nil
+	}
+
+	return wrapper.outbox.drain(ctx)
+}
+
+func (wrapper *SqsClientWrapper) newOutboxEntry(params *sqs.SendMessageInput) (*outboxEntry, error) {
+	serialized, err := serializeOutboxMessage(params.MessageBody, messages.MapFromSqsMessageAttributeValues(params.MessageAttributes))
+	if err != nil {
+		return nil, err
+	}
+
+	input := *params
+	input.MessageBody = nil
+	input.MessageAttributes = nil
+
+	return &outboxEntry{SqsInput: &input, Message: serialized}, nil
+}
+
+func (wrapper *SqsClientWrapper) sendOutboxEntry(ctx context.Context, entry *outboxEntry) error {
+	if entry.SqsInput == nil {
+		return errors.New("outbox entry is not for AWS SQS")
+	}
+
+	msg, err := messages.DeserializeHeftyMessage(entry.Message)
+	if err != nil {
+		return fmt.Errorf("unable to decode outbox entry into hefty message type. %w", err)
+	}
+
+	input := *entry.SqsInput
+	input.MessageBody = msg.Body
+	if len(msg.MessageAttributes) > 0 {
+		input.MessageAttributes = messages.MapToSqsMessageAttributeValues(msg.MessageAttributes)
+	}
+
+	_, err = wrapper.sendHeftyMessage(ctx, &input)
+	return err
+}
+
+// Backlog returns the number of messages waiting in the outbox selected with `Outbox`.
+func (wrapper *SnsClientWrapper) Backlog() int {
+	if wrapper.outbox == nil {
+		return 0
+	}
+
+	return wrapper.outbox.backlog()
+}
+
+// Drain sends all messages waiting in the outbox selected with `Outbox`. An error is returned if messages remain
+// when `ctx` is done.
+func (wrapper *SnsClientWrapper) Drain(ctx context.Context) error {
+	if wrapper.outbox == nil {
+		return nil
+	}
+
+	return wrapper.outbox.drain(ctx)
+}
+
+// Close stops sending messages from the outbox selected with `Outbox` in the background and sends the messages
+// which are still waiting. The wrapper should not be used to publish messages after Close has been called.
+func (wrapper *SnsClientWrapper) Close(ctx context.Context) error {
+	if wrapper.outbox == nil {
+		return nil
+	}
+
+	return wrapper.outbox.close(ctx)
+}
+
+func (wrapper *SnsClientWrapper) newOutboxEntry(params *sns.PublishInput) (*outboxEntry, error) {
+	serialized, err := serializeOutboxMessage(params.Message, messages.MapFromSnsMessageAttributeValues(params.MessageAttributes))
+	if err != nil {
+		return nil, err
+	}
+
+	input := *params
+	input.Message = nil
+	input.MessageAttributes = nil
+
+	return &outboxEntry{SnsInput: &input, Message: serialized}, nil
+}
+
+func (wrapper *SnsClientWrapper) sendOutboxEntry(ctx context.Context, entry *outboxEntry) error {
+	if entry.SnsInput == nil {
+		return errors.New("outbox entry is not for AWS SNS")
+	}
+
+	msg, err := messages.DeserializeHeftyMessage(entry.Message)
+	if err != nil {
+		return fmt.Errorf("unable to decode outbox entry into hefty message type. %w", err)
+	}
+
+	input := *entry.SnsInput
+	input.Message = msg.Body
+	if len(msg.MessageAttributes) > 0 {
+		input.MessageAttributes = messages.MapToSnsMessageAttributeValues(msg.MessageAttributes)
+	}
+
+	_, err = wrapper.publishHeftyMessage(ctx, &input)
+	return err
+}
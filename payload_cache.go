@@ -0,0 +1,303 @@
+package hefty
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/vinujohn/hefty/internal/messages"
+)
+
+const (
+	defaultCacheMaxBytes     = 64 << 20 // 64MB
+	defaultCacheMaxDiskBytes = 1 << 30  // 1GB
+	cacheFileSuffix          = ".payload"
+	cacheTempSuffix          = ".tmp"
+)
+
+// PayloadCacheConfig determines how many downloaded hefty messages are kept so that a redelivered reference message
+// does not download its hefty message from AWS S3 again.
+type PayloadCacheConfig struct {
+	// MaxBytes is the maximum size of the hefty messages kept in memory. Defaults to 64MB.
+	MaxBytes int64
+	// Dir is an optional directory in which hefty messages are also kept, so that they survive a restart of the consumer.
+	// It is created if it does not exist and must not be shared by several wrappers.
+	Dir string
+	// MaxDiskBytes is the maximum size of the hefty messages kept in Dir. Defaults to 1GB.
+	MaxDiskBytes int64
+}
+
+func (config *PayloadCacheConfig) validate() error {
+	if config.MaxBytes == 0 {
+		config.MaxBytes = defaultCacheMaxBytes
+	}
+	if config.MaxDiskBytes == 0 {
+		config.MaxDiskBytes = defaultCacheMaxDiskBytes
+	}
+	if config.MaxBytes < 0 {
+		return fmt.Errorf("max bytes must not be negative but received %d", config.MaxBytes)
+	}
+	if config.MaxDiskBytes < 0 {
+		return fmt.Errorf("max disk bytes must not be negative but received %d", config.MaxDiskBytes)
+	}
+	return nil
+}
+
+// If selected, hefty messages downloaded by `ReceiveHeftyMessage` are kept in a least recently used cache according to
+// `config`, keyed by their AWS S3 bucket, key, and MD5 digests. A received reference message whose hefty message is
+// cached is not downloaded again, and `DeleteHeftyMessage` removes the hefty message from the cache. Only valid for the
+// SQS client wrapper.
+func PayloadCache(config PayloadCacheConfig) Option {
+	return func(opts *options) error {
+		if err := config.validate(); err != nil {
+			return err
+		}
+		opts.payloadCache = &config
+		return nil
+	}
+}
+
+// payloadCache is a least recently used cache of hefty messages in memory and optionally on disk. The methods of a nil
+// cache do nothing.
+type payloadCache struct {
+	mu     sync.Mutex
+	memory *lruIndex
+	disk   *lruIndex // nil without a directory
+	dir    string
+}
+
+// cacheEntry is an entry of a lruIndex. `payload` is only set for entries in memory.
+type cacheEntry struct {
+	name    string
+	digest  string
+	size    int64
+	payload []byte
+}
+
+// lruIndex tracks entries by name from most to least recently used.
+type lruIndex struct {
+	maxBytes int64
+	size     int64
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+func newLruIndex(maxBytes int64) *lruIndex {
+	return &lruIndex{
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (index *lruIndex) get(name string) (*cacheEntry, bool) {
+	elem, ok := index.entries[name]
+	if !ok {
+		return nil, false
+	}
+	index.order.MoveToFront(elem)
+
+	return elem.Value.(*cacheEntry), true
+}
+
+// add adds `entry` as the most recently used entry, replacing an entry of the same name, and returns the entries
+// evicted to make room for it.
+func (index *lruIndex) add(entry *cacheEntry) []*cacheEntry {
+	index.remove(entry.name)
+	index.entries[entry.name] = index.order.PushFront(entry)
+	index.size += entry.size
+
+	var evicted []*cacheEntry
+	for index.size > index.maxBytes {
+		last := index.order.Back().Value.(*cacheEntry)
+		evicted = append(evicted, index.remove(last.name)...)
+	}
+
+	return evicted
+}
+
+func (index *lruIndex) remove(name string) []*cacheEntry {
+	elem, ok := index.entries[name]
+	if !ok {
+		return nil
+	}
+	index.order.Remove(elem)
+	delete(index.entries, name)
+	entry := elem.Value.(*cacheEntry)
+	index.size -= entry.size
+
+	return []*cacheEntry{entry}
+}
+
+func newPayloadCache(config PayloadCacheConfig) (*payloadCache, error) {
+	cache := &payloadCache{
+		memory: newLruIndex(config.MaxBytes),
+		dir:    config.Dir,
+	}
+	if config.Dir == "" {
+		return cache, nil
+	}
+
+	err := os.MkdirAll(config.Dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create payload cache directory. %w", err)
+	}
+	cache.disk = newLruIndex(config.MaxDiskBytes)
+
+	// keep the hefty messages cached by a previous run, least recently used first
+	files, err := os.ReadDir(config.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read payload cache directory. %w", err)
+	}
+	var entries []os.FileInfo
+	for _, file := range files {
+		switch {
+		case strings.HasSuffix(file.Name(), cacheTempSuffix):
+			os.Remove(filepath.Join(config.Dir, file.Name()))
+		case strings.HasSuffix(file.Name(), cacheFileSuffix):
+			if info, err := file.Info(); err == nil {
+				entries = append(entries, info)
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+	for _, info := range entries {
+		name := strings.TrimSuffix(info.Name(), cacheFileSuffix)
+		cache.removeFiles(cache.disk.add(&cacheEntry{name: name, size: info.Size()}))
+	}
+
+	return cache, nil
+}
+
+// cacheName returns the name of the hefty message `key` in `bucket` in the cache.
+func cacheName(bucket, key string) string {
+	hash := sha256.Sum256([]byte(bucket + "/" + key))
+	return hex.EncodeToString(hash[:])
+}
+
+// cacheDigest identifies the content of the hefty message of `refMsg`.
+func cacheDigest(refMsg *messages.ReferenceMsg) string {
+	return refMsg.Md5DigestMsgBody + "." + refMsg.Md5DigestMsgAttr
+}
+
+// get returns a copy of the hefty message of `refMsg` if it is cached.
+func (cache *payloadCache) get(refMsg *messages.ReferenceMsg) ([]byte, bool) {
+	if cache == nil {
+		return nil, false
+	}
+
+	name, digest := cacheName(refMsg.S3Bucket, refMsg.S3Key), cacheDigest(refMsg)
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if entry, ok := cache.memory.get(name); ok && entry.digest == digest {
+		return bytes.Clone(entry.payload), true
+	}
+
+	if cache.disk == nil {
+		return nil, false
+	}
+	if _, ok := cache.disk.get(name); !ok {
+		return nil, false
+	}
+	payload, err := cache.readFile(name, digest)
+	if err != nil {
+		return nil, false
+	}
+	if size := int64(len(payload)); size <= cache.memory.maxBytes {
+		cache.memory.add(&cacheEntry{name: name, digest: digest, size: size, payload: payload})
+	}
+
+	return bytes.Clone(payload), true
+}
+
+// put adds a copy of `payload`, the hefty message of `refMsg`, to the cache.
+func (cache *payloadCache) put(refMsg *messages.ReferenceMsg, payload []byte) {
+	if cache == nil {
+		return
+	}
+
+	name, digest := cacheName(refMsg.S3Bucket, refMsg.S3Key), cacheDigest(refMsg)
+	size := int64(len(payload))
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if size <= cache.memory.maxBytes {
+		cache.memory.add(&cacheEntry{name: name, digest: digest, size: size, payload: bytes.Clone(payload)})
+	}
+
+	if cache.disk != nil && size <= cache.disk.maxBytes {
+		if err := cache.writeFile(name, digest, payload); err != nil {
+			cache.removeFiles(cache.disk.remove(name))
+			return
+		}
+		cache.removeFiles(cache.disk.add(&cacheEntry{name: name, size: size}))
+	}
+}
+
+// evict removes the hefty message `key` in `bucket` from the cache.
+func (cache *payloadCache) evict(bucket, key string) {
+	if cache == nil {
+		return
+	}
+
+	name := cacheName(bucket, key)
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.memory.remove(name)
+	if cache.disk != nil {
+		cache.removeFiles(cache.disk.remove(name))
+	}
+}
+
+// A cache file holds the digest of the hefty message on its first line followed by the hefty message.
+
+func (cache *payloadCache) writeFile(name, digest string, payload []byte) error {
+	file := filepath.Join(cache.dir, name+cacheFileSuffix)
+	tmp := file + cacheTempSuffix
+
+	data := make([]byte, 0, len(digest)+1+len(payload))
+	data = append(data, digest...)
+	data = append(data, '\n')
+	data = append(data, payload...)
+	err := os.WriteFile(tmp, data, 0o600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+func (cache *payloadCache) readFile(name, digest string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(cache.dir, name+cacheFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	header, payload, ok := bytes.Cut(data, []byte{'\n'})
+	if !ok || string(header) != digest {
+		return nil, errors.New("cached hefty message does not match")
+	}
+
+	return payload, nil
+}
+
+func (cache *payloadCache) removeFiles(entries []*cacheEntry) {
+	for _, entry := range entries {
+		os.Remove(filepath.Join(cache.dir, entry.name+cacheFileSuffix))
+	}
+}
@@ -0,0 +1,163 @@
+package hefty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+const (
+	maxDeleteObjectsBatchSize  = 1000 // s3 limit
+	defaultDeleteFlushInterval = time.Second
+)
+
+// AsyncDeletionConfig determines how hefty messages are removed from AWS S3 in the background.
+type AsyncDeletionConfig struct {
+	// BatchSize is the number of objects which triggers a delete before FlushInterval has passed. Defaults to 1000,
+	// which is also the maximum.
+	BatchSize int
+	// FlushInterval is the maximum time an object waits before it is deleted. Defaults to 1 second.
+	FlushInterval time.Duration
+	// OnError is called for each object which could not be deleted. Objects which could not be deleted are not retried
+	// and should be expired with an S3 lifecycle rule.
+	OnError func(bucket, key string, err error)
+}
+
+// payloadDeleter batches deletes of objects in AWS S3 and performs them in the background with DeleteObjects.
+type payloadDeleter struct {
+	store  *payloadStore
+	config AsyncDeletionConfig
+
+	mu      sync.Mutex
+	pending map[string][]string // bucket -> keys
+	count   int
+
+	flush    chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func newPayloadDeleter(store *payloadStore, config AsyncDeletionConfig) *payloadDeleter {
+	deleter := &payloadDeleter{
+		store:   store,
+		config:  config,
+		pending: make(map[string][]string),
+		flush:   make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	go deleter.run()
+
+	return deleter
+}
+
+func (config *AsyncDeletionConfig) validate() error {
+	if config.BatchSize == 0 {
+		config.BatchSize = maxDeleteObjectsBatchSize
+	}
+	if config.FlushInterval == 0 {
+		config.FlushInterval = defaultDeleteFlushInterval
+	}
+	if config.BatchSize < 0 || config.BatchSize > maxDeleteObjectsBatchSize {
+		return fmt.Errorf("batch size must be between 1 and %d but received %d", maxDeleteObjectsBatchSize, config.BatchSize)
+	}
+	if config.FlushInterval < 0 {
+		return fmt.Errorf("flush interval must not be negative but received %v", config.FlushInterval)
+	}
+	return nil
+}
+
+// enqueue schedules objects in `bucket` to be deleted.
+func (deleter *payloadDeleter) enqueue(bucket string, keys ...string) {
+	deleter.mu.Lock()
+	deleter.pending[bucket] = append(deleter.pending[bucket], keys...)
+	deleter.count += len(keys)
+	full := deleter.count >= deleter.config.BatchSize
+	deleter.mu.Unlock()
+
+	if full {
+		select {
+		case deleter.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (deleter *payloadDeleter) run() {
+	defer close(deleter.done)
+
+	ticker := time.NewTicker(deleter.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-deleter.stop:
+			return
+		case <-ticker.C:
+		case <-deleter.flush:
+		}
+		_ = deleter.deletePending(context.Background())
+	}
+}
+
+// deletePending deletes all objects which are currently scheduled. Objects which could not be deleted are reported
+// to the OnError function and returned as a single error.
+func (deleter *payloadDeleter) deletePending(ctx context.Context) error {
+	deleter.mu.Lock()
+	pending := deleter.pending
+	deleter.pending = make(map[string][]string)
+	deleter.count = 0
+	deleter.mu.Unlock()
+
+	var errs []error
+	for bucket, keys := range pending {
+		for start := 0; start < len(keys); start += maxDeleteObjectsBatchSize {
+			end := min(start+maxDeleteObjectsBatchSize, len(keys))
+			errs = append(errs, deleter.deleteBatch(ctx, bucket, keys[start:end])...)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (deleter *payloadDeleter) deleteBatch(ctx context.Context, bucket string, keys []string) []error {
+	failed, err := deleter.store.deleteObjects(ctx, bucket, keys)
+	if err != nil {
+		err = fmt.Errorf("could not delete s3 objects for hefty messages. %w", err)
+		for _, key := range keys {
+			deleter.reportError(bucket, key, err)
+		}
+		return []error{err}
+	}
+
+	var errs []error
+	for _, e := range failed {
+		err = fmt.Errorf("could not delete s3 object for hefty message. %w", deleteError(bucket, e))
+		deleter.reportError(bucket, aws.ToString(e.Key), err)
+		errs = append(errs, err)
+	}
+
+	return errs
+}
+
+func (deleter *payloadDeleter) reportError(bucket, key string, err error) {
+	if deleter.config.OnError != nil {
+		deleter.config.OnError(bucket, key, err)
+	}
+}
+
+// close stops deleting in the background and deletes all objects which are still scheduled.
+func (deleter *payloadDeleter) close(ctx context.Context) error {
+	deleter.stopOnce.Do(func() {
+		close(deleter.stop)
+	})
+	<-deleter.done
+
+	return deleter.deletePending(ctx)
+}
@@ -0,0 +1,217 @@
+package hefty
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	s3manager "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// payloadStore performs the AWS S3 operations used by the client wrappers to store hefty messages.
+type payloadStore struct {
+	wrapper     string // "sqs" or "sns", for metrics
+	s3Client    *s3.Client
+	uploader    *s3manager.Uploader
+	downloader  *s3manager.Downloader
+	retryPolicy *RetryPolicy
+	breaker     *circuitBreaker
+	metrics     Metrics
+
+	checksumAlgorithm s3Types.ChecksumAlgorithm
+	contentAddressing *ContentAddressingConfig
+	presignExpiry     time.Duration
+	httpClient        *http.Client
+}
+
+func newPayloadStore(wrapper string, s3Client *s3.Client, opts *options, logger *logger) *payloadStore {
+	store := &payloadStore{
+		wrapper:    wrapper,
+		s3Client:   s3Client,
+		uploader:   s3manager.NewUploader(s3Client, opts.uploaderOptions...),
+		downloader: s3manager.NewDownloader(s3Client, opts.downloaderOptions...),
+		metrics:    metricsOrNop(opts.metrics),
+
+		checksumAlgorithm: opts.checksumAlgorithm,
+		contentAddressing: opts.contentAddressing,
+		presignExpiry:     opts.presignExpiry,
+		httpClient:        opts.httpClient,
+	}
+	if opts.retryPolicy != nil {
+		policy := *opts.retryPolicy
+		policy.OnRetry = logger.onRetry(policy.OnRetry)
+		store.retryPolicy = &policy
+	}
+	if opts.circuitBreaker != nil {
+		config := *opts.circuitBreaker
+		config.OnStateChange = logger.onStateChange(config.OnStateChange)
+		store.breaker = newCircuitBreaker(config)
+	}
+
+	return store
+}
+
+// do performs an operation, retrying it if a retry policy is set. Each attempt passes through the circuit breaker if set.
+func (store *payloadStore) do(ctx context.Context, op string, fn func() error) error {
+	timed := func() error {
+		start := time.Now()
+		err := fn()
+		store.metrics.S3Operation(store.wrapper, op, time.Since(start), err)
+		return err
+	}
+
+	attempt := timed
+	if store.breaker != nil {
+		attempt = func() error {
+			return store.breaker.call(timed)
+		}
+	}
+
+	if store.retryPolicy == nil {
+		return attempt()
+	}
+
+	return store.retryPolicy.do(ctx, op, attempt)
+}
+
+// wrapError wraps an error of an operation on an object in a PayloadStoreError.
+func wrapError(op, bucket, key string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &PayloadStoreError{Op: op, Bucket: bucket, Key: key, Err: err}
+}
+
+// state returns the state of the circuit breaker, which is always closed when no circuit breaker is set.
+func (store *payloadStore) state() CircuitState {
+	if store.breaker == nil {
+		return CircuitClosed
+	}
+
+	return store.breaker.currentState()
+}
+
+func (store *payloadStore) upload(ctx context.Context, bucket, key string, data []byte) error {
+	err := store.do(ctx, "upload", func() error {
+		_, err := store.uploader.Upload(ctx, &s3.PutObjectInput{
+			Bucket:            aws.String(bucket),
+			Key:               aws.String(key),
+			Body:              bytes.NewReader(data),
+			ChecksumAlgorithm: store.checksumAlgorithm,
+		})
+		return err
+	})
+
+	return wrapError("upload", bucket, key, err)
+}
+
+func (store *payloadStore) download(ctx context.Context, bucket, key string) ([]byte, error) {
+	var data []byte
+	err := store.do(ctx, "download", func() error {
+		buf := s3manager.NewWriteAtBuffer([]byte{})
+		input := &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		}
+		if store.checksumAlgorithm != "" {
+			input.ChecksumMode = s3Types.ChecksumModeEnabled
+		}
+		_, err := store.downloader.Download(ctx, buf, input)
+		data = buf.Bytes()
+		return err
+	})
+
+	return data, wrapError("download", bucket, key, err)
+}
+
+func (store *payloadStore) delete(ctx context.Context, bucket, key string) error {
+	err := store.do(ctx, "delete", func() error {
+		_, err := store.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	})
+
+	return wrapError("delete", bucket, key, err)
+}
+
+// deleteObjects deletes up to 1000 objects with a single request. Objects which could not be deleted are returned.
+func (store *payloadStore) deleteObjects(ctx context.Context, bucket string, keys []string) ([]s3Types.Error, error) {
+	objects := make([]s3Types.ObjectIdentifier, len(keys))
+	for i := range keys {
+		objects[i] = s3Types.ObjectIdentifier{Key: aws.String(keys[i])}
+	}
+
+	var failed []s3Types.Error
+	err := store.do(ctx, "delete", func() error {
+		out, err := store.s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &s3Types.Delete{
+				Objects: objects,
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if err == nil {
+			failed = out.Errors
+		}
+		return err
+	})
+
+	return failed, wrapError("delete", bucket, strings.Join(keys, ","), err)
+}
+
+// putMarker creates an empty object.
+func (store *payloadStore) putMarker(ctx context.Context, bucket, key string) error {
+	err := store.do(ctx, "put", func() error {
+		_, err := store.s3Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+			Body:   strings.NewReader(""),
+		})
+		return err
+	})
+
+	return wrapError("put", bucket, key, err)
+}
+
+// listKeys returns the keys of all objects starting with `prefix`.
+func (store *payloadStore) listKeys(ctx context.Context, bucket, prefix string) ([]string, error) {
+	var keys []string
+	err := store.do(ctx, "list", func() error {
+		keys = nil
+		paginator := s3.NewListObjectsV2Paginator(store.s3Client, &s3.ListObjectsV2Input{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(prefix),
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return err
+			}
+			for _, obj := range page.Contents {
+				keys = append(keys, aws.ToString(obj.Key))
+			}
+		}
+		return nil
+	})
+
+	return keys, wrapError("list", bucket, prefix, err)
+}
+
+// deleteError converts an object which could not be deleted into an error.
+func deleteError(bucket string, failed s3Types.Error) error {
+	return &PayloadStoreError{
+		Op:     "delete",
+		Bucket: bucket,
+		Key:    aws.ToString(failed.Key),
+		Err:    fmt.Errorf("%s. %s", aws.ToString(failed.Code), aws.ToString(failed.Message)),
+	}
+}
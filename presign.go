@@ -0,0 +1,197 @@
+package hefty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/vinujohn/hefty/internal/messages"
+)
+
+const (
+	// maxPresignExpiry is the longest expiry of a presigned url allowed by AWS S3.
+	maxPresignExpiry = 7 * 24 * time.Hour
+	// maxFetchLengthBytes is the largest hefty message fetched with a presigned url. Hefty messages as stored in AWS S3 are
+	// slightly larger than MaxHeftyMessageLengthBytes because of the lengths and types of their fields.
+	maxFetchLengthBytes = MaxHeftyMessageLengthBytes + 1<<20
+)
+
+// If selected, reference messages also contain a presigned url which allows getting the hefty message from AWS S3 with
+// a plain HTTP GET request for `expiry`, so that subscribers without access to the bucket, such as HTTP endpoints of
+// AWS SNS, can receive hefty messages. The expiry must be at most 7 days and is also limited by the lifetime of the
+// credentials of the S3 client. Anyone holding the reference message can get the hefty message until the url expires.
+func PresignedURLs(expiry time.Duration) Option {
+	return func(opts *options) error {
+		if expiry <= 0 || expiry > maxPresignExpiry {
+			return fmt.Errorf("presigned url expiry must be greater than 0 and at most %v but received %v", maxPresignExpiry, expiry)
+		}
+		opts.presignExpiry = expiry
+		return nil
+	}
+}
+
+// If selected, `ReceiveHeftyMessage` gets the hefty messages of reference messages which only contain a presigned url
+// with `client`, which may be http.DefaultClient. Only presigned urls of objects in the bucket of the wrapper at the
+// endpoint of its S3 client are fetched, so that senders cannot make receivers send requests to other hosts. Without this
+// option, such reference messages are received as error messages.
+func HTTPClient(client *http.Client) Option {
+	return func(opts *options) error {
+		if client == nil {
+			return errors.New("http client is nil")
+		}
+		opts.httpClient = client
+		return nil
+	}
+}
+
+// presign returns a presigned url of an object, or an empty string if presigned urls are not selected.
+func (store *payloadStore) presign(ctx context.Context, bucket, key string) (string, error) {
+	if store.presignExpiry == 0 {
+		return "", nil
+	}
+
+	// presigning does not send a request to AWS S3 and so bypasses the retry policy and circuit breaker
+	start := time.Now()
+	req, err := s3.NewPresignClient(store.s3Client, s3.WithPresignExpires(store.presignExpiry)).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	store.metrics.S3Operation(store.wrapper, "presign", time.Since(start), err)
+	if err != nil {
+		return "", wrapError("presign", bucket, key, err)
+	}
+
+	return req.URL, nil
+}
+
+// get gets the hefty message of `refMsg`, from AWS S3 if the reference message contains a bucket and key and otherwise
+// from its presigned url, which must be a url of an object in `bucket`.
+func (store *payloadStore) get(ctx context.Context, bucket string, refMsg *messages.ReferenceMsg) ([]byte, error) {
+	if refMsg.HasObject() {
+		return store.download(ctx, refMsg.S3Bucket, refMsg.S3Key)
+	}
+
+	if store.httpClient == nil {
+		return nil, wrapError("fetch", "", redactUrl(refMsg.PresignedUrl), errors.New("presigned urls are only fetched with the HTTPClient option"))
+	}
+	err := store.checkPresignedUrl(ctx, bucket, refMsg.PresignedUrl)
+	if err != nil {
+		return nil, wrapError("fetch", "", redactUrl(refMsg.PresignedUrl), err)
+	}
+
+	var data []byte
+	err = store.do(ctx, "fetch", func() (err error) {
+		data, err = fetch(ctx, store.httpClient, refMsg.PresignedUrl)
+		return err
+	})
+
+	return data, wrapError("fetch", "", redactUrl(refMsg.PresignedUrl), err)
+}
+
+// checkPresignedUrl checks that `presignedUrl` is a url of an object in `bucket` at the endpoint of the S3 client.
+func (store *payloadStore) checkPresignedUrl(ctx context.Context, bucket, presignedUrl string) error {
+	u, err := url.Parse(presignedUrl)
+	if err != nil {
+		return errors.New("unable to parse presigned url")
+	}
+
+	// the url of the bucket is determined by presigning a url of an object in it, which does not send a request
+	const probeKey = "key"
+	req, err := s3.NewPresignClient(store.s3Client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(probeKey),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to determine url of bucket %s. %w", bucket, err)
+	}
+	bucketUrl, err := url.Parse(req.URL)
+	if err != nil {
+		return fmt.Errorf("unable to determine url of bucket %s. %w", bucket, err)
+	}
+	bucketPath := strings.TrimSuffix(bucketUrl.Path, probeKey)
+
+	if u.Scheme != bucketUrl.Scheme || u.User != nil || !strings.EqualFold(u.Host, bucketUrl.Host) ||
+		!strings.HasPrefix(path.Clean(u.Path), bucketPath) {
+		return fmt.Errorf("presigned url is not a url of an object in bucket %s", bucket)
+	}
+
+	return nil
+}
+
+// fetch gets an object from AWS S3 with its presigned url. An object which does not exist is reported as an
+// s3 types.NoSuchKey error, including the 403 status AWS S3 responds with when the signer of the url may not list the
+// bucket. Objects larger than maxFetchLengthBytes are not read.
+func fetch(ctx context.Context, client *http.Client, presignedUrl string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, presignedUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create request. %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// the error of the http client contains the url and so its signature
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("unable to get presigned url. %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxFetchLengthBytes+1))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read presigned url. %w", err)
+		} else if len(data) > maxFetchLengthBytes {
+			return nil, fmt.Errorf("%w. hefty message of presigned url is greater than %d bytes", ErrMessageTooLarge, maxFetchLengthBytes)
+		}
+		return data, nil
+	case http.StatusNotFound, http.StatusForbidden:
+		return nil, &s3Types.NoSuchKey{Message: aws.String(resp.Status)}
+	default:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
+
+// redactUrl removes the query, which holds the signature, from a presigned url.
+func redactUrl(presignedUrl string) string {
+	u, err := url.Parse(presignedUrl)
+	if err != nil {
+		return ""
+	}
+	u.RawQuery = ""
+
+	return u.String()
+}
+
+// FetchHeftyMessage gets the hefty message of a reference message with the presigned url it contains, for example when
+// the reference message was delivered to an HTTP endpoint by AWS SNS. `client` may be nil to use http.DefaultClient.
+// The MD5 digest of the body of the hefty message is checked against the reference message.
+func FetchHeftyMessage(ctx context.Context, client *http.Client, referenceMsg string) (*HeftyMessage, error) {
+	refMsg, err := messages.ToReferenceMsg(referenceMsg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal reference message. %w", err)
+	} else if refMsg.PresignedUrl == "" {
+		return nil, errors.New("reference message does not contain a presigned url")
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	data, err := fetch(ctx, client, refMsg.PresignedUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	return DecodeHeftyMessage(data, refMsg)
+}
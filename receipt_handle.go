@@ -0,0 +1,79 @@
+package hefty
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	receiptHandlePrefix = "c976bb5ff9634b1ea7f69fd2390e3fef" // text used to differentiate a receipt handle belonging to a hefty message
+)
+
+// heftyReceiptHandle is the information encoded in the receipt handle of a hefty message returned by ReceiveHeftyMessage.
+type heftyReceiptHandle struct {
+	receiptHandle string // the real AWS SQS receipt handle
+	s3Bucket      string
+	s3Key         string
+
+	// deletion behavior of the hefty message in AWS S3 as set by the sender
+	subscriberCount int
+	retainPayload   bool
+}
+
+const retainPayloadToken = "retain"
+
+func (h *heftyReceiptHandle) encode() string {
+	receiptHandle := fmt.Sprintf("%s|%s|%s|%s", receiptHandlePrefix, h.receiptHandle, h.s3Bucket, h.s3Key)
+
+	// deletion behavior is only added when it differs from the default
+	if h.retainPayload {
+		receiptHandle += "|" + retainPayloadToken
+	} else if h.subscriberCount > 1 {
+		receiptHandle += "|" + strconv.Itoa(h.subscriberCount)
+	}
+
+	return base64.StdEncoding.EncodeToString([]byte(receiptHandle))
+}
+
+// decodeReceiptHandle decodes a receipt handle created by ReceiveHeftyMessage. If `receiptHandle` does not belong
+// to a hefty message, false is returned.
+func decodeReceiptHandle(receiptHandle string) (*heftyReceiptHandle, bool, error) {
+	const minHeftyReceiptHandleTokenCount, maxHeftyReceiptHandleTokenCount = 4, 5
+
+	// decode receipt handle
+	decoded, err := base64.StdEncoding.DecodeString(receiptHandle)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w. could not decode receipt handle. %w", ErrInvalidReceiptHandle, err)
+	}
+	decodedStr := string(decoded)
+
+	// check if decoded receipt handle is for a hefty message
+	if !strings.HasPrefix(decodedStr, receiptHandlePrefix) {
+		return nil, false, nil
+	}
+
+	// get tokens from receipt handle
+	tokens := strings.Split(decodedStr, "|")
+	if len(tokens) < minHeftyReceiptHandleTokenCount || len(tokens) > maxHeftyReceiptHandleTokenCount {
+		return nil, false, fmt.Errorf("%w. expected number of tokens (%d to %d) not available in receipt handle", ErrInvalidReceiptHandle, minHeftyReceiptHandleTokenCount, maxHeftyReceiptHandleTokenCount)
+	}
+
+	ret := &heftyReceiptHandle{
+		receiptHandle: tokens[1],
+		s3Bucket:      tokens[2],
+		s3Key:         tokens[3],
+	}
+
+	// get deletion behavior
+	if len(tokens) == maxHeftyReceiptHandleTokenCount {
+		if tokens[4] == retainPayloadToken {
+			ret.retainPayload = true
+		} else if ret.subscriberCount, err = strconv.Atoi(tokens[4]); err != nil {
+			return nil, false, fmt.Errorf("%w. could not parse subscriber count in receipt handle. %w", ErrInvalidReceiptHandle, err)
+		}
+	}
+
+	return ret, true, nil
+}
@@ -0,0 +1,45 @@
+package hefty
+
+import (
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/vinujohn/hefty/internal/messages"
+)
+
+// ReferenceMsgAttribute is a reserved message attribute set on every reference message. It flags a message as a reference
+// message and holds the size in bytes of the hefty message stored in AWS S3. Tools other than Hefty which create reference
+// messages can set this attribute so that their messages are recognized by `ReceiveHeftyMessage`, in which case the message
+// body only needs to be a JSON object with the fields "s3_bucket" and "s3_key".
+const ReferenceMsgAttribute = "hefty-reference-msg-size"
+
+// referenceMsgAttributes returns the message attributes which are set on a reference message of `refMsgSize` bytes for a
+// hefty message of `msgSize` bytes. These are the reserved attributes, including `reserved`, along with the attributes
+// selected by `keep` which fit within the AWS limits for message attributes and message size.
+func referenceMsgAttributes(msgAttr map[string]messages.MessageAttributeValue, keep func(name string) bool, refMsgSize, msgSize int, reserved map[string]messages.MessageAttributeValue) map[string]messages.MessageAttributeValue {
+	ret := map[string]messages.MessageAttributeValue{
+		ReferenceMsgAttribute: {
+			DataType:    aws.String("Number"),
+			StringValue: aws.String(strconv.Itoa(msgSize)),
+		},
+	}
+	for k, v := range reserved {
+		ret[k] = v
+	}
+
+	if keep == nil || len(msgAttr) == 0 {
+		return ret
+	}
+
+	reservedSize, _ := messages.MessageSize(nil, ret)
+	kept := messages.SelectMessageAttributes(msgAttr, func(name string) bool {
+		_, reserved := ret[name]
+		return !reserved && keep(name)
+	}, maxAwsMessageAttributeCount-len(ret), MaxAwsMessageLengthBytes-refMsgSize-reservedSize)
+
+	for k, v := range kept {
+		ret[k] = v
+	}
+
+	return ret
+}
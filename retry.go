@@ -0,0 +1,129 @@
+package hefty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	defaultRetryMaxAttempts    = 3
+	defaultRetryInitialBackoff = 200 * time.Millisecond
+	defaultRetryMaxBackoff     = 5 * time.Second
+)
+
+// RetryPolicy determines how AWS S3 operations performed by the client wrappers are retried. These retries are in addition
+// to the retries performed by the AWS S3 client for individual requests and cover entire operations, such as a multipart upload.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts for an operation, including the first. Defaults to 3.
+	MaxAttempts int
+	// InitialBackoff is the upper bound of the wait before the first retry. The bound doubles with every retry. Defaults to 200ms.
+	InitialBackoff time.Duration
+	// MaxBackoff is the maximum upper bound of the wait between retries. Defaults to 5s.
+	MaxBackoff time.Duration
+	// Retryable determines whether an error can be retried. Defaults to IsRetryableError.
+	Retryable func(err error) bool
+	// OnRetry is called before each retry with the name of the operation, the number of the attempt which failed, and its error.
+	OnRetry func(op string, attempt int, err error)
+}
+
+func (policy *RetryPolicy) validate() error {
+	if policy.MaxAttempts == 0 {
+		policy.MaxAttempts = defaultRetryMaxAttempts
+	}
+	if policy.InitialBackoff == 0 {
+		policy.InitialBackoff = defaultRetryInitialBackoff
+	}
+	if policy.MaxBackoff == 0 {
+		policy.MaxBackoff = defaultRetryMaxBackoff
+	}
+	if policy.Retryable == nil {
+		policy.Retryable = IsRetryableError
+	}
+	if policy.MaxAttempts < 1 {
+		return fmt.Errorf("max attempts must be greater than 0 but received %d", policy.MaxAttempts)
+	}
+	if policy.InitialBackoff < 0 || policy.MaxBackoff < policy.InitialBackoff {
+		return fmt.Errorf("backoff must be between 0 and max backoff of %v but received %v", policy.MaxBackoff, policy.InitialBackoff)
+	}
+	return nil
+}
+
+// If selected, AWS S3 operations used to send, receive, and delete hefty messages are retried according to `policy`.
+func S3RetryPolicy(policy RetryPolicy) Option {
+	return func(opts *options) error {
+		if err := policy.validate(); err != nil {
+			return err
+		}
+		opts.retryPolicy = &policy
+		return nil
+	}
+}
+
+// do calls `fn` until it succeeds, returns an error which cannot be retried, or the maximum number of attempts is reached.
+// Retries stop early if waiting for the next attempt would pass the deadline of `ctx`.
+func (policy *RetryPolicy) do(ctx context.Context, op string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= policy.MaxAttempts || !policy.Retryable(err) {
+			return err
+		}
+
+		// exponential backoff with full jitter
+		backoff := policy.InitialBackoff << (attempt - 1)
+		if backoff > policy.MaxBackoff || backoff <= 0 {
+			backoff = policy.MaxBackoff
+		}
+		wait := time.Duration(rand.Int63n(int64(backoff) + 1))
+
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return err
+		}
+
+		if policy.OnRetry != nil {
+			policy.OnRetry(op, attempt, err)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// IsRetryableError determines whether an error returned by AWS S3 is transient and the operation can be retried. Errors that
+// the AWS SDK considers retryable, such as throttling, server errors, and connection errors, are retryable along with errors
+// reading a response body and the AWS S3 error code "InternalError". Cancelled contexts are never retried.
+func IsRetryableError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary {
+		return true
+	}
+
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var apiError smithy.APIError
+	if errors.As(err, &apiError) {
+		switch apiError.ErrorCode() {
+		case "InternalError", "ServiceUnavailable":
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,61 +1,89 @@
 package hefty
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
-	"strings"
+	"sync"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	s3manager "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/sns"
 	"github.com/google/uuid"
 	"github.com/vinujohn/hefty/internal/messages"
 	"github.com/vinujohn/hefty/internal/utils"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type SnsClientWrapper struct {
 	sns.Client
 	bucket         string
-	s3Client       *s3.Client
-	uploader       *s3manager.Uploader
-	downloader     *s3manager.Downloader
+	store          *payloadStore
 	alwaysSendToS3 bool
+	keepAttribute  func(name string) bool
+
+	bucketValidator *bucketValidator
+
+	fanOutDeleteMode  FanOutDeleteMode
+	subscriberCounter subscriberCounter
+	outbox            *outbox
+	tracer            *tracer
+	metrics           Metrics
+	logger            *logger
+	interceptors      interceptors
+	topicNames        sync.Map // topicArn -> topic name, for arns which do not end with a topic name
 }
 
 // NewSnsClientWrapper will create a new Hefty SNS client wrapper using an existing AWS SNS client and AWS S3 client.
 // This Hefty SNS client wrapper will save large messages greater than MaxSqsSnsMessageLengthBytes to AWS S3 in the
 // bucket that is specified via `bucketName`. The S3 client should have the ability of reading and writing to this bucket.
-// This function will also check if the bucket exists and is accessible.
+// This function will also check if the bucket exists and is accessible unless the `BucketValidation` option is used.
 func NewSnsClientWrapper(snsClient *sns.Client, s3Client *s3.Client, bucketName string, opts ...Option) (*SnsClientWrapper, error) {
-	// check if bucket exits
-	if ok, err := utils.BucketExists(s3Client, bucketName); !ok {
+	return NewSnsClientWrapperWithContext(context.Background(), snsClient, s3Client, bucketName, opts...)
+}
+
+// NewSnsClientWrapperWithContext is the same as NewSnsClientWrapper except that `ctx` is used when checking the bucket.
+// The check can be deferred or skipped with the `BucketValidation` option.
+func NewSnsClientWrapperWithContext(ctx context.Context, snsClient *sns.Client, s3Client *s3.Client, bucketName string, opts ...Option) (*SnsClientWrapper, error) {
+	// process available options
+	var wrapperOptions options
+	for _, opt := range opts {
+		err := opt(&wrapperOptions)
 		if err != nil {
 			return nil, err
 		}
+	}
 
-		return nil, fmt.Errorf("bucket %s does not exist or is not accessible", bucketName)
+	// check if bucket exits
+	bucketValidator, err := newBucketValidator(ctx, s3Client, bucketName, wrapperOptions.bucketValidation)
+	if err != nil {
+		return nil, err
 	}
 
+	// create new wrapper
 	wrapper := &SnsClientWrapper{
-		Client:     *snsClient,
-		bucket:     bucketName,
-		s3Client:   s3Client,
-		uploader:   s3manager.NewUploader(s3Client),
-		downloader: s3manager.NewDownloader(s3Client),
-	}
+		Client: *snsClient,
+		bucket: bucketName,
 
-	// process available options
-	var wrapperOptions options
-	for _, opt := range opts {
-		err := opt(&wrapperOptions)
+		bucketValidator: bucketValidator,
+	}
+	wrapper.logger = newLogger(wrapperOptions.logger, wrapperOptions.logAttributeValues)
+	wrapper.store = newPayloadStore("sns", s3Client, &wrapperOptions, wrapper.logger)
+	wrapper.alwaysSendToS3 = wrapperOptions.alwaysSendToS3
+	wrapper.keepAttribute = wrapperOptions.keepAttribute
+	wrapper.fanOutDeleteMode = wrapperOptions.fanOutDeleteMode
+	wrapper.tracer = newTracer(wrapperOptions.tracing, "aws_sns")
+	wrapper.metrics = metricsOrNop(wrapperOptions.metrics)
+	wrapper.interceptors = wrapperOptions.interceptors
+	if wrapperOptions.outbox != nil {
+		config := *wrapperOptions.outbox
+		config.OnError = wrapper.logger.onOutboxError(config.OnError)
+		outbox, err := newOutbox(config, wrapper.sendOutboxEntry)
 		if err != nil {
 			return nil, err
 		}
+		wrapper.outbox = outbox
 	}
-	wrapper.alwaysSendToS3 = wrapperOptions.alwaysSendToS3
 
 	return wrapper, nil
 }
@@ -70,8 +98,32 @@ func NewSnsClientWrapper(snsClient *sns.Client, s3Client *s3.Client, bucketName
 // Other endpoints like AWS Lambda can use the reference message directly and download the S3 message without using the
 // hefty client.
 //
+// When the `Outbox` option is used, a message which could not be published may be stored to be published later, in which
+// case an empty output without a message id is returned with ErrStoredInOutbox. The message is published later without
+// `optFns`.
+//
 // Note that this function's signature matches that of the AWS SNS SDK's Publish method.
 func (wrapper *SnsClientWrapper) PublishHeftyMessage(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error) {
+	if wrapper.outbox == nil || params == nil || params.Message == nil {
+		return wrapper.publishHeftyMessage(ctx, params, optFns...)
+	}
+
+	var out *sns.PublishOutput
+	err := wrapper.outbox.sendOrStore(func() (err error) {
+		out, err = wrapper.publishHeftyMessage(ctx, params, optFns...)
+		return err
+	}, func() (*outboxEntry, error) {
+		return wrapper.newOutboxEntry(params)
+	})
+	if errors.Is(err, ErrStoredInOutbox) {
+		wrapper.logger.WarnContext(ctx, "message stored in outbox", "destination", aws.ToString(params.TopicArn), "backlog", wrapper.outbox.backlog(), "error", err)
+		return &sns.PublishOutput{}, err
+	}
+
+	return out, err
+}
+
+func (wrapper *SnsClientWrapper) publishHeftyMessage(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (out *sns.PublishOutput, err error) {
 	// input validation; if invalid input let AWS SDK handle it
 	if params == nil ||
 		params.Message == nil ||
@@ -80,67 +132,146 @@ func (wrapper *SnsClientWrapper) PublishHeftyMessage(ctx context.Context, params
 		return wrapper.Publish(ctx, params, optFns...)
 	}
 
+	var msgSize int
+	var offloaded bool
+	var s3Key string
+	var msgAttributes map[string]messages.MessageAttributeValue
+	ctx, span := wrapper.tracer.start(ctx, "send", trace.SpanKindProducer, messagingDestinationKey.String(aws.ToString(params.TopicArn)))
+	defer func() {
+		var messageId *string
+		if out != nil {
+			messageId = out.MessageId
+			span.SetAttributes(messagingMessageIdKey.String(aws.ToString(messageId)))
+		}
+		if err == nil {
+			wrapper.metrics.MessageSent("sns", offloaded, msgSize)
+		}
+		wrapper.logger.sent(ctx, aws.ToString(params.TopicArn), msgSize, offloaded, wrapper.bucket, s3Key, msgAttributes, messageId, err)
+		endSpan(span, err)
+	}()
+
 	// normalize message attributes
-	msgAttributes := messages.MapFromSnsMessageAttributeValues(params.MessageAttributes)
+	msgAttributes = messages.MapFromSnsMessageAttributeValues(params.MessageAttributes)
 
 	// calculate message size
-	msgSize, err := messages.MessageSize(params.Message, msgAttributes)
+	msgSize, err = messages.MessageSize(params.Message, msgAttributes)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get size of message. %v", err)
+		return nil, fmt.Errorf("unable to get size of message. %w", err)
 	}
+	span.SetAttributes(messageSizeKey.Int(msgSize))
+	intercepted := &InterceptedMessage{Wrapper: "sns", Destination: aws.ToString(params.TopicArn)}
 
 	// validate message size
 	if !wrapper.alwaysSendToS3 && msgSize <= MaxAwsMessageLengthBytes {
-		return wrapper.Publish(ctx, params, optFns...)
+		span.SetAttributes(offloadedKey.Bool(false))
+
+		intercepted.Message = messages.NewHeftyMessage(params.Message, msgAttributes, msgSize)
+
+		return wrapper.publish(ctx, params, intercepted, optFns...)
 	} else if msgSize > MaxHeftyMessageLengthBytes {
-		return nil, fmt.Errorf("message size of %d bytes greater than allowed message size of %d bytes", msgSize, MaxHeftyMessageLengthBytes)
+		return nil, fmt.Errorf("%w. message size of %d bytes greater than allowed message size of %d bytes", ErrMessageTooLarge, msgSize, MaxHeftyMessageLengthBytes)
 	}
+	offloaded = true
+	span.SetAttributes(offloadedKey.Bool(true))
 
 	// create and serialize hefty message
-	heftyMsg := messages.NewHeftyMessage(params.Message, msgAttributes, msgSize)
-	serialized, bodyOffset, msgAttrOffset, err := heftyMsg.Serialize()
+	intercepted.Offloaded = true
+	intercepted.Message = messages.NewHeftyMessage(params.Message, msgAttributes, msgSize)
+	serialized, msgBodyHash, msgAttrHash, err := serializeHeftyMessage(ctx, wrapper.tracer, wrapper.interceptors, intercepted)
 	if err != nil {
-		return nil, fmt.Errorf("unable to serialize message. %v", err)
+		return nil, err
 	}
+	heftyMsg := intercepted.Message
 
-	// create md5 digests
-	msgBodyHash := messages.Md5Digest(serialized[bodyOffset:msgAttrOffset])
-	msgAttrHash := ""
-	if len(heftyMsg.MessageAttributes) > 0 {
-		msgAttrHash = messages.Md5Digest(serialized[msgAttrOffset:])
+	// create reference message
+	topicName, err := wrapper.topicName(ctx, params.TopicArn)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create reference message from topicArn. %w", err)
 	}
+	refMsg := newSnsReferenceMessage(topicName, wrapper.bucket, wrapper.Options().Region, msgBodyHash, msgAttrHash)
+	if key, ok := wrapper.store.contentKey(serialized); ok {
+		// content addressed hefty messages may be shared by several reference messages and are expired by a lifecycle rule
+		refMsg.S3Key = key
+		refMsg.RetainPayload = true
+	} else {
+		// record how subscribers should delete the hefty message
+		err = wrapper.setFanOutDeletion(ctx, params.TopicArn, refMsg)
+		if err != nil {
+			return nil, fmt.Errorf("unable to determine deletion of hefty message. %w", err)
+		}
+	}
+	s3Key = refMsg.S3Key
+	intercepted.Bucket, intercepted.Key = refMsg.S3Bucket, refMsg.S3Key
+	span.SetAttributes(s3BucketKey.String(refMsg.S3Bucket), s3KeyKey.String(refMsg.S3Key))
 
-	// create reference message
-	refMsg, err := newSnsReferenceMessage(params.TopicArn, wrapper.bucket, wrapper.Options().Region, msgBodyHash, msgAttrHash)
+	// check if bucket exists when validating lazily
+	err = wrapper.bucketValidator.validate(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("unable to create reference message from topicArn. %v", err)
+		return nil, err
 	}
 
 	// upload hefty message to s3
-	_, err = wrapper.uploader.Upload(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(wrapper.bucket),
-		Key:    aws.String(refMsg.S3Key),
-		Body:   bytes.NewReader(serialized),
-	})
+	err = wrapper.interceptors.run(ctx, beforeUpload, intercepted)
 	if err != nil {
-		return nil, fmt.Errorf("unable to upload hefty message to s3. %v", err)
+		return nil, err
+	}
+	uploadCtx, uploadSpan := wrapper.tracer.start(ctx, "upload", trace.SpanKindClient, messageSizeKey.Int(len(serialized)))
+	uploaded, err := wrapper.store.put(uploadCtx, wrapper.bucket, refMsg.S3Key, serialized)
+	uploadSpan.SetAttributes(uploadedKey.Bool(uploaded))
+	endSpan(uploadSpan, err)
+	if err != nil {
+		return nil, fmt.Errorf("unable to upload hefty message to s3. %w", err)
+	}
+	if wrapper.outbox != nil && !refMsg.RetainPayload {
+		// a message which is not sent is stored in the outbox and uploaded again from there
+		defer func() {
+			if err != nil {
+				discardPayload(ctx, wrapper.store, wrapper.logger, refMsg.S3Bucket, refMsg.S3Key)
+			}
+		}()
+	}
+	if uploaded {
+		wrapper.metrics.PayloadUploaded("sns", len(serialized))
+	}
+	err = wrapper.interceptors.run(ctx, afterUpload, intercepted)
+	if err != nil {
+		return nil, err
+	}
+
+	// allow getting the hefty message without access to the bucket
+	refMsg.PresignedUrl, err = wrapper.store.presign(ctx, refMsg.S3Bucket, refMsg.S3Key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to presign url of hefty message. %w", err)
 	}
 
 	// replace incoming message body with reference message
 	jsonRefMsg, err := refMsg.ToJson()
 	if err != nil {
-		return nil, fmt.Errorf("unable to marshal message to json. %v", err)
+		return nil, fmt.Errorf("unable to marshal message to json. %w", err)
 	}
-	params.Message = aws.String(string(jsonRefMsg))
 
-	// clear out all message attributes
-	orgMsgAttr := params.MessageAttributes
-	params.MessageAttributes = nil
+	// keep selected message attributes on the reference message
+	refMsgAttr := referenceMsgAttributes(heftyMsg.MessageAttributes, wrapper.keepAttribute, len(jsonRefMsg), heftyMsg.Size, wrapper.tracer.reservedAttributes(ctx))
+	refMsgSize, _ := messages.MessageSize(aws.String(string(jsonRefMsg)), refMsgAttr)
+	intercepted.Message = messages.NewHeftyMessage(aws.String(string(jsonRefMsg)), refMsgAttr, refMsgSize)
+
+	return wrapper.publish(ctx, params, intercepted, optFns...)
+}
+
+// publish publishes the message of `intercepted` in place of the message and message attributes of `params`, which are
+// restored afterwards, between the send hooks of the interceptors.
+func (wrapper *SnsClientWrapper) publish(ctx context.Context, params *sns.PublishInput, intercepted *InterceptedMessage, optFns ...func(*sns.Options)) (*sns.PublishOutput, error) {
+	err := wrapper.interceptors.run(ctx, beforeSend, intercepted)
+	if err != nil {
+		return nil, err
+	}
 
-	// replace overwritten values with original values
+	origMsg, origMsgAttr := params.Message, params.MessageAttributes
+	params.Message = intercepted.Message.Body
+	params.MessageAttributes = messages.MapToSnsMessageAttributeValues(intercepted.Message.MessageAttributes)
 	defer func() {
-		params.Message = heftyMsg.Body
-		params.MessageAttributes = orgMsgAttr
+		params.Message = origMsg
+		params.MessageAttributes = origMsgAttr
 	}()
 
 	out, err := wrapper.Publish(ctx, params, optFns...)
@@ -148,26 +279,54 @@ func (wrapper *SnsClientWrapper) PublishHeftyMessage(ctx context.Context, params
 		return out, err
 	}
 
-	return out, err
+	intercepted.MessageId = aws.ToString(out.MessageId)
+	err = wrapper.interceptors.run(ctx, afterSend, intercepted)
+	if err != nil {
+		return out, err
+	}
+
+	return out, nil
 }
 
-// Example topicArn: arn:aws:sns:us-west-2:765908583888:MyTopic
-func newSnsReferenceMessage(topicArn *string, bucketName, region, msgBodyHash, msgAttrHash string) (*messages.ReferenceMsg, error) {
-	const expectedTokenCount = 6
-
-	if topicArn != nil {
-		tokens := strings.Split(*topicArn, ":")
-		if len(tokens) != expectedTokenCount {
-			return nil, fmt.Errorf("expected %d tokens when splitting topicArn by ':' but received %d", expectedTokenCount, len(tokens))
-		} else {
-			return messages.NewReferenceMsg(
-				region,
-				bucketName,
-				fmt.Sprintf("%s/%s", tokens[4], uuid.New().String()), // S3Key: topicArn/uuid,
-				msgBodyHash,
-				msgAttrHash), nil
-		}
+// newSnsReferenceMessage creates a reference message for a hefty message published to the topic named `topicName`.
+func newSnsReferenceMessage(topicName, bucketName, region, msgBodyHash, msgAttrHash string) *messages.ReferenceMsg {
+	return messages.NewReferenceMsg(
+		region,
+		bucketName,
+		fmt.Sprintf("%s/%s", topicName, uuid.New().String()), // S3Key: topicName/uuid
+		msgBodyHash,
+		msgAttrHash)
+}
+
+// topicName returns the name of the topic with `topicArn`, such as arn:aws:sns:us-west-2:765908583888:MyTopic. Topic
+// arns which do not end with a topic name are resolved with the TopicArn attribute of the topic in AWS SNS, in which
+// case the name is cached.
+func (wrapper *SnsClientWrapper) topicName(ctx context.Context, topicArn *string) (string, error) {
+	if topicArn == nil {
+		return "", errors.New("topicArn is nil")
+	}
+
+	name, err := utils.TopicNameFromArn(*topicArn)
+	if err == nil {
+		return name, nil
 	}
 
-	return nil, errors.New("topicArn is nil")
+	if cached, ok := wrapper.topicNames.Load(*topicArn); ok {
+		return cached.(string), nil
+	}
+
+	out, err := wrapper.GetTopicAttributes(ctx, &sns.GetTopicAttributesInput{
+		TopicArn: topicArn,
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to get attributes of topic %s. %w", *topicArn, err)
+	}
+	name, err = utils.TopicNameFromArn(out.Attributes["TopicArn"])
+	if err != nil {
+		return "", err
+	}
+
+	wrapper.topicNames.Store(*topicArn, name)
+
+	return name, nil
 }
@@ -1,69 +1,108 @@
 package hefty
 
 import (
-	"bytes"
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"strings"
+	"sync"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	s3manager "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
 	"github.com/google/uuid"
 	"github.com/vinujohn/hefty/internal/messages"
 	"github.com/vinujohn/hefty/internal/utils"
-)
-
-const (
-	receiptHandlePrefix = "c976bb5ff9634b1ea7f69fd2390e3fef" // text used to differentiate a receipt handle belonging to a hefty message
+	"go.opentelemetry.io/otel/trace"
 )
 
 type SqsClientWrapper struct {
 	sqs.Client
 	bucket         string
-	s3Client       *s3.Client
-	uploader       *s3manager.Uploader
-	downloader     *s3manager.Downloader
+	store          *payloadStore
 	alwaysSendToS3 bool
+	keepAttribute  func(name string) bool
+
+	bucketValidator *bucketValidator
+
+	missingPayloadPolicy MissingPayloadPolicy
+	deletePayloadFirst   bool
+	payloadDeleter       *payloadDeleter
+	outbox               *outbox
+	tracer               *tracer
+	metrics              Metrics
+	logger               *logger
+	interceptors         interceptors
+	payloadCache         *payloadCache
+	queueNames           sync.Map // queueUrl -> queue name, for urls which do not end with a queue name
+	queueArns            sync.Map // queueUrl -> queue arn, for acknowledging deletes of hefty messages published to AWS SNS
 }
 
 // NewSqsClientWrapper will create a new Hefty SQS client wrapper using an existing AWS SQS client and AWS S3 client.
 // This Hefty SQS client wrapper will save large messages greater than MaxSqsSnsMessageLengthBytes to AWS S3 in the
 // bucket that is specified via `bucketName`. The S3 client should have the ability of reading and writing to this bucket.
-// This function will also check if the bucket exists and is accessible.
+// This function will also check if the bucket exists and is accessible unless the `BucketValidation` option is used.
 func NewSqsClientWrapper(sqsClient *sqs.Client, s3Client *s3.Client, bucketName string, opts ...Option) (*SqsClientWrapper, error) {
-	// check if bucket exits
-	if ok, err := utils.BucketExists(s3Client, bucketName); !ok {
+	return NewSqsClientWrapperWithContext(context.Background(), sqsClient, s3Client, bucketName, opts...)
+}
+
+// NewSqsClientWrapperWithContext is the same as NewSqsClientWrapper except that `ctx` is used when checking the bucket.
+// The check can be deferred or skipped with the `BucketValidation` option.
+func NewSqsClientWrapperWithContext(ctx context.Context, sqsClient *sqs.Client, s3Client *s3.Client, bucketName string, opts ...Option) (*SqsClientWrapper, error) {
+	// process available options
+	var wrapperOptions options
+	for _, opt := range opts {
+		err := opt(&wrapperOptions)
 		if err != nil {
 			return nil, err
 		}
+	}
 
-		return nil, fmt.Errorf("bucket %s does not exist or is not accessible", bucketName)
+	// check if bucket exits
+	bucketValidator, err := newBucketValidator(ctx, s3Client, bucketName, wrapperOptions.bucketValidation)
+	if err != nil {
+		return nil, err
 	}
 
 	// create new wrapper
 	wrapper := &SqsClientWrapper{
-		Client:     *sqsClient,
-		bucket:     bucketName,
-		s3Client:   s3Client,
-		uploader:   s3manager.NewUploader(s3Client),
-		downloader: s3manager.NewDownloader(s3Client),
-	}
+		Client: *sqsClient,
+		bucket: bucketName,
 
-	// process available options
-	var wrapperOptions options
-	for _, opt := range opts {
-		err := opt(&wrapperOptions)
+		bucketValidator: bucketValidator,
+	}
+	wrapper.logger = newLogger(wrapperOptions.logger, wrapperOptions.logAttributeValues)
+	wrapper.store = newPayloadStore("sqs", s3Client, &wrapperOptions, wrapper.logger)
+	wrapper.alwaysSendToS3 = wrapperOptions.alwaysSendToS3
+	wrapper.keepAttribute = wrapperOptions.keepAttribute
+	wrapper.missingPayloadPolicy = wrapperOptions.missingPayloadPolicy
+	wrapper.deletePayloadFirst = wrapperOptions.deletePayloadFirst
+	wrapper.tracer = newTracer(wrapperOptions.tracing, "aws_sqs")
+	wrapper.metrics = metricsOrNop(wrapperOptions.metrics)
+	wrapper.interceptors = wrapperOptions.interceptors
+	if wrapperOptions.payloadCache != nil {
+		wrapper.payloadCache, err = newPayloadCache(*wrapperOptions.payloadCache)
 		if err != nil {
 			return nil, err
 		}
 	}
-	wrapper.alwaysSendToS3 = wrapperOptions.alwaysSendToS3
+	if wrapperOptions.outbox != nil {
+		config := *wrapperOptions.outbox
+		config.OnError = wrapper.logger.onOutboxError(config.OnError)
+		outbox, err := newOutbox(config, wrapper.sendOutboxEntry)
+		if err != nil {
+			return nil, err
+		}
+		wrapper.outbox = outbox
+	}
+	if wrapperOptions.asyncDeletion != nil {
+		config := *wrapperOptions.asyncDeletion
+		config.OnError = wrapper.logger.onDeleteError(config.OnError)
+		wrapper.payloadDeleter = newPayloadDeleter(wrapper.store, config)
+	}
 
 	return wrapper, nil
 }
@@ -75,8 +114,31 @@ func NewSqsClientWrapper(sqsClient *sqs.Client, s3Client *s3.Client, bucketName
 // In the case of the reference message being sent, the message itself contains metadata about the hefty message saved in AWS S3
 // including bucket name, S3 key, region, and md5 digests.
 //
+// When the `Outbox` option is used, a message which could not be sent may be stored to be sent later, in which case
+// an empty output without a message id is returned with ErrStoredInOutbox. The message is sent later without `optFns`.
+//
 // Note that this function's signature matches that of the AWS SQS SDK's SendMessage function.
 func (wrapper *SqsClientWrapper) SendHeftyMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	if wrapper.outbox == nil || params == nil || params.MessageBody == nil {
+		return wrapper.sendHeftyMessage(ctx, params, optFns...)
+	}
+
+	var out *sqs.SendMessageOutput
+	err := wrapper.outbox.sendOrStore(func() (err error) {
+		out, err = wrapper.sendHeftyMessage(ctx, params, optFns...)
+		return err
+	}, func() (*outboxEntry, error) {
+		return wrapper.newOutboxEntry(params)
+	})
+	if errors.Is(err, ErrStoredInOutbox) {
+		wrapper.logger.WarnContext(ctx, "message stored in outbox", "destination", aws.ToString(params.QueueUrl), "backlog", wrapper.outbox.backlog(), "error", err)
+		return &sqs.SendMessageOutput{}, err
+	}
+
+	return out, err
+}
+
+func (wrapper *SqsClientWrapper) sendHeftyMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (out *sqs.SendMessageOutput, err error) {
 	// input validation; if invalid input let AWS SDK handle it
 	if params == nil ||
 		params.MessageBody == nil ||
@@ -85,71 +147,125 @@ func (wrapper *SqsClientWrapper) SendHeftyMessage(ctx context.Context, params *s
 		return wrapper.SendMessage(ctx, params, optFns...)
 	}
 
+	var msgSize int
+	var offloaded bool
+	var s3Key string
+	var msgAttributes map[string]messages.MessageAttributeValue
+	ctx, span := wrapper.tracer.start(ctx, "send", trace.SpanKindProducer, messagingDestinationKey.String(aws.ToString(params.QueueUrl)))
+	defer func() {
+		var messageId *string
+		if out != nil {
+			messageId = out.MessageId
+			span.SetAttributes(messagingMessageIdKey.String(aws.ToString(messageId)))
+		}
+		if err == nil {
+			wrapper.metrics.MessageSent("sqs", offloaded, msgSize)
+		}
+		wrapper.logger.sent(ctx, aws.ToString(params.QueueUrl), msgSize, offloaded, wrapper.bucket, s3Key, msgAttributes, messageId, err)
+		endSpan(span, err)
+	}()
+
 	// normalize message attributes
-	msgAttributes := messages.MapFromSqsMessageAttributeValues(params.MessageAttributes)
+	msgAttributes = messages.MapFromSqsMessageAttributeValues(params.MessageAttributes)
 
 	// calculate message size
-	msgSize, err := messages.MessageSize(params.MessageBody, msgAttributes)
+	msgSize, err = messages.MessageSize(params.MessageBody, msgAttributes)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get size of message. %v", err)
+		return nil, fmt.Errorf("unable to get size of message. %w", err)
 	}
+	span.SetAttributes(messageSizeKey.Int(msgSize))
+	intercepted := &InterceptedMessage{Wrapper: "sqs", Destination: aws.ToString(params.QueueUrl)}
 
 	// validate message size
 	if !wrapper.alwaysSendToS3 && msgSize <= MaxAwsMessageLengthBytes {
-		return wrapper.SendMessage(ctx, params, optFns...)
+		span.SetAttributes(offloadedKey.Bool(false))
+
+		intercepted.Message = messages.NewHeftyMessage(params.MessageBody, msgAttributes, msgSize)
+
+		return wrapper.sendMessage(ctx, params, intercepted, optFns...)
 	} else if msgSize > MaxHeftyMessageLengthBytes {
-		return nil, fmt.Errorf("message size of %d bytes greater than allowed message size of %d bytes", msgSize, MaxHeftyMessageLengthBytes)
+		return nil, fmt.Errorf("%w. message size of %d bytes greater than allowed message size of %d bytes", ErrMessageTooLarge, msgSize, MaxHeftyMessageLengthBytes)
 	}
+	offloaded = true
+	span.SetAttributes(offloadedKey.Bool(true))
 
 	// create and serialize hefty message
-	heftyMsg := messages.NewHeftyMessage(params.MessageBody, msgAttributes, msgSize)
-	serialized, bodyOffset, msgAttrOffset, err := heftyMsg.Serialize()
+	intercepted.Offloaded = true
+	intercepted.Message = messages.NewHeftyMessage(params.MessageBody, msgAttributes, msgSize)
+	serialized, msgBodyHash, msgAttrHash, err := serializeHeftyMessage(ctx, wrapper.tracer, wrapper.interceptors, intercepted)
 	if err != nil {
-		return nil, fmt.Errorf("unable to serialize message. %v", err)
+		return nil, err
 	}
+	heftyMsg := intercepted.Message
 
-	// create md5 digests
-	msgBodyHash := messages.Md5Digest(serialized[bodyOffset:msgAttrOffset])
-	msgAttrHash := ""
-	if len(heftyMsg.MessageAttributes) > 0 {
-		msgAttrHash = messages.Md5Digest(serialized[msgAttrOffset:])
+	// create reference message
+	queueName, err := wrapper.queueName(ctx, params.QueueUrl)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create reference message from queueUrl. %w", err)
 	}
+	refMsg := newSqsReferenceMessage(queueName, wrapper.bucket, wrapper.Options().Region, msgBodyHash, msgAttrHash)
+	if key, ok := wrapper.store.contentKey(serialized); ok {
+		// content addressed hefty messages may be shared by several reference messages and are expired by a lifecycle rule
+		refMsg.S3Key = key
+		refMsg.RetainPayload = true
+	}
+	s3Key = refMsg.S3Key
+	intercepted.Bucket, intercepted.Key = refMsg.S3Bucket, refMsg.S3Key
+	span.SetAttributes(s3BucketKey.String(refMsg.S3Bucket), s3KeyKey.String(refMsg.S3Key))
 
-	// create reference message
-	refMsg, err := newSqsReferenceMessage(params.QueueUrl, wrapper.bucket, wrapper.Options().Region, msgBodyHash, msgAttrHash)
+	// check if bucket exists when validating lazily
+	err = wrapper.bucketValidator.validate(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("unable to create reference message from queueUrl. %v", err)
+		return nil, err
 	}
 
 	// upload hefty message to s3
-	_, err = wrapper.uploader.Upload(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(wrapper.bucket),
-		Key:    aws.String(refMsg.S3Key),
-		Body:   bytes.NewReader(serialized),
-	})
+	err = wrapper.interceptors.run(ctx, beforeUpload, intercepted)
+	if err != nil {
+		return nil, err
+	}
+	uploadCtx, uploadSpan := wrapper.tracer.start(ctx, "upload", trace.SpanKindClient, messageSizeKey.Int(len(serialized)))
+	uploaded, err := wrapper.store.put(uploadCtx, wrapper.bucket, refMsg.S3Key, serialized)
+	uploadSpan.SetAttributes(uploadedKey.Bool(uploaded))
+	endSpan(uploadSpan, err)
+	if err != nil {
+		return nil, fmt.Errorf("unable to upload hefty message to s3. %w", err)
+	}
+	if wrapper.outbox != nil && !refMsg.RetainPayload {
+		// a message which is not sent is stored in the outbox and uploaded again from there
+		defer func() {
+			if err != nil {
+				discardPayload(ctx, wrapper.store, wrapper.logger, refMsg.S3Bucket, refMsg.S3Key)
+			}
+		}()
+	}
+	if uploaded {
+		wrapper.metrics.PayloadUploaded("sqs", len(serialized))
+	}
+	err = wrapper.interceptors.run(ctx, afterUpload, intercepted)
+	if err != nil {
+		return nil, err
+	}
+
+	// allow getting the hefty message without access to the bucket
+	refMsg.PresignedUrl, err = wrapper.store.presign(ctx, refMsg.S3Bucket, refMsg.S3Key)
 	if err != nil {
-		return nil, fmt.Errorf("unable to upload hefty message to s3. %v", err)
+		return nil, fmt.Errorf("unable to presign url of hefty message. %w", err)
 	}
 
 	// replace incoming message body with reference message
 	jsonRefMsg, err := refMsg.ToJson()
 	if err != nil {
-		return nil, fmt.Errorf("unable to marshal json message. %v", err)
+		return nil, fmt.Errorf("unable to marshal json message. %w", err)
 	}
-	params.MessageBody = aws.String(string(jsonRefMsg))
 
-	// clear out all message attributes
-	origMsgAttr := params.MessageAttributes
-	params.MessageAttributes = nil
-
-	// replace overwritten values with original values
-	defer func() {
-		params.MessageBody = heftyMsg.Body
-		params.MessageAttributes = origMsgAttr
-	}()
+	// keep selected message attributes on the reference message
+	refMsgAttr := referenceMsgAttributes(heftyMsg.MessageAttributes, wrapper.keepAttribute, len(jsonRefMsg), heftyMsg.Size, wrapper.tracer.reservedAttributes(ctx))
+	refMsgSize, _ := messages.MessageSize(aws.String(string(jsonRefMsg)), refMsgAttr)
+	intercepted.Message = messages.NewHeftyMessage(aws.String(string(jsonRefMsg)), refMsgAttr, refMsgSize)
 
 	// send reference message to sqs
-	out, err := wrapper.SendMessage(ctx, params, optFns...)
+	out, err = wrapper.sendMessage(ctx, params, intercepted, optFns...)
 	if err != nil {
 		return out, err
 	}
@@ -161,6 +277,36 @@ func (wrapper *SqsClientWrapper) SendHeftyMessage(ctx context.Context, params *s
 	return out, err
 }
 
+// sendMessage sends the message of `intercepted` in place of the body and message attributes of `params`, which are
+// restored afterwards, between the send hooks of the interceptors.
+func (wrapper *SqsClientWrapper) sendMessage(ctx context.Context, params *sqs.SendMessageInput, intercepted *InterceptedMessage, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	err := wrapper.interceptors.run(ctx, beforeSend, intercepted)
+	if err != nil {
+		return nil, err
+	}
+
+	origBody, origMsgAttr := params.MessageBody, params.MessageAttributes
+	params.MessageBody = intercepted.Message.Body
+	params.MessageAttributes = messages.MapToSqsMessageAttributeValues(intercepted.Message.MessageAttributes)
+	defer func() {
+		params.MessageBody = origBody
+		params.MessageAttributes = origMsgAttr
+	}()
+
+	out, err := wrapper.SendMessage(ctx, params, optFns...)
+	if err != nil {
+		return out, err
+	}
+
+	intercepted.MessageId = aws.ToString(out.MessageId)
+	err = wrapper.interceptors.run(ctx, afterSend, intercepted)
+	if err != nil {
+		return out, err
+	}
+
+	return out, nil
+}
+
 // SendHeftyMessageBatch is currently not supported and will use the underlying AWS SQS SDK's method `SendMessageBatch`
 func (wrapper *SqsClientWrapper) SendHeftyMessageBatch(ctx context.Context, params *sqs.SendMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
 	return wrapper.SendMessageBatch(ctx, params, optFns...)
@@ -170,60 +316,257 @@ func (wrapper *SqsClientWrapper) SendHeftyMessageBatch(ctx context.Context, para
 // This method will then download the hefty message and then place its body and message attributes in the returned
 // ReceiveMessageOutput. No modification of messages are made when the message has gone through AWS SQS. It is
 // important to use this function when `SendHeftyMessage` is used so that hefty messages can be downloaded from S3.
+// Only the message attributes requested with `MessageAttributeNames` are returned, just like AWS SQS.
 //
 // Note that this function's signature matches that of the AWS SQS SDK's ReceiveMessage function.
-func (wrapper *SqsClientWrapper) ReceiveHeftyMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
-	out, err := wrapper.ReceiveMessage(ctx, params, optFns...)
+func (wrapper *SqsClientWrapper) ReceiveHeftyMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (out *sqs.ReceiveMessageOutput, err error) {
+	ctx, span := wrapper.tracer.start(ctx, "receive", trace.SpanKindConsumer)
+	defer func() {
+		if out != nil {
+			span.SetAttributes(messagingBatchCountKey.Int(len(out.Messages)))
+		}
+		endSpan(span, err)
+	}()
+	if params != nil {
+		span.SetAttributes(messagingDestinationKey.String(aws.ToString(params.QueueUrl)))
+	}
+
+	// request the reserved message attributes so that reference messages can be detected and traces linked, and all
+	// message attributes when reference messages with missing payloads are forwarded with them
+	reserved := []string{ReferenceMsgAttribute}
+	if wrapper.tracer.enabled() {
+		reserved = append(reserved, TraceContextAttribute)
+	}
+	if wrapper.missingPayloadPolicy.action == forwardOnMissingPayload {
+		reserved = append(reserved, "All")
+	}
+	var origAttrNames, unrequested []string
+	if params != nil {
+		origAttrNames = params.MessageAttributeNames
+		for _, name := range reserved {
+			if len(messages.FilterMessageAttributes(map[string]messages.MessageAttributeValue{name: {}}, origAttrNames)) == 0 {
+				unrequested = append(unrequested, name)
+			}
+		}
+		if len(unrequested) > 0 {
+			params.MessageAttributeNames = append(origAttrNames[:len(origAttrNames):len(origAttrNames)], unrequested...)
+			defer func() {
+				params.MessageAttributeNames = origAttrNames
+			}()
+		}
+	}
+
+	out, err = wrapper.ReceiveMessage(ctx, params, optFns...)
 	if err != nil || out == nil {
 		return out, err
 	}
 
+	// messages removed due to the missing payload policy
+	var removed []int
+
 	for i := range out.Messages {
-		if !messages.IsReferenceMsg(*out.Messages[i].Body) {
+		refMsg, ok, err := referenceMsgFromSqsMessage(&out.Messages[i])
+		msgAttr := messages.MapFromSqsMessageAttributeValues(out.Messages[i].MessageAttributes)
+		if len(unrequested) > 0 {
+			removeUnrequestedAttributes(&out.Messages[i], msgAttr, origAttrNames)
+		}
+		if !ok {
+			wrapper.logger.DebugContext(ctx, "received message", "message_id", aws.ToString(out.Messages[i].MessageId), "offloaded", false)
+			continue
+		} else if err != nil {
+			wrapper.logger.ErrorContext(ctx, "received invalid reference message", "message_id", aws.ToString(out.Messages[i].MessageId), "error", err)
+			addErrorToSqsMessage(&out.Messages[i], nil, err)
+			wrapper.metrics.DownloadFailed("sqs", DownloadErrorInvalidReference)
 			continue
 		}
 
-		// deserialize message body
-		refMsg, err := messages.ToReferenceMsg(*out.Messages[i].Body)
-		if err != nil {
-			addErrorToSqsMessage(&out.Messages[i], nil, fmt.Errorf("unable to unmarshal reference message. %v", err))
-			continue
+		if wrapper.receiveHeftyMessage(ctx, params, &out.Messages[i], refMsg, msgAttr) {
+			removed = append(removed, i)
 		}
+	}
 
-		// make call to s3 to get message
-		buf := s3manager.NewWriteAtBuffer([]byte{})
-		_, err = wrapper.downloader.Download(ctx, buf, &s3.GetObjectInput{
-			Bucket: &refMsg.S3Bucket,
-			Key:    &refMsg.S3Key,
-		})
+	// remove messages which have been handled by the missing payload policy
+	for j := len(removed) - 1; j >= 0; j-- {
+		out.Messages = append(out.Messages[:removed[j]], out.Messages[removed[j]+1:]...)
+	}
+
+	return out, nil
+}
+
+// removeUnrequestedAttributes removes the message attributes of `msg` which were not requested with `names`. The md5
+// digest of its message attributes is calculated again if any are removed.
+func removeUnrequestedAttributes(msg *types.Message, msgAttr map[string]messages.MessageAttributeValue, names []string) {
+	requested := messages.FilterMessageAttributes(msgAttr, names)
+	if len(requested) == len(msgAttr) {
+		return
+	}
+
+	for name := range msg.MessageAttributes {
+		if _, ok := requested[name]; !ok {
+			delete(msg.MessageAttributes, name)
+		}
+	}
+	msg.MD5OfMessageAttributes = nil
+	if digest, err := messages.MessageAttributesMd5Digest(requested); err == nil && digest != "" {
+		msg.MD5OfMessageAttributes = &digest
+	}
+}
+
+// receiveHeftyMessage replaces the reference message `msg` with its hefty message from AWS S3. `msgAttr` holds the
+// message attributes of the reference message. Returns true if the message was removed by the missing payload policy.
+func (wrapper *SqsClientWrapper) receiveHeftyMessage(ctx context.Context, params *sqs.ReceiveMessageInput, msg *types.Message, refMsg *messages.ReferenceMsg, msgAttr map[string]messages.MessageAttributeValue) (removed bool) {
+	var err error
+	ctx, span := wrapper.tracer.startLinked(ctx, "download", msgAttr,
+		s3BucketKey.String(refMsg.S3Bucket), s3KeyKey.String(refMsg.S3Key), messagingMessageIdKey.String(aws.ToString(msg.MessageId)))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	intercepted := &InterceptedMessage{
+		Wrapper:     "sqs",
+		Destination: aws.ToString(params.QueueUrl),
+		Offloaded:   true,
+		Bucket:      refMsg.S3Bucket,
+		Key:         refMsg.S3Key,
+		MessageId:   aws.ToString(msg.MessageId),
+	}
+	err = wrapper.interceptors.run(ctx, beforeDownload, intercepted)
+	if err != nil {
+		addErrorToSqsMessage(msg, refMsg, err)
+		return false
+	}
+
+	// make call to s3 to get message unless it is cached
+	var payload []byte
+	var cached bool
+	if refMsg.HasObject() {
+		payload, cached = wrapper.payloadCache.get(refMsg)
+	}
+	if !cached {
+		payload, err = wrapper.store.get(ctx, wrapper.bucket, refMsg)
+	}
+	if err != nil {
+		wrapper.metrics.DownloadFailed("sqs", downloadErrorKind(err))
+		missing := utils.IsNoSuchKey(err)
+		if missing {
+			wrapper.logger.WarnContext(ctx, "hefty message is missing from s3", "message_id", aws.ToString(msg.MessageId), "bucket", refMsg.S3Bucket, "key", refMsg.S3Key)
+		} else {
+			wrapper.logger.ErrorContext(ctx, "unable to download hefty message", "message_id", aws.ToString(msg.MessageId), "bucket", refMsg.S3Bucket, "key", refMsg.S3Key, "error", err)
+		}
+		err = fmt.Errorf("unable to get message from s3. %w", err)
+		if missing {
+			return wrapper.handleMissingPayload(ctx, params.QueueUrl, msg, refMsg, msgAttr, err)
+		}
+		addErrorToSqsMessage(msg, refMsg, err)
+		return false
+	}
+	span.SetAttributes(messageSizeKey.Int(len(payload)), cacheHitKey.Bool(cached))
+	if !cached {
+		wrapper.metrics.PayloadDownloaded("sqs", len(payload))
+		if refMsg.HasObject() {
+			wrapper.payloadCache.put(refMsg, payload)
+		}
+	}
+
+	intercepted.Serialized = payload
+	for _, stage := range []interceptStage{afterDownload, beforeDeserialize} {
+		err = wrapper.interceptors.run(ctx, stage, intercepted)
 		if err != nil {
-			addErrorToSqsMessage(&out.Messages[i], refMsg, fmt.Errorf("unable to get message from s3. %v", err))
-			continue
+			addErrorToSqsMessage(msg, refMsg, err)
+			return false
 		}
+	}
+
+	// decode message from s3
+	heftyMsg, err := messages.DeserializeHeftyMessage(intercepted.Serialized)
+	if err != nil {
+		wrapper.metrics.DownloadFailed("sqs", DownloadErrorDecode)
+		wrapper.logger.ErrorContext(ctx, "unable to decode hefty message", "message_id", aws.ToString(msg.MessageId), "bucket", refMsg.S3Bucket, "key", refMsg.S3Key, "error", err)
+		err = fmt.Errorf("unable to decode bytes from s3 into hefty message type. %w", err)
+		addErrorToSqsMessage(msg, refMsg, err)
+		return false
+	}
 
-		// decode message from s3
-		heftyMsg, err := messages.DeserializeHeftyMessage(buf.Bytes())
+	// the message may be changed by an interceptor, in which case its md5 digests are calculated again
+	intercepted.Message = heftyMsg
+	err = wrapper.interceptors.run(ctx, afterDeserialize, intercepted)
+	if err != nil {
+		addErrorToSqsMessage(msg, refMsg, err)
+		return false
+	}
+	heftyMsg = intercepted.Message
+	modified := wrapper.interceptors.intercepts(afterDeserialize)
+	msgBodyHash := refMsg.Md5DigestMsgBody
+	if modified {
+		msgBodyHash = messages.Md5Digest([]byte(aws.ToString(heftyMsg.Body)))
+	}
+
+	// only return the message attributes which were requested
+	filteredAttr := messages.FilterMessageAttributes(heftyMsg.MessageAttributes, params.MessageAttributeNames)
+	msgAttrHash := &refMsg.Md5DigestMsgAttr
+	if len(filteredAttr) == 0 {
+		msgAttrHash = nil
+	} else if modified || len(filteredAttr) != len(heftyMsg.MessageAttributes) {
+		var digest string
+		digest, err = messages.MessageAttributesMd5Digest(filteredAttr)
 		if err != nil {
-			addErrorToSqsMessage(&out.Messages[i], refMsg, fmt.Errorf("unable to decode bytes from s3 into hefty message type. %v", err))
-			continue
+			err = fmt.Errorf("unable to calculate md5 digest of message attributes. %w", err)
+			addErrorToSqsMessage(msg, refMsg, err)
+			return false
 		}
+		msgAttrHash = &digest
+	}
 
-		// replace message body and attributes with s3 message
-		out.Messages[i].Body = heftyMsg.Body
-		sqsAttributes := messages.MapToSqsMessageAttributeValues(heftyMsg.MessageAttributes)
-		out.Messages[i].MessageAttributes = sqsAttributes
+	if wrapper.logger.Enabled(ctx, slog.LevelDebug) {
+		wrapper.logger.DebugContext(ctx, "received message", "message_id", aws.ToString(msg.MessageId), "offloaded", true,
+			"size", heftyMsg.Size, "bucket", refMsg.S3Bucket, "key", refMsg.S3Key, "cached", cached, wrapper.logger.attributes(filteredAttr))
+	}
+
+	// replace message body and attributes with s3 message
+	msg.Body = heftyMsg.Body
+	msg.MessageAttributes = messages.MapToSqsMessageAttributeValues(filteredAttr)
 
-		// replace md5 hashes
-		out.Messages[i].MD5OfBody = &refMsg.Md5DigestMsgBody
-		out.Messages[i].MD5OfMessageAttributes = &refMsg.Md5DigestMsgAttr
+	// replace md5 hashes
+	msg.MD5OfBody = &msgBodyHash
+	msg.MD5OfMessageAttributes = msgAttrHash
 
-		// modify receipt handle to contain s3 bucket and key info
-		newReceiptHandle := fmt.Sprintf("%s|%s|%s|%s", receiptHandlePrefix, *out.Messages[i].ReceiptHandle, refMsg.S3Bucket, refMsg.S3Key)
-		newReceiptHandle = base64.StdEncoding.EncodeToString([]byte(newReceiptHandle))
-		out.Messages[i].ReceiptHandle = &newReceiptHandle
+	// a hefty message which was only received with its presigned url cannot be removed from AWS S3
+	if !refMsg.HasObject() {
+		return false
 	}
 
-	return out, nil
+	// modify receipt handle to contain s3 bucket and key info
+	receiptHandle := &heftyReceiptHandle{
+		receiptHandle: *msg.ReceiptHandle,
+		s3Bucket:      refMsg.S3Bucket,
+		s3Key:         refMsg.S3Key,
+
+		subscriberCount: refMsg.SubscriberCount,
+		retainPayload:   refMsg.RetainPayload,
+	}
+	msg.ReceiptHandle = aws.String(receiptHandle.encode())
+
+	return false
+}
+
+// referenceMsgFromSqsMessage determines if `msg` is a reference message, either by the reserved reference message attribute
+// or by its body, and returns the reference message. An error is returned if `msg` is a reference message which is invalid.
+func referenceMsgFromSqsMessage(msg *types.Message) (*messages.ReferenceMsg, bool, error) {
+	body := aws.ToString(msg.Body)
+	_, flagged := msg.MessageAttributes[ReferenceMsgAttribute]
+	if !flagged && !messages.IsReferenceMsg(body) {
+		return nil, false, nil
+	}
+
+	// deserialize message body
+	refMsg, err := messages.ToReferenceMsg(body)
+	if err != nil {
+		return nil, true, fmt.Errorf("unable to unmarshal reference message. %w", err)
+	} else if !refMsg.IsValid() {
+		return nil, true, errors.New("reference message does not contain an s3 bucket and s3 key or a presigned url")
+	}
+
+	return refMsg, true, nil
 }
 
 func addErrorToSqsMessage(msg *types.Message, refMsg *messages.ReferenceMsg, err error) {
@@ -240,66 +583,202 @@ func addErrorToSqsMessage(msg *types.Message, refMsg *messages.ReferenceMsg, err
 // It is important to use the `ReceiptHandle` from `ReceiveHeftyMessage` in this function as this is the only way to determine
 // if a hefty message resides in AWS S3 or not.
 //
+// The reference message is deleted from AWS SQS first and the hefty message is only removed from AWS S3 once that
+// delete succeeds. If the hefty message could not be removed, the output of the AWS SQS delete is returned along with
+// an error. This order can be reversed with the `DeletePayloadFirst` option.
+//
 // Note that this function's signature matches that of the AWS SQS SDK's DeleteMessage function.
-func (wrapper *SqsClientWrapper) DeleteHeftyMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
-	const expectedHeftyReceiptHandleTokenCount = 4
+func (wrapper *SqsClientWrapper) DeleteHeftyMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (out *sqs.DeleteMessageOutput, err error) {
+	var receiptHandle *heftyReceiptHandle
+	outcome := DeleteOutcomeInline
+	defer func() {
+		if err != nil {
+			outcome = DeleteOutcomeFailed
+		}
+		wrapper.metrics.MessageDeleted("sqs", outcome)
+		wrapper.logDelete(ctx, params, receiptHandle, outcome, err)
+	}()
 
 	if params.ReceiptHandle == nil {
 		return wrapper.DeleteMessage(ctx, params, optFns...)
 	}
 
-	// decode receipt handle
-	decoded, err := base64.StdEncoding.DecodeString(*params.ReceiptHandle)
+	// check if receipt handle is for a hefty message
+	receiptHandle, ok, err := decodeReceiptHandle(*params.ReceiptHandle)
 	if err != nil {
-		return nil, fmt.Errorf("could not decode receipt handle. %v", err)
+		return nil, err
+	} else if !ok {
+		return wrapper.DeleteMessage(ctx, params, optFns...)
 	}
-	decodedStr := string(decoded)
 
-	// check if decoded receipt handle is for a hefty message
-	if !strings.HasPrefix(decodedStr, receiptHandlePrefix) {
+	ctx, span := wrapper.tracer.start(ctx, "delete", trace.SpanKindClient, messagingDestinationKey.String(aws.ToString(params.QueueUrl)),
+		s3BucketKey.String(receiptHandle.s3Bucket), s3KeyKey.String(receiptHandle.s3Key))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	// the hefty message is no longer needed by this consumer
+	wrapper.payloadCache.evict(receiptHandle.s3Bucket, receiptHandle.s3Key)
+
+	// replace receipt handle with real one to delete sqs message
+	heftyReceiptHandle := params.ReceiptHandle
+	params.ReceiptHandle = &receiptHandle.receiptHandle
+	defer func() {
+		params.ReceiptHandle = heftyReceiptHandle
+	}()
+
+	// delete hefty message from s3 before sqs message if requested
+	if wrapper.deletePayloadFirst && wrapper.payloadDeleter == nil {
+		outcome, err = wrapper.deletePayload(ctx, params.QueueUrl, receiptHandle)
+		if err != nil {
+			return nil, err
+		}
+
 		return wrapper.DeleteMessage(ctx, params, optFns...)
 	}
 
-	// get tokens from receipt handle
-	tokens := strings.Split(decodedStr, "|")
-	if len(tokens) != expectedHeftyReceiptHandleTokenCount {
-		return nil, fmt.Errorf("expected number of tokens (%d) not available in receipt handle", expectedHeftyReceiptHandleTokenCount)
+	// delete sqs message
+	out, err = wrapper.DeleteMessage(ctx, params, optFns...)
+	if err != nil {
+		return out, err
 	}
 
-	// delete hefty message from s3
-	receiptHandle, s3Bucket, s3Key := tokens[1], tokens[2], tokens[3]
-	_, err = wrapper.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
-		Bucket: &s3Bucket,
-		Key:    &s3Key,
-	})
+	// delete hefty message from s3 now that the reference message can no longer be received
+	outcome, err = wrapper.deletePayload(ctx, params.QueueUrl, receiptHandle)
 	if err != nil {
-		return nil, fmt.Errorf("could not delete s3 object for hefty message. %v", err)
+		return out, err
 	}
 
-	// replace receipt handle with real one to delete sqs message
-	params.ReceiptHandle = &receiptHandle
+	return out, nil
+}
+
+// logDelete logs the outcome of deleting a message. `receiptHandle` is nil if the message was not stored in AWS S3.
+func (wrapper *SqsClientWrapper) logDelete(ctx context.Context, params *sqs.DeleteMessageInput, receiptHandle *heftyReceiptHandle, outcome DeleteOutcome, err error) {
+	attrs := []any{"destination", aws.ToString(params.QueueUrl), "outcome", outcome}
+	if receiptHandle != nil {
+		attrs = append(attrs, "bucket", receiptHandle.s3Bucket, "key", receiptHandle.s3Key)
+	}
+
+	if err != nil {
+		wrapper.logger.ErrorContext(ctx, "unable to delete message", append(attrs, "error", err)...)
+		return
+	}
 
-	return wrapper.DeleteMessage(ctx, params, optFns...)
+	wrapper.logger.DebugContext(ctx, "deleted message", attrs...)
 }
 
-// Example queueUrl: https://sqs.us-west-2.amazonaws.com/765908583888/MyTestQueue
-func newSqsReferenceMessage(queueUrl *string, bucketName, region, msgBodyHash, msgAttrHash string) (*messages.ReferenceMsg, error) {
-	const expectedTokenCount = 5
+// Close removes hefty messages from AWS S3 which are still scheduled to be deleted when the `AsyncPayloadDeletion` option
+// is used and sends the messages which are still waiting when the `Outbox` option is used. The wrapper should not be used
+// to send or delete messages after Close has been called.
+func (wrapper *SqsClientWrapper) Close(ctx context.Context) error {
+	var errs []error
+	if wrapper.outbox != nil {
+		errs = append(errs, wrapper.outbox.close(ctx))
+	}
+	if wrapper.payloadDeleter != nil {
+		errs = append(errs, wrapper.payloadDeleter.close(ctx))
+	}
 
-	if queueUrl != nil {
-		tokens := strings.Split(*queueUrl, "/")
-		if len(tokens) != expectedTokenCount {
-			return nil, fmt.Errorf("expected %d tokens when splitting queueUrl by '/' but received %d", expectedTokenCount, len(tokens))
-		} else {
+	return errors.Join(errs...)
+}
+
+// ChangeHeftyMessageVisibility will change the visibility timeout of a message received with `ReceiveHeftyMessage`.
+// It is important to use the `ReceiptHandle` from `ReceiveHeftyMessage` in this function as the receipt handle of a
+// hefty message contains the real AWS SQS receipt handle.
+//
+// Note that this function's signature matches that of the AWS SQS SDK's ChangeMessageVisibility function.
+func (wrapper *SqsClientWrapper) ChangeHeftyMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error) {
+	if params.ReceiptHandle == nil {
+		return wrapper.ChangeMessageVisibility(ctx, params, optFns...)
+	}
 
-			return messages.NewReferenceMsg(
-				region,
-				bucketName,
-				fmt.Sprintf("%s/%s", tokens[4], uuid.New().String()), // S3Key: queueName/uuid
-				msgBodyHash,
-				msgAttrHash), nil
+	// check if receipt handle is for a hefty message
+	receiptHandle, ok, err := decodeReceiptHandle(*params.ReceiptHandle)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return wrapper.ChangeMessageVisibility(ctx, params, optFns...)
+	}
+
+	// use a copy of params so that the caller's hefty receipt handle can be used again
+	input := *params
+	input.ReceiptHandle = &receiptHandle.receiptHandle
+
+	return wrapper.ChangeMessageVisibility(ctx, &input, optFns...)
+}
+
+// newSqsReferenceMessage creates a reference message for a hefty message sent to the queue named `queueName`.
+func newSqsReferenceMessage(queueName, bucketName, region, msgBodyHash, msgAttrHash string) *messages.ReferenceMsg {
+	return messages.NewReferenceMsg(
+		region,
+		bucketName,
+		fmt.Sprintf("%s/%s", queueName, uuid.New().String()), // S3Key: queueName/uuid
+		msgBodyHash,
+		msgAttrHash)
+}
+
+// queueName returns the name of the queue at `queueUrl`. Queue urls which do not end with a queue name are resolved with
+// AWS SQS, in which case the name is cached. A queue name in place of a url is accepted if the queue exists.
+func (wrapper *SqsClientWrapper) queueName(ctx context.Context, queueUrl *string) (string, error) {
+	if queueUrl == nil {
+		return "", fmt.Errorf("%w. queueUrl is nil", ErrInvalidQueueURL)
+	}
+
+	name, err := utils.QueueNameFromUrl(*queueUrl)
+	if err == nil {
+		return name, nil
+	}
+
+	if cached, ok := wrapper.queueNames.Load(*queueUrl); ok {
+		return cached.(string), nil
+	}
+
+	if !strings.Contains(*queueUrl, "://") {
+		_, err = wrapper.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{
+			QueueName: queueUrl,
+		})
+		if err != nil {
+			return "", fmt.Errorf("%w. unable to get url of queue %s. %w", ErrInvalidQueueURL, *queueUrl, err)
+		}
+		name = *queueUrl
+	} else {
+		out, err := wrapper.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+			QueueUrl:       queueUrl,
+			AttributeNames: []types.QueueAttributeName{types.QueueAttributeNameQueueArn},
+		})
+		if err != nil {
+			return "", fmt.Errorf("%w. unable to get arn of queue %s. %w", ErrInvalidQueueURL, *queueUrl, err)
 		}
+		name, err = utils.QueueNameFromArn(out.Attributes[string(types.QueueAttributeNameQueueArn)])
+		if err != nil {
+			return "", fmt.Errorf("%w. %w", ErrInvalidQueueURL, err)
+		}
+	}
+
+	wrapper.queueNames.Store(*queueUrl, name)
+
+	return name, nil
+}
+
+// queueArn returns the arn of the queue at `queueUrl`, which is cached.
+func (wrapper *SqsClientWrapper) queueArn(ctx context.Context, queueUrl *string) (string, error) {
+	if cached, ok := wrapper.queueArns.Load(aws.ToString(queueUrl)); ok {
+		return cached.(string), nil
 	}
 
-	return nil, errors.New("queueUrl is nil")
+	out, err := wrapper.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       queueUrl,
+		AttributeNames: []types.QueueAttributeName{types.QueueAttributeNameQueueArn},
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to get arn of queue %s. %w", aws.ToString(queueUrl), err)
+	}
+	queueArn := out.Attributes[string(types.QueueAttributeNameQueueArn)]
+	if queueArn == "" {
+		return "", fmt.Errorf("unable to get arn of queue %s", aws.ToString(queueUrl))
+	}
+
+	wrapper.queueArns.Store(aws.ToString(queueUrl), queueArn)
+
+	return queueArn, nil
 }
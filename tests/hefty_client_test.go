@@ -1,9 +1,24 @@
 package tests
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -13,12 +28,17 @@ import (
 	snsTypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	sqsTypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go"
 	"github.com/google/uuid"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/vinujohn/hefty"
+	"github.com/vinujohn/hefty/heftytest"
 	"github.com/vinujohn/hefty/internal/messages"
 	"github.com/vinujohn/hefty/internal/testutils"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 var (
@@ -34,39 +54,103 @@ var (
 	testTopics []*string
 )
 
+// roundTripper is an http.RoundTripper implemented by a function.
+type roundTripper func(r *http.Request) (*http.Response, error)
+
+func (fn roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	return fn(r)
+}
+
+// zeros is an io.Reader of an endless stream of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
 func TestHefty(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Hefty Tests Suite")
 }
 
+// testServer serves the fakes of AWS used by all ginkgo processes. It is nil when testing against AWS.
+var testServer *heftytest.Server
+
+// testAws runs the tests against AWS instead of the fakes of the heftytest package when set to "true".
+var testAws = os.Getenv("HEFTY_TEST_AWS") == "true"
+
+// testEnv is shared between all ginkgo processes if running in parallel.
+type testEnv struct {
+	Bucket      string
+	SqsEndpoint string
+	SnsEndpoint string
+	S3Endpoint  string
+}
+
 var _ = SynchronizedBeforeSuite(func() []byte {
-	// get sdk config
-	sdkConfig, err := config.LoadDefaultConfig(context.TODO())
-	Expect(err).To(BeNil())
+	env := testEnv{
+		Bucket: uuid.NewString(),
+	}
+	input := &s3.CreateBucketInput{
+		Bucket: &env.Bucket,
+	}
 
-	// create s3 bucket
-	client := s3.NewFromConfig(sdkConfig)
-	bucket := uuid.NewString()
-	_, err = client.CreateBucket(context.TODO(), &s3.CreateBucketInput{
-		Bucket: &bucket,
-		CreateBucketConfiguration: &s3Types.CreateBucketConfiguration{
+	var client *s3.Client
+	if testAws {
+		// get sdk config
+		sdkConfig, err := config.LoadDefaultConfig(context.TODO())
+		Expect(err).To(BeNil())
+		client = s3.NewFromConfig(sdkConfig)
+		input.CreateBucketConfiguration = &s3Types.CreateBucketConfiguration{
 			LocationConstraint: s3Types.BucketLocationConstraintUsWest2,
-		},
-	})
+		}
+	} else {
+		// the fakes are served by the first ginkgo process until all processes are done
+		testServer = heftytest.NewServer()
+		env.SqsEndpoint = testServer.SqsEndpoint()
+		env.SnsEndpoint = testServer.SnsEndpoint()
+		env.S3Endpoint = testServer.S3Endpoint()
+		client = testServer.S3Client()
+	}
+
+	// create s3 bucket
+	_, err := client.CreateBucket(context.TODO(), input)
 	Expect(err).To(BeNil())
 
-	return []byte(bucket)
-}, func(bucket []byte) {
-	testBucket = string(bucket)
+	data, err := json.Marshal(env)
+	Expect(err).To(BeNil())
 
-	// get sdk config
-	sdkConfig, err := config.LoadDefaultConfig(context.TODO())
+	return data
+}, func(data []byte) {
+	var env testEnv
+	err := json.Unmarshal(data, &env)
 	Expect(err).To(BeNil())
+	testBucket = env.Bucket
 
 	// create clients to wrap
-	sqsClient = sqs.NewFromConfig(sdkConfig)
-	s3Client = s3.NewFromConfig(sdkConfig)
-	snsClient = sns.NewFromConfig(sdkConfig)
+	if testAws {
+		// get sdk config
+		sdkConfig, err := config.LoadDefaultConfig(context.TODO())
+		Expect(err).To(BeNil())
+
+		sqsClient = sqs.NewFromConfig(sdkConfig)
+		s3Client = s3.NewFromConfig(sdkConfig)
+		snsClient = sns.NewFromConfig(sdkConfig)
+	} else {
+		sdkConfig := heftytest.Config()
+
+		sqsClient = sqs.NewFromConfig(sdkConfig, func(o *sqs.Options) {
+			o.BaseEndpoint = &env.SqsEndpoint
+		})
+		s3Client = s3.NewFromConfig(sdkConfig, func(o *s3.Options) {
+			o.BaseEndpoint = &env.S3Endpoint
+			o.UsePathStyle = true
+		})
+		snsClient = sns.NewFromConfig(sdkConfig, func(o *sns.Options) {
+			o.BaseEndpoint = &env.SnsEndpoint
+		})
+	}
 
 	// create hefty clients
 	heftySqsClient, err = hefty.NewSqsClientWrapper(sqsClient, s3Client, testBucket)
@@ -124,7 +208,7 @@ var _ = SynchronizedAfterSuite(func() {
 		if !*listObjects.IsTruncated {
 			break
 		} else {
-			continueToken = listObjects.ContinuationToken
+			continueToken = listObjects.NextContinuationToken
 		}
 	}
 
@@ -133,6 +217,10 @@ var _ = SynchronizedAfterSuite(func() {
 		Bucket: &testBucket,
 	})
 	Expect(err).To(BeNil())
+
+	if testServer != nil {
+		testServer.Close()
+	}
 })
 
 var _ = Describe("Hefty Client Wrapper", func() {
@@ -176,6 +264,23 @@ var _ = Describe("Hefty Client Wrapper", func() {
 		return res
 	}
 
+	CountQueueMessages := func(queueUrl string) int {
+		GinkgoHelper()
+		attr, err := heftySqsClient.GetQueueAttributes(context.TODO(), &sqs.GetQueueAttributesInput{
+			QueueUrl: &queueUrl,
+			AttributeNames: []sqsTypes.QueueAttributeName{
+				sqsTypes.QueueAttributeNameApproximateNumberOfMessages,
+				sqsTypes.QueueAttributeNameApproximateNumberOfMessagesNotVisible,
+			},
+		})
+		Expect(err).To(BeNil())
+
+		visible, _ := strconv.Atoi(attr.Attributes[string(sqsTypes.QueueAttributeNameApproximateNumberOfMessages)])
+		notVisible, _ := strconv.Atoi(attr.Attributes[string(sqsTypes.QueueAttributeNameApproximateNumberOfMessagesNotVisible)])
+
+		return visible + notVisible
+	}
+
 	DeleteHeftyMessage := func(queueUrl, receiptHandle string) {
 		GinkgoHelper()
 		_, err := heftySqsClient.DeleteHeftyMessage(context.TODO(), &sqs.DeleteMessageInput{
@@ -185,6 +290,73 @@ var _ = Describe("Hefty Client Wrapper", func() {
 		Expect(err).To(BeNil())
 	}
 
+	CreateSnsTopic := func() *string {
+		GinkgoHelper()
+		// create topic
+		topicName := uuid.NewString()
+		t, err := heftySnsClient.CreateTopic(context.TODO(), &sns.CreateTopicInput{
+			Name: aws.String(topicName),
+		})
+		Expect(err).To(BeNil())
+		testTopics = append(testTopics, t.TopicArn)
+
+		return t.TopicArn
+	}
+
+	SubscribeSqsQueue := func(topicArn *string, queueUrl *string) {
+		GinkgoHelper()
+		// get queue arn
+		qAttr, err := heftySqsClient.GetQueueAttributes(context.TODO(), &sqs.GetQueueAttributesInput{
+			QueueUrl: queueUrl,
+			AttributeNames: []sqsTypes.QueueAttributeName{
+				"QueueArn",
+				"Policy",
+			},
+		})
+		Expect(err).To(BeNil())
+		qArn := qAttr.Attributes["QueueArn"]
+
+		// subscribe queue to topic
+		_, err = heftySnsClient.Subscribe(context.TODO(), &sns.SubscribeInput{
+			Protocol: aws.String("sqs"),
+			TopicArn: topicArn,
+			Attributes: map[string]string{
+				"RawMessageDelivery": "true",
+			},
+			Endpoint: aws.String(qArn),
+		})
+		Expect(err).To(BeNil())
+
+		// add permission to queue so that sns can send messages to it
+		_, err = heftySqsClient.SetQueueAttributes(context.TODO(), &sqs.SetQueueAttributesInput{
+			QueueUrl: queueUrl,
+			Attributes: map[string]string{
+				"Policy": fmt.Sprintf(`
+							{
+								"Version": "2012-10-17",
+								"Id": "snsAccessPolicy",
+								"Statement": [
+								  {
+									"Effect": "Allow",
+									"Principal": {
+									  "Service": "sns.amazonaws.com"
+									},
+									"Action": "sqs:SendMessage",
+									"Resource": "%s",
+									"Condition": {
+									  "ArnEquals": {
+										"aws:SourceArn": "%s"
+									  }
+									}
+								  }
+								]
+							}
+							`, qArn, *topicArn),
+			},
+		})
+		Expect(err).To(BeNil())
+	}
+
 	When("When sending a message to AWS SQS with the Hefty client wrapper", func() {
 		var queueUrl *string
 		var msg *string
@@ -225,8 +397,10 @@ var _ = Describe("Hefty Client Wrapper", func() {
 				Expect(res.Messages[0].Body).To(Equal(msg))
 			})
 
-			It("and even though 2 attributes were requested, we receive all message attributes sent.", func() {
-				Expect(res.Messages[0].MessageAttributes).To(Equal(sqsMsgAttr))
+			It("and since 2 attributes were requested, we receive 2 of them", func() {
+				Expect(res.Messages[0].MessageAttributes).Should(HaveLen(2))
+				Expect(res.Messages[0].MessageAttributes["test03"]).To(Equal(sqsMsgAttr["test03"]))
+				Expect(res.Messages[0].MessageAttributes["test05"]).To(Equal(sqsMsgAttr["test05"]))
 			})
 		})
 
@@ -274,8 +448,10 @@ var _ = Describe("Hefty Client Wrapper", func() {
 					DeleteHeftyMessage(*queueUrl, *res.Messages[0].ReceiptHandle)
 				})
 
-				It("and even though 2 attributes were requested, we receive all of them", func() {
-					Expect(res.Messages[0].MessageAttributes).To(Equal(sqsMsgAttr))
+				It("and since 2 attributes were requested, we receive 2 of them", func() {
+					Expect(res.Messages[0].MessageAttributes).Should(HaveLen(2))
+					Expect(res.Messages[0].MessageAttributes["test03"]).To(Equal(sqsMsgAttr["test03"]))
+					Expect(res.Messages[0].MessageAttributes["test05"]).To(Equal(sqsMsgAttr["test05"]))
 				})
 			})
 		})
@@ -293,66 +469,10 @@ var _ = Describe("Hefty Client Wrapper", func() {
 
 		CreateSnsTopicAndSubscription := func(queueUrl *string) *string {
 			GinkgoHelper()
-			// create topic
-			topicName := uuid.NewString()
-			t, err := heftySnsClient.CreateTopic(context.TODO(), &sns.CreateTopicInput{
-				Name: aws.String(topicName),
-			})
-			Expect(err).To(BeNil())
-			testTopics = append(testTopics, t.TopicArn)
-
-			// get queue arn
-			qAttr, err := heftySqsClient.GetQueueAttributes(context.TODO(), &sqs.GetQueueAttributesInput{
-				QueueUrl: queueUrl,
-				AttributeNames: []sqsTypes.QueueAttributeName{
-					"QueueArn",
-					"Policy",
-				},
-			})
-			Expect(err).To(BeNil())
-			qArn := qAttr.Attributes["QueueArn"]
-
-			// subscribe queue to topic
-			_, err = heftySnsClient.Subscribe(context.TODO(), &sns.SubscribeInput{
-				Protocol: aws.String("sqs"),
-				TopicArn: t.TopicArn,
-				Attributes: map[string]string{
-					"RawMessageDelivery": "true",
-				},
-				Endpoint: aws.String(qArn),
-			})
-			Expect(err).To(BeNil())
-
-			// add permission to queue so that sns can send messages to it
-			_, err = heftySqsClient.SetQueueAttributes(context.TODO(), &sqs.SetQueueAttributesInput{
-				QueueUrl: queueUrl,
-				Attributes: map[string]string{
-					"Policy": fmt.Sprintf(`
-								{
-									"Version": "2012-10-17",
-									"Id": "snsAccessPolicy",
-									"Statement": [
-									  {
-										"Effect": "Allow",
-										"Principal": {
-										  "Service": "sns.amazonaws.com"
-										},
-										"Action": "sqs:SendMessage",
-										"Resource": "%s",
-										"Condition": {
-										  "ArnEquals": {
-											"aws:SourceArn": "%s"
-										  }
-										}
-									  }
-									]
-								}
-								`, qArn, *t.TopicArn),
-				},
-			})
-			Expect(err).To(BeNil())
+			topicArn := CreateSnsTopic()
+			SubscribeSqsQueue(topicArn, queueUrl)
 
-			return t.TopicArn
+			return topicArn
 		}
 
 		PublishSnsMessage := func(topicArn *string, msg *string, attributes map[string]snsTypes.MessageAttributeValue) *sns.PublishInput {
@@ -402,8 +522,10 @@ var _ = Describe("Hefty Client Wrapper", func() {
 				Expect(res.Messages[0].Body).To(Equal(msg))
 			})
 
-			It("and even though 2 attributes were requested, we receive all message attributes sent.", func() {
-				Expect(res.Messages[0].MessageAttributes).To(Equal(sqsMsgAttr))
+			It("and since 2 attributes were requested, we receive 2 of them", func() {
+				Expect(res.Messages[0].MessageAttributes).Should(HaveLen(2))
+				Expect(res.Messages[0].MessageAttributes["test03"]).To(Equal(sqsMsgAttr["test03"]))
+				Expect(res.Messages[0].MessageAttributes["test05"]).To(Equal(sqsMsgAttr["test05"]))
 			})
 		})
 
@@ -455,9 +577,1505 @@ var _ = Describe("Hefty Client Wrapper", func() {
 				DeleteHeftyMessage(*queueUrl, *res.Messages[0].ReceiptHandle)
 			})
 
-			It("and even though 2 attributes were requested, we receive all of them", func() {
-				Expect(res.Messages[0].MessageAttributes).To(Equal(sqsMsgAttr))
+			It("and since 2 attributes were requested, we receive 2 of them", func() {
+				Expect(res.Messages[0].MessageAttributes).Should(HaveLen(2))
+				Expect(res.Messages[0].MessageAttributes["test03"]).To(Equal(sqsMsgAttr["test03"]))
+				Expect(res.Messages[0].MessageAttributes["test05"]).To(Equal(sqsMsgAttr["test05"]))
+			})
+		})
+	})
+
+	When("When consuming messages with the Hefty consumer", func() {
+		var queueUrl *string
+		var msg *string
+		var sqsMsgAttr map[string]sqsTypes.MessageAttributeValue
+		var received chan sqsTypes.Message
+
+		RunConsumer := func(handler hefty.MessageHandler, opts ...hefty.ConsumerOption) {
+			GinkgoHelper()
+			opts = append([]hefty.ConsumerOption{hefty.ConsumerWaitTimeSeconds(1)}, opts...)
+			consumer, err := hefty.NewConsumer(heftySqsClient, *queueUrl, handler, opts...)
+			Expect(err).To(BeNil())
+
+			ctx, cancel := context.WithCancel(context.TODO())
+			done := make(chan error)
+			go func() {
+				done <- consumer.Run(ctx)
+			}()
+			Eventually(received).WithTimeout(30 * time.Second).Should(Receive())
+			cancel()
+			Eventually(done).WithTimeout(30 * time.Second).Should(Receive(BeNil()))
+		}
+
+		BeforeEach(func() {
+			queueUrl = CreateSqsQueue()
+			var msgAttr map[string]messages.MessageAttributeValue
+			msg, msgAttr = testutils.GetMaxHeftyMsgBodyAndAttr()
+			sqsMsgAttr = messages.MapToSqsMessageAttributeValues(msgAttr)
+			received = make(chan sqsTypes.Message, 1)
+			SendSqsMessage(*queueUrl, *msg, sqsMsgAttr)
+		})
+
+		It("and the handler succeeds, the message is received and deleted", func() {
+			RunConsumer(func(ctx context.Context, m sqsTypes.Message) error {
+				Expect(m.Body).To(Equal(msg))
+				Expect(m.MessageAttributes).To(Equal(sqsMsgAttr))
+				received <- m
+				return nil
+			})
+
+			Expect(CountQueueMessages(*queueUrl)).To(Equal(0))
+		})
+
+		It("and the handler fails, the message is not deleted", func() {
+			RunConsumer(func(ctx context.Context, m sqsTypes.Message) error {
+				received <- m
+				return errors.New("handler failed")
+			})
+
+			Expect(CountQueueMessages(*queueUrl)).To(Equal(1))
+		})
+
+		It("and the handler does not complete within the shutdown grace period, its context is cancelled", func() {
+			RunConsumer(func(ctx context.Context, m sqsTypes.Message) error {
+				received <- m
+				<-ctx.Done()
+				return ctx.Err()
+			}, hefty.ConsumerShutdownGracePeriod(100*time.Millisecond))
+
+			Expect(CountQueueMessages(*queueUrl)).To(Equal(1))
+		})
+	})
+
+	When("When extending the visibility timeout of a hefty message with a heartbeat", func() {
+		It("the message does not become visible while the heartbeat is running", func() {
+			queueUrl := CreateSqsQueue()
+			msg, msgAttr := testutils.GetMaxHeftyMsgBodyAndAttr()
+			SendSqsMessage(*queueUrl, *msg, messages.MapToSqsMessageAttributeValues(msgAttr))
+
+			res, err := heftySqsClient.ReceiveHeftyMessage(context.TODO(), &sqs.ReceiveMessageInput{
+				QueueUrl:          queueUrl,
+				WaitTimeSeconds:   20,
+				VisibilityTimeout: 2,
+			})
+			Expect(err).To(BeNil())
+			Expect(res.Messages).To(HaveLen(1))
+
+			heartbeat, err := heftySqsClient.StartVisibilityHeartbeat(context.TODO(), *queueUrl, *res.Messages[0].ReceiptHandle, hefty.VisibilityHeartbeatConfig{
+				Interval:          time.Second,
+				VisibilityTimeout: 2 * time.Second,
+			})
+			Expect(err).To(BeNil())
+
+			time.Sleep(4 * time.Second)
+			again, err := heftySqsClient.ReceiveHeftyMessage(context.TODO(), &sqs.ReceiveMessageInput{
+				QueueUrl:        queueUrl,
+				WaitTimeSeconds: 1,
+			})
+			Expect(err).To(BeNil())
+			Expect(again.Messages).To(BeEmpty())
+
+			Expect(heartbeat.Stop()).To(BeNil())
+			DeleteHeftyMessage(*queueUrl, *res.Messages[0].ReceiptHandle)
+		})
+	})
+
+	When("When receiving a reference message whose hefty message is missing from AWS S3", func() {
+		var queueUrl *string
+
+		DeleteAllS3Objects := func(prefix string) {
+			GinkgoHelper()
+			list, err := s3Client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
+				Bucket: &testBucket,
+				Prefix: &prefix,
+			})
+			Expect(err).To(BeNil())
+			Expect(list.Contents).NotTo(BeEmpty())
+			for _, obj := range list.Contents {
+				_, err = s3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+					Bucket: &testBucket,
+					Key:    obj.Key,
+				})
+				Expect(err).To(BeNil())
+			}
+		}
+
+		BeforeEach(func() {
+			queueUrl = CreateSqsQueue()
+			msg, msgAttr := testutils.GetMaxHeftyMsgBodyAndAttr()
+			SendSqsMessage(*queueUrl, *msg, messages.MapToSqsMessageAttributeValues(msgAttr))
+			DeleteAllS3Objects(path.Base(*queueUrl))
+		})
+
+		It("and no policy is set, an error message is received", func() {
+			res := ReceiveSqsMessage(*queueUrl, nil)
+			errMsg, ok := hefty.ErrorMsg(*res.Messages[0].Body)
+			Expect(ok).To(BeTrue())
+
+			// the download error is embedded once, with request ids which differ per request removed
+			_, s3Err := s3Client.GetObject(context.TODO(), &s3.GetObjectInput{
+				Bucket: &errMsg.ReferenceMsg.S3Bucket,
+				Key:    &errMsg.ReferenceMsg.S3Key,
+			})
+			Expect(s3Err).NotTo(BeNil())
+			requestIds := regexp.MustCompile(`RequestID: [^,]*, HostID: [^,]*`)
+			expected := fmt.Sprintf("unable to get message from s3. unable to download s3 object %s in bucket %s. %v", errMsg.ReferenceMsg.S3Key, testBucket, s3Err)
+			Expect(requestIds.ReplaceAllString(errMsg.Error, "")).To(Equal(requestIds.ReplaceAllString(expected, "")))
+		})
+
+		It("and the forward policy is set, the message is forwarded to the dead letter queue", func() {
+			dlqUrl := CreateSqsQueue()
+			client, err := hefty.NewSqsClientWrapper(sqsClient, s3Client, testBucket, hefty.OnMissingPayload(hefty.ForwardOnMissingPayload(*dlqUrl)))
+			Expect(err).To(BeNil())
+
+			res, err := client.ReceiveHeftyMessage(context.TODO(), &sqs.ReceiveMessageInput{
+				QueueUrl:        queueUrl,
+				WaitTimeSeconds: 20,
+			})
+			Expect(err).To(BeNil())
+			Expect(res.Messages).To(BeEmpty())
+			Expect(CountQueueMessages(*queueUrl)).To(Equal(0))
+
+			// the payload is still missing so the forwarded reference message is received without the hefty client
+			forwarded, err := sqsClient.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{
+				QueueUrl:              dlqUrl,
+				WaitTimeSeconds:       20,
+				MessageAttributeNames: []string{"All"},
+			})
+			Expect(err).To(BeNil())
+			Expect(forwarded.Messages).To(HaveLen(1))
+			_, ok := hefty.ReferenceMsg(*forwarded.Messages[0].Body)
+			Expect(ok).To(BeTrue())
+			Expect(forwarded.Messages[0].MessageAttributes).To(HaveKey(hefty.MissingPayloadErrorAttribute))
+			Expect(*forwarded.Messages[0].MessageAttributes[hefty.MissingPayloadSourceQueueAttribute].StringValue).To(Equal(*queueUrl))
+		})
+
+		It("and the forward policy is set, the message is forwarded with its own message attributes", func() {
+			sender, err := hefty.NewSqsClientWrapper(sqsClient, s3Client, testBucket, hefty.KeepAttributesOnReference("correlation-id"))
+			Expect(err).To(BeNil())
+			sourceUrl := CreateSqsQueue()
+			msg, _ := testutils.GetMsgBodyAndAttrs(hefty.MaxAwsMessageLengthBytes+1, 0, 0)
+			correlationId := sqsTypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(uuid.NewString())}
+			_, err = sender.SendHeftyMessage(context.TODO(), &sqs.SendMessageInput{
+				QueueUrl:          sourceUrl,
+				MessageBody:       msg,
+				MessageAttributes: map[string]sqsTypes.MessageAttributeValue{"correlation-id": correlationId},
+			})
+			Expect(err).To(BeNil())
+			DeleteAllS3Objects(path.Base(*sourceUrl))
+
+			// a message which is not a reference message is received with the requested message attributes only
+			_, err = sqsClient.SendMessage(context.TODO(), &sqs.SendMessageInput{
+				QueueUrl:          sourceUrl,
+				MessageBody:       aws.String("inline"),
+				MessageAttributes: map[string]sqsTypes.MessageAttributeValue{"correlation-id": correlationId},
+			})
+			Expect(err).To(BeNil())
+
+			dlqUrl := CreateSqsQueue()
+			client, err := hefty.NewSqsClientWrapper(sqsClient, s3Client, testBucket, hefty.OnMissingPayload(hefty.ForwardOnMissingPayload(*dlqUrl)))
+			Expect(err).To(BeNil())
+			var received []sqsTypes.Message
+			for len(received) < 1 || CountQueueMessages(*sourceUrl) > 1 {
+				res, err := client.ReceiveHeftyMessage(context.TODO(), &sqs.ReceiveMessageInput{
+					QueueUrl:            sourceUrl,
+					WaitTimeSeconds:     20,
+					MaxNumberOfMessages: 10,
+				})
+				Expect(err).To(BeNil())
+				received = append(received, res.Messages...)
+			}
+			Expect(received).To(HaveLen(1))
+			Expect(*received[0].Body).To(Equal("inline"))
+			Expect(received[0].MessageAttributes).To(BeEmpty())
+			Expect(received[0].MD5OfMessageAttributes).To(BeNil())
+
+			forwarded, err := sqsClient.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{
+				QueueUrl:              dlqUrl,
+				WaitTimeSeconds:       20,
+				MessageAttributeNames: []string{"All"},
+			})
+			Expect(err).To(BeNil())
+			Expect(forwarded.Messages).To(HaveLen(1))
+			forwardedAttr := forwarded.Messages[0].MessageAttributes
+			Expect(forwardedAttr).To(HaveKey(hefty.ReferenceMsgAttribute))
+			Expect(forwardedAttr).To(HaveKey(hefty.MissingPayloadErrorAttribute))
+			Expect(forwardedAttr["correlation-id"].StringValue).To(Equal(correlationId.StringValue))
+		})
+
+		It("and the callback policy is set, the callback is called with the reference message", func() {
+			var called []*hefty.ReferenceMessage
+			callback := func(ctx context.Context, url string, msg sqsTypes.Message, refMsg *hefty.ReferenceMessage) error {
+				Expect(url).To(Equal(*queueUrl))
+				called = append(called, refMsg)
+				_, err := sqsClient.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+					QueueUrl:      &url,
+					ReceiptHandle: msg.ReceiptHandle,
+				})
+				return err
+			}
+			client, err := hefty.NewSqsClientWrapper(sqsClient, s3Client, testBucket, hefty.OnMissingPayload(hefty.CallbackOnMissingPayload(callback)))
+			Expect(err).To(BeNil())
+
+			res, err := client.ReceiveHeftyMessage(context.TODO(), &sqs.ReceiveMessageInput{
+				QueueUrl:        queueUrl,
+				WaitTimeSeconds: 20,
+			})
+			Expect(err).To(BeNil())
+			Expect(res.Messages).To(BeEmpty())
+			Expect(called).To(HaveLen(1))
+			Expect(called[0].S3Bucket).To(Equal(testBucket))
+			Expect(CountQueueMessages(*queueUrl)).To(Equal(0))
+		})
+	})
+
+	When("When publishing a hefty message to an AWS SNS topic with several AWS SQS subscribers", func() {
+		It("and fan out deletion waits for all subscribers, every subscriber receives the message", func() {
+			client, err := hefty.NewSnsClientWrapper(snsClient, s3Client, testBucket, hefty.FanOutDelete(hefty.DeleteAfterAllSubscribers))
+			Expect(err).To(BeNil())
+
+			topicArn := CreateSnsTopic()
+			queueUrls := []*string{CreateSqsQueue(), CreateSqsQueue()}
+			for _, q := range queueUrls {
+				SubscribeSqsQueue(topicArn, q)
+			}
+
+			msg, msgAttr := testutils.GetMaxHeftyMsgBodyAndAttr()
+			_, err = client.PublishHeftyMessage(context.TODO(), &sns.PublishInput{
+				Message:           msg,
+				MessageAttributes: messages.MapToSnsMessageAttributeValues(msgAttr),
+				TopicArn:          topicArn,
+			})
+			Expect(err).To(BeNil())
+
+			topicName := (*topicArn)[strings.LastIndex(*topicArn, ":")+1:]
+			for _, q := range queueUrls {
+				res := ReceiveSqsMessage(*q, nil)
+				Expect(res.Messages[0].Body).To(Equal(msg))
+				DeleteHeftyMessage(*q, *res.Messages[0].ReceiptHandle)
+			}
+
+			list, err := s3Client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
+				Bucket: &testBucket,
+				Prefix: &topicName,
+			})
+			Expect(err).To(BeNil())
+			Expect(list.Contents).To(BeEmpty())
+		})
+
+		It("and fan out deletion waits for all subscribers, each subscriber acknowledges its delete under the arn of its queue", func() {
+			client, err := hefty.NewSnsClientWrapper(snsClient, s3Client, testBucket, hefty.FanOutDelete(hefty.DeleteAfterAllSubscribers))
+			Expect(err).To(BeNil())
+
+			topicArn := CreateSnsTopic()
+			queueUrls := []*string{CreateSqsQueue(), CreateSqsQueue()}
+			for _, q := range queueUrls {
+				SubscribeSqsQueue(topicArn, q)
+			}
+
+			msg, _ := testutils.GetMsgBodyAndAttrs(hefty.MaxAwsMessageLengthBytes+1, 0, 0)
+			_, err = client.PublishHeftyMessage(context.TODO(), &sns.PublishInput{
+				Message:  msg,
+				TopicArn: topicArn,
+			})
+			Expect(err).To(BeNil())
+
+			res := ReceiveSqsMessage(*queueUrls[0], nil)
+			DeleteHeftyMessage(*queueUrls[0], *res.Messages[0].ReceiptHandle)
+
+			// queues of the same name in other accounts or regions acknowledge separately
+			attr, err := sqsClient.GetQueueAttributes(context.TODO(), &sqs.GetQueueAttributesInput{
+				QueueUrl:       queueUrls[0],
+				AttributeNames: []sqsTypes.QueueAttributeName{sqsTypes.QueueAttributeNameQueueArn},
+			})
+			Expect(err).To(BeNil())
+			topicName := (*topicArn)[strings.LastIndex(*topicArn, ":")+1:]
+			list, err := s3Client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
+				Bucket: &testBucket,
+				Prefix: &topicName,
+			})
+			Expect(err).To(BeNil())
+			Expect(list.Contents).To(HaveLen(2))
+			Expect(list.Contents[1].Key).To(HaveValue(HaveSuffix(".acks/" + attr.Attributes[string(sqsTypes.QueueAttributeNameQueueArn)])))
+
+			res = ReceiveSqsMessage(*queueUrls[1], nil)
+			DeleteHeftyMessage(*queueUrls[1], *res.Messages[0].ReceiptHandle)
+			list, err = s3Client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
+				Bucket: &testBucket,
+				Prefix: &topicName,
+			})
+			Expect(err).To(BeNil())
+			Expect(list.Contents).To(BeEmpty())
+		})
+	})
+
+	When("When deleting hefty messages asynchronously", func() {
+		It("the hefty message is removed from AWS S3 once the wrapper is closed", func() {
+			client, err := hefty.NewSqsClientWrapper(sqsClient, s3Client, testBucket, hefty.AsyncPayloadDeletion(hefty.AsyncDeletionConfig{
+				FlushInterval: time.Hour,
+			}))
+			Expect(err).To(BeNil())
+
+			queueUrl := CreateSqsQueue()
+			msg, msgAttr := testutils.GetMaxHeftyMsgBodyAndAttr()
+			_, err = client.SendHeftyMessage(context.TODO(), &sqs.SendMessageInput{
+				QueueUrl:          queueUrl,
+				MessageBody:       msg,
+				MessageAttributes: messages.MapToSqsMessageAttributeValues(msgAttr),
+			})
+			Expect(err).To(BeNil())
+
+			res, err := client.ReceiveHeftyMessage(context.TODO(), &sqs.ReceiveMessageInput{
+				QueueUrl:        queueUrl,
+				WaitTimeSeconds: 20,
+			})
+			Expect(err).To(BeNil())
+			Expect(res.Messages).To(HaveLen(1))
+			_, err = client.DeleteHeftyMessage(context.TODO(), &sqs.DeleteMessageInput{
+				QueueUrl:      queueUrl,
+				ReceiptHandle: res.Messages[0].ReceiptHandle,
+			})
+			Expect(err).To(BeNil())
+
+			prefix := path.Base(*queueUrl)
+			list, err := s3Client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
+				Bucket: &testBucket,
+				Prefix: &prefix,
+			})
+			Expect(err).To(BeNil())
+			Expect(list.Contents).To(HaveLen(1))
+
+			Expect(client.Close(context.TODO())).To(BeNil())
+			list, err = s3Client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
+				Bucket: &testBucket,
+				Prefix: &prefix,
+			})
+			Expect(err).To(BeNil())
+			Expect(list.Contents).To(BeEmpty())
+		})
+	})
+
+	When("When keeping message attributes on the reference message", func() {
+		It("the kept message attributes are available without the Hefty client wrapper", func() {
+			client, err := hefty.NewSqsClientWrapper(sqsClient, s3Client, testBucket, hefty.KeepAttributesOnReference("test03", "test05"))
+			Expect(err).To(BeNil())
+
+			queueUrl := CreateSqsQueue()
+			msg, msgAttr := testutils.GetMsgBodyAndAttrs(hefty.MaxAwsMessageLengthBytes, 6, 100)
+			sqsMsgAttr := messages.MapToSqsMessageAttributeValues(msgAttr)
+			_, err = client.SendHeftyMessage(context.TODO(), &sqs.SendMessageInput{
+				QueueUrl:          queueUrl,
+				MessageBody:       msg,
+				MessageAttributes: sqsMsgAttr,
+			})
+			Expect(err).To(BeNil())
+
+			res, err := sqsClient.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{
+				QueueUrl:              queueUrl,
+				WaitTimeSeconds:       20,
+				MessageAttributeNames: []string{"All"},
+			})
+			Expect(err).To(BeNil())
+			Expect(res.Messages).To(HaveLen(1))
+			_, ok := hefty.ReferenceMsg(*res.Messages[0].Body)
+			Expect(ok).To(BeTrue())
+			Expect(res.Messages[0].MessageAttributes).To(HaveLen(3))
+			Expect(res.Messages[0].MessageAttributes).To(HaveKey(hefty.ReferenceMsgAttribute))
+			Expect(res.Messages[0].MessageAttributes["test03"].BinaryValue).To(Equal(sqsMsgAttr["test03"].BinaryValue))
+			Expect(res.Messages[0].MessageAttributes["test05"].BinaryValue).To(Equal(sqsMsgAttr["test05"].BinaryValue))
+		})
+	})
+
+	When("When receiving a reference message created by another tool", func() {
+		It("the reference message is detected by the reserved reference message attribute", func() {
+			queueUrl := CreateSqsQueue()
+			msg, msgAttr := testutils.GetMaxHeftyMsgBodyAndAttr()
+			heftyMsg := messages.NewHeftyMessage(msg, msgAttr, 0)
+			serialized, _, _, err := heftyMsg.Serialize()
+			Expect(err).To(BeNil())
+
+			key := path.Base(*queueUrl) + "/" + uuid.NewString()
+			_, err = s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
+				Bucket: &testBucket,
+				Key:    &key,
+				Body:   bytes.NewReader(serialized),
+			})
+			Expect(err).To(BeNil())
+
+			_, err = sqsClient.SendMessage(context.TODO(), &sqs.SendMessageInput{
+				QueueUrl:    queueUrl,
+				MessageBody: aws.String(fmt.Sprintf(`{"s3_bucket": "%s", "s3_key": "%s"}`, testBucket, key)),
+				MessageAttributes: map[string]sqsTypes.MessageAttributeValue{
+					hefty.ReferenceMsgAttribute: {
+						DataType:    aws.String("Number"),
+						StringValue: aws.String(strconv.Itoa(len(serialized))),
+					},
+				},
+			})
+			Expect(err).To(BeNil())
+
+			res := ReceiveSqsMessage(*queueUrl, nil)
+			Expect(res.Messages[0].Body).To(Equal(msg))
+			Expect(res.Messages[0].MessageAttributes).To(BeEmpty())
+			DeleteHeftyMessage(*queueUrl, *res.Messages[0].ReceiptHandle)
+		})
+	})
+
+	When("When creating a client wrapper with a context", func() {
+		It("the bucket is validated lazily and the health check succeeds", func() {
+			ctx, cancel := context.WithTimeout(context.TODO(), 30*time.Second)
+			defer cancel()
+
+			client, err := hefty.NewSqsClientWrapperWithContext(ctx, sqsClient, s3Client, "hefty-bucket-that-does-not-exist-"+uuid.NewString(), hefty.BucketValidation(hefty.ValidateBucketLazily))
+			Expect(err).To(BeNil())
+			msg, _ := testutils.GetMsgBodyAndAttrs(hefty.MaxAwsMessageLengthBytes+1, 0, 0)
+			_, err = client.SendHeftyMessage(ctx, &sqs.SendMessageInput{
+				QueueUrl:    CreateSqsQueue(),
+				MessageBody: msg,
+			})
+			Expect(err).ToNot(BeNil())
+
+			client, err = hefty.NewSqsClientWrapperWithContext(ctx, sqsClient, s3Client, testBucket)
+			Expect(err).To(BeNil())
+			Expect(client.HealthCheck(ctx)).To(Succeed())
+
+			list, err := s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+				Bucket: &testBucket,
+				Prefix: aws.String("hefty-health-check/"),
+			})
+			Expect(err).To(BeNil())
+			Expect(list.Contents).To(BeEmpty())
+		})
+
+		It("and the health check fails to get the probe object, the probe object is deleted", func() {
+			faults := heftytest.NewFaults(heftytest.Rule{Service: "S3", Operation: "GetObject", Fault: heftytest.Error(http.StatusForbidden, "AccessDenied", "access denied")})
+			client, err := hefty.NewSqsClientWrapperWithContext(context.TODO(), sqsClient, s3.New(s3Client.Options(), faults.S3), testBucket)
+			Expect(err).To(BeNil())
+			Expect(client.HealthCheck(context.TODO())).NotTo(Succeed())
+			Expect(faults.Injected()).To(BeNumerically(">", 0))
+
+			list, err := s3Client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
+				Bucket: &testBucket,
+				Prefix: aws.String("hefty-health-check/"),
 			})
+			Expect(err).To(BeNil())
+			Expect(list.Contents).To(BeEmpty())
+		})
+	})
+
+	When("When sending to a queue url or topic arn which does not end with its name", func() {
+		// Rewrite replaces `alias` with `target` in the requests it is injected into, so that a custom endpoint which
+		// identifies queues and topics by something other than their name is simulated.
+		Rewrite := func(alias, target string, calls *int) heftytest.Fault {
+			return func(r *http.Request, next aws.HTTPClient) (*http.Response, error) {
+				*calls++
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					return nil, err
+				}
+				body = bytes.ReplaceAll(body, []byte(alias), []byte(target))
+				body = bytes.ReplaceAll(body, []byte(url.QueryEscape(alias)), []byte(url.QueryEscape(target)))
+				r.Body = io.NopCloser(bytes.NewReader(body))
+				r.ContentLength = int64(len(body))
+				r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+				return next.Do(r)
+			}
+		}
+
+		It("the queue name is resolved once with the queue attributes", func() {
+			queueUrl := CreateSqsQueue()
+			queueName := path.Base(*queueUrl)
+			alias := "https://sqs.example.com/queues/" + queueName + ".queue"
+			var resolved, requests int
+			faults := heftytest.NewFaults(
+				heftytest.Rule{Service: "SQS", Operation: "GetQueueAttributes", Fault: Rewrite(alias, *queueUrl, &resolved)},
+				heftytest.Rule{Service: "SQS", Fault: Rewrite(alias, *queueUrl, &requests)},
+			)
+			client, err := hefty.NewSqsClientWrapper(sqs.New(sqsClient.Options(), faults.Sqs), s3Client, testBucket, hefty.AlwaysSendToS3())
+			Expect(err).To(BeNil())
+
+			for i := 0; i < 2; i++ {
+				msg, _ := testutils.GetMsgBodyAndAttrs(100, 0, 0)
+				_, err = client.SendHeftyMessage(context.TODO(), &sqs.SendMessageInput{
+					QueueUrl:    &alias,
+					MessageBody: msg,
+				})
+				Expect(err).To(BeNil())
+			}
+			Expect(resolved).To(Equal(1))
+
+			for i := 0; i < 2; i++ {
+				res, err := sqsClient.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{
+					QueueUrl:        queueUrl,
+					WaitTimeSeconds: 20,
+				})
+				Expect(err).To(BeNil())
+				Expect(res.Messages).To(HaveLen(1))
+				refMsg, ok := hefty.ReferenceMsg(*res.Messages[0].Body)
+				Expect(ok).To(BeTrue())
+				Expect(refMsg.S3Key).To(HavePrefix(queueName + "/"))
+				DeleteHeftyMessage(*queueUrl, *res.Messages[0].ReceiptHandle)
+			}
+		})
+
+		It("a queue name in place of a queue url is resolved with the queue url", func() {
+			queueUrl := CreateSqsQueue()
+			queueName := path.Base(*queueUrl)
+			client, err := hefty.NewSqsClientWrapper(sqsClient, s3Client, testBucket, hefty.AlwaysSendToS3())
+			Expect(err).To(BeNil())
+
+			msg, _ := testutils.GetMsgBodyAndAttrs(100, 0, 0)
+			_, err = client.SendHeftyMessage(context.TODO(), &sqs.SendMessageInput{
+				QueueUrl:    &queueName,
+				MessageBody: msg,
+			})
+			Expect(err).To(BeNil())
+
+			res, err := sqsClient.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{
+				QueueUrl:        queueUrl,
+				WaitTimeSeconds: 20,
+			})
+			Expect(err).To(BeNil())
+			Expect(res.Messages).To(HaveLen(1))
+			refMsg, ok := hefty.ReferenceMsg(*res.Messages[0].Body)
+			Expect(ok).To(BeTrue())
+			Expect(refMsg.S3Key).To(HavePrefix(queueName + "/"))
+			DeleteHeftyMessage(*queueUrl, *res.Messages[0].ReceiptHandle)
+
+			_, err = client.SendHeftyMessage(context.TODO(), &sqs.SendMessageInput{
+				QueueUrl:    aws.String("hefty-queue-that-does-not-exist-" + uuid.NewString()),
+				MessageBody: msg,
+			})
+			Expect(err).To(MatchError(hefty.ErrInvalidQueueURL))
+		})
+
+		It("the topic name is resolved once with the topic attributes", func() {
+			topicArn := CreateSnsTopic()
+			queueUrl := CreateSqsQueue()
+			SubscribeSqsQueue(topicArn, queueUrl)
+			topicName := path.Base(strings.ReplaceAll(*topicArn, ":", "/"))
+			alias := strings.TrimSuffix(*topicArn, topicName) + "topics/" + topicName
+			var resolved, requests int
+			faults := heftytest.NewFaults(
+				heftytest.Rule{Service: "SNS", Operation: "GetTopicAttributes", Fault: Rewrite(alias, *topicArn, &resolved)},
+				heftytest.Rule{Service: "SNS", Fault: Rewrite(alias, *topicArn, &requests)},
+			)
+			client, err := hefty.NewSnsClientWrapper(sns.New(snsClient.Options(), faults.Sns), s3Client, testBucket, hefty.AlwaysSendToS3())
+			Expect(err).To(BeNil())
+
+			for i := 0; i < 2; i++ {
+				msg, _ := testutils.GetMsgBodyAndAttrs(100, 0, 0)
+				_, err = client.PublishHeftyMessage(context.TODO(), &sns.PublishInput{
+					TopicArn: &alias,
+					Message:  msg,
+				})
+				Expect(err).To(BeNil())
+			}
+			Expect(resolved).To(Equal(1))
+
+			for i := 0; i < 2; i++ {
+				res, err := sqsClient.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{
+					QueueUrl:        queueUrl,
+					WaitTimeSeconds: 20,
+				})
+				Expect(err).To(BeNil())
+				Expect(res.Messages).To(HaveLen(1))
+				refMsg, ok := hefty.ReferenceMsg(*res.Messages[0].Body)
+				Expect(ok).To(BeTrue())
+				Expect(refMsg.S3Key).To(HavePrefix(topicName + "/"))
+				DeleteHeftyMessage(*queueUrl, *res.Messages[0].ReceiptHandle)
+			}
+		})
+	})
+
+	When("When an operation of the Hefty client wrapper fails", func() {
+		It("the error can be matched with the exported errors", func() {
+			queueUrl := CreateSqsQueue()
+			msg, _ := testutils.GetMsgBodyAndAttrs(hefty.MaxHeftyMessageLengthBytes+1, 0, 0)
+			_, err := heftySqsClient.SendHeftyMessage(context.TODO(), &sqs.SendMessageInput{
+				QueueUrl:    queueUrl,
+				MessageBody: msg,
+			})
+			Expect(err).To(MatchError(hefty.ErrMessageTooLarge))
+
+			_, err = heftySqsClient.DeleteHeftyMessage(context.TODO(), &sqs.DeleteMessageInput{
+				QueueUrl:      queueUrl,
+				ReceiptHandle: aws.String(base64.StdEncoding.EncodeToString([]byte("c976bb5ff9634b1ea7f69fd2390e3fef|only|three"))),
+			})
+			Expect(err).To(MatchError(hefty.ErrInvalidReceiptHandle))
+
+			client, err := hefty.NewSqsClientWrapper(sqsClient, s3Client, testBucket, hefty.AlwaysSendToS3())
+			Expect(err).To(BeNil())
+			small, _ := testutils.GetMsgBodyAndAttrs(100, 0, 0)
+			_, err = client.SendHeftyMessage(context.TODO(), &sqs.SendMessageInput{
+				QueueUrl:    aws.String("https://sqs.us-west-2.amazonaws.com/"),
+				MessageBody: small,
+			})
+			Expect(err).To(MatchError(hefty.ErrInvalidQueueURL))
+
+			missing := "hefty-bucket-that-does-not-exist-" + uuid.NewString()
+			client, err = hefty.NewSqsClientWrapper(sqsClient, s3Client, missing, hefty.AlwaysSendToS3(), hefty.BucketValidation(hefty.SkipBucketValidation))
+			Expect(err).To(BeNil())
+			_, err = client.SendHeftyMessage(context.TODO(), &sqs.SendMessageInput{
+				QueueUrl:    queueUrl,
+				MessageBody: small,
+			})
+			var storeErr *hefty.PayloadStoreError
+			Expect(errors.As(err, &storeErr)).To(BeTrue())
+			Expect(storeErr.Op).To(Equal("upload"))
+			Expect(storeErr.Bucket).To(Equal(missing))
+			var apiErr smithy.APIError
+			Expect(errors.As(err, &apiErr)).To(BeTrue())
+		})
+	})
+
+	When("When tuning the transfers of hefty messages to and from AWS S3", func() {
+		It("a hefty message larger than the part size is uploaded in parts with a checksum and received unchanged", func() {
+			var puts, parts int
+			var checksums []string
+			faults := heftytest.NewFaults(
+				heftytest.Rule{Service: "S3", Operation: "PutObject", Fault: func(r *http.Request, next aws.HTTPClient) (*http.Response, error) {
+					puts++
+					return next.Do(r)
+				}},
+				heftytest.Rule{Service: "S3", Operation: "UploadPart", Fault: func(r *http.Request, next aws.HTTPClient) (*http.Response, error) {
+					parts++
+					checksums = append(checksums, r.Header.Get("X-Amz-Checksum-Crc32c"))
+					return next.Do(r)
+				}},
+			)
+			client, err := hefty.NewSqsClientWrapper(sqsClient, s3.New(s3Client.Options(), faults.S3), testBucket,
+				hefty.S3PartSize(5<<20), hefty.S3Concurrency(1), hefty.S3ChecksumAlgorithm(s3Types.ChecksumAlgorithmCrc32c))
+			Expect(err).To(BeNil())
+
+			queueUrl := CreateSqsQueue()
+			msg, _ := testutils.GetMsgBodyAndAttrs(12<<20, 0, 0)
+			_, err = client.SendHeftyMessage(context.TODO(), &sqs.SendMessageInput{
+				QueueUrl:    queueUrl,
+				MessageBody: msg,
+			})
+			Expect(err).To(BeNil())
+			Expect(puts).To(Equal(0))
+			Expect(parts).To(Equal(3))
+			Expect(checksums).NotTo(ContainElement(BeEmpty()))
+
+			res, err := client.ReceiveHeftyMessage(context.TODO(), &sqs.ReceiveMessageInput{
+				QueueUrl:        queueUrl,
+				WaitTimeSeconds: 20,
+			})
+			Expect(err).To(BeNil())
+			Expect(res.Messages).To(HaveLen(1))
+			Expect(aws.ToString(res.Messages[0].Body) == *msg).To(BeTrue())
+			Expect(aws.ToString(res.Messages[0].MD5OfBody)).To(Equal(messages.Md5Digest([]byte(*msg))))
+		})
+
+		It("invalid transfer options are rejected", func() {
+			for _, opt := range []struct {
+				option hefty.Option
+				expErr string
+			}{
+				{option: hefty.S3PartSize(5<<20 - 1), expErr: "part size must be at least 5242880 bytes but received 5242879"},
+				{option: hefty.S3PartSize(0), expErr: "part size must be at least 5242880 bytes but received 0"},
+				{option: hefty.S3Concurrency(0), expErr: "concurrency must be greater than 0 but received 0"},
+				{option: hefty.S3Concurrency(-1), expErr: "concurrency must be greater than 0 but received -1"},
+				{option: hefty.S3ChecksumAlgorithm("MD4"), expErr: "unknown checksum algorithm MD4"},
+				{option: hefty.S3UploadBufferProvider(nil), expErr: "upload buffer provider is nil"},
+				{option: hefty.S3DownloadBufferProvider(nil), expErr: "download buffer provider is nil"},
+			} {
+				_, err := hefty.NewSqsClientWrapper(sqsClient, s3Client, testBucket, opt.option)
+				Expect(err).To(MatchError(ContainSubstring(opt.expErr)))
+			}
+		})
+	})
+
+	When("When AWS S3 operations are retried with a retry policy", func() {
+		type Retry struct {
+			Op      string
+			Attempt int
+		}
+		NewClient := func(faults *heftytest.Faults, policy hefty.RetryPolicy) *hefty.SqsClientWrapper {
+			GinkgoHelper()
+			// every attempt of the retry policy is a single request
+			client, err := hefty.NewSqsClientWrapper(sqsClient, s3.New(s3Client.Options(), faults.S3, func(o *s3.Options) {
+				o.RetryMaxAttempts = 1
+			}), testBucket, hefty.AlwaysSendToS3(), hefty.S3RetryPolicy(policy))
+			Expect(err).To(BeNil())
+
+			return client
+		}
+		Send := func(ctx context.Context, client *hefty.SqsClientWrapper, queueUrl *string) error {
+			msg, _ := testutils.GetMsgBodyAndAttrs(100, 0, 0)
+			_, err := client.SendHeftyMessage(ctx, &sqs.SendMessageInput{
+				QueueUrl:    queueUrl,
+				MessageBody: msg,
+			})
+			return err
+		}
+		Unavailable := heftytest.Error(http.StatusServiceUnavailable, "ServiceUnavailable", "service unavailable")
+
+		It("an upload which fails with a retryable error is retried until it succeeds", func() {
+			faults := heftytest.NewFaults(heftytest.Rule{Service: "S3", Operation: "PutObject", Times: 2, Fault: Unavailable})
+			var retries []Retry
+			client := NewClient(faults, hefty.RetryPolicy{
+				MaxAttempts:    3,
+				InitialBackoff: time.Millisecond,
+				MaxBackoff:     10 * time.Millisecond,
+				OnRetry: func(op string, attempt int, err error) {
+					retries = append(retries, Retry{Op: op, Attempt: attempt})
+				},
+			})
+
+			queueUrl := CreateSqsQueue()
+			Expect(Send(context.TODO(), client, queueUrl)).To(BeNil())
+			Expect(faults.Injected()).To(Equal(2))
+			Expect(retries).To(Equal([]Retry{{Op: "upload", Attempt: 1}, {Op: "upload", Attempt: 2}}))
+			Expect(ReceiveSqsMessage(*queueUrl, nil).Messages).To(HaveLen(1))
+		})
+
+		It("an upload which fails with an error which cannot be retried is not retried", func() {
+			faults := heftytest.NewFaults(heftytest.Rule{Service: "S3", Operation: "PutObject", Fault: heftytest.Error(http.StatusForbidden, "AccessDenied", "access denied")})
+			var retries []Retry
+			client := NewClient(faults, hefty.RetryPolicy{
+				MaxAttempts:    3,
+				InitialBackoff: time.Millisecond,
+				OnRetry: func(op string, attempt int, err error) {
+					retries = append(retries, Retry{Op: op, Attempt: attempt})
+				},
+			})
+
+			Expect(Send(context.TODO(), client, CreateSqsQueue())).NotTo(BeNil())
+			Expect(faults.Injected()).To(Equal(1))
+			Expect(retries).To(BeEmpty())
+		})
+
+		It("an upload is not retried past the deadline of its context", func() {
+			faults := heftytest.NewFaults(heftytest.Rule{Service: "S3", Operation: "PutObject", Fault: Unavailable})
+			client := NewClient(faults, hefty.RetryPolicy{
+				MaxAttempts:    1000,
+				InitialBackoff: 50 * time.Millisecond,
+				MaxBackoff:     50 * time.Millisecond,
+			})
+
+			ctx, cancel := context.WithTimeout(context.TODO(), 300*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			err := Send(ctx, client, CreateSqsQueue())
+			Expect(err).NotTo(BeNil())
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			Expect(faults.Injected()).To(BeNumerically("<", 1000))
+			var apiErr smithy.APIError
+			Expect(errors.As(err, &apiErr)).To(BeTrue())
+			Expect(apiErr.ErrorCode()).To(Equal("ServiceUnavailable"))
+		})
+	})
+
+	When("When AWS S3 operations are guarded by a circuit breaker", func() {
+		It("a call which started before the circuit opened is not taken as the probe of the half-open circuit", func() {
+			faults := heftytest.NewFaults(
+				heftytest.Rule{Service: "S3", Operation: "PutObject", Times: 1, Fault: heftytest.Latency(time.Second)},
+				heftytest.Rule{Service: "S3", Operation: "PutObject", Times: 1, Fault: heftytest.Error(http.StatusForbidden, "AccessDenied", "access denied")},
+				heftytest.Rule{Service: "S3", Operation: "PutObject", Times: 1, Fault: heftytest.Latency(2 * time.Second)},
+			)
+			client, err := hefty.NewSqsClientWrapper(sqsClient, s3.New(s3Client.Options(), faults.S3), testBucket, hefty.AlwaysSendToS3(),
+				hefty.S3CircuitBreaker(hefty.CircuitBreakerConfig{
+					FailureThreshold: 1,
+					OpenTimeout:      100 * time.Millisecond,
+					IsFailure:        func(err error) bool { return err != nil },
+				}))
+			Expect(err).To(BeNil())
+
+			queueUrl := CreateSqsQueue()
+			Send := func() <-chan error {
+				done := make(chan error, 1)
+				go func() {
+					msg, _ := testutils.GetMsgBodyAndAttrs(100, 0, 0)
+					_, err := client.SendHeftyMessage(context.TODO(), &sqs.SendMessageInput{
+						QueueUrl:    queueUrl,
+						MessageBody: msg,
+					})
+					done <- err
+				}()
+				return done
+			}
+
+			// a slow upload starts while the circuit is closed and a failed upload opens the circuit
+			slow := Send()
+			Eventually(faults.Injected).Should(Equal(1))
+			Expect(<-Send()).NotTo(BeNil())
+			Expect(client.PayloadStoreState()).To(Equal(hefty.CircuitOpen))
+
+			// the probe starts once the circuit is half-open
+			Eventually(client.PayloadStoreState).Should(Equal(hefty.CircuitHalfOpen))
+			probe := Send()
+			Eventually(faults.Injected).Should(Equal(3))
+
+			Eventually(slow).WithTimeout(5 * time.Second).Should(Receive(BeNil()))
+			Expect(client.PayloadStoreState()).To(Equal(hefty.CircuitHalfOpen))
+
+			Eventually(probe).WithTimeout(5 * time.Second).Should(Receive(BeNil()))
+			Expect(client.PayloadStoreState()).To(Equal(hefty.CircuitClosed))
+		})
+	})
+
+	When("When messages are stored in an outbox while AWS SQS is unavailable", func() {
+		// Count counts the requests it is injected into without changing them.
+		Count := func(calls *int) heftytest.Fault {
+			return func(r *http.Request, next aws.HTTPClient) (*http.Response, error) {
+				*calls++
+				return next.Do(r)
+			}
+		}
+		Unavailable := heftytest.Rule{Service: "SQS", Operation: "SendMessage", Fault: heftytest.Error(http.StatusServiceUnavailable, "ServiceUnavailable", "service unavailable")}
+		NewClient := func(faults *heftytest.Faults, config hefty.OutboxConfig) *hefty.SqsClientWrapper {
+			GinkgoHelper()
+			client, err := hefty.NewSqsClientWrapper(sqs.New(sqsClient.Options(), faults.Sqs, func(o *sqs.Options) {
+				o.RetryMaxAttempts = 1
+			}), s3.New(s3Client.Options(), faults.S3), testBucket, hefty.AlwaysSendToS3(), hefty.Outbox(config))
+			Expect(err).To(BeNil())
+
+			return client
+		}
+		Send := func(client *hefty.SqsClientWrapper, queueUrl *string, body string) error {
+			GinkgoHelper()
+			out, err := client.SendHeftyMessage(context.TODO(), &sqs.SendMessageInput{
+				QueueUrl:    queueUrl,
+				MessageBody: aws.String(body),
+			})
+			Expect(out).NotTo(BeNil())
+			if errors.Is(err, hefty.ErrStoredInOutbox) {
+				Expect(out.MessageId).To(BeNil())
+			}
+
+			return err
+		}
+		Entries := func(dir, suffix string) int {
+			GinkgoHelper()
+			files, err := os.ReadDir(dir)
+			Expect(err).To(BeNil())
+			count := 0
+			for _, file := range files {
+				if strings.HasSuffix(file.Name(), suffix) {
+					count++
+				}
+			}
+
+			return count
+		}
+
+		It("the messages are sent in order once AWS SQS is available again and their uploaded hefty messages are removed", func() {
+			var deletes int
+			faults := heftytest.NewFaults(Unavailable, heftytest.Rule{Service: "S3", Operation: "DeleteObject", Fault: Count(&deletes)})
+			dir := GinkgoT().TempDir()
+			client := NewClient(faults, hefty.OutboxConfig{Dir: dir, ReplayInterval: time.Hour})
+			DeferCleanup(func() {
+				ctx, cancel := context.WithTimeout(context.TODO(), time.Second)
+				defer cancel()
+				_ = client.Close(ctx)
+			})
+
+			queueUrl := CreateSqsQueue()
+			missingQueueUrl := aws.String(*queueUrl + "-missing")
+			Expect(Send(client, queueUrl, "message 0")).To(MatchError(hefty.ErrStoredInOutbox))
+			Expect(Send(client, missingQueueUrl, "message to missing queue")).To(MatchError(hefty.ErrStoredInOutbox))
+			Expect(Send(client, queueUrl, "message 1")).To(MatchError(hefty.ErrStoredInOutbox))
+			Expect(client.Backlog()).To(Equal(3))
+			Expect(Entries(dir, ".json")).To(Equal(3))
+			// only the first message was uploaded, the others were stored without sending them as the outbox held messages
+			Expect(deletes).To(Equal(1))
+
+			// messages are still stored while the outbox holds messages so that they are not sent out of order
+			faults.Reset()
+			Expect(Send(client, queueUrl, "message 2")).To(MatchError(hefty.ErrStoredInOutbox))
+			Expect(client.Backlog()).To(Equal(4))
+
+			// the message to the missing queue can never be sent and is kept aside
+			err := client.Drain(context.TODO())
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("unable to send message from outbox entry"))
+			Expect(client.Backlog()).To(Equal(0))
+			Expect(Entries(dir, ".json")).To(Equal(0))
+			Expect(Entries(dir, ".failed")).To(Equal(1))
+
+			// messages are sent directly once the outbox is empty
+			Expect(Send(client, queueUrl, "message 3")).To(BeNil())
+
+			var bodies []string
+			for len(bodies) < 4 {
+				for _, msg := range ReceiveSqsMessage(*queueUrl, nil).Messages {
+					bodies = append(bodies, aws.ToString(msg.Body))
+					DeleteHeftyMessage(*queueUrl, *msg.ReceiptHandle)
+				}
+			}
+			Expect(bodies).To(Equal([]string{"message 0", "message 1", "message 2", "message 3"}))
+		})
+
+		It("closing the wrapper cancels a replay which does not complete and the messages are sent by the next wrapper", func() {
+			faults := heftytest.NewFaults(Unavailable)
+			dir := GinkgoT().TempDir()
+			client := NewClient(faults, hefty.OutboxConfig{Dir: dir, ReplayInterval: 10 * time.Millisecond})
+
+			queueUrl := CreateSqsQueue()
+			Expect(Send(client, queueUrl, "message 0")).To(MatchError(hefty.ErrStoredInOutbox))
+
+			// the replay in the background hangs until it is cancelled
+			faults.Reset()
+			faults.Add(heftytest.Rule{Service: "SQS", Operation: "SendMessage", Fault: heftytest.Latency(time.Hour)})
+			Eventually(faults.Injected).Should(BeNumerically(">", 0))
+
+			ctx, cancel := context.WithTimeout(context.TODO(), 500*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			Expect(client.Close(ctx)).To(MatchError(context.DeadlineExceeded))
+			Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+			Expect(client.Backlog()).To(Equal(1))
+
+			// the journal is sent by a wrapper created with the same directory
+			faults.Reset()
+			client = NewClient(faults, hefty.OutboxConfig{Dir: dir, ReplayInterval: time.Hour})
+			Expect(client.Backlog()).To(Equal(1))
+			Expect(client.Close(context.TODO())).To(BeNil())
+			Expect(client.Backlog()).To(Equal(0))
+
+			msg := ReceiveSqsMessage(*queueUrl, nil).Messages[0]
+			Expect(aws.ToString(msg.Body)).To(Equal("message 0"))
+		})
+	})
+
+	When("When tracing the Hefty client wrapper", func() {
+		It("the download span of a received hefty message links to the span which sent it", func() {
+			recorder := tracetest.NewSpanRecorder()
+			provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+			client, err := hefty.NewSqsClientWrapper(sqsClient, s3Client, testBucket, hefty.Tracing(hefty.TracingConfig{
+				TracerProvider: provider,
+				Propagator:     propagation.TraceContext{},
+			}))
+			Expect(err).To(BeNil())
+
+			queueUrl := CreateSqsQueue()
+			msg, msgAttr := testutils.GetMsgBodyAndAttrs(hefty.MaxAwsMessageLengthBytes, 2, 100)
+			_, err = client.SendHeftyMessage(context.TODO(), &sqs.SendMessageInput{
+				QueueUrl:          queueUrl,
+				MessageBody:       msg,
+				MessageAttributes: messages.MapToSqsMessageAttributeValues(msgAttr),
+			})
+			Expect(err).To(BeNil())
+
+			res, err := client.ReceiveHeftyMessage(context.TODO(), &sqs.ReceiveMessageInput{
+				QueueUrl:              queueUrl,
+				WaitTimeSeconds:       20,
+				MessageAttributeNames: []string{"All"},
+			})
+			Expect(err).To(BeNil())
+			Expect(res.Messages).To(HaveLen(1))
+			Expect(res.Messages[0].Body).To(Equal(msg))
+			Expect(res.Messages[0].MessageAttributes).To(HaveLen(2))
+
+			spans := map[string]sdktrace.ReadOnlySpan{}
+			for _, span := range recorder.Ended() {
+				spans[span.Name()] = span
+			}
+			Expect(spans).To(HaveKey("hefty.send"))
+			Expect(spans).To(HaveKey("hefty.serialize"))
+			Expect(spans).To(HaveKey("hefty.upload"))
+			Expect(spans).To(HaveKey("hefty.receive"))
+			Expect(spans).To(HaveKey("hefty.download"))
+			Expect(spans["hefty.upload"].Parent().SpanID()).To(Equal(spans["hefty.send"].SpanContext().SpanID()))
+			Expect(spans["hefty.download"].Links()).To(HaveLen(1))
+			Expect(spans["hefty.download"].Links()[0].SpanContext.SpanID()).To(Equal(spans["hefty.send"].SpanContext().SpanID()))
+		})
+
+		It("a message which is not sent to AWS S3 is sent with the message attributes of the caller only", func() {
+			provider := sdktrace.NewTracerProvider()
+			client, err := hefty.NewSqsClientWrapper(sqsClient, s3Client, testBucket, hefty.Tracing(hefty.TracingConfig{
+				TracerProvider: provider,
+				Propagator:     propagation.TraceContext{},
+			}))
+			Expect(err).To(BeNil())
+
+			queueUrl := CreateSqsQueue()
+			msg, msgAttr := testutils.GetMsgBodyAndAttrs(100, 2, 100)
+			sqsMsgAttr := messages.MapToSqsMessageAttributeValues(msgAttr)
+			ctx, span := provider.Tracer("test").Start(context.TODO(), "test")
+			defer span.End()
+			out, err := client.SendHeftyMessage(ctx, &sqs.SendMessageInput{
+				QueueUrl:          queueUrl,
+				MessageBody:       msg,
+				MessageAttributes: sqsMsgAttr,
+			})
+			Expect(err).To(BeNil())
+			md5OfMsgAttr, err := messages.MessageAttributesMd5Digest(msgAttr)
+			Expect(err).To(BeNil())
+			Expect(*out.MD5OfMessageAttributes).To(Equal(md5OfMsgAttr))
+
+			res, err := sqsClient.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{
+				QueueUrl:              queueUrl,
+				WaitTimeSeconds:       20,
+				MessageAttributeNames: []string{"All"},
+			})
+			Expect(err).To(BeNil())
+			Expect(res.Messages).To(HaveLen(1))
+			Expect(res.Messages[0].Body).To(Equal(msg))
+			Expect(res.Messages[0].MessageAttributes).To(Equal(sqsMsgAttr))
+		})
+	})
+
+	When("When logging with the Hefty client wrapper", func() {
+		It("sending and receiving a hefty message is logged with redacted message attribute values", func() {
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+			client, err := hefty.NewSqsClientWrapper(sqsClient, s3Client, testBucket, hefty.Logger(logger))
+			Expect(err).To(BeNil())
+
+			queueUrl := CreateSqsQueue()
+			msg, msgAttr := testutils.GetMsgBodyAndAttrs(hefty.MaxAwsMessageLengthBytes, 2, 100)
+			_, err = client.SendHeftyMessage(context.TODO(), &sqs.SendMessageInput{
+				QueueUrl:          queueUrl,
+				MessageBody:       msg,
+				MessageAttributes: messages.MapToSqsMessageAttributeValues(msgAttr),
+			})
+			Expect(err).To(BeNil())
+
+			res, err := client.ReceiveHeftyMessage(context.TODO(), &sqs.ReceiveMessageInput{
+				QueueUrl:              queueUrl,
+				WaitTimeSeconds:       20,
+				MessageAttributeNames: []string{"All"},
+			})
+			Expect(err).To(BeNil())
+			Expect(res.Messages).To(HaveLen(1))
+
+			logs := buf.String()
+			Expect(logs).To(ContainSubstring(`"msg":"sent message"`))
+			Expect(logs).To(ContainSubstring(`"msg":"received message"`))
+			Expect(logs).To(ContainSubstring(`"offloaded":true`))
+			Expect(logs).To(ContainSubstring(`"[REDACTED]"`))
+			for _, v := range msgAttr {
+				if v.StringValue != nil {
+					Expect(logs).NotTo(ContainSubstring(*v.StringValue))
+				}
+			}
+			Expect(logs).NotTo(ContainSubstring(*msg))
+		})
+	})
+
+	When("When intercepting messages of the Hefty client wrapper", func() {
+		It("interceptors can change the hefty message and abort the send", func() {
+			var audited []string
+			reverse := func(b []byte) []byte {
+				ret := make([]byte, len(b))
+				for i := range b {
+					ret[i] = b[len(b)-1-i]
+				}
+				return ret
+			}
+			client, err := hefty.NewSqsClientWrapper(sqsClient, s3Client, testBucket, hefty.Intercept(hefty.Interceptor{
+				BeforeSerialize: func(ctx context.Context, msg *hefty.InterceptedMessage) error {
+					msg.Message.MessageAttributes["tenant"] = hefty.MessageAttributeValue{
+						DataType:    aws.String("String"),
+						StringValue: aws.String("tenant-a"),
+					}
+					return nil
+				},
+				AfterSerialize: func(ctx context.Context, msg *hefty.InterceptedMessage) error {
+					msg.Serialized = reverse(msg.Serialized)
+					return nil
+				},
+				BeforeDeserialize: func(ctx context.Context, msg *hefty.InterceptedMessage) error {
+					msg.Serialized = reverse(msg.Serialized)
+					return nil
+				},
+				AfterDownload: func(ctx context.Context, msg *hefty.InterceptedMessage) error {
+					audited = append(audited, msg.Key)
+					return nil
+				},
+			}))
+			Expect(err).To(BeNil())
+
+			queueUrl := CreateSqsQueue()
+			msg, msgAttr := testutils.GetMsgBodyAndAttrs(hefty.MaxAwsMessageLengthBytes, 2, 100)
+			_, err = client.SendHeftyMessage(context.TODO(), &sqs.SendMessageInput{
+				QueueUrl:          queueUrl,
+				MessageBody:       msg,
+				MessageAttributes: messages.MapToSqsMessageAttributeValues(msgAttr),
+			})
+			Expect(err).To(BeNil())
+
+			res, err := client.ReceiveHeftyMessage(context.TODO(), &sqs.ReceiveMessageInput{
+				QueueUrl:              queueUrl,
+				WaitTimeSeconds:       20,
+				MessageAttributeNames: []string{"All"},
+			})
+			Expect(err).To(BeNil())
+			Expect(res.Messages).To(HaveLen(1))
+			Expect(res.Messages[0].Body).To(Equal(msg))
+			Expect(res.Messages[0].MessageAttributes).To(HaveLen(3))
+			Expect(*res.Messages[0].MessageAttributes["tenant"].StringValue).To(Equal("tenant-a"))
+			Expect(audited).To(HaveLen(1))
+
+			errInvalid := errors.New("invalid payload")
+			client, err = hefty.NewSqsClientWrapper(sqsClient, s3Client, testBucket, hefty.Intercept(hefty.Interceptor{
+				BeforeUpload: func(ctx context.Context, msg *hefty.InterceptedMessage) error {
+					return errInvalid
+				},
+			}))
+			Expect(err).To(BeNil())
+
+			_, err = client.SendHeftyMessage(context.TODO(), &sqs.SendMessageInput{
+				QueueUrl:          queueUrl,
+				MessageBody:       msg,
+				MessageAttributes: messages.MapToSqsMessageAttributeValues(msgAttr),
+			})
+			Expect(errors.Is(err, errInvalid)).To(BeTrue())
+		})
+	})
+
+	When("When caching hefty messages of the Hefty client wrapper", func() {
+		It("a redelivered reference message is received without downloading its hefty message again", func() {
+			client, err := hefty.NewSqsClientWrapper(sqsClient, s3Client, testBucket, hefty.PayloadCache(hefty.PayloadCacheConfig{
+				Dir: GinkgoT().TempDir(),
+			}))
+			Expect(err).To(BeNil())
+
+			queueUrl := CreateSqsQueue()
+			msg, msgAttr := testutils.GetMsgBodyAndAttrs(hefty.MaxAwsMessageLengthBytes, 2, 100)
+			_, err = client.SendHeftyMessage(context.TODO(), &sqs.SendMessageInput{
+				QueueUrl:          queueUrl,
+				MessageBody:       msg,
+				MessageAttributes: messages.MapToSqsMessageAttributeValues(msgAttr),
+			})
+			Expect(err).To(BeNil())
+
+			receive := func() sqsTypes.Message {
+				GinkgoHelper()
+				res, err := client.ReceiveHeftyMessage(context.TODO(), &sqs.ReceiveMessageInput{
+					QueueUrl:              queueUrl,
+					WaitTimeSeconds:       20,
+					MessageAttributeNames: []string{"All"},
+				})
+				Expect(err).To(BeNil())
+				Expect(res.Messages).To(HaveLen(1))
+				Expect(res.Messages[0].Body).To(Equal(msg))
+				return res.Messages[0]
+			}
+			received := receive()
+
+			// remove the hefty message from s3 and make the reference message visible again
+			list, err := s3Client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
+				Bucket: &testBucket,
+				Prefix: aws.String(path.Base(*queueUrl)),
+			})
+			Expect(err).To(BeNil())
+			Expect(list.Contents).To(HaveLen(1))
+			_, err = s3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+				Bucket: &testBucket,
+				Key:    list.Contents[0].Key,
+			})
+			Expect(err).To(BeNil())
+			_, err = client.ChangeHeftyMessageVisibility(context.TODO(), &sqs.ChangeMessageVisibilityInput{
+				QueueUrl:          queueUrl,
+				ReceiptHandle:     received.ReceiptHandle,
+				VisibilityTimeout: 0,
+			})
+			Expect(err).To(BeNil())
+
+			received = receive()
+			_, err = client.DeleteHeftyMessage(context.TODO(), &sqs.DeleteMessageInput{
+				QueueUrl:      queueUrl,
+				ReceiptHandle: received.ReceiptHandle,
+			})
+			Expect(err).To(BeNil())
+		})
+	})
+
+	When("When storing hefty messages by their content", func() {
+		It("a message sent to several queues is stored once and is not removed when deleted", func() {
+			prefix := fmt.Sprintf("hefty-cas-test/%s/", uuid.New().String())
+			client, err := hefty.NewSqsClientWrapper(sqsClient, s3Client, testBucket, hefty.ContentAddressing(hefty.ContentAddressingConfig{
+				Prefix: prefix,
+			}))
+			Expect(err).To(BeNil())
+
+			msg, msgAttr := testutils.GetMsgBodyAndAttrs(hefty.MaxAwsMessageLengthBytes, 2, 100)
+			queueUrls := []*string{CreateSqsQueue(), CreateSqsQueue()}
+			for _, queueUrl := range queueUrls {
+				_, err = client.SendHeftyMessage(context.TODO(), &sqs.SendMessageInput{
+					QueueUrl:          queueUrl,
+					MessageBody:       msg,
+					MessageAttributes: messages.MapToSqsMessageAttributeValues(msgAttr),
+				})
+				Expect(err).To(BeNil())
+			}
+
+			list, err := s3Client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
+				Bucket: &testBucket,
+				Prefix: &prefix,
+			})
+			Expect(err).To(BeNil())
+			Expect(list.Contents).To(HaveLen(1))
+
+			for _, queueUrl := range queueUrls {
+				res, err := client.ReceiveHeftyMessage(context.TODO(), &sqs.ReceiveMessageInput{
+					QueueUrl:              queueUrl,
+					WaitTimeSeconds:       20,
+					MessageAttributeNames: []string{"All"},
+				})
+				Expect(err).To(BeNil())
+				Expect(res.Messages).To(HaveLen(1))
+				Expect(res.Messages[0].Body).To(Equal(msg))
+
+				_, err = client.DeleteHeftyMessage(context.TODO(), &sqs.DeleteMessageInput{
+					QueueUrl:      queueUrl,
+					ReceiptHandle: res.Messages[0].ReceiptHandle,
+				})
+				Expect(err).To(BeNil())
+			}
+
+			_, err = s3Client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+				Bucket: &testBucket,
+				Key:    list.Contents[0].Key,
+			})
+			Expect(err).To(BeNil())
+		})
+
+		It("a prefix which would corrupt the receipt handles of hefty messages is rejected", func() {
+			_, err := hefty.NewSqsClientWrapper(sqsClient, s3Client, testBucket, hefty.ContentAddressing(hefty.ContentAddressingConfig{Prefix: "hefty|cas/"}))
+			Expect(err).To(MatchError(`prefix must not contain "|" but received hefty|cas/`))
+		})
+	})
+
+	When("When presigning urls of hefty messages", func() {
+		It("the hefty message can be received with only the presigned url", func() {
+			client, err := hefty.NewSqsClientWrapper(sqsClient, s3Client, testBucket, hefty.PresignedURLs(time.Hour), hefty.HTTPClient(http.DefaultClient))
+			Expect(err).To(BeNil())
+
+			queueUrl := CreateSqsQueue()
+			msg, msgAttr := testutils.GetMsgBodyAndAttrs(hefty.MaxAwsMessageLengthBytes, 2, 100)
+			_, err = client.SendHeftyMessage(context.TODO(), &sqs.SendMessageInput{
+				QueueUrl:          queueUrl,
+				MessageBody:       msg,
+				MessageAttributes: messages.MapToSqsMessageAttributeValues(msgAttr),
+			})
+			Expect(err).To(BeNil())
+
+			// receive the reference message without hefty, like an http subscriber
+			res, err := sqsClient.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{
+				QueueUrl:        queueUrl,
+				WaitTimeSeconds: 20,
+			})
+			Expect(err).To(BeNil())
+			Expect(res.Messages).To(HaveLen(1))
+			refMsg, ok := hefty.ReferenceMsg(*res.Messages[0].Body)
+			Expect(ok).To(BeTrue())
+			Expect(refMsg.PresignedUrl).NotTo(BeEmpty())
+
+			heftyMsg, err := hefty.FetchHeftyMessage(context.TODO(), nil, *res.Messages[0].Body)
+			Expect(err).To(BeNil())
+			Expect(heftyMsg.Body).To(Equal(msg))
+			Expect(heftyMsg.MessageAttributes).To(Equal(msgAttr))
+			_, err = sqsClient.DeleteMessage(context.TODO(), &sqs.DeleteMessageInput{
+				QueueUrl:      queueUrl,
+				ReceiptHandle: res.Messages[0].ReceiptHandle,
+			})
+			Expect(err).To(BeNil())
+
+			// a reference message with only the presigned url is received over http
+			bucket, key := refMsg.S3Bucket, refMsg.S3Key
+			refMsg.S3Bucket, refMsg.S3Key = "", ""
+			jsonRefMsg, err := refMsg.ToJson()
+			Expect(err).To(BeNil())
+			_, err = sqsClient.SendMessage(context.TODO(), &sqs.SendMessageInput{
+				QueueUrl:    queueUrl,
+				MessageBody: aws.String(string(jsonRefMsg)),
+			})
+			Expect(err).To(BeNil())
+
+			received, err := client.ReceiveHeftyMessage(context.TODO(), &sqs.ReceiveMessageInput{
+				QueueUrl:              queueUrl,
+				WaitTimeSeconds:       20,
+				MessageAttributeNames: []string{"All"},
+			})
+			Expect(err).To(BeNil())
+			Expect(received.Messages).To(HaveLen(1))
+			Expect(received.Messages[0].Body).To(Equal(msg))
+			Expect(*received.Messages[0].MD5OfBody).To(Equal(refMsg.Md5DigestMsgBody))
+
+			_, err = client.DeleteHeftyMessage(context.TODO(), &sqs.DeleteMessageInput{
+				QueueUrl:      queueUrl,
+				ReceiptHandle: received.Messages[0].ReceiptHandle,
+			})
+			Expect(err).To(BeNil())
+			_, err = s3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+				Bucket: &bucket,
+				Key:    &key,
+			})
+			Expect(err).To(BeNil())
+		})
+
+		It("a presigned url is only fetched if selected and if it is a url of an object in the bucket of the wrapper", func() {
+			var requests int
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+			}))
+			defer server.Close()
+
+			sender, err := hefty.NewSqsClientWrapper(sqsClient, s3Client, testBucket, hefty.PresignedURLs(time.Hour))
+			Expect(err).To(BeNil())
+			queueUrl := CreateSqsQueue()
+			msg, _ := testutils.GetMsgBodyAndAttrs(hefty.MaxAwsMessageLengthBytes+1, 0, 0)
+			_, err = sender.SendHeftyMessage(context.TODO(), &sqs.SendMessageInput{
+				QueueUrl:    queueUrl,
+				MessageBody: msg,
+			})
+			Expect(err).To(BeNil())
+			res, err := sqsClient.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{
+				QueueUrl:        queueUrl,
+				WaitTimeSeconds: 20,
+			})
+			Expect(err).To(BeNil())
+			Expect(res.Messages).To(HaveLen(1))
+			refMsg, ok := hefty.ReferenceMsg(*res.Messages[0].Body)
+			Expect(ok).To(BeTrue())
+			_, err = sqsClient.DeleteMessage(context.TODO(), &sqs.DeleteMessageInput{
+				QueueUrl:      queueUrl,
+				ReceiptHandle: res.Messages[0].ReceiptHandle,
+			})
+			Expect(err).To(BeNil())
+			presignedUrl, err := url.Parse(refMsg.PresignedUrl)
+			Expect(err).To(BeNil())
+			otherBucketUrl := *presignedUrl
+			otherBucketUrl.Path = "/hefty-other-bucket/" + refMsg.S3Key
+			otherHostUrl := *presignedUrl
+			otherHostUrl.Host = strings.TrimPrefix(server.URL, "http://")
+			otherHostUrl.Scheme = "http"
+			refMsg.S3Bucket, refMsg.S3Key = "", ""
+
+			var tests = []struct {
+				desc         string
+				opts         []hefty.Option
+				presignedUrl string
+				expErr       string
+			}{
+				{
+					desc:         "not selected",
+					presignedUrl: presignedUrl.String(),
+					expErr:       "presigned urls are only fetched with the HTTPClient option",
+				},
+				{
+					desc:         "other bucket",
+					opts:         []hefty.Option{hefty.HTTPClient(http.DefaultClient)},
+					presignedUrl: otherBucketUrl.String(),
+					expErr:       "presigned url is not a url of an object in bucket " + testBucket,
+				},
+				{
+					desc:         "other host",
+					opts:         []hefty.Option{hefty.HTTPClient(http.DefaultClient)},
+					presignedUrl: otherHostUrl.String(),
+					expErr:       "presigned url is not a url of an object in bucket " + testBucket,
+				},
+			}
+			for _, test := range tests {
+				By(test.desc)
+				client, err := hefty.NewSqsClientWrapper(sqsClient, s3Client, testBucket, test.opts...)
+				Expect(err).To(BeNil())
+
+				refMsg.PresignedUrl = test.presignedUrl
+				jsonRefMsg, err := refMsg.ToJson()
+				Expect(err).To(BeNil())
+				_, err = sqsClient.SendMessage(context.TODO(), &sqs.SendMessageInput{
+					QueueUrl:    queueUrl,
+					MessageBody: aws.String(string(jsonRefMsg)),
+				})
+				Expect(err).To(BeNil())
+
+				received, err := client.ReceiveHeftyMessage(context.TODO(), &sqs.ReceiveMessageInput{
+					QueueUrl:        queueUrl,
+					WaitTimeSeconds: 20,
+				})
+				Expect(err).To(BeNil())
+				Expect(received.Messages).To(HaveLen(1))
+				errMsg, ok := hefty.ErrorMsg(*received.Messages[0].Body)
+				Expect(ok).To(BeTrue())
+				Expect(errMsg.Error).To(HaveSuffix(test.expErr))
+				_, err = sqsClient.DeleteMessage(context.TODO(), &sqs.DeleteMessageInput{
+					QueueUrl:      queueUrl,
+					ReceiptHandle: received.Messages[0].ReceiptHandle,
+				})
+				Expect(err).To(BeNil())
+			}
+			Expect(requests).To(Equal(0))
+		})
+
+		It("a presigned url which is forbidden because the hefty message is missing is handled by the missing payload policy", func() {
+			sender, err := hefty.NewSqsClientWrapper(sqsClient, s3Client, testBucket, hefty.PresignedURLs(time.Hour))
+			Expect(err).To(BeNil())
+			queueUrl := CreateSqsQueue()
+			msg, _ := testutils.GetMsgBodyAndAttrs(hefty.MaxAwsMessageLengthBytes+1, 0, 0)
+			_, err = sender.SendHeftyMessage(context.TODO(), &sqs.SendMessageInput{
+				QueueUrl:    queueUrl,
+				MessageBody: msg,
+			})
+			Expect(err).To(BeNil())
+			res, err := sqsClient.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{
+				QueueUrl:        queueUrl,
+				WaitTimeSeconds: 20,
+			})
+			Expect(err).To(BeNil())
+			Expect(res.Messages).To(HaveLen(1))
+			_, err = sqsClient.DeleteMessage(context.TODO(), &sqs.DeleteMessageInput{
+				QueueUrl:      queueUrl,
+				ReceiptHandle: res.Messages[0].ReceiptHandle,
+			})
+			Expect(err).To(BeNil())
+
+			// the hefty message is removed and only the presigned url is sent
+			refMsg, ok := hefty.ReferenceMsg(*res.Messages[0].Body)
+			Expect(ok).To(BeTrue())
+			_, err = s3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+				Bucket: &refMsg.S3Bucket,
+				Key:    &refMsg.S3Key,
+			})
+			Expect(err).To(BeNil())
+			refMsg.S3Bucket, refMsg.S3Key = "", ""
+			jsonRefMsg, err := refMsg.ToJson()
+			Expect(err).To(BeNil())
+			_, err = sqsClient.SendMessage(context.TODO(), &sqs.SendMessageInput{
+				QueueUrl:    queueUrl,
+				MessageBody: aws.String(string(jsonRefMsg)),
+			})
+			Expect(err).To(BeNil())
+
+			// AWS S3 responds with 403 rather than 404 when the signer of the url may not list the bucket
+			forbidden := &http.Client{Transport: roundTripper(func(r *http.Request) (*http.Response, error) {
+				resp, err := http.DefaultTransport.RoundTrip(r)
+				if err == nil && resp.StatusCode == http.StatusNotFound {
+					resp.StatusCode, resp.Status = http.StatusForbidden, "403 Forbidden"
+				}
+				return resp, err
+			})}
+			client, err := hefty.NewSqsClientWrapper(sqsClient, s3Client, testBucket, hefty.HTTPClient(forbidden), hefty.OnMissingPayload(hefty.DeleteOnMissingPayload()))
+			Expect(err).To(BeNil())
+
+			received, err := client.ReceiveHeftyMessage(context.TODO(), &sqs.ReceiveMessageInput{
+				QueueUrl:        queueUrl,
+				WaitTimeSeconds: 20,
+			})
+			Expect(err).To(BeNil())
+			Expect(received.Messages).To(BeEmpty())
+			Expect(CountQueueMessages(*queueUrl)).To(Equal(0))
+		})
+
+		It("a hefty message which is too large is not fetched with its presigned url", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.CopyN(w, zeros{}, hefty.MaxHeftyMessageLengthBytes+2<<20)
+			}))
+			defer server.Close()
+
+			refMsg := messages.NewReferenceMsg("", "", "", "", "")
+			refMsg.PresignedUrl = server.URL + "/" + testBucket + "/key"
+			jsonRefMsg, err := refMsg.ToJson()
+			Expect(err).To(BeNil())
+
+			_, err = hefty.FetchHeftyMessage(context.TODO(), nil, string(jsonRefMsg))
+			Expect(err).To(MatchError(hefty.ErrMessageTooLarge))
 		})
 	})
 })
@@ -0,0 +1,165 @@
+package hefty
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/vinujohn/hefty/internal/messages"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const tracerName = "github.com/vinujohn/hefty"
+
+// TraceContextAttribute is a reserved message attribute holding the trace context of the span which sent a message when the
+// `Tracing` option is used. It is only added to reference messages so that messages which are not offloaded to AWS S3 are
+// sent with the message attributes of the caller. Its value is a JSON object of the fields set by the propagator, such as
+// "traceparent".
+const TraceContextAttribute = "hefty-trace-context"
+
+// span attributes
+const (
+	messagingSystemKey      = attribute.Key("messaging.system")
+	messagingDestinationKey = attribute.Key("messaging.destination.name")
+	messagingMessageIdKey   = attribute.Key("messaging.message.id")
+	messagingBatchCountKey  = attribute.Key("messaging.batch.message_count")
+	messageSizeKey          = attribute.Key("hefty.message.size")
+	offloadedKey            = attribute.Key("hefty.offloaded")
+	s3BucketKey             = attribute.Key("hefty.s3.bucket")
+	s3KeyKey                = attribute.Key("hefty.s3.key")
+	cacheHitKey             = attribute.Key("hefty.cache.hit")
+	uploadedKey             = attribute.Key("hefty.s3.uploaded")
+)
+
+// TracingConfig determines how hefty operations are traced with OpenTelemetry.
+type TracingConfig struct {
+	// TracerProvider creates the tracer of the wrapper. Defaults to the global tracer provider.
+	TracerProvider trace.TracerProvider
+	// Propagator injects and extracts the trace context held by TraceContextAttribute. Defaults to the global propagator.
+	Propagator propagation.TextMapPropagator
+}
+
+// If selected, sending, receiving, and deleting hefty messages is traced with OpenTelemetry according to `config`. Spans
+// are created for serializing, uploading, sending, receiving, downloading, and deleting messages. The trace context of a
+// message sent to AWS S3 is propagated with the TraceContextAttribute message attribute of its reference message so that
+// the download spans of receivers link to the span of the sender.
+func Tracing(config TracingConfig) Option {
+	return func(opts *options) error {
+		if config.TracerProvider == nil {
+			config.TracerProvider = otel.GetTracerProvider()
+		}
+		if config.Propagator == nil {
+			config.Propagator = otel.GetTextMapPropagator()
+		}
+		opts.tracing = &config
+		return nil
+	}
+}
+
+// tracer creates spans of a wrapper. Without the `Tracing` option, spans are not recorded and no trace context is propagated.
+type tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	system     attribute.KeyValue
+}
+
+func newTracer(config *TracingConfig, system string) *tracer {
+	if config == nil {
+		return &tracer{
+			tracer: noop.NewTracerProvider().Tracer(tracerName),
+			system: messagingSystemKey.String(system),
+		}
+	}
+
+	return &tracer{
+		tracer:     config.TracerProvider.Tracer(tracerName),
+		propagator: config.Propagator,
+		system:     messagingSystemKey.String(system),
+	}
+}
+
+func (t *tracer) start(ctx context.Context, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return t.tracer.Start(ctx, "hefty."+name, trace.WithSpanKind(kind), trace.WithAttributes(append(attrs, t.system)...))
+}
+
+// startLinked starts a span which links to the span that sent a message with the message attributes `msgAttr`.
+func (t *tracer) startLinked(ctx context.Context, name string, msgAttr map[string]messages.MessageAttributeValue, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(append(attrs, t.system)...)}
+	if link, ok := t.link(msgAttr); ok {
+		opts = append(opts, trace.WithLinks(link))
+	}
+
+	return t.tracer.Start(ctx, "hefty."+name, opts...)
+}
+
+// endSpan records `err` on `span` and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceContext returns the trace context of `ctx` as a message attribute.
+func (t *tracer) traceContext(ctx context.Context) (messages.MessageAttributeValue, bool) {
+	if t.propagator == nil || !trace.SpanContextFromContext(ctx).IsValid() {
+		return messages.MessageAttributeValue{}, false
+	}
+
+	carrier := propagation.MapCarrier{}
+	t.propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return messages.MessageAttributeValue{}, false
+	}
+
+	value, err := json.Marshal(carrier)
+	if err != nil {
+		return messages.MessageAttributeValue{}, false
+	}
+
+	return messages.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(string(value)),
+	}, true
+}
+
+// reservedAttributes returns the trace context of `ctx` as reserved message attributes of a reference message.
+func (t *tracer) reservedAttributes(ctx context.Context) map[string]messages.MessageAttributeValue {
+	value, ok := t.traceContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	return map[string]messages.MessageAttributeValue{TraceContextAttribute: value}
+}
+
+// link returns a link to the span which sent a message with the message attributes `msgAttr`.
+func (t *tracer) link(msgAttr map[string]messages.MessageAttributeValue) (trace.Link, bool) {
+	value, ok := msgAttr[TraceContextAttribute]
+	if t.propagator == nil || !ok || value.StringValue == nil {
+		return trace.Link{}, false
+	}
+
+	carrier := propagation.MapCarrier{}
+	if err := json.Unmarshal([]byte(*value.StringValue), &carrier); err != nil {
+		return trace.Link{}, false
+	}
+
+	spanContext := trace.SpanContextFromContext(t.propagator.Extract(context.Background(), carrier))
+	if !spanContext.IsValid() {
+		return trace.Link{}, false
+	}
+
+	return trace.Link{SpanContext: spanContext}, true
+}
+
+// enabled returns whether trace context is propagated with messages.
+func (t *tracer) enabled() bool {
+	return t.propagator != nil
+}
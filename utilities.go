@@ -1,6 +1,17 @@
 package hefty
 
-import "github.com/vinujohn/hefty/internal/messages"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	s3manager "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/vinujohn/hefty/internal/messages"
+)
 
 // ReferenceMsg determines if a message body is a reference message and returns a struct representing the reference message.
 // This function is provided to developers who are using workflows where SNS/SQS messages are being sent to endpoints like
@@ -19,6 +30,58 @@ func ReferenceMsg(msgBody string) (*messages.ReferenceMsg, bool) {
 	return ret, true
 }
 
+// SqsReferenceMsg determines if a message received from AWS SQS without Hefty is a reference message, either by its body
+// or by the reserved reference message attribute set by other tools, the same way `ReceiveHeftyMessage` does. An error
+// is returned if the message is a reference message which is invalid.
+func SqsReferenceMsg(msg types.Message) (*ReferenceMessage, bool, error) {
+	return referenceMsgFromSqsMessage(&msg)
+}
+
+// DownloadHeftyMessage gets the hefty message of `refMsg` as stored in AWS S3, which can be decoded with
+// `DecodeHeftyMessage`. The hefty message is downloaded with `s3Client`, in the region of the reference message if it
+// differs from the region of the client. The presigned url of `refMsg` is only fetched with `httpClient` when it does not
+// contain an AWS S3 bucket and key. `httpClient` may be nil to use http.DefaultClient.
+func DownloadHeftyMessage(ctx context.Context, s3Client *s3.Client, httpClient *http.Client, refMsg *ReferenceMessage) ([]byte, error) {
+	if !refMsg.HasObject() {
+		if refMsg.PresignedUrl == "" {
+			return nil, errors.New("reference message does not contain an s3 bucket and s3 key or a presigned url")
+		}
+		if httpClient == nil {
+			httpClient = http.DefaultClient
+		}
+		return fetch(ctx, httpClient, refMsg.PresignedUrl)
+	}
+
+	if refMsg.S3Region != "" && refMsg.S3Region != s3Client.Options().Region {
+		s3Client = s3.New(s3Client.Options(), func(o *s3.Options) {
+			o.Region = refMsg.S3Region
+		})
+	}
+	buf := s3manager.NewWriteAtBuffer([]byte{})
+	_, err := s3manager.NewDownloader(s3Client).Download(ctx, buf, &s3.GetObjectInput{
+		Bucket: aws.String(refMsg.S3Bucket),
+		Key:    aws.String(refMsg.S3Key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to download hefty message from s3 bucket %s with key %s. %w", refMsg.S3Bucket, refMsg.S3Key, err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeHeftyMessage decodes a hefty message as stored in AWS S3 and checks the MD5 digest of its body against `refMsg`.
+func DecodeHeftyMessage(data []byte, refMsg *ReferenceMessage) (*HeftyMessage, error) {
+	heftyMsg, err := messages.DeserializeHeftyMessage(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode hefty message. %w", err)
+	}
+	if digest := messages.Md5Digest([]byte(aws.ToString(heftyMsg.Body))); refMsg.Md5DigestMsgBody != "" && digest != refMsg.Md5DigestMsgBody {
+		return nil, fmt.Errorf("md5 digest of hefty message body %s does not match reference message digest %s", digest, refMsg.Md5DigestMsgBody)
+	}
+
+	return heftyMsg, nil
+}
+
 // ErrorMsg determines if a message body is an error message and returns a struct holding the error and the reference message.
 // If a message is indeed an error, the error signifies a problem getting either the hefty message from AWS S3 or an error
 // deserializing the reference message.
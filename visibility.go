@@ -0,0 +1,122 @@
+package hefty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+const maxSqsVisibilityTimeout = 12 * time.Hour // sqs limit
+
+// VisibilityHeartbeatConfig determines how a VisibilityHeartbeat extends the visibility timeout of a message.
+type VisibilityHeartbeatConfig struct {
+	// Interval is how often the visibility timeout is extended. Defaults to half of VisibilityTimeout.
+	Interval time.Duration
+	// VisibilityTimeout is the visibility timeout set on the message each time it is extended, counted from
+	// the time of the extension.
+	VisibilityTimeout time.Duration
+	// MaxExtension is the maximum total time, counted from the start of the heartbeat, that the message is kept
+	// invisible. The last extension is shortened so that this limit is not exceeded. Defaults to 12 hours.
+	MaxExtension time.Duration
+}
+
+func (config *VisibilityHeartbeatConfig) validate() error {
+	if config.VisibilityTimeout < time.Second || config.VisibilityTimeout > maxSqsVisibilityTimeout {
+		return fmt.Errorf("visibility timeout must be between 1s and %v but received %v", maxSqsVisibilityTimeout, config.VisibilityTimeout)
+	}
+	if config.Interval < 0 || config.Interval >= config.VisibilityTimeout {
+		return fmt.Errorf("interval must be less than the visibility timeout of %v but received %v", config.VisibilityTimeout, config.Interval)
+	}
+	if config.MaxExtension < 0 || config.MaxExtension > maxSqsVisibilityTimeout {
+		return fmt.Errorf("max extension must be at most %v but received %v", maxSqsVisibilityTimeout, config.MaxExtension)
+	}
+	return nil
+}
+
+// VisibilityHeartbeat periodically extends the visibility timeout of a message while it is being processed so that
+// the message does not become visible to other consumers. A VisibilityHeartbeat is created with `StartVisibilityHeartbeat`
+// and must be stopped with `Stop` once processing of the message has finished.
+type VisibilityHeartbeat struct {
+	cancel  context.CancelFunc
+	done    chan struct{}
+	mu      sync.Mutex
+	lastErr error
+}
+
+// StartVisibilityHeartbeat starts extending the visibility timeout of the message with `receiptHandle` as determined by
+// `config`. `receiptHandle` can be the receipt handle of a hefty message as returned by `ReceiveHeftyMessage`. The
+// heartbeat stops when `Stop` is called, `ctx` is cancelled, or the maximum extension is reached.
+func (wrapper *SqsClientWrapper) StartVisibilityHeartbeat(ctx context.Context, queueUrl, receiptHandle string, config VisibilityHeartbeatConfig) (*VisibilityHeartbeat, error) {
+	if config.Interval == 0 {
+		config.Interval = config.VisibilityTimeout / 2
+	}
+	if config.MaxExtension == 0 {
+		config.MaxExtension = maxSqsVisibilityTimeout
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	heartbeat := &VisibilityHeartbeat{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go heartbeat.run(ctx, wrapper, queueUrl, receiptHandle, config)
+
+	return heartbeat, nil
+}
+
+func (heartbeat *VisibilityHeartbeat) run(ctx context.Context, wrapper *SqsClientWrapper, queueUrl, receiptHandle string, config VisibilityHeartbeatConfig) {
+	defer close(heartbeat.done)
+
+	deadline := time.Now().Add(config.MaxExtension)
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// do not keep the message invisible past the maximum extension
+		timeout := config.VisibilityTimeout
+		remaining := time.Until(deadline)
+		if remaining < timeout {
+			timeout = remaining
+		}
+		if timeout < time.Second {
+			return
+		}
+
+		_, err := wrapper.ChangeHeftyMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          aws.String(queueUrl),
+			ReceiptHandle:     aws.String(receiptHandle),
+			VisibilityTimeout: int32(timeout / time.Second),
+		})
+		if err != nil && !errors.Is(err, context.Canceled) {
+			heartbeat.mu.Lock()
+			heartbeat.lastErr = fmt.Errorf("unable to change message visibility. %w", err)
+			heartbeat.mu.Unlock()
+		}
+	}
+}
+
+// Stop stops the heartbeat and waits for any in flight extension to finish. The last error encountered while extending
+// the visibility timeout is returned, if any.
+func (heartbeat *VisibilityHeartbeat) Stop() error {
+	heartbeat.cancel()
+	<-heartbeat.done
+
+	heartbeat.mu.Lock()
+	defer heartbeat.mu.Unlock()
+	return heartbeat.lastErr
+}